@@ -3,30 +3,76 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
 	"github.com/ocmoxa/SwapTile-Imager/internal/app"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/core"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository/imredis"
 )
 
-func main() {
-	const noMigrate = -1
+const usage = `Usage: imager [-config FILE] [COMMAND]
+
+Without a command it starts the server.
+
+Commands:
+  migrate status           prints known migrations and their state
+  migrate up [VERSION]     applies pending migrations up to VERSION
+  migrate down [VERSION]   reverts migrations down to VERSION,
+                           by default the last one
+  export FILE              writes the catalog archive, "-" is stdout
+  import [-mode MODE] FILE reads the catalog archive, "-" is stdin,
+                           MODE is merge (default) or replace
+  copy-storage -from FILE -to FILE [-workers N] [-verify-checksum]
+                           copies originals between storages
+                           configured in both files
+  warm [-category NAME] [-workers N]
+                           renders renditions of images in the
+                           category, by default of all images
+  difficulty               computes the puzzle difficulty of images
+                           for configured grids they miss
 
+Flags:
+`
+
+func main() {
 	configFile := flag.String("config", "", "path to config")
-	migrateVersion := flag.Int("migrate-version", noMigrate, "id of migration to run")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	ctx := context.Background()
 
-	if *migrateVersion != noMigrate {
-		app.Migrate(ctx, *configFile, *migrateVersion)
-
-		return
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+		serve(ctx, *configFile)
+	case "migrate":
+		migrate(ctx, *configFile, flag.Args()[1:])
+	case "export":
+		export(ctx, *configFile, flag.Args()[1:])
+	case "import":
+		importArchive(ctx, *configFile, flag.Args()[1:])
+	case "copy-storage":
+		copyStorage(ctx, flag.Args()[1:])
+	case "warm":
+		warm(ctx, *configFile, flag.Args()[1:])
+	case "difficulty":
+		difficulty(ctx, *configFile, flag.Args()[1:])
+	default:
+		fmt.Fprintf(flag.CommandLine.Output(), "unknown command: %s\n", cmd)
+		flag.Usage()
+		os.Exit(2)
 	}
+}
 
+func serve(ctx context.Context, configFile string) {
 	ctx, cancel := context.WithCancel(ctx)
-	done := app.Start(ctx, *configFile)
+	done := app.Start(ctx, configFile)
 
 	go func() {
 		defer cancel()
@@ -38,3 +84,90 @@ func main() {
 
 	<-done
 }
+
+func migrate(ctx context.Context, configFile string, args []string) {
+	if len(args) == 0 || len(args) > 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	version := app.MigrateLatest
+	if len(args) == 2 {
+		var err error
+
+		version, err = strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "invalid version: %s\n", args[1])
+			os.Exit(2)
+		}
+	}
+
+	app.Migrate(ctx, configFile, args[0], version)
+}
+
+func export(ctx context.Context, configFile string, args []string) {
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	app.Export(ctx, configFile, args[0])
+}
+
+func importArchive(ctx context.Context, configFile string, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Usage = flag.Usage
+	mode := fs.String("mode", string(core.ImportMerge), "merge or replace")
+
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	app.Import(ctx, configFile, fs.Arg(0), core.ImportMode(*mode))
+}
+
+func copyStorage(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("copy-storage", flag.ExitOnError)
+	fs.Usage = flag.Usage
+	from := fs.String("from", "", "path to config of the source storage")
+	to := fs.String("to", "", "path to config of the destination storage")
+	workers := fs.Int("workers", 4, "count of files copied concurrently")
+	verifyChecksum := fs.Bool("verify-checksum", false, "read copied and skipped files back and compare checksums")
+
+	_ = fs.Parse(args)
+
+	if *from == "" || *to == "" || fs.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	app.CopyStorage(ctx, *from, *to, *workers, *verifyChecksum)
+}
+
+func warm(ctx context.Context, configFile string, args []string) {
+	fs := flag.NewFlagSet("warm", flag.ExitOnError)
+	fs.Usage = flag.Usage
+	category := fs.String("category", imredis.CategoryNameAll, "category of images")
+	workers := fs.Int("workers", 4, "count of images rendered concurrently")
+
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	app.Warm(ctx, configFile, *category, *workers)
+}
+
+func difficulty(ctx context.Context, configFile string, args []string) {
+	if len(args) != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	app.BackfillDifficulty(ctx, configFile)
+}
@@ -2,16 +2,22 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"os"
 	"time"
 
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/api/imhttp"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/core"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/jobs"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository/imredis"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage/local"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage/s3"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/tracing"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/validate"
 
 	"github.com/gomodule/redigo/redis"
@@ -61,44 +67,45 @@ func runApp(
 
 	l.Debug().Interface("config", cfg).Msg("loaded config")
 
-	kvp := &redis.Pool{
-		Dial: func() (redis.Conn, error) {
-			return redis.DialURL(cfg.Redis.Endpoint)
-		},
-	}
-
-	repoImageMeta := imredis.NewImageMetaRepository(kvp)
-
-	fileStorage, err := s3.NewStorage(cfg.S3)
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing, cfg.Environment)
 	if err != nil {
-		return fmt.Errorf("initializing file storage: %w", err)
+		return fmt.Errorf("setting up tracing: %w", err)
 	}
 
-	validate := validate.New()
-
-	c := core.NewCore(core.Essentials{
-		KVP:                 kvp,
-		ImageMetaRepository: repoImageMeta,
-		FileStorage:         fileStorage,
-		Validate:            validate,
-	}, cfg.Core)
-
 	promRegistry := prometheus.NewRegistry()
 	err = promRegistry.Register(prometheus.NewGoCollector())
 	if err != nil {
 		return fmt.Errorf("registering go collector: %w", err)
 	}
 
+	c, queue, err := newCore(cfg, promRegistry)
+	if err != nil {
+		return fmt.Errorf("initializing core: %w", err)
+	}
+
 	srv, err := imhttp.NewServer(imhttp.Essentials{
 		Logger:       l,
 		Core:         c,
+		Jobs:         queue,
 		PromRegistry: promRegistry,
 	}, cfg.Server)
 	if err != nil {
 		return fmt.Errorf("creating server: %w", err)
 	}
 
+	jobsDone := make(chan struct{})
+
 	go func() {
+		defer close(jobsDone)
+
+		queue.Run(l.WithContext(ctx))
+	}()
+
+	shutdownDone := make(chan struct{})
+
+	go func() {
+		defer close(shutdownDone)
+
 		<-ctx.Done()
 
 		ctx, cancel := context.WithTimeout(
@@ -107,18 +114,92 @@ func runApp(
 		)
 		defer cancel()
 
+		// Workers finish current jobs concurrently, they are stopped by the
+		// same context. Jobs enqueued by remaining requests are kept in
+		// Redis for the next start.
 		serr := srv.Shutdown(ctx)
 		if serr != nil {
 			l.Warn().Err(serr).Msg("shutdowing server")
 		}
+
+		<-jobsDone
+
+		serr = shutdownTracing(ctx)
+		if serr != nil {
+			l.Warn().Err(serr).Msg("shutdowing tracing")
+		}
 	}()
 
 	l.Info().Msgf("starting server on %s", cfg.Server.Address)
 
 	err = srv.ListenAndServe()
-	if err != nil {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("lister and server: %w", err)
 	}
 
+	// ListenAndServe returns immediately after Shutdown is called, wait
+	// for workers and the flush of spans.
+	<-shutdownDone
+
 	return nil
 }
+
+// newCore initializes dependencies and creates the core with the job
+// queue. Metrics of the queue are registered if promRegistry is not nil.
+func newCore(
+	cfg config.Config,
+	promRegistry prometheus.Registerer,
+) (*core.Core, *jobs.Queue, error) {
+	kvp := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(cfg.Redis.Endpoint)
+		},
+	}
+
+	repoImageMeta := tracing.NewImageMetaRepository(imredis.NewImageMetaRepository(kvp))
+
+	fileStorage, err := newFileStorage(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("initializing file storage: %w", err)
+	}
+
+	queue, err := jobs.NewQueue(jobs.Essentials{
+		KVP:          kvp,
+		PromRegistry: promRegistry,
+	}, cfg.Jobs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("initializing job queue: %w", err)
+	}
+
+	watermark, err := core.NewWatermark(cfg.Core)
+	if err != nil {
+		return nil, nil, fmt.Errorf("initializing watermark: %w", err)
+	}
+
+	variants, err := core.NewVariants(cfg.Core)
+	if err != nil {
+		return nil, nil, fmt.Errorf("initializing variants: %w", err)
+	}
+
+	return core.NewCore(core.Essentials{
+		KVP:                 kvp,
+		Jobs:                queue,
+		Watermark:           watermark,
+		Variants:            variants,
+		ImageMetaRepository: repoImageMeta,
+		FileStorage:         tracing.NewFileStorage(fileStorage),
+		Validate:            validate.New(),
+	}, cfg.Core), queue, nil
+}
+
+// newFileStorage creates the file storage selected by the driver.
+func newFileStorage(cfg config.Config) (storage.FileStorage, error) {
+	switch cfg.Storage.Driver {
+	case config.StorageDriverS3:
+		return s3.NewStorage(cfg.S3)
+	case config.StorageDriverLocal:
+		return local.NewStorage(cfg.Local)
+	default:
+		return nil, fmt.Errorf("unknown storage driver: %s", cfg.Storage.Driver)
+	}
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/test"
+
+	"github.com/rs/zerolog"
+)
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	test.AssertErrNil(t, err)
+
+	addr := ln.Addr().String()
+	test.AssertErrNil(t, ln.Close())
+
+	return addr
+}
+
+func TestRunApp_shutdownFlushesTraces(t *testing.T) {
+	dir := t.TempDir()
+	tracesFile := filepath.Join(dir, "traces.json")
+	addr := freeAddress(t)
+
+	cfgData, err := json.Marshal(map[string]interface{}{
+		"storage": map[string]interface{}{"driver": config.StorageDriverLocal},
+		"local":   map[string]interface{}{"root": filepath.Join(dir, "images")},
+		"Server":  map[string]interface{}{"address": addr},
+		"tracing": map[string]interface{}{
+			"exporter":     config.TracingExporterFile,
+			"file":         tracesFile,
+			"sample_ratio": 1,
+		},
+	})
+	test.AssertErrNil(t, err)
+
+	configFile := filepath.Join(dir, "config.json")
+	test.AssertErrNil(t, ioutil.WriteFile(configFile, cfgData, 0o600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- runApp(ctx, zerolog.New(ioutil.Discard), configFile)
+	}()
+
+	url := fmt.Sprintf("http://%s/api/v1/categories", addr)
+
+	for i := 0; ; i++ {
+		resp, err := http.Get(url) // nolint: gosec, noctx // URL is local.
+		if err == nil {
+			test.AssertErrNil(t, resp.Body.Close())
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatal("exp", http.StatusOK, "got", resp.StatusCode)
+			}
+
+			break
+		}
+
+		if i == 50 {
+			t.Fatal(err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	cancel()
+
+	select {
+	case err = <-errc:
+		test.AssertErrNil(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("app is not stopped")
+	}
+
+	traces, err := ioutil.ReadFile(tracesFile)
+	test.AssertErrNil(t, err)
+
+	if !strings.Contains(string(traces), `"Name":"GET /api/v1/categories"`) {
+		t.Fatal("exp span of the request in", string(traces))
+	}
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/core"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+
+	"github.com/rs/zerolog"
+)
+
+// StdStream is a file name that means stdin or stdout.
+const StdStream = "-"
+
+// Export writes the catalog archive to the file.
+func Export(ctx context.Context, configFile string, file string) {
+	// Stdout can be used for the archive.
+	l := zerolog.New(os.Stderr)
+	ctx = l.WithContext(ctx)
+
+	c := mustCore(l, configFile)
+
+	err := func() (err error) {
+		var w io.Writer = os.Stdout
+
+		if file != StdStream {
+			f, err := os.Create(file)
+			if err != nil {
+				return fmt.Errorf("creating file: %w", err)
+			}
+
+			defer func() { err = imerrors.ErrorPair(err, f.Close()) }()
+
+			w = f
+		}
+
+		return c.ExportCatalog(ctx, w)
+	}()
+	if err != nil {
+		l.Fatal().Err(err).Msg("exporting catalog")
+	}
+
+	l.Info().Str("file", file).Msg("catalog exported")
+}
+
+// Import reads the catalog archive from the file.
+func Import(ctx context.Context, configFile string, file string, mode core.ImportMode) {
+	l := zerolog.New(os.Stderr)
+	ctx = l.WithContext(ctx)
+
+	c := mustCore(l, configFile)
+
+	report, err := func() (report core.ImportReport, err error) {
+		var r io.Reader = os.Stdin
+
+		if file != StdStream {
+			f, err := os.Open(file)
+			if err != nil {
+				return report, fmt.Errorf("opening file: %w", err)
+			}
+
+			defer func() { err = imerrors.ErrorPair(err, f.Close()) }()
+
+			r = f
+		}
+
+		return c.ImportCatalog(ctx, r, mode)
+	}()
+	if err != nil {
+		l.Fatal().Err(err).
+			Int("imported", report.Imported).
+			Int("skipped", report.Skipped).
+			Msg("importing catalog")
+	}
+
+	l.Info().
+		Str("file", file).
+		Int("imported", report.Imported).
+		Int("skipped", report.Skipped).
+		Msg("catalog imported")
+}
+
+func mustCore(l zerolog.Logger, configFile string) *core.Core {
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		l.Fatal().Err(err).Msg("loading config")
+	}
+
+	// Jobs are processed by workers of the server.
+	c, _, err := newCore(cfg, nil)
+	if err != nil {
+		l.Fatal().Err(err).Msg("initializing core")
+	}
+
+	return c
+}
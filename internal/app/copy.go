@@ -0,0 +1,67 @@
+package app
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage/transfer"
+
+	"github.com/rs/zerolog"
+)
+
+const copyProgressInterval = 10 * time.Second
+
+// CopyStorage copies all originals from the storage configured in
+// fromConfig to the storage configured in toConfig. It exits with an
+// error if some files were not copied or storages differ afterwards.
+func CopyStorage(
+	ctx context.Context,
+	fromConfig string,
+	toConfig string,
+	workers int,
+	verifyChecksum bool,
+) {
+	l := zerolog.New(os.Stdout)
+	ctx = l.WithContext(ctx)
+
+	src := mustFileStorage(l, fromConfig)
+	dst := mustFileStorage(l, toConfig)
+
+	report, err := transfer.Copy(ctx, src, dst, transfer.Options{
+		Workers:          workers,
+		VerifyChecksum:   verifyChecksum,
+		ProgressInterval: copyProgressInterval,
+	})
+
+	e := l.Info()
+	if err != nil || report.Failed > 0 || !report.Diff.Empty() {
+		e = l.Fatal().Err(err)
+	}
+
+	e.
+		Int64("copied", report.Copied).
+		Int64("skipped", report.Skipped).
+		Int64("failed", report.Failed).
+		Int64("bytes", report.Bytes).
+		Strs("missing", report.Diff.Missing).
+		Strs("mismatched", report.Diff.Mismatched).
+		Strs("extra", report.Diff.Extra).
+		Msg("storage copied")
+}
+
+func mustFileStorage(l zerolog.Logger, configFile string) storage.FileStorage {
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		l.Fatal().Err(err).Str("config", configFile).Msg("loading config")
+	}
+
+	fs, err := newFileStorage(cfg)
+	if err != nil {
+		l.Fatal().Err(err).Str("config", configFile).Msg("initializing file storage")
+	}
+
+	return fs
+}
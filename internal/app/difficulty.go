@@ -0,0 +1,51 @@
+package app
+
+import (
+	"context"
+	"os"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rs/zerolog"
+)
+
+// BackfillDifficulty computes the puzzle difficulty of images for grids
+// of core.difficulty_grids they miss, for example after the grids were
+// configured or changed. It can run along with the server.
+func BackfillDifficulty(ctx context.Context, configFile string) {
+	l := zerolog.New(os.Stdout)
+	ctx = l.WithContext(ctx)
+
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		l.Fatal().Err(err).Msg("loading config")
+	}
+
+	if len(cfg.Core.DifficultyGrids) == 0 {
+		l.Fatal().Msg("difficulty grids are not configured")
+	}
+
+	kv, err := redis.DialURL(cfg.Redis.Endpoint)
+	if err != nil {
+		l.Fatal().Err(err).Msg("connecting to redis")
+	}
+
+	defer func() {
+		if err := kv.Close(); err != nil {
+			l.Warn().Err(err).Msg("closing redis connection")
+		}
+	}()
+
+	fileStorage, err := newFileStorage(cfg)
+	if err != nil {
+		l.Fatal().Err(err).Msg("initializing file storage")
+	}
+
+	env := migrationEnv{KV: kv, FileStorage: fileStorage, Core: cfg.Core}
+
+	err = backfillImageDifficulty(ctx, env, "ocmoxa:image_meta", cfg.Core.DifficultyGrids)
+	if err != nil {
+		l.Fatal().Err(err).Msg("backfilling difficulty")
+	}
+}
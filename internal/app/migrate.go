@@ -2,23 +2,60 @@ package app
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"strings"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
 
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
-	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/improto"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog"
-	"google.golang.org/protobuf/proto"
 )
 
-// Migrate runs database migration by version.
-func Migrate(ctx context.Context, configFile string, version int) {
+// Migration operations.
+const (
+	MigrateStatus = "status"
+	MigrateUp     = "up"
+	MigrateDown   = "down"
+)
+
+// MigrateLatest tells to migrate without a target version. For up it
+// means the latest known migration, for down it means one step back.
+const MigrateLatest = -1
+
+const (
+	keyMigrationState = "ocmoxa:migration"
+	keyMigrationLock  = "ocmoxa:migration_lock"
+)
+
+const migrationLockTTL = time.Minute
+
+const (
+	errUnknownVersion    imerrors.Error = "unknown version"
+	errUnknownOperation  imerrors.Error = "unknown operation"
+	errIrreversible      imerrors.Error = "migration is irreversible"
+	errMigrationLocked   imerrors.Error = "another migration is in progress"
+	errMigrationLockLost imerrors.Error = "migration lock lost"
+)
+
+// Migrate runs the migration operation: status, up or down. The version
+// is a target of the operation, use MigrateLatest for the default one.
+func Migrate(
+	ctx context.Context,
+	configFile string,
+	operation string,
+	version int,
+) {
 	l := zerolog.New(os.Stdout)
+	ctx = l.WithContext(ctx)
 
 	cfg, err := config.Load(configFile)
 	if err != nil {
@@ -30,105 +67,397 @@ func Migrate(ctx context.Context, configFile string, version int) {
 			return redis.DialURL(cfg.Redis.Endpoint)
 		},
 	}
+	defer func() {
+		if err := kvp.Close(); err != nil {
+			l.Warn().Err(err).Msg("closing redis pool")
+		}
+	}()
 
-	err = applyMigration(kvp, version)
+	fileStorage, err := newFileStorage(cfg)
 	if err != nil {
-		l.Fatal().Err(err).Msg("applying migration")
+		l.Fatal().Err(err).Msg("initializing file storage")
 	}
 
-	l.Info().Msgf("migration #%d applied", version)
-}
-
-const errUnknownVersion imerrors.Error = "unknown version"
+	m := newMigrator(kvp, fileStorage, cfg.Core, getMigrations())
 
-func applyMigration(kvp *redis.Pool, version int) (err error) {
-	migrations := getMigrations()
-	if version < 0 || version >= len(migrations) {
-		return errUnknownVersion
+	switch operation {
+	case MigrateStatus:
+		err = m.PrintStatus(ctx, os.Stdout)
+	case MigrateUp:
+		err = m.Up(ctx, version, l)
+	case MigrateDown:
+		err = m.Down(ctx, version, l)
+	default:
+		err = fmt.Errorf("%w: %s", errUnknownOperation, operation)
 	}
 
-	kv := kvp.Get()
-	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
-
-	err = migrations[version](kv)
 	if err != nil {
-		return fmt.Errorf("applying migration: %d: %w", version, err)
+		l.Fatal().Err(err).Str("operation", operation).Msg("migrating")
 	}
+}
 
-	return nil
+// migration is a versioned change of the stored data. Up and Down must
+// be idempotent or guarded, because they can be interrupted and run
+// again. Down is nil if the migration is irreversible.
+type migration struct {
+	Version int
+	Name    string
+	Up      migrationFunc
+	Down    migrationFunc
 }
 
-type migration func(kv redis.Conn) (err error)
+type migrationFunc func(ctx context.Context, env migrationEnv) (err error)
+
+// migrationEnv holds dependencies of the migration.
+type migrationEnv struct {
+	KV          redis.Conn
+	FileStorage storage.FileStorage
+	// Core is the config of the core, migrations compute image details
+	// like the server does.
+	Core config.Core
+}
 
-func getMigrations() [1]migration {
-	return [...]migration{
-		migrateV1ProtoBufToJSON,
+// migrationStatus describes the state of the known migration.
+type migrationStatus struct {
+	migration
+
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// migrator applies migrations and records applied versions in Redis.
+// It holds a lock, so only one process migrates at a time.
+type migrator struct {
+	kvp         *redis.Pool
+	fileStorage storage.FileStorage
+	cfgCore     config.Core
+	migrations  []migration
+
+	keyState string
+	keyLock  string
+}
+
+func newMigrator(
+	kvp *redis.Pool,
+	fileStorage storage.FileStorage,
+	cfgCore config.Core,
+	migrations []migration,
+) *migrator {
+	sorted := make([]migration, len(migrations))
+	copy(sorted, migrations)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+
+	return &migrator{
+		kvp:         kvp,
+		fileStorage: fileStorage,
+		cfgCore:     cfgCore,
+		migrations:  sorted,
+
+		keyState: keyMigrationState,
+		keyLock:  keyMigrationLock,
 	}
 }
 
-func migrateV1ProtoBufToJSON(kv redis.Conn) (err error) {
-	const keyImageIDs = "ocmoxa:image_id"
-	const keyImageMeta = "ocmoxa:image_meta"
-	const categoryAll = "all"
+// Status returns all known migrations with their state.
+func (m *migrator) Status(ctx context.Context) (status []migrationStatus, err error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	status = make([]migrationStatus, len(m.migrations))
+	for i, mig := range m.migrations {
+		appliedAt, ok := applied[mig.Version]
 
-	categories, err := redis.Strings(kv.Do("KEYS", keyImageMeta+":*"))
+		status[i] = migrationStatus{
+			migration: mig,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		}
+	}
+
+	return status, nil
+}
+
+// PrintStatus writes the table of known migrations to w.
+func (m *migrator) PrintStatus(ctx context.Context, w io.Writer) (err error) {
+	status, err := m.Status(ctx)
 	if err != nil {
-		return fmt.Errorf("getting categories: %w", err)
+		return fmt.Errorf("getting status: %w", err)
 	}
 
-	im := new(improto.ImageMeta)
-	for _, category := range categories {
-		category = strings.TrimPrefix(category, keyImageMeta+":")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
 
-		if category == categoryAll {
-			continue
+	for _, s := range status {
+		appliedAt := "pending"
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format(time.RFC3339)
 		}
 
-		imRange, err := redis.ByteSlices(kv.Do(
-			"LRANGE",
-			"ocmoxa:image_meta:"+category,
-			0,  // Start.
-			-1, // Stop.
-		))
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+
+	return tw.Flush()
+}
+
+// Up applies pending migrations in order up to the target version
+// inclusive.
+func (m *migrator) Up(ctx context.Context, target int, l zerolog.Logger) (err error) {
+	if target == MigrateLatest && len(m.migrations) > 0 {
+		target = m.migrations[len(m.migrations)-1].Version
+	}
+
+	if target != MigrateLatest && !m.known(target) {
+		return fmt.Errorf("%w: %d", errUnknownVersion, target)
+	}
+
+	return m.withLock(ctx, func(ctx context.Context) error {
+		applied, err := m.applied()
 		if err != nil {
-			return fmt.Errorf("doing lrange: %w", err)
+			return err
 		}
 
-		for _, imBytes := range imRange {
-			err := proto.Unmarshal(imBytes, im)
-			if err != nil {
-				return fmt.Errorf("decoding image meta: %w", err)
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok || mig.Version > target {
+				continue
+			}
+
+			l.Info().Int("version", mig.Version).Str("name", mig.Name).
+				Msg("applying migration")
+
+			if err = m.run(ctx, mig.Up); err != nil {
+				return fmt.Errorf("applying migration: %d: %w", mig.Version, err)
+			}
+
+			if err = m.setApplied(mig.Version, time.Now()); err != nil {
+				return fmt.Errorf("recording migration: %d: %w", mig.Version, err)
 			}
+		}
 
-			imID := im.GetId()
-			imMap := map[string]interface{}{
-				"id":       imID,
-				"author":   im.GetAuthor(),
-				"source":   im.GetWebSource(),
-				"mimetype": im.GetMimeType(),
-				"category": category,
+		return nil
+	})
+}
+
+// Down reverts applied migrations in reverse order while their version
+// is greater than the target. By default it reverts the last one.
+func (m *migrator) Down(ctx context.Context, target int, l zerolog.Logger) (err error) {
+	if target != MigrateLatest && target != 0 && !m.known(target) {
+		return fmt.Errorf("%w: %d", errUnknownVersion, target)
+	}
+
+	return m.withLock(ctx, func(ctx context.Context) error {
+		applied, err := m.applied()
+		if err != nil {
+			return err
+		}
+
+		reverted := 0
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+
+			if _, ok := applied[mig.Version]; !ok {
+				continue
 			}
-			imBytes, err := json.Marshal(&imMap)
-			if err != nil {
-				return fmt.Errorf("encoding image meta: %w", err)
+
+			if (target == MigrateLatest && reverted > 0) || mig.Version <= target {
+				break
 			}
 
-			_, err = kv.Do("HSET", keyImageMeta, imID, imBytes)
-			if err != nil {
-				return fmt.Errorf("saving image meta: %w", err)
+			if mig.Down == nil {
+				return fmt.Errorf("reverting migration: %d: %w", mig.Version, errIrreversible)
 			}
 
-			_, err = kv.Do("RPUSH", keyImageIDs+":"+category, imID)
-			if err != nil {
-				return fmt.Errorf("saving image meta: %w", err)
+			l.Info().Int("version", mig.Version).Str("name", mig.Name).
+				Msg("reverting migration")
+
+			if err = m.run(ctx, mig.Down); err != nil {
+				return fmt.Errorf("reverting migration: %d: %w", mig.Version, err)
 			}
 
-			_, err = kv.Do("RPUSH", keyImageIDs+":"+categoryAll, imID)
-			if err != nil {
-				return fmt.Errorf("saving image meta: %w", err)
+			if err = m.unsetApplied(mig.Version); err != nil {
+				return fmt.Errorf("recording migration: %d: %w", mig.Version, err)
 			}
+
+			reverted++
+		}
+
+		return nil
+	})
+}
+
+func (m *migrator) known(version int) bool {
+	for _, mig := range m.migrations {
+		if mig.Version == version {
+			return true
 		}
 	}
 
+	return false
+}
+
+func (m *migrator) run(ctx context.Context, fn migrationFunc) (err error) {
+	kv := m.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	return fn(ctx, migrationEnv{
+		KV:          kv,
+		FileStorage: m.fileStorage,
+		Core:        m.cfgCore,
+	})
+}
+
+// applied returns applied versions with the time of application.
+func (m *migrator) applied() (applied map[int]time.Time, err error) {
+	kv := m.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	values, err := redis.StringMap(kv.Do("HGETALL", m.keyState))
+	if err != nil {
+		return nil, fmt.Errorf("doing hgetall: %w", err)
+	}
+
+	applied = make(map[int]time.Time, len(values))
+	for versionStr, appliedAtStr := range values {
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing version: %w", err)
+		}
+
+		appliedAt, err := time.Parse(time.RFC3339, appliedAtStr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing applied at: %w", err)
+		}
+
+		applied[version] = appliedAt
+	}
+
+	return applied, nil
+}
+
+func (m *migrator) setApplied(version int, appliedAt time.Time) (err error) {
+	kv := m.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	_, err = kv.Do("HSET", m.keyState, version, appliedAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("doing hset: %w", err)
+	}
+
+	return nil
+}
+
+func (m *migrator) unsetApplied(version int) (err error) {
+	kv := m.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	_, err = kv.Do("HDEL", m.keyState, version)
+	if err != nil {
+		return fmt.Errorf("doing hdel: %w", err)
+	}
+
 	return nil
 }
+
+// nolint: gochecknoglobals // Scripts are immutable.
+var (
+	scriptUnlock = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+	scriptExtendLock = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+)
+
+// withLock runs fn holding the migration lock. The lock is extended
+// periodically until fn returns. The context of fn is cancelled if the
+// lock is lost.
+func (m *migrator) withLock(
+	ctx context.Context,
+	fn func(ctx context.Context) error,
+) (err error) {
+	token := uuid.NewString()
+	ttl := migrationLockTTL.Milliseconds()
+
+	kv := m.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	_, err = redis.String(kv.Do("SET", m.keyLock, token, "NX", "PX", ttl))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+		return errMigrationLocked
+	case err != nil:
+		return fmt.Errorf("acquiring lock: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lost := make(chan error, 1)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		if lerr := m.extendLock(stop, token); lerr != nil {
+			lost <- lerr
+
+			cancel()
+		}
+	}()
+
+	fnErr := fn(ctx)
+
+	close(stop)
+	<-done
+
+	select {
+	case lerr := <-lost:
+		fnErr = imerrors.ErrorPair(fnErr, lerr)
+	default:
+	}
+
+	_, err = scriptUnlock.Do(kv, m.keyLock, token)
+	if err != nil {
+		err = fmt.Errorf("releasing lock: %w", err)
+	}
+
+	return imerrors.ErrorPair(fnErr, err)
+}
+
+func (m *migrator) extendLock(stop <-chan struct{}, token string) (err error) {
+	ticker := time.NewTicker(migrationLockTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		kv := m.kvp.Get()
+		extended, err := redis.Bool(scriptExtendLock.Do(
+			kv,
+			m.keyLock,
+			token,
+			migrationLockTTL.Milliseconds(),
+		))
+		err = imerrors.ErrorPair(err, kv.Close())
+
+		switch {
+		case err != nil:
+			return fmt.Errorf("extending lock: %w", err)
+		case !extended:
+			return errMigrationLockLost
+		}
+	}
+}
@@ -1,34 +1,171 @@
 package app
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
 	"testing"
 
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/picture"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository/imredis"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage/local"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/test"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
 )
 
-func TestMigration_applyMigration_invalid(t *testing.T) {
+func newTestMigrator(t *testing.T, kvp *redis.Pool, migrations []migration) *migrator {
+	t.Helper()
+
+	m := newMigrator(kvp, nil, config.Core{}, migrations)
+	m.keyState = "test:migration:" + uuid.NewString()
+	m.keyLock = "test:migration_lock:" + uuid.NewString()
+
+	t.Cleanup(func() {
+		kv := kvp.Get()
+		defer func() { test.AssertErrNil(t, kv.Close()) }()
+
+		_, err := kv.Do("DEL", m.keyState, m.keyLock)
+		test.AssertErrNil(t, err)
+	})
+
+	return m
+}
+
+func TestMigrator(t *testing.T) {
 	kvp := test.InitKVP(t)
 	t.Cleanup(func() { test.DisposeKVP(t, kvp) })
 
-	t.Run("negative", func(t *testing.T) {
-		err := applyMigration(kvp, -1)
-		if !errors.Is(err, errUnknownVersion) {
+	ctx := context.Background()
+	l := zerolog.New(ioutil.Discard)
+
+	var calls []int
+	counter := func(version int) migrationFunc {
+		return func(ctx context.Context, env migrationEnv) error {
+			calls = append(calls, version)
+
+			return nil
+		}
+	}
+
+	m := newTestMigrator(t, kvp, []migration{
+		{Version: 3, Name: "third", Up: counter(3), Down: counter(-3)},
+		{Version: 1, Name: "first", Up: counter(1), Down: nil},
+		{Version: 2, Name: "second", Up: counter(2), Down: counter(-2)},
+	})
+
+	assertCalls := func(t *testing.T, exp ...int) {
+		t.Helper()
+
+		defer func() { calls = nil }()
+
+		if len(calls) != len(exp) {
+			t.Fatal("exp", exp, "got", calls)
+		}
+
+		for i := range exp {
+			if calls[i] != exp[i] {
+				t.Fatal("exp", exp, "got", calls)
+			}
+		}
+	}
+
+	t.Run("up_to_version", func(t *testing.T) {
+		test.AssertErrNil(t, m.Up(ctx, 2, l))
+		assertCalls(t, 1, 2)
+	})
+
+	t.Run("up_latest", func(t *testing.T) {
+		test.AssertErrNil(t, m.Up(ctx, MigrateLatest, l))
+		assertCalls(t, 3)
+	})
+
+	t.Run("up_again", func(t *testing.T) {
+		test.AssertErrNil(t, m.Up(ctx, MigrateLatest, l))
+		assertCalls(t)
+	})
+
+	t.Run("status", func(t *testing.T) {
+		status, err := m.Status(ctx)
+		test.AssertErrNil(t, err)
+
+		for i, s := range status {
+			switch {
+			case s.Version != i+1:
+				t.Fatal("exp", i+1, "got", s.Version)
+			case !s.Applied, s.AppliedAt.IsZero():
+				t.Fatal(s)
+			}
+		}
+	})
+
+	t.Run("down_step", func(t *testing.T) {
+		test.AssertErrNil(t, m.Down(ctx, MigrateLatest, l))
+		assertCalls(t, -3)
+	})
+
+	t.Run("down_irreversible", func(t *testing.T) {
+		err := m.Down(ctx, 0, l)
+		if !errors.Is(err, errIrreversible) {
 			t.Fatal(err)
 		}
+
+		assertCalls(t, -2)
+
+		status, err := m.Status(ctx)
+		test.AssertErrNil(t, err)
+
+		if !status[0].Applied || status[1].Applied || status[2].Applied {
+			t.Fatal(status)
+		}
 	})
 
-	t.Run("oversized", func(t *testing.T) {
-		err := applyMigration(kvp, len(getMigrations()))
+	t.Run("unknown_version", func(t *testing.T) {
+		err := m.Up(ctx, 4, l)
 		if !errors.Is(err, errUnknownVersion) {
 			t.Fatal(err)
 		}
 	})
 }
 
-func TestMigration_applyMigration_0(t *testing.T) {
+func TestMigrator_locked(t *testing.T) {
+	kvp := test.InitKVP(t)
+	t.Cleanup(func() { test.DisposeKVP(t, kvp) })
+
+	ctx := context.Background()
+	l := zerolog.New(ioutil.Discard)
+
+	var m *migrator
+	m = newTestMigrator(t, kvp, []migration{{
+		Version: 1,
+		Name:    "nested",
+		Up: func(ctx context.Context, env migrationEnv) error {
+			return m.Up(ctx, MigrateLatest, l)
+		},
+	}})
+
+	err := m.Up(ctx, MigrateLatest, l)
+	if !errors.Is(err, errMigrationLocked) {
+		t.Fatal(err)
+	}
+
+	// The lock is released after the failure.
+	m.migrations[0].Up = func(ctx context.Context, env migrationEnv) error {
+		return nil
+	}
+
+	test.AssertErrNil(t, m.Up(ctx, MigrateLatest, l))
+}
+
+func TestMigration_protoBufToJSON(t *testing.T) {
 	const imageID = "unsplash_SVwOposMxHY"
 
 	kvp := test.InitKVP(t)
@@ -37,6 +174,20 @@ func TestMigration_applyMigration_0(t *testing.T) {
 	kv := kvp.Get()
 	t.Cleanup(func() { test.AssertErrNil(t, kv.Close()) })
 
+	cleanup := func() {
+		_, err := kv.Do("HDEL", "ocmoxa:image_meta", imageID)
+		test.AssertErrNil(t, err)
+
+		_, err = kv.Do("LREM", "ocmoxa:image_id:all", 0, imageID)
+		test.AssertErrNil(t, err)
+
+		_, err = kv.Do("DEL", "ocmoxa:image_id:color", "ocmoxa:image_meta:color")
+		test.AssertErrNil(t, err)
+	}
+
+	cleanup()
+	t.Cleanup(cleanup)
+
 	_, err := kv.Do(
 		"LPUSH",
 		"ocmoxa:image_meta:color",
@@ -44,25 +195,614 @@ func TestMigration_applyMigration_0(t *testing.T) {
 	)
 	test.AssertErrNil(t, err)
 
-	err = applyMigration(kvp, 0)
-	test.AssertErrNil(t, err)
+	ctx := context.Background()
+
+	// Running twice must not duplicate ids.
+	for i := 0; i < 2; i++ {
+		err = migrateV1ProtoBufToJSON(ctx, migrationEnv{KV: kv})
+		test.AssertErrNil(t, err)
+	}
 
 	_, err = kv.Do("HGET", "ocmoxa:image_meta", imageID)
 	test.AssertErrNil(t, err)
 
 	const expRemoveCount = 1
 	var removed int
-	removed, err = redis.Int(kv.Do("LREM", "ocmoxa:image_id:all", expRemoveCount, imageID))
+	removed, err = redis.Int(kv.Do("LREM", "ocmoxa:image_id:all", 0, imageID))
 	test.AssertErrNil(t, err)
 
 	if removed != expRemoveCount {
 		t.Fatal("got", removed, "exp", expRemoveCount)
 	}
 
-	removed, err = redis.Int(kv.Do("LREM", "ocmoxa:image_id:color", expRemoveCount, imageID))
+	removed, err = redis.Int(kv.Do("LREM", "ocmoxa:image_id:color", 0, imageID))
 	test.AssertErrNil(t, err)
 
 	if removed != expRemoveCount {
 		t.Fatal("got", removed, "exp", expRemoveCount)
 	}
 }
+
+func TestMigration_imageMetaDetails(t *testing.T) {
+	imageID := "test_" + uuid.NewString()
+	keyImageMeta := "test:image_meta:" + uuid.NewString()
+
+	kvp := test.InitKVP(t)
+	t.Cleanup(func() { test.DisposeKVP(t, kvp) })
+
+	kv := kvp.Get()
+	t.Cleanup(func() { test.AssertErrNil(t, kv.Close()) })
+
+	t.Cleanup(func() {
+		_, err := kv.Do("DEL", keyImageMeta)
+		test.AssertErrNil(t, err)
+	})
+
+	fileStorage, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	var imgData bytes.Buffer
+	err = png.Encode(&imgData, image.NewGray(image.Rect(0, 0, 4, 3)))
+	test.AssertErrNil(t, err)
+
+	ctx := context.Background()
+	err = fileStorage.Upload(ctx, imager.ImageMeta{
+		ID:       imageID,
+		MIMEType: "image/png",
+	}, bytes.NewReader(imgData.Bytes()))
+	test.AssertErrNil(t, err)
+
+	_, err = kv.Do("HSET", keyImageMeta, imageID, `{"id":"`+imageID+`","author":"test_author"}`)
+	test.AssertErrNil(t, err)
+
+	env := migrationEnv{KV: kv, FileStorage: fileStorage}
+
+	var prev imager.ImageMeta
+	for i := 0; i < 2; i++ {
+		err = backfillImageMetaDetails(ctx, env, keyImageMeta)
+		test.AssertErrNil(t, err)
+
+		imBytes, err := redis.Bytes(kv.Do("HGET", keyImageMeta, imageID))
+		test.AssertErrNil(t, err)
+
+		im, err := imager.RawImageMetaJSON(imBytes).ImageMeta()
+		test.AssertErrNil(t, err)
+
+		switch {
+		case im.Author != "test_author":
+			t.Fatal("exp test_author, got", im.Author)
+		case im.Size != int64(imgData.Len()):
+			t.Fatal("exp", imgData.Len(), "got", im.Size)
+		case im.Width != 4 || im.Height != 3:
+			t.Fatal("exp 4x3, got", im.Width, im.Height)
+		case im.SHA256 != picture.Checksum(imgData.Bytes()):
+			t.Fatal("unexpected checksum", im.SHA256)
+		case im.CreatedAt.IsZero() || im.UpdatedAt.IsZero():
+			t.Fatal("zero timestamps", im.CreatedAt, im.UpdatedAt)
+		case i > 0 && !im.UpdatedAt.Equal(prev.UpdatedAt):
+			t.Fatal("migrated image was changed again")
+		}
+
+		prev = im
+	}
+}
+
+func TestMigration_imageDHash(t *testing.T) {
+	imageID := "test_" + uuid.NewString()
+	keyImageMeta := "test:image_meta:" + uuid.NewString()
+	keyImageDHash := "test:image_dhash:" + uuid.NewString()
+
+	kvp := test.InitKVP(t)
+	t.Cleanup(func() { test.DisposeKVP(t, kvp) })
+
+	kv := kvp.Get()
+	t.Cleanup(func() { test.AssertErrNil(t, kv.Close()) })
+
+	t.Cleanup(func() {
+		_, err := kv.Do("DEL", keyImageMeta, keyImageDHash)
+		test.AssertErrNil(t, err)
+	})
+
+	fileStorage, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+
+	var imgData bytes.Buffer
+	err = png.Encode(&imgData, img)
+	test.AssertErrNil(t, err)
+
+	ctx := context.Background()
+	im := imager.ImageMeta{
+		ID:       imageID,
+		MIMEType: "image/png",
+		ObjectID: "sha256-" + picture.Checksum(imgData.Bytes()),
+	}
+
+	err = fileStorage.Upload(ctx, imager.ImageMeta{
+		ID:       im.ObjectID,
+		MIMEType: im.MIMEType,
+	}, bytes.NewReader(imgData.Bytes()))
+	test.AssertErrNil(t, err)
+
+	imBytes, err := im.RawJSON()
+	test.AssertErrNil(t, err)
+
+	_, err = kv.Do("HSET", keyImageMeta, imageID, []byte(imBytes))
+	test.AssertErrNil(t, err)
+
+	env := migrationEnv{KV: kv, FileStorage: fileStorage}
+	err = backfillImageDHash(ctx, env, keyImageMeta, keyImageDHash)
+	test.AssertErrNil(t, err)
+
+	expDHash := picture.FormatHash(picture.DHash(img))
+
+	dhash, err := redis.String(kv.Do("HGET", keyImageDHash, imageID))
+	test.AssertErrNil(t, err)
+
+	if dhash != expDHash {
+		t.Fatal("exp", expDHash, "got", dhash)
+	}
+
+	imBytes, err = redis.Bytes(kv.Do("HGET", keyImageMeta, imageID))
+	test.AssertErrNil(t, err)
+
+	im, err = imBytes.ImageMeta()
+	test.AssertErrNil(t, err)
+
+	if im.DHash != expDHash {
+		t.Fatal("exp", expDHash, "got", im.DHash)
+	}
+}
+
+func TestMigration_imagePlaceholders(t *testing.T) {
+	imageID := "test_" + uuid.NewString()
+	keyImageMeta := "test:image_meta:" + uuid.NewString()
+
+	kvp := test.InitKVP(t)
+	t.Cleanup(func() { test.DisposeKVP(t, kvp) })
+
+	kv := kvp.Get()
+	t.Cleanup(func() { test.AssertErrNil(t, kv.Close()) })
+
+	t.Cleanup(func() {
+		_, err := kv.Do("DEL", keyImageMeta)
+		test.AssertErrNil(t, err)
+	})
+
+	fileStorage, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+
+	var imgData bytes.Buffer
+	err = png.Encode(&imgData, img)
+	test.AssertErrNil(t, err)
+
+	ctx := context.Background()
+	im := imager.ImageMeta{
+		ID:       imageID,
+		MIMEType: "image/png",
+	}
+
+	err = fileStorage.Upload(ctx, im, bytes.NewReader(imgData.Bytes()))
+	test.AssertErrNil(t, err)
+
+	imBytes, err := im.RawJSON()
+	test.AssertErrNil(t, err)
+
+	_, err = kv.Do("HSET", keyImageMeta, imageID, []byte(imBytes))
+	test.AssertErrNil(t, err)
+
+	env := migrationEnv{KV: kv, FileStorage: fileStorage}
+	err = backfillImagePlaceholders(ctx, env, keyImageMeta)
+	test.AssertErrNil(t, err)
+
+	imBytes, err = redis.Bytes(kv.Do("HGET", keyImageMeta, imageID))
+	test.AssertErrNil(t, err)
+
+	im, err = imBytes.ImageMeta()
+	test.AssertErrNil(t, err)
+
+	if expBlurHash := picture.BlurHash(img); im.BlurHash != expBlurHash {
+		t.Fatal("exp", expBlurHash, "got", im.BlurHash)
+	}
+
+	if im.LQIP == "" {
+		t.Fatal("lqip is empty")
+	}
+}
+
+func TestMigration_imagePalette(t *testing.T) {
+	imageID := "test_" + uuid.NewString()
+	keyImageMeta := "test:image_meta:" + uuid.NewString()
+
+	kvp := test.InitKVP(t)
+	t.Cleanup(func() { test.DisposeKVP(t, kvp) })
+
+	kv := kvp.Get()
+	t.Cleanup(func() { test.AssertErrNil(t, kv.Close()) })
+
+	t.Cleanup(func() {
+		_, err := kv.Do("DEL", keyImageMeta)
+		test.AssertErrNil(t, err)
+	})
+
+	fileStorage, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+
+	var imgData bytes.Buffer
+	err = png.Encode(&imgData, img)
+	test.AssertErrNil(t, err)
+
+	ctx := context.Background()
+	im := imager.ImageMeta{
+		ID:       imageID,
+		MIMEType: "image/png",
+	}
+
+	err = fileStorage.Upload(ctx, im, bytes.NewReader(imgData.Bytes()))
+	test.AssertErrNil(t, err)
+
+	imBytes, err := im.RawJSON()
+	test.AssertErrNil(t, err)
+
+	_, err = kv.Do("HSET", keyImageMeta, imageID, []byte(imBytes))
+	test.AssertErrNil(t, err)
+
+	env := migrationEnv{KV: kv, FileStorage: fileStorage}
+	err = backfillImagePalette(ctx, env, keyImageMeta)
+	test.AssertErrNil(t, err)
+
+	imBytes, err = redis.Bytes(kv.Do("HGET", keyImageMeta, imageID))
+	test.AssertErrNil(t, err)
+
+	im, err = imBytes.ImageMeta()
+	test.AssertErrNil(t, err)
+
+	exp := []imager.PaletteColor{{Color: "#000000", Weight: 1}}
+	if len(im.Palette) != 1 || im.Palette[0] != exp[0] {
+		t.Fatal("exp", exp, "got", im.Palette)
+	}
+}
+
+func TestMigration_imageOrientedSize(t *testing.T) {
+	keyImageMeta := "test:image_meta:" + uuid.NewString()
+
+	kvp := test.InitKVP(t)
+	t.Cleanup(func() { test.DisposeKVP(t, kvp) })
+
+	kv := kvp.Get()
+	t.Cleanup(func() { test.AssertErrNil(t, kv.Close()) })
+
+	t.Cleanup(func() {
+		_, err := kv.Do("DEL", keyImageMeta)
+		test.AssertErrNil(t, err)
+	})
+
+	fileStorage, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	var imgData bytes.Buffer
+	err = jpeg.Encode(&imgData, image.NewGray(image.Rect(0, 0, 16, 8)), nil)
+	test.AssertErrNil(t, err)
+
+	ctx := context.Background()
+
+	testCases := []struct {
+		Name        string
+		ID          string
+		Orientation uint16
+		ExpWidth    int
+		ExpHeight   int
+	}{{
+		Name:        "rotated_90",
+		ID:          "test_" + uuid.NewString(),
+		Orientation: 6,
+		ExpWidth:    8,
+		ExpHeight:   16,
+	}, {
+		Name:        "rotated_180",
+		ID:          "test_" + uuid.NewString(),
+		Orientation: 3,
+		ExpWidth:    16,
+		ExpHeight:   8,
+	}}
+
+	for _, tc := range testCases {
+		data := test.JPEGWithOrientation(imgData.Bytes(), tc.Orientation)
+
+		im := imager.ImageMeta{ID: tc.ID, MIMEType: "image/jpeg", Size: int64(len(data))}
+
+		err = fileStorage.Upload(ctx, im, bytes.NewReader(data))
+		test.AssertErrNil(t, err)
+
+		// Dimensions are stored before the orientation was known.
+		im.Width, im.Height = 16, 8
+
+		imBytes, err := im.RawJSON()
+		test.AssertErrNil(t, err)
+
+		_, err = kv.Do("HSET", keyImageMeta, im.ID, []byte(imBytes))
+		test.AssertErrNil(t, err)
+	}
+
+	env := migrationEnv{KV: kv, FileStorage: fileStorage}
+	err = backfillImageOrientedSize(ctx, env, keyImageMeta)
+	test.AssertErrNil(t, err)
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			imBytes, err := redis.Bytes(kv.Do("HGET", keyImageMeta, tc.ID))
+			test.AssertErrNil(t, err)
+
+			im, err := imager.RawImageMetaJSON(imBytes).ImageMeta()
+			test.AssertErrNil(t, err)
+
+			if im.Width != tc.ExpWidth || im.Height != tc.ExpHeight {
+				t.Fatal("exp", tc.ExpWidth, tc.ExpHeight, "got", im.Width, im.Height)
+			}
+		})
+	}
+}
+
+func TestMigration_imageDifficulty(t *testing.T) {
+	imageID := "test_" + uuid.NewString()
+	keyImageMeta := "test:image_meta:" + uuid.NewString()
+
+	kvp := test.InitKVP(t)
+	t.Cleanup(func() { test.DisposeKVP(t, kvp) })
+
+	kv := kvp.Get()
+	t.Cleanup(func() { test.AssertErrNil(t, kv.Close()) })
+
+	t.Cleanup(func() {
+		_, err := kv.Do("DEL", keyImageMeta)
+		test.AssertErrNil(t, err)
+	})
+
+	fileStorage, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+
+	var imgData bytes.Buffer
+	err = png.Encode(&imgData, img)
+	test.AssertErrNil(t, err)
+
+	ctx := context.Background()
+	im := imager.ImageMeta{
+		ID:       imageID,
+		MIMEType: "image/png",
+	}
+
+	err = fileStorage.Upload(ctx, im, bytes.NewReader(imgData.Bytes()))
+	test.AssertErrNil(t, err)
+
+	imBytes, err := im.RawJSON()
+	test.AssertErrNil(t, err)
+
+	_, err = kv.Do("HSET", keyImageMeta, imageID, []byte(imBytes))
+	test.AssertErrNil(t, err)
+
+	env := migrationEnv{KV: kv, FileStorage: fileStorage}
+	err = backfillImageDifficulty(ctx, env, keyImageMeta, []int{3, 4})
+	test.AssertErrNil(t, err)
+
+	imBytes, err = redis.Bytes(kv.Do("HGET", keyImageMeta, imageID))
+	test.AssertErrNil(t, err)
+
+	im, err = imBytes.ImageMeta()
+	test.AssertErrNil(t, err)
+
+	// The flat image is the most difficult.
+	exp := map[string]float64{"3x3": 1, "4x4": 1}
+	if im.Difficulty != 1 || len(im.GridDifficulty) != len(exp) ||
+		im.GridDifficulty["3x3"] != 1 || im.GridDifficulty["4x4"] != 1 {
+		t.Fatal("exp", exp, "got", im.Difficulty, im.GridDifficulty)
+	}
+
+	// The added grid is backfilled, the removed one is kept.
+	err = backfillImageDifficulty(ctx, env, keyImageMeta, []int{4, 5})
+	test.AssertErrNil(t, err)
+
+	imBytes, err = redis.Bytes(kv.Do("HGET", keyImageMeta, imageID))
+	test.AssertErrNil(t, err)
+
+	im, err = imBytes.ImageMeta()
+	test.AssertErrNil(t, err)
+
+	exp = map[string]float64{"3x3": 1, "4x4": 1, "5x5": 1}
+	if len(im.GridDifficulty) != len(exp) || im.GridDifficulty["5x5"] != 1 {
+		t.Fatal("exp", exp, "got", im.GridDifficulty)
+	}
+}
+
+func TestBackfillImageMeta(t *testing.T) {
+	keyImageMeta := "test:image_meta:" + uuid.NewString()
+	keyIndex := "test:image_index:" + uuid.NewString()
+
+	kvp := test.InitKVP(t)
+	t.Cleanup(func() { test.DisposeKVP(t, kvp) })
+
+	kv := kvp.Get()
+	t.Cleanup(func() { test.AssertErrNil(t, kv.Close()) })
+
+	t.Cleanup(func() {
+		_, err := kv.Do("DEL", keyImageMeta, keyIndex)
+		test.AssertErrNil(t, err)
+	})
+
+	setImageMeta := func(im imager.ImageMeta) {
+		imBytes, err := im.RawJSON()
+		test.AssertErrNil(t, err)
+
+		_, err = kv.Do("HSET", keyImageMeta, im.ID, []byte(imBytes))
+		test.AssertErrNil(t, err)
+	}
+
+	broken := imager.ImageMeta{ID: "test_" + uuid.NewString()}
+	changed := imager.ImageMeta{ID: "test_" + uuid.NewString()}
+
+	setImageMeta(broken)
+	setImageMeta(changed)
+
+	// The other connection changes the meta while it is filled.
+	otherKV := kvp.Get()
+	t.Cleanup(func() { test.AssertErrNil(t, otherKV.Close()) })
+
+	var fills int
+
+	fill := func(im *imager.ImageMeta) (bool, error) {
+		fills++
+
+		switch {
+		case im.ID == broken.ID:
+			return false, errors.New("broken original")
+		case im.DHash != "":
+			return false, nil
+		case im.Author == "":
+			concurrent := *im
+			concurrent.Author = "concurrent"
+
+			imBytes, err := concurrent.RawJSON()
+			test.AssertErrNil(t, err)
+
+			_, err = otherKV.Do("HSET", keyImageMeta, im.ID, []byte(imBytes))
+			test.AssertErrNil(t, err)
+		}
+
+		im.DHash = "hash"
+
+		return true, nil
+	}
+
+	index := func(im imager.ImageMeta) []imredis.IndexField {
+		return []imredis.IndexField{{Key: keyIndex, Value: im.DHash}}
+	}
+
+	ctx := context.Background()
+
+	err := backfillImageMeta(ctx, kv, keyImageMeta, fill, index)
+	test.AssertErrNil(t, err)
+
+	imBytes, err := redis.Bytes(kv.Do("HGET", keyImageMeta, changed.ID))
+	test.AssertErrNil(t, err)
+
+	im, err := imager.RawImageMetaJSON(imBytes).ImageMeta()
+	test.AssertErrNil(t, err)
+
+	if im.Author != "concurrent" || im.DHash != "hash" {
+		t.Fatal("exp concurrent author and hash, got", im.Author, im.DHash)
+	}
+
+	hash, err := redis.String(kv.Do("HGET", keyIndex, changed.ID))
+	test.AssertErrNil(t, err)
+
+	if hash != "hash" {
+		t.Fatal("exp hash, got", hash)
+	}
+
+	// The broken image and the changed one twice.
+	if fills != 3 {
+		t.Fatal("exp 3 fills, got", fills)
+	}
+}
+
+func TestMigration_objectRefs(t *testing.T) {
+	keyImageMeta := "test:image_meta:" + uuid.NewString()
+	keyPrefixObjectRefs := "test:object_refs:" + uuid.NewString() + ":"
+
+	kvp := test.InitKVP(t)
+	t.Cleanup(func() { test.DisposeKVP(t, kvp) })
+
+	kv := kvp.Get()
+	t.Cleanup(func() { test.AssertErrNil(t, kv.Close()) })
+
+	images := []imager.ImageMeta{
+		{ID: "legacy"},
+		{ID: "first", ObjectID: "sha256-shared"},
+		{ID: "second", ObjectID: "sha256-shared"},
+	}
+
+	for _, im := range images {
+		imBytes, err := im.RawJSON()
+		test.AssertErrNil(t, err)
+
+		_, err = kv.Do("HSET", keyImageMeta, im.ID, []byte(imBytes))
+		test.AssertErrNil(t, err)
+	}
+
+	t.Cleanup(func() {
+		_, err := kv.Do("DEL", keyImageMeta, keyPrefixObjectRefs+"legacy", keyPrefixObjectRefs+"sha256-shared")
+		test.AssertErrNil(t, err)
+	})
+
+	env := migrationEnv{KV: kv}
+
+	for i := 0; i < 2; i++ {
+		test.AssertErrNil(t, countObjectRefs(env, keyImageMeta, keyPrefixObjectRefs))
+
+		for objectID, exp := range map[string]int{"legacy": 1, "sha256-shared": 2} {
+			got, err := redis.Int(kv.Do("GET", keyPrefixObjectRefs+objectID))
+			test.AssertErrNil(t, err)
+
+			if got != exp {
+				t.Fatal(objectID, "exp", exp, "got", got)
+			}
+		}
+	}
+}
+
+func TestMigration_dhashBands(t *testing.T) {
+	keyImageDHash := "test:image_dhash:" + uuid.NewString()
+	keyPrefixDHashBand := "test:image_dhash_band:" + uuid.NewString() + ":"
+
+	kvp := test.InitKVP(t)
+	t.Cleanup(func() { test.DisposeKVP(t, kvp) })
+
+	kv := kvp.Get()
+	t.Cleanup(func() { test.AssertErrNil(t, kv.Close()) })
+
+	const hash uint64 = 0x00ff00ff12345678
+
+	_, err := kv.Do("HSET", keyImageDHash, "valid", picture.FormatHash(hash), "invalid", "hash")
+	test.AssertErrNil(t, err)
+
+	bands := picture.Bands(hash)
+
+	t.Cleanup(func() {
+		keys := []interface{}{keyImageDHash}
+		for _, band := range bands {
+			keys = append(keys, keyPrefixDHashBand+band)
+		}
+
+		_, err := kv.Do("DEL", keys...)
+		test.AssertErrNil(t, err)
+	})
+
+	env := migrationEnv{KV: kv}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		test.AssertErrNil(t, indexDHashBands(ctx, env, keyImageDHash, keyPrefixDHashBand))
+
+		for _, band := range bands {
+			ids, err := redis.Strings(kv.Do("SMEMBERS", keyPrefixDHashBand+band))
+			test.AssertErrNil(t, err)
+
+			if len(ids) != 1 || ids[0] != "valid" {
+				t.Fatal(band, "exp valid got", ids)
+			}
+		}
+	}
+}
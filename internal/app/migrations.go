@@ -0,0 +1,701 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/core"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/improto"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/picture"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository/imredis"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+)
+
+// getMigrations returns all known migrations. Versions must be unique,
+// new migrations are appended to the end.
+func getMigrations() []migration {
+	return []migration{{
+		Version: 1,
+		Name:    "protobuf_to_json",
+		Up:      migrateV1ProtoBufToJSON,
+		Down:    nil,
+	}, {
+		Version: 2,
+		Name:    "image_meta_details",
+		Up:      migrateV2ImageMetaDetails,
+		Down:    nil,
+	}, {
+		Version: 3,
+		Name:    "checksum_index",
+		Up:      migrateV3ChecksumIndexUp,
+		Down:    migrateV3ChecksumIndexDown,
+	}, {
+		Version: 4,
+		Name:    "image_dhash",
+		Up:      migrateV4ImageDHash,
+		Down:    nil,
+	}, {
+		Version: 5,
+		Name:    "image_placeholders",
+		Up:      migrateV5ImagePlaceholders,
+		Down:    nil,
+	}, {
+		Version: 6,
+		Name:    "image_palette",
+		Up:      migrateV6ImagePalette,
+		Down:    nil,
+	}, {
+		Version: 7,
+		Name:    "image_difficulty",
+		Up:      migrateV7ImageDifficulty,
+		Down:    nil,
+	}, {
+		Version: 8,
+		Name:    "object_refs",
+		Up:      migrateV8ObjectRefs,
+		Down:    nil,
+	}, {
+		Version: 9,
+		Name:    "image_oriented_size",
+		Up:      migrateV9ImageOrientedSize,
+		Down:    nil,
+	}, {
+		Version: 10,
+		Name:    "dhash_bands",
+		Up:      migrateV10DHashBands,
+		Down:    nil,
+	}}
+}
+
+func migrateV1ProtoBufToJSON(ctx context.Context, env migrationEnv) (err error) {
+	const keyImageIDs = "ocmoxa:image_id"
+	const keyImageMeta = "ocmoxa:image_meta"
+	const categoryAll = "all"
+
+	kv := env.KV
+
+	categories, err := redis.Strings(kv.Do("KEYS", keyImageMeta+":*"))
+	if err != nil {
+		return fmt.Errorf("getting categories: %w", err)
+	}
+
+	im := new(improto.ImageMeta)
+	for _, category := range categories {
+		category = strings.TrimPrefix(category, keyImageMeta+":")
+
+		if category == categoryAll {
+			continue
+		}
+
+		imRange, err := redis.ByteSlices(kv.Do(
+			"LRANGE",
+			"ocmoxa:image_meta:"+category,
+			0,  // Start.
+			-1, // Stop.
+		))
+		if err != nil {
+			return fmt.Errorf("doing lrange: %w", err)
+		}
+
+		for _, imBytes := range imRange {
+			err := proto.Unmarshal(imBytes, im)
+			if err != nil {
+				return fmt.Errorf("decoding image meta: %w", err)
+			}
+
+			imID := im.GetId()
+
+			// The image is already migrated, it guards against
+			// duplicates in the lists of ids.
+			found, err := redis.Bool(kv.Do("HEXISTS", keyImageMeta, imID))
+			switch {
+			case err != nil:
+				return fmt.Errorf("checking image meta: %w", err)
+			case found:
+				continue
+			}
+
+			imMap := map[string]interface{}{
+				"id":       imID,
+				"author":   im.GetAuthor(),
+				"source":   im.GetWebSource(),
+				"mimetype": im.GetMimeType(),
+				"category": category,
+			}
+			imBytes, err := json.Marshal(&imMap)
+			if err != nil {
+				return fmt.Errorf("encoding image meta: %w", err)
+			}
+
+			// Commands are pipelined and sent with EXEC, so the
+			// connection is not left in the transaction if one of
+			// them fails.
+			if err = kv.Send("MULTI"); err != nil {
+				return fmt.Errorf("sending multi: %w", err)
+			}
+
+			if err = kv.Send("HSET", keyImageMeta, imID, imBytes); err != nil {
+				return fmt.Errorf("saving image meta: %w", err)
+			}
+
+			if err = kv.Send("RPUSH", keyImageIDs+":"+category, imID); err != nil {
+				return fmt.Errorf("saving image meta: %w", err)
+			}
+
+			if err = kv.Send("RPUSH", keyImageIDs+":"+categoryAll, imID); err != nil {
+				return fmt.Errorf("saving image meta: %w", err)
+			}
+
+			_, err = kv.Do("EXEC")
+			if err != nil {
+				return fmt.Errorf("doing exec: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateV2ImageMetaDetails backfills size, dimensions, checksum and
+// timestamps of images by reading their originals. The time of the last
+// modification of the original is used as the upload time.
+func migrateV2ImageMetaDetails(ctx context.Context, env migrationEnv) (err error) {
+	return backfillImageMetaDetails(ctx, env, "ocmoxa:image_meta")
+}
+
+func backfillImageMetaDetails(
+	ctx context.Context,
+	env migrationEnv,
+	keyImageMeta string,
+) (err error) {
+	return backfillImageMeta(ctx, env.KV, keyImageMeta, func(im *imager.ImageMeta) (bool, error) {
+		if im.SHA256 != "" {
+			return false, nil
+		}
+
+		if err := describeOriginal(ctx, env.FileStorage, im); err != nil {
+			return false, fmt.Errorf("describing original: %w", err)
+		}
+
+		return true, nil
+	}, nil)
+}
+
+func describeOriginal(
+	ctx context.Context,
+	fileStorage storage.FileStorage,
+	im *imager.ImageMeta,
+) (err error) {
+	fi, err := fileStorage.Stat(ctx, im.ID)
+	if err != nil {
+		return fmt.Errorf("getting stat: %w", err)
+	}
+
+	data, err := readOriginal(ctx, fileStorage, im.ID)
+	if err != nil {
+		return err
+	}
+
+	hdr, err := picture.DecodeHeader(data)
+	if err != nil {
+		return fmt.Errorf("decoding image header: %w", err)
+	}
+
+	im.Size = int64(len(data))
+	im.Width, im.Height = hdr.OrientedSize()
+	im.SHA256 = picture.Checksum(data)
+
+	if im.CreatedAt.IsZero() {
+		im.CreatedAt = fi.ModTime.UTC()
+	}
+
+	if im.UpdatedAt.IsZero() {
+		im.UpdatedAt = fi.ModTime.UTC()
+	}
+
+	return nil
+}
+
+// migrateV3ChecksumIndexUp indexes existing images by checksums, so
+// new uploads can find the same content.
+func migrateV3ChecksumIndexUp(ctx context.Context, env migrationEnv) (err error) {
+	const keyImageMeta = "ocmoxa:image_meta"
+	const keyPrefixSHA256 = "ocmoxa:image_sha256:"
+
+	kv := env.KV
+
+	return scanImageMeta(kv, keyImageMeta, func(im imager.ImageMeta) error {
+		if im.SHA256 == "" {
+			return nil
+		}
+
+		_, err := kv.Do("SADD", keyPrefixSHA256+im.SHA256, im.ID)
+		if err != nil {
+			return fmt.Errorf("doing sadd: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// migrateV3ChecksumIndexDown deletes the index of checksums.
+func migrateV3ChecksumIndexDown(ctx context.Context, env migrationEnv) (err error) {
+	const keyPrefixSHA256 = "ocmoxa:image_sha256:"
+
+	kv := env.KV
+
+	keys, err := redis.Values(kv.Do("KEYS", keyPrefixSHA256+"*"))
+	if err != nil {
+		return fmt.Errorf("getting keys: %w", err)
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if _, err = kv.Do("DEL", keys...); err != nil {
+		return fmt.Errorf("deleting keys: %w", err)
+	}
+
+	return nil
+}
+
+// scanImageMeta calls fn for each image meta in the hash. The hash can
+// be changed by fn, HSCAN can return some images twice in this case.
+func scanImageMeta(
+	kv redis.Conn,
+	keyImageMeta string,
+	fn func(im imager.ImageMeta) error,
+) (err error) {
+	return scanRawImageMeta(kv, keyImageMeta, func(id string, raw imager.RawImageMetaJSON) error {
+		im, err := raw.ImageMeta()
+		if err != nil {
+			return fmt.Errorf("decoding image meta: %s: %w", id, err)
+		}
+
+		return fn(im)
+	})
+}
+
+// scanRawImageMeta calls fn for each encoded image meta in the hash. HSCAN
+// can return some images twice.
+func scanRawImageMeta(
+	kv redis.Conn,
+	keyImageMeta string,
+	fn func(id string, raw imager.RawImageMetaJSON) error,
+) (err error) {
+	cursor := 0
+	for {
+		values, err := redis.Values(kv.Do("HSCAN", keyImageMeta, cursor))
+		if err != nil {
+			return fmt.Errorf("doing hscan: %w", err)
+		}
+
+		var fields [][]byte
+		if _, err = redis.Scan(values, &cursor, &fields); err != nil {
+			return fmt.Errorf("scanning hscan reply: %w", err)
+		}
+
+		// Fields are pairs of id and meta.
+		for i := 1; i < len(fields); i += 2 {
+			if err = fn(string(fields[i-1]), fields[i]); err != nil {
+				return err
+			}
+		}
+
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// backfillImageMeta calls fill for each image and saves the changed meta
+// with fields of the image in indexes, index can be nil. The meta is
+// saved only if it is not changed concurrently, otherwise the fresh one
+// is filled again. Failures of single images are logged and skipped, so
+// one broken original does not stop the migration. Filled images are
+// skipped when the migration runs again.
+func backfillImageMeta(
+	ctx context.Context,
+	kv redis.Conn,
+	keyImageMeta string,
+	fill func(im *imager.ImageMeta) (changed bool, err error),
+	index func(im imager.ImageMeta) []imredis.IndexField,
+) (err error) {
+	l := zerolog.Ctx(ctx)
+
+	var backfilled, failed int
+
+	err = scanRawImageMeta(kv, keyImageMeta, func(id string, raw imager.RawImageMetaJSON) error {
+		changed, err := backfillImage(kv, keyImageMeta, id, raw, fill, index)
+		switch {
+		case err != nil:
+			failed++
+
+			l.Warn().Err(err).Str("image_id", id).Msg("skipping image")
+		case changed:
+			backfilled++
+
+			l.Debug().Str("image_id", id).Msg("image meta backfilled")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	l.Info().Int("backfilled", backfilled).Int("failed", failed).Msg("image meta backfilled")
+
+	return nil
+}
+
+// backfillImage fills the meta of the image and sets it by compare and
+// set. Deleted images are skipped.
+func backfillImage(
+	kv redis.Conn,
+	keyImageMeta string,
+	id string,
+	raw imager.RawImageMetaJSON,
+	fill func(im *imager.ImageMeta) (changed bool, err error),
+	index func(im imager.ImageMeta) []imredis.IndexField,
+) (changed bool, err error) {
+	const maxAttempts = 10
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		im, err := raw.ImageMeta()
+		if err != nil {
+			return false, fmt.Errorf("decoding image meta: %w", err)
+		}
+
+		if changed, err = fill(&im); err != nil || !changed {
+			return false, err
+		}
+
+		imBytes, err := im.RawJSON()
+		if err != nil {
+			return false, fmt.Errorf("encoding image meta: %w", err)
+		}
+
+		var indexes []imredis.IndexField
+		if index != nil {
+			indexes = index(im)
+		}
+
+		set, err := imredis.CompareAndSetImageMeta(kv, keyImageMeta, id, raw, imBytes, indexes...)
+		if err != nil || set {
+			return set, err
+		}
+
+		// The meta was changed concurrently, fill the fresh one.
+		raw, err = redis.Bytes(kv.Do("HGET", keyImageMeta, id))
+		switch {
+		case errors.Is(err, redis.ErrNil):
+			return false, nil
+		case err != nil:
+			return false, fmt.Errorf("doing hget: %w", err)
+		}
+	}
+
+	return false, imerrors.NewTemporaryError(imerrors.Error("too many concurrent changes"))
+}
+
+// migrateV4ImageDHash computes perceptual hashes of images by reading
+// their originals.
+func migrateV4ImageDHash(ctx context.Context, env migrationEnv) (err error) {
+	return backfillImageDHash(ctx, env, "ocmoxa:image_meta", "ocmoxa:image_dhash")
+}
+
+func backfillImageDHash(
+	ctx context.Context,
+	env migrationEnv,
+	keyImageMeta string,
+	keyImageDHash string,
+) (err error) {
+	index := func(im imager.ImageMeta) []imredis.IndexField {
+		return []imredis.IndexField{{Key: keyImageDHash, Value: im.DHash}}
+	}
+
+	return backfillImageMeta(ctx, env.KV, keyImageMeta, func(im *imager.ImageMeta) (bool, error) {
+		if im.DHash != "" {
+			return false, nil
+		}
+
+		img, err := decodeOriginal(ctx, env.FileStorage, im.StorageID())
+		if err != nil {
+			return false, err
+		}
+
+		im.DHash = picture.FormatHash(picture.DHash(img))
+
+		return true, nil
+	}, index)
+}
+
+// migrateV5ImagePlaceholders computes BlurHash and LQIP placeholders of
+// images by reading their originals.
+func migrateV5ImagePlaceholders(ctx context.Context, env migrationEnv) (err error) {
+	return backfillImagePlaceholders(ctx, env, "ocmoxa:image_meta")
+}
+
+func backfillImagePlaceholders(
+	ctx context.Context,
+	env migrationEnv,
+	keyImageMeta string,
+) (err error) {
+	return backfillImageMeta(ctx, env.KV, keyImageMeta, func(im *imager.ImageMeta) (bool, error) {
+		if im.BlurHash != "" && im.LQIP != "" {
+			return false, nil
+		}
+
+		img, err := decodeOriginal(ctx, env.FileStorage, im.StorageID())
+		if err != nil {
+			return false, err
+		}
+
+		im.BlurHash = picture.BlurHash(img)
+
+		im.LQIP, err = picture.LQIP(img)
+		if err != nil {
+			return false, fmt.Errorf("making placeholder: %w", err)
+		}
+
+		return true, nil
+	}, nil)
+}
+
+// migrateV6ImagePalette extracts dominant colors of images by reading
+// their originals.
+func migrateV6ImagePalette(ctx context.Context, env migrationEnv) (err error) {
+	return backfillImagePalette(ctx, env, "ocmoxa:image_meta")
+}
+
+func backfillImagePalette(
+	ctx context.Context,
+	env migrationEnv,
+	keyImageMeta string,
+) (err error) {
+	return backfillImageMeta(ctx, env.KV, keyImageMeta, func(im *imager.ImageMeta) (bool, error) {
+		if len(im.Palette) > 0 {
+			return false, nil
+		}
+
+		img, err := decodeOriginal(ctx, env.FileStorage, im.StorageID())
+		if err != nil {
+			return false, err
+		}
+
+		im.Palette = core.ImagePalette(img)
+
+		return true, nil
+	}, nil)
+}
+
+// migrateV7ImageDifficulty computes puzzle difficulty of images for
+// configured grids by reading their originals. Without grids there is
+// nothing to compute, the difficulty command backfills images after
+// they are configured.
+func migrateV7ImageDifficulty(ctx context.Context, env migrationEnv) (err error) {
+	if len(env.Core.DifficultyGrids) == 0 {
+		zerolog.Ctx(ctx).Warn().Msg("difficulty grids are not configured, run the difficulty command after configuring them")
+
+		return nil
+	}
+
+	return backfillImageDifficulty(ctx, env, "ocmoxa:image_meta", env.Core.DifficultyGrids)
+}
+
+func backfillImageDifficulty(
+	ctx context.Context,
+	env migrationEnv,
+	keyImageMeta string,
+	grids []int,
+) (err error) {
+	return backfillImageMeta(ctx, env.KV, keyImageMeta, func(im *imager.ImageMeta) (bool, error) {
+		if core.HasGridDifficulty(*im, grids) {
+			return false, nil
+		}
+
+		img, err := decodeOriginal(ctx, env.FileStorage, im.StorageID())
+		if err != nil {
+			return false, err
+		}
+
+		average, gridDifficulty := core.ImageDifficulty(img, grids)
+		if len(gridDifficulty) == 0 {
+			return false, nil
+		}
+
+		// Difficulties of grids that are not configured anymore are kept.
+		if im.GridDifficulty == nil {
+			im.GridDifficulty = make(map[string]float64, len(gridDifficulty))
+		}
+
+		for key, difficulty := range gridDifficulty {
+			im.GridDifficulty[key] = difficulty
+		}
+
+		im.Difficulty = average
+
+		return true, nil
+	}, nil)
+}
+
+// migrateV8ObjectRefs counts references of images to originals, so
+// shared originals are deleted with the last image. Counts are set, the
+// migration can be run again.
+func migrateV8ObjectRefs(ctx context.Context, env migrationEnv) (err error) {
+	return countObjectRefs(env, "ocmoxa:image_meta", "ocmoxa:object_refs:")
+}
+
+func countObjectRefs(
+	env migrationEnv,
+	keyImageMeta string,
+	keyPrefixObjectRefs string,
+) (err error) {
+	kv := env.KV
+
+	refs := map[string]int{}
+	seen := map[string]struct{}{}
+
+	err = scanImageMeta(kv, keyImageMeta, func(im imager.ImageMeta) error {
+		// HSCAN can return some images twice.
+		if _, ok := seen[im.ID]; !ok {
+			seen[im.ID] = struct{}{}
+			refs[im.StorageID()]++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for objectID, count := range refs {
+		if _, err = kv.Do("SET", keyPrefixObjectRefs+objectID, count); err != nil {
+			return fmt.Errorf("doing set: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// migrateV9ImageOrientedSize swaps dimensions of JPEG images rotated by
+// the EXIF orientation, crops are validated against oriented ones.
+func migrateV9ImageOrientedSize(ctx context.Context, env migrationEnv) (err error) {
+	return backfillImageOrientedSize(ctx, env, "ocmoxa:image_meta")
+}
+
+func backfillImageOrientedSize(
+	ctx context.Context,
+	env migrationEnv,
+	keyImageMeta string,
+) (err error) {
+	return backfillImageMeta(ctx, env.KV, keyImageMeta, func(im *imager.ImageMeta) (bool, error) {
+		if im.MIMEType != "image/jpeg" || im.Width == im.Height {
+			return false, nil
+		}
+
+		data, err := readOriginal(ctx, env.FileStorage, im.StorageID())
+		if err != nil {
+			return false, err
+		}
+
+		hdr, err := picture.DecodeHeader(data)
+		if err != nil {
+			return false, err
+		}
+
+		width, height := hdr.OrientedSize()
+		if im.Width == width && im.Height == height {
+			return false, nil
+		}
+
+		im.Width, im.Height = width, height
+
+		return true, nil
+	}, nil)
+}
+
+// migrateV10DHashBands indexes perceptual hashes by bands, so similar
+// images are found without comparing all hashes. Sets are added to, the
+// migration can be run again.
+func migrateV10DHashBands(ctx context.Context, env migrationEnv) (err error) {
+	return indexDHashBands(ctx, env, "ocmoxa:image_dhash", "ocmoxa:image_dhash_band:")
+}
+
+func indexDHashBands(
+	ctx context.Context,
+	env migrationEnv,
+	keyImageDHash string,
+	keyPrefixDHashBand string,
+) (err error) {
+	kv := env.KV
+
+	dhashes, err := redis.StringMap(kv.Do("HGETALL", keyImageDHash))
+	if err != nil {
+		return fmt.Errorf("doing hgetall: %w", err)
+	}
+
+	for id, dhash := range dhashes {
+		hash, err := picture.ParseHash(dhash)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("image_id", id).Msg("skipping image")
+
+			continue
+		}
+
+		for _, band := range picture.Bands(hash) {
+			if _, err = kv.Do("SADD", keyPrefixDHashBand+band, id); err != nil {
+				return fmt.Errorf("doing sadd: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// decodeOriginal reads and decodes the whole original.
+func decodeOriginal(
+	ctx context.Context,
+	fileStorage storage.FileStorage,
+	id string,
+) (img image.Image, err error) {
+	data, err := readOriginal(ctx, fileStorage, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return picture.Decode(data)
+}
+
+func readOriginal(
+	ctx context.Context,
+	fileStorage storage.FileStorage,
+	id string,
+) (data []byte, err error) {
+	f, err := fileStorage.Get(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("getting original: %w", err)
+	}
+
+	defer func() { err = imerrors.ErrorPair(err, f.Close()) }()
+
+	data, err = io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading original: %w", err)
+	}
+
+	return data, nil
+}
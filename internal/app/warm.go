@@ -0,0 +1,30 @@
+package app
+
+import (
+	"context"
+	"os"
+
+	"github.com/rs/zerolog"
+)
+
+// Warm renders renditions of all images in the category, for example
+// after the list of supported sizes was changed.
+func Warm(ctx context.Context, configFile string, category string, workers int) {
+	l := zerolog.New(os.Stdout)
+	ctx = l.WithContext(ctx)
+
+	c := mustCore(l, configFile)
+
+	report, err := c.WarmRenditions(ctx, category, workers)
+
+	e := l.Info()
+	if err != nil || report.Failed > 0 {
+		e = l.Fatal().Err(err)
+	}
+
+	e.
+		Str("category", category).
+		Int64("rendered", report.Rendered).
+		Int64("failed", report.Failed).
+		Msg("renditions warmed")
+}
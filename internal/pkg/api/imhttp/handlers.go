@@ -7,11 +7,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/core"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/jobs"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository"
 
 	"github.com/gorilla/mux"
@@ -22,16 +25,33 @@ const (
 	headerContentType  = "Content-Type"
 	headerServer       = "Server"
 	headerCacheControl = "Cache-Control"
+	headerUploader     = "X-Uploader"
+	headerDuplicateOf  = "X-Duplicate-Of"
+	headerContentMD5   = "Content-MD5"
+	headerSHA256       = "X-Content-SHA256"
+	headerVary         = "Vary"
+	headerAcceptCH     = "Accept-CH"
+	headerCriticalCH   = "Critical-CH"
+	headerRequestID    = "X-Request-ID"
+	headerETag         = "ETag"
+	headerIfNoneMatch  = "If-None-Match"
 )
 
 const (
 	contentTypeJSON = "application/json"
 )
 
+const (
+	defaultSimilarLimit = 10
+	defaultJobsLimit    = 100
+)
+
 type handlers struct {
 	exposeErrors bool
+	autoRedirect bool
 
 	core *core.Core
+	jobs *jobs.Queue
 }
 
 func (h *handlers) ListImages(w http.ResponseWriter, r *http.Request) {
@@ -64,19 +84,88 @@ func (h *handlers) ListImages(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	images, err := h.core.ListImages(ctx, category, repository.Pagination{
+	pagination := repository.Pagination{
 		Limit:  limit,
 		Offset: offset,
-	})
+	}
+
+	filter, err := parseImageFilter(query)
+	if err != nil {
+		h.respondErr(ctx, w, imerrors.NewBadRequestError(err))
+
+		return
+	}
+
+	rawImages, err := h.core.SearchImages(ctx, category, filter, pagination)
 	if err != nil {
 		h.respondErr(ctx, w, err)
 
 		return
 	}
 
+	images := make([]imager.ImageMeta, 0, len(rawImages))
+
+	for _, rawIM := range rawImages {
+		im, err := rawIM.ImageMeta()
+		if err != nil {
+			h.respondErr(ctx, w, err)
+
+			return
+		}
+
+		images = append(images, publicImageMeta(im))
+	}
+
 	h.respondJSON(ctx, w, images)
 }
 
+// publicImageMeta drops ids of files in the storage from the image meta,
+// they are internal.
+func publicImageMeta(im imager.ImageMeta) imager.ImageMeta {
+	im.ObjectID = ""
+	im.SourceID = ""
+
+	return im
+}
+
+// parseImageFilter reads hue, grid, min_difficulty, max_difficulty and
+// sort query parameters.
+func parseImageFilter(query url.Values) (filter core.ImageFilter, err error) {
+	filter.Hue = query.Get("hue")
+	filter.Sort = query.Get("sort")
+
+	if gridStr := query.Get("grid"); gridStr != "" {
+		filter.Grid, err = strconv.Atoi(gridStr)
+		if err != nil {
+			return core.ImageFilter{}, fmt.Errorf("grid: %w", err)
+		}
+	}
+
+	parseDifficulty := func(name string) (*float64, error) {
+		value := query.Get(name)
+		if value == "" {
+			return nil, nil
+		}
+
+		difficulty, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		return &difficulty, nil
+	}
+
+	if filter.MinDifficulty, err = parseDifficulty("min_difficulty"); err != nil {
+		return core.ImageFilter{}, err
+	}
+
+	if filter.MaxDifficulty, err = parseDifficulty("max_difficulty"); err != nil {
+		return core.ImageFilter{}, err
+	}
+
+	return filter, nil
+}
+
 func (h *handlers) ListCategories(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
@@ -92,19 +181,206 @@ func (h *handlers) ListCategories(w http.ResponseWriter, r *http.Request) {
 
 func (h *handlers) GetImage(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	l := zerolog.Ctx(ctx)
+	query := r.URL.Query()
+
+	rendition := core.Rendition{
+		Size:    imager.ImageSize(mux.Vars(r)["size"]),
+		Format:  query.Get("format"),
+		Variant: query.Get("variant"),
+	}
+
+	var err error
+
+	if qualityStr := query.Get("quality"); qualityStr != "" {
+		rendition.Quality, err = strconv.Atoi(qualityStr)
+		if err != nil {
+			err = fmt.Errorf("quality: %w", err)
+			h.respondErr(ctx, w, imerrors.NewBadRequestError(err))
+
+			return
+		}
+	}
+
+	rendition.Overlay, err = parseOverlay(query)
+	if err != nil {
+		h.respondErr(ctx, w, imerrors.NewBadRequestError(err))
+
+		return
+	}
+
+	h.respondRendition(w, r, mux.Vars(r)["id"], rendition)
+}
+
+// parseOverlay reads grid, grid_color, grid_width, numbers and ghost
+// query parameters.
+func parseOverlay(query url.Values) (overlay core.Overlay, err error) {
+	overlay.GridColor = query.Get("grid_color")
+
+	parseInt := func(name string) (int, error) {
+		value := query.Get(name)
+		if value == "" {
+			return 0, nil
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", name, err)
+		}
+
+		return n, nil
+	}
+
+	parseBool := func(name string) (bool, error) {
+		value := query.Get(name)
+		if value == "" {
+			return false, nil
+		}
+
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", name, err)
+		}
+
+		return b, nil
+	}
+
+	if overlay.Grid, err = parseInt("grid"); err != nil {
+		return core.Overlay{}, err
+	}
+
+	if overlay.GridWidth, err = parseInt("grid_width"); err != nil {
+		return core.Overlay{}, err
+	}
+
+	if overlay.Numbers, err = parseBool("numbers"); err != nil {
+		return core.Overlay{}, err
+	}
+
+	if overlay.Ghost, err = parseBool("ghost"); err != nil {
+		return core.Overlay{}, err
+	}
+
+	return overlay, nil
+}
+
+// GetAutoImage selects the size and the quality of the image by client
+// hints. Query parameters override headers.
+func (h *handlers) GetAutoImage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	hints, err := parseClientHints(r)
+	if err != nil {
+		h.respondErr(ctx, w, imerrors.NewBadRequestError(err))
+
+		return
+	}
+
+	query := r.URL.Query()
+
+	rendition := h.core.SelectRendition(hints)
+	rendition.Format = query.Get("format")
+	rendition.Variant = query.Get("variant")
 
+	rendition.Overlay, err = parseOverlay(query)
+	if err != nil {
+		h.respondErr(ctx, w, imerrors.NewBadRequestError(err))
+
+		return
+	}
+
+	w.Header().Set(headerAcceptCH, acceptCH)
+	w.Header().Set(headerCriticalCH, criticalCH)
+	w.Header().Add(headerVary, varyCH)
+
+	if !h.autoRedirect {
+		h.respondRendition(w, r, mux.Vars(r)["id"], rendition)
+
+		return
+	}
+
+	http.Redirect(w, r, renditionURL(mux.Vars(r)["id"], rendition), http.StatusFound)
+}
+
+// GetRenditionManifest lists URLs of renditions of the image.
+func (h *handlers) GetRenditionManifest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	id := mux.Vars(r)["id"]
-	size := imager.ImageSize(mux.Vars(r)["size"])
 
-	f, err := h.core.GetImage(ctx, id, size)
+	manifest, err := h.core.GetRenditionManifest(ctx, id)
 	if err != nil {
 		h.respondErr(ctx, w, err)
 
 		return
 	}
 
-	w.Header().Set(headerContentType, f.ContentType)
+	manifest.Placeholder.URL = renditionURL(id, manifest.Placeholder.Rendition)
+
+	for i, mr := range manifest.Renditions {
+		manifest.Renditions[i].URL = renditionURL(id, mr.Rendition)
+	}
+
+	h.respondJSON(ctx, w, manifest)
+}
+
+// renditionURL returns the path of the rendition in the public API.
+func renditionURL(id string, rendition core.Rendition) string {
+	query := url.Values{}
+	if rendition.Format != "" {
+		query.Set("format", rendition.Format)
+	}
+
+	if rendition.Quality != 0 {
+		query.Set("quality", strconv.Itoa(rendition.Quality))
+	}
+
+	if rendition.Variant != "" {
+		query.Set("variant", rendition.Variant)
+	}
+
+	overlay := rendition.Overlay
+	if overlay.Grid != 0 {
+		query.Set("grid", strconv.Itoa(overlay.Grid))
+	}
+
+	if overlay.GridColor != "" {
+		query.Set("grid_color", overlay.GridColor)
+	}
+
+	if overlay.GridWidth != 0 {
+		query.Set("grid_width", strconv.Itoa(overlay.GridWidth))
+	}
+
+	if overlay.Numbers {
+		query.Set("numbers", "true")
+	}
+
+	if overlay.Ghost {
+		query.Set("ghost", "true")
+	}
+
+	location := url.URL{
+		Path:     "/api/v1/images/" + id + "/" + string(rendition.Size),
+		RawQuery: query.Encode(),
+	}
+
+	return location.String()
+}
+
+func (h *handlers) respondRendition(
+	w http.ResponseWriter,
+	r *http.Request,
+	id string,
+	rendition core.Rendition,
+) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+
+	f, err := h.core.GetRendition(ctx, id, rendition)
+	if err != nil {
+		h.respondErr(ctx, w, err)
+
+		return
+	}
 
 	defer func() {
 		cerr := f.Close()
@@ -113,6 +389,18 @@ func (h *handlers) GetImage(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	if f.ETag != "" {
+		w.Header().Set(headerETag, f.ETag)
+
+		if etagMatch(r.Header.Get(headerIfNoneMatch), f.ETag) {
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+	}
+
+	w.Header().Set(headerContentType, f.ContentType)
+
 	_, err = io.Copy(w, f)
 	if err != nil {
 		l.Warn().Err(err).Msg("copying data to response")
@@ -121,6 +409,76 @@ func (h *handlers) GetImage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// etagMatch tells if the If-None-Match header matches the ETag. Weak
+// ETags match as well.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *handlers) GetSimilarImages(w http.ResponseWriter, r *http.Request) {
+	var err error
+	ctx := r.Context()
+
+	id := mux.Vars(r)["id"]
+
+	limit := defaultSimilarLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil {
+			err = fmt.Errorf("limit: %w", err)
+			h.respondErr(ctx, w, imerrors.NewBadRequestError(err))
+
+			return
+		}
+	}
+
+	images, err := h.core.SimilarImages(ctx, id, limit)
+	if err != nil {
+		h.respondErr(ctx, w, err)
+
+		return
+	}
+
+	for i := range images {
+		images[i].ImageMeta = publicImageMeta(images[i].ImageMeta)
+	}
+
+	h.respondJSON(ctx, w, images)
+}
+
+func (h *handlers) GetNearDuplicates(w http.ResponseWriter, r *http.Request) {
+	var err error
+	ctx := r.Context()
+
+	// The configured distance is used by default.
+	distance := -1
+	if distanceStr := r.URL.Query().Get("distance"); distanceStr != "" {
+		distance, err = strconv.Atoi(distanceStr)
+		if err != nil || distance < 0 {
+			err = fmt.Errorf("distance: invalid value: %s", distanceStr)
+			h.respondErr(ctx, w, imerrors.NewBadRequestError(err))
+
+			return
+		}
+	}
+
+	clusters, err := h.core.NearDuplicateClusters(ctx, distance)
+	if err != nil {
+		h.respondErr(ctx, w, err)
+
+		return
+	}
+
+	h.respondJSON(ctx, w, clusters)
+}
+
 func (h *handlers) PutImage(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	log := zerolog.Ctx(ctx)
@@ -152,12 +510,38 @@ func (h *handlers) PutImage(w http.ResponseWriter, r *http.Request) {
 		WEBSource: r.FormValue("websource"),
 		Category:  r.FormValue("category"),
 		ID:        r.FormValue("id"),
+		// The internal API is not authenticated, the uploader is
+		// claimed by the client and validated as other fields.
+		Uploader: r.Header.Get(headerUploader),
 
 		MIMEType: fileHeader.Header.Get(headerContentType),
 		Size:     fileHeader.Size,
 	}
 
-	im, err = h.core.UploadImage(ctx, im, file)
+	res, err := h.core.UploadImage(ctx, im, file, core.UploadOptions{
+		Duplicates:     core.DuplicatePolicy(r.FormValue("duplicates")),
+		NearDuplicates: core.NearDuplicatePolicy(r.FormValue("near_duplicates")),
+		ContentMD5:     fileHeader.Header.Get(headerContentMD5),
+		ContentSHA256:  fileHeader.Header.Get(headerSHA256),
+	})
+	if err != nil {
+		var dupErr core.DuplicateError
+		if errors.As(err, &dupErr) {
+			w.Header().Set(headerDuplicateOf, dupErr.ImageID)
+		}
+
+		h.respondErr(ctx, w, err)
+
+		return
+	}
+
+	h.respondJSON(ctx, w, res)
+}
+
+func (h *handlers) GetImageMeta(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	im, err := h.core.GetImageMeta(ctx, mux.Vars(r)["image_id"])
 	if err != nil {
 		h.respondErr(ctx, w, err)
 
@@ -181,6 +565,122 @@ func (h *handlers) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	h.respondJSON(ctx, w, "ok")
 }
 
+func (h *handlers) PutFocalPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var fp imager.FocalPoint
+
+	err := json.NewDecoder(r.Body).Decode(&fp)
+	if err != nil {
+		h.respondErr(ctx, w, imerrors.NewBadRequestError(err))
+
+		return
+	}
+
+	im, err := h.core.SetFocalPoint(ctx, mux.Vars(r)["image_id"], &fp)
+	if err != nil {
+		h.respondErr(ctx, w, err)
+
+		return
+	}
+
+	h.respondJSON(ctx, w, im)
+}
+
+func (h *handlers) DeleteFocalPoint(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	im, err := h.core.SetFocalPoint(ctx, mux.Vars(r)["image_id"], nil)
+	if err != nil {
+		h.respondErr(ctx, w, err)
+
+		return
+	}
+
+	h.respondJSON(ctx, w, im)
+}
+
+func (h *handlers) PutWatermark(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		h.respondErr(ctx, w, imerrors.NewBadRequestError(err))
+
+		return
+	}
+
+	if body.Enabled == nil {
+		err = imerrors.Error("enabled is required")
+		h.respondErr(ctx, w, imerrors.NewBadRequestError(err))
+
+		return
+	}
+
+	im, err := h.core.SetWatermark(ctx, mux.Vars(r)["image_id"], body.Enabled)
+	if err != nil {
+		h.respondErr(ctx, w, err)
+
+		return
+	}
+
+	h.respondJSON(ctx, w, im)
+}
+
+func (h *handlers) DeleteWatermark(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	im, err := h.core.SetWatermark(ctx, mux.Vars(r)["image_id"], nil)
+	if err != nil {
+		h.respondErr(ctx, w, err)
+
+		return
+	}
+
+	h.respondJSON(ctx, w, im)
+}
+
+func (h *handlers) PutCrop(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+
+	var rect imager.CropRect
+
+	err := json.NewDecoder(r.Body).Decode(&rect)
+	if err != nil {
+		h.respondErr(ctx, w, imerrors.NewBadRequestError(err))
+
+		return
+	}
+
+	im, err := h.core.SetCrop(ctx, vars["image_id"], vars["key"], &rect)
+	if err != nil {
+		h.respondErr(ctx, w, err)
+
+		return
+	}
+
+	h.respondJSON(ctx, w, im)
+}
+
+func (h *handlers) DeleteCrop(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+
+	im, err := h.core.SetCrop(ctx, vars["image_id"], vars["key"], nil)
+	if err != nil {
+		h.respondErr(ctx, w, err)
+
+		return
+	}
+
+	h.respondJSON(ctx, w, im)
+}
+
 func (h *handlers) PostShuffle(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
@@ -206,6 +706,96 @@ func (h *handlers) PostShuffle(w http.ResponseWriter, r *http.Request) {
 	h.respondJSON(ctx, w, "ok")
 }
 
+func (h *handlers) PostWarmRenditions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var body struct {
+		Category string `json:"category"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		h.respondErr(ctx, w, imerrors.NewBadRequestError(err))
+
+		return
+	}
+
+	count, err := h.core.QueueRenditions(ctx, body.Category)
+	if err != nil {
+		h.respondErr(ctx, w, err)
+
+		return
+	}
+
+	h.respondJSON(ctx, w, map[string]int{"queued": count})
+}
+
+func (h *handlers) ListJobs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	limit := defaultJobsLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil {
+			err = fmt.Errorf("limit: %w", err)
+			h.respondErr(ctx, w, imerrors.NewBadRequestError(err))
+
+			return
+		}
+	}
+
+	list, err := h.jobs.List(ctx, query.Get("state"), limit)
+	if err != nil {
+		h.respondErr(ctx, w, err)
+
+		return
+	}
+
+	h.respondJSON(ctx, w, list)
+}
+
+func (h *handlers) GetJobStats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	stats, err := h.jobs.Stats(ctx)
+	if err != nil {
+		h.respondErr(ctx, w, err)
+
+		return
+	}
+
+	h.respondJSON(ctx, w, stats)
+}
+
+func (h *handlers) GetJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	job, err := h.jobs.Get(ctx, mux.Vars(r)["job_id"])
+	if err != nil {
+		h.respondErr(ctx, w, err)
+
+		return
+	}
+
+	h.respondJSON(ctx, w, job)
+}
+
+func (h *handlers) PostRetryJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	err := h.jobs.RetryDead(ctx, mux.Vars(r)["job_id"])
+	if err != nil {
+		h.respondErr(ctx, w, err)
+
+		return
+	}
+
+	h.respondJSON(ctx, w, "ok")
+}
+
 func (h *handlers) respondJSON(ctx context.Context, w http.ResponseWriter, data interface{}) {
 	w.Header().Set(headerContentType, contentTypeJSON)
 
@@ -219,46 +809,22 @@ func (h *handlers) respondJSON(ctx context.Context, w http.ResponseWriter, data
 	}
 }
 
+// respondErr writes the error as application/problem+json.
 func (h *handlers) respondErr(ctx context.Context, w http.ResponseWriter, err error) {
-	l := zerolog.Ctx(ctx)
+	if err == nil {
+		return
+	}
+
+	p := newProblem(ctx, err, h.exposeErrors)
 
-	var status int
-	logEvt := l.Warn()
-
-	switch {
-	case err == nil:
-		w.WriteHeader(status)
-
-		return
-	case errors.As(err, &imerrors.NotFoundError{}):
-		status = http.StatusNotFound
-	case errors.As(err, &imerrors.ConflictError{}):
-		status = http.StatusConflict
-	case errors.As(err, &imerrors.UnprocessableEntity{}):
-		status = http.StatusUnprocessableEntity
-	case errors.As(err, &imerrors.BadRequestError{}):
-		status = http.StatusBadRequest
-	case errors.As(err, &imerrors.MediaTypeError{}):
-		status = http.StatusUnsupportedMediaType
-	case errors.As(err, &imerrors.OversizeError{}):
-		status = http.StatusRequestEntityTooLarge
-	case imerrors.IsTemporaryError(err):
-		status = http.StatusServiceUnavailable
-	default:
-		status = http.StatusInternalServerError
+	logEvt := zerolog.Ctx(ctx).Warn()
+	if p.Status >= http.StatusInternalServerError && p.Status != http.StatusServiceUnavailable {
 		logEvt = zerolog.Ctx(ctx).Error()
 	}
 
-	logEvt.Int("status", status).Err(err).Msg("http server error")
-
-	w.WriteHeader(status)
+	logEvt.Int("status", p.Status).Str("code", p.Code).Err(err).Msg("http server error")
 
-	if h.exposeErrors && err != nil {
-		_, err = w.Write([]byte(err.Error()))
-		if err != nil {
-			l.Warn().Err(err).Msg("writing response")
-		}
-	}
+	writeProblem(ctx, w, p)
 }
 
 func (h *handlers) getHealth(w http.ResponseWriter, r *http.Request) {
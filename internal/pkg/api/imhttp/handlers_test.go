@@ -16,6 +16,7 @@ import (
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/api/imhttp"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/core"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/jobs"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository/imredis"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage/s3"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/test"
@@ -37,10 +38,12 @@ func TestServer(t *testing.T) {
 	testCases := []struct {
 		Request   func() *http.Request
 		ExpStatus int
+		// UnexpectedBody must not be in the response.
+		UnexpectedBody string
 	}{{
 		Request: func() *http.Request {
 			var imageData bytes.Buffer
-			image := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+			image := image.NewNRGBA(image.Rect(0, 0, 128, 128))
 			err := jpeg.Encode(&imageData, image, &jpeg.Options{Quality: 10})
 			test.AssertErrNil(t, err)
 
@@ -95,6 +98,61 @@ func TestServer(t *testing.T) {
 				nil,
 			)
 		},
+		ExpStatus:      http.StatusOK,
+		UnexpectedBody: `"object_id"`,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images?limit=1&offset=0&hue=blue&category="+category,
+				nil,
+			)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images?limit=1&offset=0&hue=beige&category="+category,
+				nil,
+			)
+		},
+		ExpStatus: http.StatusUnprocessableEntity,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images?limit=1&offset=0&grid=4&max_difficulty=0.8&sort=-difficulty&category="+category,
+				nil,
+			)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images?limit=1&offset=0&min_difficulty=x&category="+category,
+				nil,
+			)
+		},
+		ExpStatus: http.StatusBadRequest,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images?limit=1&offset=0&grid=7&category="+category,
+				nil,
+			)
+		},
+		ExpStatus: http.StatusUnprocessableEntity,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/internal/api/v1/images/"+imageID,
+				nil,
+			)
+		},
 		ExpStatus: http.StatusOK,
 	}, {
 		Request: func() *http.Request {
@@ -105,6 +163,149 @@ func TestServer(t *testing.T) {
 			)
 		},
 		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			r := httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/"+string(size),
+				nil,
+			)
+			// The rendition is cached by the previous request.
+			r.Header.Set("If-None-Match", "*")
+
+			return r
+		},
+		ExpStatus: http.StatusNotModified,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/"+string(size)+"?format=gif",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusUnprocessableEntity,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/"+string(size)+"@2x",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/"+string(size)+"@9x",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusUnprocessableEntity,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/100x100",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusUnprocessableEntity,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/"+string(size)+"?quality=77",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusUnprocessableEntity,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/"+string(size)+"?variant=grayscale",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/"+string(size)+"?variant=unknown",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusUnprocessableEntity,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/"+string(size)+"?grid=4&numbers=true&ghost=true",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/"+string(size)+"?grid=four",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusBadRequest,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/"+string(size)+"?numbers=true",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusUnprocessableEntity,
+	}, {
+		Request: func() *http.Request {
+			r := httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/auto",
+				nil,
+			)
+			r.Header.Set("Sec-CH-DPR", "2")
+			r.Header.Set("Save-Data", "on")
+
+			return r
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/auto?dpr=x",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusBadRequest,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/renditions",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+uuid.NewString()+"/renditions",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusNotFound,
 	}, {
 		Request: func() *http.Request {
 			return httptest.NewRequest(
@@ -114,6 +315,34 @@ func TestServer(t *testing.T) {
 			)
 		},
 		ExpStatus: http.StatusNotFound,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+imageID+"/similar?limit=5",
+				nil,
+			)
+		},
+		ExpStatus:      http.StatusOK,
+		UnexpectedBody: `"object_id"`,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/api/v1/images/"+uuid.NewString()+"/similar",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusNotFound,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodGet,
+				"/internal/api/v1/images/duplicates?distance=4",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusOK,
 	}, {
 		Request: func() *http.Request {
 			const data = `{"category":"test","depth":1}`
@@ -124,6 +353,142 @@ func TestServer(t *testing.T) {
 			)
 		},
 		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			const data = `{"x":0.3,"y":0.7}`
+			return httptest.NewRequest(
+				http.MethodPut,
+				"/internal/api/v1/images/"+imageID+"/focal_point",
+				strings.NewReader(data),
+			)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			const data = `{"x":2,"y":0.7}`
+			return httptest.NewRequest(
+				http.MethodPut,
+				"/internal/api/v1/images/"+imageID+"/focal_point",
+				strings.NewReader(data),
+			)
+		},
+		ExpStatus: http.StatusUnprocessableEntity,
+	}, {
+		Request: func() *http.Request {
+			const data = `{"x":0.5,"y":0.5}`
+			return httptest.NewRequest(
+				http.MethodPut,
+				"/internal/api/v1/images/"+uuid.NewString()+"/focal_point",
+				strings.NewReader(data),
+			)
+		},
+		ExpStatus: http.StatusNotFound,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodDelete,
+				"/internal/api/v1/images/"+imageID+"/focal_point",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			const data = `{"enabled":true}`
+			return httptest.NewRequest(
+				http.MethodPut,
+				"/internal/api/v1/images/"+imageID+"/watermark",
+				strings.NewReader(data),
+			)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			const data = `{}`
+			return httptest.NewRequest(
+				http.MethodPut,
+				"/internal/api/v1/images/"+imageID+"/watermark",
+				strings.NewReader(data),
+			)
+		},
+		ExpStatus: http.StatusBadRequest,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodDelete,
+				"/internal/api/v1/images/"+imageID+"/watermark",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			const data = `{"x":10,"y":0,"width":96,"height":128}`
+			return httptest.NewRequest(
+				http.MethodPut,
+				"/internal/api/v1/images/"+imageID+"/crops/3:4",
+				strings.NewReader(data),
+			)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			const data = `{"x":100,"y":0,"width":96,"height":128}`
+			return httptest.NewRequest(
+				http.MethodPut,
+				"/internal/api/v1/images/"+imageID+"/crops/"+string(size),
+				strings.NewReader(data),
+			)
+		},
+		ExpStatus: http.StatusUnprocessableEntity,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodDelete,
+				"/internal/api/v1/images/"+imageID+"/crops/3:4",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			const data = `{"category":"test"}`
+			return httptest.NewRequest(
+				http.MethodPost,
+				"/internal/api/v1/renditions/warm",
+				strings.NewReader(data),
+			)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/internal/api/v1/jobs/stats", nil)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/internal/api/v1/jobs?state=ready&limit=10", nil)
+		},
+		ExpStatus: http.StatusOK,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/internal/api/v1/jobs?state=unknown", nil)
+		},
+		ExpStatus: http.StatusUnprocessableEntity,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/internal/api/v1/jobs/"+uuid.NewString(), nil)
+		},
+		ExpStatus: http.StatusNotFound,
+	}, {
+		Request: func() *http.Request {
+			return httptest.NewRequest(
+				http.MethodPost,
+				"/internal/api/v1/jobs/"+uuid.NewString()+"/retry",
+				nil,
+			)
+		},
+		ExpStatus: http.StatusNotFound,
 	}, {
 		Request: func() *http.Request {
 			return httptest.NewRequest(
@@ -147,7 +512,8 @@ func TestServer(t *testing.T) {
 
 	cfg := test.LoadConfig(t)
 	cfg.Core.ImageContentTypes = append(cfg.Core.ImageContentTypes, contentType)
-	cfg.Core.SupportedImageSizes = append(cfg.Core.SupportedImageSizes, size)
+	// Test images are smaller than default sizes.
+	cfg.Core.SupportedImageSizes = []imager.ImageSize{size}
 	cfg.Server.ExposeErrors = true
 
 	kvp := test.InitKVP(t)
@@ -156,8 +522,20 @@ func TestServer(t *testing.T) {
 	s3, err := s3.NewStorage(cfg.S3)
 	test.AssertErrNil(t, err)
 
+	queue, err := jobs.NewQueue(jobs.Essentials{KVP: kvp}, cfg.Jobs)
+	test.AssertErrNil(t, err)
+
+	watermark, err := core.NewWatermark(cfg.Core)
+	test.AssertErrNil(t, err)
+
+	variants, err := core.NewVariants(cfg.Core)
+	test.AssertErrNil(t, err)
+
 	c := core.NewCore(core.Essentials{
 		KVP:                 kvp,
+		Jobs:                queue,
+		Watermark:           watermark,
+		Variants:            variants,
 		ImageMetaRepository: imredis.NewImageMetaRepository(kvp),
 		FileStorage:         s3,
 		Validate:            validate.New(),
@@ -167,6 +545,7 @@ func TestServer(t *testing.T) {
 		imhttp.Essentials{
 			Logger:       zerolog.New(os.Stdout),
 			Core:         c,
+			Jobs:         queue,
 			PromRegistry: prometheus.NewRegistry(),
 		},
 		cfg.Server,
@@ -186,6 +565,10 @@ func TestServer(t *testing.T) {
 			if w.Code != tc.ExpStatus {
 				t.Fatal("exp", tc.ExpStatus, "got", w.Code)
 			}
+
+			if tc.UnexpectedBody != "" && strings.Contains(w.Body.String(), tc.UnexpectedBody) {
+				t.Fatal("unexpected", tc.UnexpectedBody, "in", w.Body.String())
+			}
 		})
 	}
 }
@@ -0,0 +1,105 @@
+package imhttp
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/core"
+)
+
+// Client hints. Legacy names are still sent by some browsers.
+const (
+	headerCHWidth          = "Sec-CH-Width"
+	headerCHWidthLegacy    = "Width"
+	headerCHDPR            = "Sec-CH-DPR"
+	headerCHDPRLegacy      = "DPR"
+	headerCHViewportWidth  = "Sec-CH-Viewport-Width"
+	headerCHViewportLegacy = "Viewport-Width"
+	headerCHViewportHeight = "Sec-CH-Viewport-Height"
+	headerCHSaveData       = "Save-Data"
+)
+
+const (
+	acceptCH = headerCHWidth + ", " + headerCHDPR + ", " +
+		headerCHViewportWidth + ", " + headerCHViewportHeight + ", " +
+		headerCHWidthLegacy + ", " + headerCHDPRLegacy + ", " + headerCHViewportLegacy
+	criticalCH = headerCHDPR + ", " + headerCHViewportWidth
+	varyCH     = headerCHWidth + ", " + headerCHDPR + ", " +
+		headerCHViewportWidth + ", " + headerCHViewportHeight + ", " +
+		headerCHWidthLegacy + ", " + headerCHDPRLegacy + ", " + headerCHViewportLegacy + ", " +
+		headerCHSaveData
+)
+
+// parseClientHints reads hints from headers and query parameters: width,
+// dpr, viewport_width, viewport_height and save_data.
+func parseClientHints(r *http.Request) (hints core.ClientHints, err error) {
+	query := r.URL.Query()
+
+	value := func(param string, headers ...string) string {
+		if v := query.Get(param); v != "" {
+			return v
+		}
+
+		for _, header := range headers {
+			if v := r.Header.Get(header); v != "" {
+				return v
+			}
+		}
+
+		return ""
+	}
+
+	parseInt := func(name string, v string) (int, error) {
+		if v == "" {
+			return 0, nil
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%s: invalid value: %s", name, v)
+		}
+
+		return n, nil
+	}
+
+	hints.Width, err = parseInt("width", value("width", headerCHWidth, headerCHWidthLegacy))
+	if err != nil {
+		return core.ClientHints{}, err
+	}
+
+	hints.ViewportWidth, err = parseInt("viewport_width", value(
+		"viewport_width",
+		headerCHViewportWidth,
+		headerCHViewportLegacy,
+	))
+	if err != nil {
+		return core.ClientHints{}, err
+	}
+
+	hints.ViewportHeight, err = parseInt("viewport_height", value(
+		"viewport_height",
+		headerCHViewportHeight,
+	))
+	if err != nil {
+		return core.ClientHints{}, err
+	}
+
+	if dpr := value("dpr", headerCHDPR, headerCHDPRLegacy); dpr != "" {
+		hints.DPR, err = strconv.ParseFloat(dpr, 64)
+		if err != nil || hints.DPR < 0 {
+			return core.ClientHints{}, fmt.Errorf("dpr: invalid value: %s", dpr)
+		}
+	}
+
+	switch saveData := strings.ToLower(value("save_data", headerCHSaveData)); saveData {
+	case "on", "1", "true":
+		hints.SaveData = true
+	case "", "off", "0", "false":
+	default:
+		return core.ClientHints{}, fmt.Errorf("save_data: invalid value: %s", saveData)
+	}
+
+	return hints, nil
+}
@@ -0,0 +1,97 @@
+package imhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/core"
+)
+
+func TestParseClientHints(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		URL     string
+		Headers map[string]string
+		Exp     core.ClientHints
+		ExpErr  bool
+	}{{
+		Name: "none",
+		URL:  "/",
+	}, {
+		Name: "headers",
+		URL:  "/",
+		Headers: map[string]string{
+			headerCHWidth:          "720",
+			headerCHDPR:            "2.5",
+			headerCHViewportWidth:  "360",
+			headerCHViewportHeight: "640",
+			headerCHSaveData:       "on",
+		},
+		Exp: core.ClientHints{
+			Width:          720,
+			ViewportWidth:  360,
+			ViewportHeight: 640,
+			DPR:            2.5,
+			SaveData:       true,
+		},
+	}, {
+		Name: "legacy_headers",
+		URL:  "/",
+		Headers: map[string]string{
+			headerCHDPRLegacy:      "2",
+			headerCHViewportLegacy: "400",
+		},
+		Exp: core.ClientHints{
+			ViewportWidth: 400,
+			DPR:           2,
+		},
+	}, {
+		Name: "query_overrides",
+		URL:  "/?dpr=3&viewport_width=320&save_data=0",
+		Headers: map[string]string{
+			headerCHDPR:      "2",
+			headerCHSaveData: "on",
+		},
+		Exp: core.ClientHints{
+			ViewportWidth: 320,
+			DPR:           3,
+		},
+	}, {
+		Name:   "invalid_width",
+		URL:    "/?width=-1",
+		ExpErr: true,
+	}, {
+		Name:   "invalid_dpr",
+		URL:    "/?dpr=x",
+		ExpErr: true,
+	}, {
+		Name:   "invalid_save_data",
+		URL:    "/?save_data=maybe",
+		ExpErr: true,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.URL, nil)
+			for k, v := range tc.Headers {
+				r.Header.Set(k, v)
+			}
+
+			got, err := parseClientHints(r)
+
+			switch {
+			case tc.ExpErr && err == nil:
+				t.Fatal("exp error, got", got)
+			case tc.ExpErr:
+				return
+			case err != nil:
+				t.Fatal(err)
+			case got != tc.Exp:
+				t.Fatal("exp", tc.Exp, "got", got)
+			}
+		})
+	}
+}
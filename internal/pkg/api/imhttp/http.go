@@ -8,6 +8,7 @@ import (
 	"github.com/ocmoxa/SwapTile-Imager/docs"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/core"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/jobs"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
@@ -24,6 +25,7 @@ type Server struct {
 type Essentials struct {
 	zerolog.Logger
 	*core.Core
+	Jobs         *jobs.Queue
 	PromRegistry *prometheus.Registry
 }
 
@@ -31,7 +33,9 @@ type Essentials struct {
 func NewServer(es Essentials, cfg config.Server) (*Server, error) {
 	h := handlers{
 		core:         es.Core,
+		jobs:         es.Jobs,
 		exposeErrors: cfg.ExposeErrors,
+		autoRedirect: cfg.AutoRedirect,
 	}
 
 	r := mux.NewRouter()
@@ -43,6 +47,8 @@ func NewServer(es Essentials, cfg config.Server) (*Server, error) {
 	r.Use(
 		mux.CORSMethodMiddleware(r),
 		middlewareServerHeader(cfg.Name),
+		middlewareRequestID,
+		middlewareTracing,
 		middlewareLogger(es.Logger),
 		middlewareDump,
 		middlewareMetrics(es.PromRegistry),
@@ -103,6 +109,18 @@ func mountPublicAPI(r *mux.Router, h *handlers, cfg config.Server) {
 		Methods(http.MethodGet).
 		HandlerFunc(h.ListImages)
 
+	apiV1.Path("/images/{id}/similar").
+		Methods(http.MethodGet).
+		HandlerFunc(h.GetSimilarImages)
+
+	apiV1.Path("/images/{id}/renditions").
+		Methods(http.MethodGet).
+		HandlerFunc(h.GetRenditionManifest)
+
+	apiV1.Path("/images/{id}/auto").
+		Methods(http.MethodGet).
+		HandlerFunc(h.GetAutoImage)
+
 	apiV1.Path("/images/{id}/{size}").
 		Methods(http.MethodGet).
 		HandlerFunc(h.GetImage)
@@ -126,13 +144,78 @@ func mountInternalAPI(r *mux.Router, h *handlers) {
 		Methods(http.MethodPut).
 		HandlerFunc(h.PutImage)
 
+	internalAPIV1.
+		Path("/images/duplicates").
+		Methods(http.MethodGet).
+		HandlerFunc(h.GetNearDuplicates)
+
+	internalAPIV1.
+		Path("/images/{image_id}").
+		Methods(http.MethodGet).
+		HandlerFunc(h.GetImageMeta)
+
 	internalAPIV1.
 		Path("/images/{image_id}").
 		Methods(http.MethodDelete).
 		HandlerFunc(h.DeleteImage)
 
+	internalAPIV1.
+		Path("/images/{image_id}/focal_point").
+		Methods(http.MethodPut).
+		HandlerFunc(h.PutFocalPoint)
+
+	internalAPIV1.
+		Path("/images/{image_id}/focal_point").
+		Methods(http.MethodDelete).
+		HandlerFunc(h.DeleteFocalPoint)
+
+	internalAPIV1.
+		Path("/images/{image_id}/watermark").
+		Methods(http.MethodPut).
+		HandlerFunc(h.PutWatermark)
+
+	internalAPIV1.
+		Path("/images/{image_id}/watermark").
+		Methods(http.MethodDelete).
+		HandlerFunc(h.DeleteWatermark)
+
+	internalAPIV1.
+		Path("/images/{image_id}/crops/{key}").
+		Methods(http.MethodPut).
+		HandlerFunc(h.PutCrop)
+
+	internalAPIV1.
+		Path("/images/{image_id}/crops/{key}").
+		Methods(http.MethodDelete).
+		HandlerFunc(h.DeleteCrop)
+
 	internalAPIV1.
 		Path("/images/shuffle").
 		Methods(http.MethodPost).
 		HandlerFunc(h.PostShuffle)
+
+	internalAPIV1.
+		Path("/renditions/warm").
+		Methods(http.MethodPost).
+		HandlerFunc(h.PostWarmRenditions)
+
+	internalAPIV1.
+		Path("/jobs").
+		Methods(http.MethodGet).
+		HandlerFunc(h.ListJobs)
+
+	internalAPIV1.
+		Path("/jobs/stats").
+		Methods(http.MethodGet).
+		HandlerFunc(h.GetJobStats)
+
+	internalAPIV1.
+		Path("/jobs/{job_id}").
+		Methods(http.MethodGet).
+		HandlerFunc(h.GetJob)
+
+	internalAPIV1.
+		Path("/jobs/{job_id}/retry").
+		Methods(http.MethodPost).
+		HandlerFunc(h.PostRetryJob)
 }
@@ -1,14 +1,23 @@
 package imhttp
 
 import (
+	"context"
 	"net/http"
 	"runtime/debug"
 	"strconv"
 	"time"
 
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/tracing"
+
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func middlewareServerHeader(server string) func(next http.Handler) http.Handler {
@@ -21,11 +30,69 @@ func middlewareServerHeader(server string) func(next http.Handler) http.Handler
 	}
 }
 
+// requestIDMaxLength limits ids of requests sent by clients.
+const requestIDMaxLength = 128
+
+type requestIDContextKey struct{}
+
+// middlewareRequestID takes the id of the request from the header or
+// generates it. The id is echoed in the response.
+func middlewareRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(headerRequestID)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set(headerRequestID, id)
+
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, id)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validRequestID checks that the id is printable ASCII of limited length.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > requestIDMaxLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestIDFromContext returns the id of the request, it is empty out of
+// requests.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+
+	return id
+}
+
+// middlewareLogger puts the logger with ids of the request and the trace
+// to the context.
 func middlewareLogger(log zerolog.Logger) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
-			ctx = log.WithContext(ctx)
+
+			logCtx := log.With()
+			if id := requestIDFromContext(ctx); id != "" {
+				logCtx = logCtx.Str("request_id", id)
+			}
+
+			if id := tracing.TraceID(ctx); id != "" {
+				logCtx = logCtx.Str("trace_id", id)
+			}
+
+			l := logCtx.Logger()
+			ctx = l.WithContext(ctx)
 
 			r = r.WithContext(ctx)
 
@@ -73,7 +140,13 @@ func middlewareRecoverPanic(next http.Handler) http.Handler {
 
 		defer func() {
 			if rerr := recover(); rerr != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+				writeProblem(ctx, w, problem{
+					Type:      "about:blank",
+					Title:     http.StatusText(http.StatusInternalServerError),
+					Status:    http.StatusInternalServerError,
+					Code:      codeInternal,
+					RequestID: requestIDFromContext(ctx),
+				})
 
 				zerolog.Ctx(ctx).Error().
 					Str("stack", string(debug.Stack())).
@@ -102,6 +175,71 @@ func middlewareCacheControl(maxAge time.Duration) func(next http.Handler) http.H
 	}
 }
 
+// middlewareTracing continues the trace of the client by W3C trace
+// context headers and starts the span of the route.
+func middlewareTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		// Unmatched paths are not used as names, so the number of
+		// span names is bounded by routes.
+		name := "HTTP " + r.Method
+		attrs := []attribute.KeyValue{
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPTargetKey.String(r.URL.RequestURI()),
+			attribute.String("http.request_id", requestIDFromContext(ctx)),
+		}
+
+		if route, ok := matchedRoute(r); ok {
+			name = r.Method + " " + route
+			attrs = append(attrs, semconv.HTTPRouteKey.String(route))
+		}
+
+		ctx, span := tracing.Tracer().Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attrs...),
+		)
+		defer span.End()
+
+		srw := &statusResponseWriter{ResponseWriter: w, Code: http.StatusOK}
+		next.ServeHTTP(srw, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(srw.Code))
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(srw.Code, trace.SpanKindServer))
+	})
+}
+
+// routeTemplate returns the template of the matched route or the URL.
+func routeTemplate(r *http.Request) string {
+	if route, ok := matchedRoute(r); ok {
+		return route
+	}
+
+	if url := r.URL; url != nil {
+		return url.String()
+	}
+
+	return "unknown"
+}
+
+// matchedRoute returns the template of the matched route, ok is false
+// if no route is matched or it has no template.
+func matchedRoute(r *http.Request) (route string, ok bool) {
+	cr := mux.CurrentRoute(r)
+	if cr == nil {
+		return "", false
+	}
+
+	route, err := cr.GetPathTemplate()
+	if err != nil {
+		zerolog.Ctx(r.Context()).Warn().Msg("getting template")
+
+		return "", false
+	}
+
+	return route, true
+}
+
 func middlewareMetrics(registerer prometheus.Registerer) func(next http.Handler) http.Handler {
 	histogramVec := prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: "swaptile",
@@ -113,16 +251,7 @@ func middlewareMetrics(registerer prometheus.Registerer) func(next http.Handler)
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			route := "unknown"
-			if cr := mux.CurrentRoute(r); cr != nil {
-				var err error
-				route, err = cr.GetPathTemplate()
-				if err != nil {
-					zerolog.Ctx(r.Context()).Warn().Msg("getting template")
-				}
-			} else if url := r.URL; url != nil {
-				route = url.String()
-			}
+			route := routeTemplate(r)
 
 			srw := &statusResponseWriter{ResponseWriter: w}
 			t := time.Now()
@@ -2,16 +2,25 @@ package imhttp
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/test"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/tracing"
 
+	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestMiddlewareServerHeader(t *testing.T) {
@@ -30,6 +39,54 @@ func TestMiddlewareServerHeader(t *testing.T) {
 	}
 }
 
+func TestMiddlewareRequestID(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Header   string
+		ExpEqual bool
+	}{{
+		Name:     "client",
+		Header:   "client-request-1",
+		ExpEqual: true,
+	}, {
+		Name: "generated",
+	}, {
+		Name:   "invalid",
+		Header: "bad\nid",
+	}, {
+		Name:   "long",
+		Header: strings.Repeat("a", requestIDMaxLength+1),
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.Header != "" {
+				r.Header.Set(headerRequestID, tc.Header)
+			}
+
+			w := httptest.NewRecorder()
+
+			var got string
+
+			middlewareRequestID(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				got = requestIDFromContext(r.Context())
+			})).ServeHTTP(w, r)
+
+			switch {
+			case got == "":
+				t.Fatal("exp request id")
+			case w.Header().Get(headerRequestID) != got:
+				t.Fatal("exp", got, "got", w.Header().Get(headerRequestID))
+			case tc.ExpEqual != (got == tc.Header):
+				t.Fatal("unexpected request id", got)
+			}
+		})
+	}
+}
+
 func TestMiddlewareLogger(t *testing.T) {
 	l := zerolog.New(ioutil.Discard).Level(zerolog.DebugLevel)
 
@@ -54,6 +111,80 @@ func TestMiddlewareLogger(t *testing.T) {
 	}
 }
 
+func TestMiddlewareTracing(t *testing.T) {
+	const (
+		requestID = "test-request"
+		traceID   = "4bf92f3577b34da6a3ce929d0e0e4736"
+	)
+
+	_, err := tracing.Setup(context.Background(), config.Tracing{Exporter: config.TracingExporterNone}, "")
+	test.AssertErrNil(t, err)
+
+	var logBuf bytes.Buffer
+	l := zerolog.New(&logBuf)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(headerRequestID, requestID)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	w := httptest.NewRecorder()
+
+	var gotTraceID string
+
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		gotTraceID = tracing.TraceID(r.Context())
+
+		zerolog.Ctx(r.Context()).Info().Msg("test")
+	})
+
+	middlewareRequestID(middlewareTracing(middlewareLogger(l)(h))).ServeHTTP(w, r)
+
+	if gotTraceID != traceID {
+		t.Fatal("exp", traceID, "got", gotTraceID)
+	}
+
+	var line struct {
+		RequestID string `json:"request_id"`
+		TraceID   string `json:"trace_id"`
+	}
+
+	test.AssertErrNil(t, json.Unmarshal(logBuf.Bytes(), &line))
+
+	if line.RequestID != requestID || line.TraceID != traceID {
+		t.Fatal("unexpected log line", logBuf.String())
+	}
+}
+
+func TestMiddlewareTracing_spanName(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+
+	prevProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(prevProvider) })
+
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+
+	router := mux.NewRouter()
+	router.Use(middlewareTracing)
+	router.Handle("/images/{id}", h)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/images/test", nil))
+	middlewareTracing(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/unknown/test", nil))
+
+	spans := recorder.Ended()
+
+	expNames := []string{"GET /images/{id}", "HTTP GET"}
+	if len(spans) != len(expNames) {
+		t.Fatal("exp", expNames, "got", len(spans), "spans")
+	}
+
+	for i, span := range spans {
+		if span.Name() != expNames[i] {
+			t.Fatal("exp", expNames[i], "got", span.Name())
+		}
+	}
+}
+
 func TestMiddlewareDump(t *testing.T) {
 	var logBuf bytes.Buffer
 	l := zerolog.New(&logBuf).Level(zerolog.DebugLevel)
@@ -0,0 +1,125 @@
+package imhttp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog"
+)
+
+const contentTypeProblem = "application/problem+json"
+
+// Codes of errors by imerrors types, they are stable for clients.
+const (
+	codeNotFound             = "not_found"
+	codeConflict             = "conflict"
+	codeUnprocessableEntity  = "unprocessable_entity"
+	codeBadRequest           = "bad_request"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeOversize             = "oversize"
+	codeUnavailable          = "unavailable"
+	codeInternal             = "internal"
+)
+
+// problem is a body of error responses by RFC 7807.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// Detail is the message of the error. Causes of internal errors are
+	// exposed only by the config.
+	Detail string `json:"detail,omitempty"`
+	// Code is one of code constants.
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+	// Errors are failed validations of fields.
+	Errors []fieldProblem `json:"errors,omitempty"`
+}
+
+// fieldProblem is a failed validation of the field.
+type fieldProblem struct {
+	// Field is a path to the field by JSON names like crop.x, it is
+	// empty for validated values.
+	Field string `json:"field,omitempty"`
+	// Rule is a failed validation rule like lte, aliases like image_id
+	// are expanded.
+	Rule string `json:"rule"`
+	// Param is a parameter of the rule like 1 of lte=1.
+	Param string `json:"param,omitempty"`
+}
+
+// newProblem describes the error. The detail of internal errors is kept
+// unless they are exposed.
+func newProblem(ctx context.Context, err error, exposeErrors bool) problem {
+	p := problem{
+		Type:      "about:blank",
+		RequestID: requestIDFromContext(ctx),
+	}
+
+	switch {
+	case errors.As(err, &imerrors.NotFoundError{}):
+		p.Status, p.Code = http.StatusNotFound, codeNotFound
+	case errors.As(err, &imerrors.ConflictError{}):
+		p.Status, p.Code = http.StatusConflict, codeConflict
+	case errors.As(err, &imerrors.UnprocessableEntity{}):
+		p.Status, p.Code = http.StatusUnprocessableEntity, codeUnprocessableEntity
+	case errors.As(err, &imerrors.BadRequestError{}):
+		p.Status, p.Code = http.StatusBadRequest, codeBadRequest
+	case errors.As(err, &imerrors.MediaTypeError{}):
+		p.Status, p.Code = http.StatusUnsupportedMediaType, codeUnsupportedMediaType
+	case errors.As(err, &imerrors.OversizeError{}):
+		p.Status, p.Code = http.StatusRequestEntityTooLarge, codeOversize
+	case imerrors.IsTemporaryError(err):
+		p.Status, p.Code = http.StatusServiceUnavailable, codeUnavailable
+	default:
+		p.Status, p.Code = http.StatusInternalServerError, codeInternal
+	}
+
+	p.Title = http.StatusText(p.Status)
+
+	if p.Status < http.StatusInternalServerError || exposeErrors {
+		p.Detail = err.Error()
+	}
+
+	var verrs validator.ValidationErrors
+	if errors.As(err, &verrs) {
+		p.Errors = make([]fieldProblem, len(verrs))
+
+		for i, fe := range verrs {
+			p.Errors[i] = fieldProblem{
+				Field: fieldPath(fe.Namespace()),
+				Rule:  fe.ActualTag(),
+				Param: fe.Param(),
+			}
+		}
+	}
+
+	return p
+}
+
+// fieldPath returns the path to the field without the name of the
+// validated struct.
+func fieldPath(namespace string) string {
+	for i, r := range namespace {
+		if r == '.' {
+			return namespace[i+1:]
+		}
+	}
+
+	return ""
+}
+
+// writeProblem writes the problem as the response.
+func writeProblem(ctx context.Context, w http.ResponseWriter, p problem) {
+	w.Header().Set(headerContentType, contentTypeProblem)
+	w.WriteHeader(p.Status)
+
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("writing response")
+	}
+}
@@ -0,0 +1,157 @@
+package imhttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/validate"
+)
+
+type temporaryTestError struct{}
+
+func (temporaryTestError) Error() string   { return "temporary" }
+func (temporaryTestError) Temporary() bool { return true }
+
+func TestNewProblem(t *testing.T) {
+	const errTest imerrors.Error = "test error"
+
+	testCases := []struct {
+		Name      string
+		Err       error
+		Expose    bool
+		ExpStatus int
+		ExpCode   string
+		ExpDetail string
+	}{{
+		Name:      "not_found",
+		Err:       fmt.Errorf("getting image: %w", imerrors.NewNotFoundError(errTest)),
+		ExpStatus: http.StatusNotFound,
+		ExpCode:   codeNotFound,
+		ExpDetail: "getting image: test error",
+	}, {
+		Name:      "conflict",
+		Err:       imerrors.NewConflictError(errTest),
+		ExpStatus: http.StatusConflict,
+		ExpCode:   codeConflict,
+		ExpDetail: "test error",
+	}, {
+		Name:      "unprocessable_entity",
+		Err:       imerrors.NewUnprocessableEntity(errTest),
+		ExpStatus: http.StatusUnprocessableEntity,
+		ExpCode:   codeUnprocessableEntity,
+		ExpDetail: "test error",
+	}, {
+		Name:      "bad_request",
+		Err:       imerrors.NewBadRequestError(errTest),
+		ExpStatus: http.StatusBadRequest,
+		ExpCode:   codeBadRequest,
+		ExpDetail: "test error",
+	}, {
+		Name:      "media_type",
+		Err:       imerrors.NewMediaTypeError(errTest),
+		ExpStatus: http.StatusUnsupportedMediaType,
+		ExpCode:   codeUnsupportedMediaType,
+		ExpDetail: "test error",
+	}, {
+		Name:      "oversize",
+		Err:       imerrors.NewOversizeError(errTest),
+		ExpStatus: http.StatusRequestEntityTooLarge,
+		ExpCode:   codeOversize,
+		ExpDetail: "test error",
+	}, {
+		Name:      "temporary",
+		Err:       temporaryTestError{},
+		ExpStatus: http.StatusServiceUnavailable,
+		ExpCode:   codeUnavailable,
+	}, {
+		Name:      "internal",
+		Err:       errTest,
+		ExpStatus: http.StatusInternalServerError,
+		ExpCode:   codeInternal,
+	}, {
+		Name:      "exposed_internal",
+		Err:       errTest,
+		Expose:    true,
+		ExpStatus: http.StatusInternalServerError,
+		ExpCode:   codeInternal,
+		ExpDetail: "test error",
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			p := newProblem(context.Background(), tc.Err, tc.Expose)
+
+			switch {
+			case p.Status != tc.ExpStatus:
+				t.Fatal("exp", tc.ExpStatus, "got", p.Status)
+			case p.Code != tc.ExpCode:
+				t.Fatal("exp", tc.ExpCode, "got", p.Code)
+			case p.Detail != tc.ExpDetail:
+				t.Fatal("exp", tc.ExpDetail, "got", p.Detail)
+			case p.Title != http.StatusText(tc.ExpStatus):
+				t.Fatal("exp", http.StatusText(tc.ExpStatus), "got", p.Title)
+			}
+		})
+	}
+}
+
+func TestNewProblem_fields(t *testing.T) {
+	v := validate.New()
+
+	err := v.Struct(&imager.FocalPoint{X: 2, Y: -1})
+	err = imerrors.NewUnprocessableEntity(fmt.Errorf("validating focal point: %w", err))
+
+	p := newProblem(context.Background(), err, false)
+
+	exp := []fieldProblem{
+		{Field: "x", Rule: "lte", Param: "1"},
+		{Field: "y", Rule: "gte", Param: "0"},
+	}
+	if !reflect.DeepEqual(p.Errors, exp) {
+		t.Fatal("exp", exp, "got", p.Errors)
+	}
+
+	err = imerrors.NewUnprocessableEntity(v.Var("", "image_id"))
+
+	p = newProblem(context.Background(), err, false)
+
+	exp = []fieldProblem{{Rule: "min", Param: "1"}}
+	if !reflect.DeepEqual(p.Errors, exp) {
+		t.Fatal("exp", exp, "got", p.Errors)
+	}
+}
+
+func TestWriteProblem(t *testing.T) {
+	const requestID = "test-request"
+
+	ctx := context.WithValue(context.Background(), requestIDContextKey{}, requestID)
+	w := httptest.NewRecorder()
+
+	writeProblem(ctx, w, newProblem(ctx, imerrors.NewNotFoundError(imerrors.Error("missing")), false))
+
+	if w.Code != http.StatusNotFound {
+		t.Fatal("exp", http.StatusNotFound, "got", w.Code)
+	}
+
+	if got := w.Header().Get(headerContentType); got != contentTypeProblem {
+		t.Fatal("exp", contentTypeProblem, "got", got)
+	}
+
+	var p problem
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.RequestID != requestID || p.Code != codeNotFound || p.Detail != "missing" {
+		t.Fatal("unexpected problem", p)
+	}
+}
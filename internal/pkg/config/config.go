@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
@@ -22,10 +23,14 @@ type Config struct {
 	Environment string `json:"environment" env:"SWAPTILE_ENVIRONMENT" envDefault:"development"`
 	LogLevel    string `json:"loglevel" env:"SWAPTILE_LOGLEVEL" envDefault:"debug"`
 
-	S3     `json:"s3"`
-	Redis  `json:"redis"`
-	Core   `json:"core"`
-	Server `json:"Server"`
+	Storage `json:"storage"`
+	S3      `json:"s3"`
+	Local   `json:"local"`
+	Redis   `json:"redis"`
+	Core    `json:"core"`
+	Jobs    `json:"jobs"`
+	Server  `json:"Server"`
+	Tracing `json:"tracing"`
 }
 
 // Server contains config of the HTTP server.
@@ -37,14 +42,155 @@ type Server struct {
 	WriteTimeout       Duration `json:"write_timeout" env:"SWAPTILE_SERVER_WRITE_TIMEOUT" envDefault:"15s"`
 	ShutdownTimeout    Duration `json:"shutdown_timeout" env:"SWAPTILE_SERVER_SHUTDOWN_TIMEOUT" envDefault:"5s"`
 	CacheControlMaxAge Duration `json:"cache_control_max_age" env:"SWAPTILE_SERVER_CACHE_CONTROL_MAX_AGE" envDefault:"0"`
+	// AutoRedirect tells the auto endpoint to redirect to the URL of the
+	// selected size instead of serving it.
+	AutoRedirect bool `json:"auto_redirect" env:"SWAPTILE_SERVER_AUTO_REDIRECT" envDefault:"false"`
 }
 
 // Core contains config of the main application logic.
 type Core struct {
 	ImageContentTypes   []string           `json:"image_content_types" env:"SWAPTILE_CORE_IMAGE_CONTENT_TYPE" envDefault:"image/jpeg,image/webp,image/png"`
 	SupportedImageSizes []imager.ImageSize `json:"supported_image_sizes" env:"SWAPTILE_CORE_SUPPORTED_IMAGE_SIZES" envDefault:"1920x1080,480x360,1080x1920,360x480"`
+	// SizePolicy tells what to do with requested sizes that are not in
+	// SupportedImageSizes: "list" rejects them, "snap" snaps them to the
+	// nearest size allowed by the policy and "reject" rejects sizes that
+	// are not allowed by it.
+	SizePolicy string `json:"size_policy" env:"SWAPTILE_CORE_SIZE_POLICY" envDefault:"list"`
+	// SizeAspectRatios are allowed aspect ratios like 3:4, any ratio is
+	// allowed if it is empty.
+	SizeAspectRatios []string `json:"size_aspect_ratios" env:"SWAPTILE_CORE_SIZE_ASPECT_RATIOS" envDefault:""`
+	// SizeMinDimension and SizeMaxDimension limit the width and the
+	// height of requested sizes.
+	SizeMinDimension int `json:"size_min_dimension" env:"SWAPTILE_CORE_SIZE_MIN_DIMENSION" envDefault:"32"`
+	SizeMaxDimension int `json:"size_max_dimension" env:"SWAPTILE_CORE_SIZE_MAX_DIMENSION" envDefault:"2048"`
+	// SizeStep is a step of widths of requested sizes, it limits the
+	// count of cached renditions.
+	SizeStep int `json:"size_step" env:"SWAPTILE_CORE_SIZE_STEP" envDefault:"16"`
+	// MaxDPR is a max device pixel ratio of the @2x size suffix.
+	MaxDPR int `json:"max_dpr" env:"SWAPTILE_CORE_MAX_DPR" envDefault:"3"`
 	// MaxImageSize is in bytes.
 	MaxImageSize int64 `json:"max_image_size" env:"SWAPTILE_CORE_MAX_IMAGE_SIZE" envDefault:"12582912"`
+	// MaxImageWidth, MaxImageHeight and MaxImagePixels limit decoded
+	// dimensions of originals, zero disables the limit. Uploaded
+	// originals should cover each of supported image sizes by both
+	// sides.
+	MaxImageWidth  int   `json:"max_image_width" env:"SWAPTILE_CORE_MAX_IMAGE_WIDTH" envDefault:"10000"`
+	MaxImageHeight int   `json:"max_image_height" env:"SWAPTILE_CORE_MAX_IMAGE_HEIGHT" envDefault:"10000"`
+	MaxImagePixels int64 `json:"max_image_pixels" env:"SWAPTILE_CORE_MAX_IMAGE_PIXELS" envDefault:"40000000"`
+	// Duplicates is a default policy for uploads of known content:
+	// reject or share.
+	Duplicates string `json:"duplicates" env:"SWAPTILE_CORE_DUPLICATES" envDefault:"share"`
+	// NearDuplicates is a default policy for uploads of images similar
+	// to known ones: warn or reject.
+	NearDuplicates string `json:"near_duplicates" env:"SWAPTILE_CORE_NEAR_DUPLICATES" envDefault:"warn"`
+	// NearDuplicateDistance is a max Hamming distance between
+	// perceptual hashes of similar images, from 0 to 8. Greater
+	// distances are limited to 8.
+	NearDuplicateDistance int `json:"near_duplicate_distance" env:"SWAPTILE_CORE_NEAR_DUPLICATE_DISTANCE" envDefault:"8"`
+	// NormalizeImages enables normalization of uploaded images. The
+	// enabled steps are applied and the image is re-encoded once.
+	NormalizeImages bool `json:"normalize_images" env:"SWAPTILE_CORE_NORMALIZE_IMAGES" envDefault:"false"`
+	// NormalizeOrientation applies the EXIF orientation. The metadata is
+	// stripped too, otherwise the orientation is applied twice.
+	NormalizeOrientation bool `json:"normalize_orientation" env:"SWAPTILE_CORE_NORMALIZE_ORIENTATION" envDefault:"true"`
+	// NormalizeStripMetadata strips EXIF, XMP and other metadata.
+	NormalizeStripMetadata bool `json:"normalize_strip_metadata" env:"SWAPTILE_CORE_NORMALIZE_STRIP_METADATA" envDefault:"true"`
+	// NormalizeSRGB converts the image to sRGB by its color profile.
+	NormalizeSRGB bool `json:"normalize_srgb" env:"SWAPTILE_CORE_NORMALIZE_SRGB" envDefault:"true"`
+	// NormalizeQuality is a quality of re-encoded JPEG and WEBP images.
+	NormalizeQuality int `json:"normalize_quality" env:"SWAPTILE_CORE_NORMALIZE_QUALITY" envDefault:"90"`
+	// KeepSources tells to keep uploaded files of normalized images.
+	KeepSources bool `json:"keep_sources" env:"SWAPTILE_CORE_KEEP_SOURCES" envDefault:"false"`
+	// RenditionFormats are formats rendered besides the format of the
+	// original, like webp.
+	RenditionFormats []string `json:"rendition_formats" env:"SWAPTILE_CORE_RENDITION_FORMATS" envDefault:""`
+	// AutoDefaultWidth is a width in CSS pixels used by the auto
+	// endpoint if the client sent no hints.
+	AutoDefaultWidth int `json:"auto_default_width" env:"SWAPTILE_CORE_AUTO_DEFAULT_WIDTH" envDefault:"360"`
+	// SaveDataQuality is a quality of renditions for clients that ask to
+	// save data, zero keeps the default quality.
+	SaveDataQuality int `json:"save_data_quality" env:"SWAPTILE_CORE_SAVE_DATA_QUALITY" envDefault:"50"`
+	// DifficultyGrids are sizes of n×n grids of tiles the difficulty of
+	// images is computed for.
+	DifficultyGrids []int `json:"difficulty_grids" env:"SWAPTILE_CORE_DIFFICULTY_GRIDS" envDefault:"3,4,5"`
+	// Variants are named chains of transforms of renditions, like
+	// grayscale, blur:SIGMA, sharpen, contrast:PERCENT and
+	// remap:deuteranopia. In the environment they are separated by
+	// commas and steps are separated by pipes: hard=grayscale|blur:2.
+	Variants Variants `json:"variants" env:"SWAPTILE_CORE_VARIANTS" envDefault:"grayscale=grayscale,high_contrast=contrast:50|sharpen,color_blind=remap:deuteranopia"`
+	// OverlayGridColor is a default color of grid lines of overlays like
+	// #rrggbb or #rrggbbaa.
+	OverlayGridColor string `json:"overlay_grid_color" env:"SWAPTILE_CORE_OVERLAY_GRID_COLOR" envDefault:"#ffffffcc"`
+	// OverlayGridWidth is a default width of grid lines of overlays in
+	// CSS pixels.
+	OverlayGridWidth int `json:"overlay_grid_width" env:"SWAPTILE_CORE_OVERLAY_GRID_WIDTH" envDefault:"2"`
+	// OverlayGridColors are colors of grid lines clients can select
+	// besides the default one, like #rrggbb or #rrggbbaa.
+	OverlayGridColors []string `json:"overlay_grid_colors" env:"SWAPTILE_CORE_OVERLAY_GRID_COLORS" envDefault:"#ffffffcc,#000000cc,#ffd700ff"`
+	// OverlayGridWidths are widths of grid lines in CSS pixels clients can
+	// select besides the default one.
+	OverlayGridWidths []int `json:"overlay_grid_widths" env:"SWAPTILE_CORE_OVERLAY_GRID_WIDTHS" envDefault:"1,2,4"`
+	// OverlayMaxGrid is the largest grid of n×n tiles of overlays.
+	OverlayMaxGrid int `json:"overlay_max_grid" env:"SWAPTILE_CORE_OVERLAY_MAX_GRID" envDefault:"10"`
+	// OverlayGhostOpacity is an opacity of the faded image of the ghost
+	// overlay from 0 to 1.
+	OverlayGhostOpacity float64 `json:"overlay_ghost_opacity" env:"SWAPTILE_CORE_OVERLAY_GHOST_OPACITY" envDefault:"0.35"`
+	// WatermarkCategories are categories of images with watermarked
+	// renditions. The image meta can toggle the watermark of the image.
+	WatermarkCategories []string `json:"watermark_categories" env:"SWAPTILE_CORE_WATERMARK_CATEGORIES" envDefault:""`
+	// WatermarkText is a template of the text of the watermark, fields
+	// of the image meta like {{.Author}} are available.
+	WatermarkText string `json:"watermark_text" env:"SWAPTILE_CORE_WATERMARK_TEXT" envDefault:"© {{.Author}}"`
+	// WatermarkImage is a path to the image of the watermark, it is drawn
+	// instead of the text if it is set.
+	WatermarkImage string `json:"watermark_image" env:"SWAPTILE_CORE_WATERMARK_IMAGE" envDefault:""`
+	// WatermarkPosition is top_left, top_right, bottom_left, bottom_right
+	// or center.
+	WatermarkPosition string `json:"watermark_position" env:"SWAPTILE_CORE_WATERMARK_POSITION" envDefault:"bottom_right"`
+	// WatermarkOpacity is an opacity of the watermark from 0 to 1.
+	WatermarkOpacity float64 `json:"watermark_opacity" env:"SWAPTILE_CORE_WATERMARK_OPACITY" envDefault:"0.6"`
+	// WatermarkMinWidth is a width of renditions in pixels, narrower ones
+	// are not watermarked.
+	WatermarkMinWidth int `json:"watermark_min_width" env:"SWAPTILE_CORE_WATERMARK_MIN_WIDTH" envDefault:"720"`
+	// RenderOnUpload tells to enqueue rendering of all renditions of
+	// uploaded images as background jobs.
+	RenderOnUpload bool `json:"render_on_upload" env:"SWAPTILE_CORE_RENDER_ON_UPLOAD" envDefault:"true"`
+}
+
+// Jobs contains config of the background job queue.
+type Jobs struct {
+	// Workers is a count of jobs processed concurrently.
+	Workers int `json:"workers" env:"SWAPTILE_JOBS_WORKERS" envDefault:"4"`
+	// MaxAttempts is a count of attempts before the job is moved to the
+	// dead-letter list.
+	MaxAttempts int `json:"max_attempts" env:"SWAPTILE_JOBS_MAX_ATTEMPTS" envDefault:"5"`
+	// VisibilityTimeout is a time of processing of the job, after it the
+	// job is given to another worker.
+	VisibilityTimeout Duration `json:"visibility_timeout" env:"SWAPTILE_JOBS_VISIBILITY_TIMEOUT" envDefault:"5m"`
+	// MinBackoff is a delay before the first retry, it is doubled for
+	// each next one up to MaxBackoff.
+	MinBackoff Duration `json:"min_backoff" env:"SWAPTILE_JOBS_MIN_BACKOFF" envDefault:"1s"`
+	MaxBackoff Duration `json:"max_backoff" env:"SWAPTILE_JOBS_MAX_BACKOFF" envDefault:"10m"`
+	// PollInterval is an interval of checking for new jobs when the queue
+	// is empty.
+	PollInterval Duration `json:"poll_interval" env:"SWAPTILE_JOBS_POLL_INTERVAL" envDefault:"1s"`
+}
+
+// Storage drivers.
+const (
+	StorageDriverS3    = "s3"
+	StorageDriverLocal = "local"
+)
+
+// Storage selects the file storage of originals.
+type Storage struct {
+	// Driver is one of: s3, local.
+	Driver string `json:"driver" env:"SWAPTILE_STORAGE_DRIVER" envDefault:"s3"`
+}
+
+// Local file system storage config.
+type Local struct {
+	Root string `json:"root" env:"SWAPTILE_LOCAL_ROOT" envDefault:"./data/images"`
 }
 
 // S3 storage client config.
@@ -62,6 +208,30 @@ type Redis struct {
 	Endpoint string `json:"endpoint" env:"SWAPTILE_REDIS_ENDPOINT" envDefault:"redis://localhost:6380"`
 }
 
+// Tracing exporters.
+const (
+	TracingExporterNone   = "none"
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+	TracingExporterFile   = "file"
+)
+
+// Tracing contains config of OpenTelemetry tracing.
+type Tracing struct {
+	// Exporter is one of: none, otlp, stdout, file.
+	Exporter    string `json:"exporter" env:"SWAPTILE_TRACING_EXPORTER" envDefault:"none"`
+	ServiceName string `json:"service_name" env:"SWAPTILE_TRACING_SERVICE_NAME" envDefault:"swaptile-imager"`
+	// OTLPEndpoint is a host and port of the OTLP HTTP collector.
+	OTLPEndpoint string `json:"otlp_endpoint" env:"SWAPTILE_TRACING_OTLP_ENDPOINT" envDefault:"localhost:4318"`
+	OTLPInsecure bool   `json:"otlp_insecure" env:"SWAPTILE_TRACING_OTLP_INSECURE" envDefault:"true"`
+	// File is a path of the file spans are appended to as JSON by the
+	// file exporter.
+	File string `json:"file" env:"SWAPTILE_TRACING_FILE" envDefault:"./data/traces.json"`
+	// SampleRatio is a share of sampled traces from 0 to 1, sampled
+	// parents are always followed.
+	SampleRatio float64 `json:"sample_ratio" env:"SWAPTILE_TRACING_SAMPLE_RATIO" envDefault:"1"`
+}
+
 // Load config from the file or the environment. The file has the
 // highest priority.
 func Load(file string) (cfg Config, err error) {
@@ -74,6 +244,7 @@ func Load(file string) (cfg Config, err error) {
 
 			return Duration(d), nil
 		},
+		reflect.TypeOf(Variants{}): parseVariants,
 	})
 	if err != nil {
 		return cfg, fmt.Errorf("parsing environment: %w", err)
@@ -100,6 +271,44 @@ func Load(file string) (cfg Config, err error) {
 	return cfg, nil
 }
 
+// Variants are chains of transforms by names.
+type Variants map[string][]string
+
+// UnmarshalJSON implements json unmarshaller interface. Variants of the
+// file replace default ones.
+func (v *Variants) UnmarshalJSON(b []byte) error {
+	var variants map[string][]string
+	if err := json.Unmarshal(b, &variants); err != nil {
+		return fmt.Errorf("decoding variants: %w", err)
+	}
+
+	*v = variants
+
+	return nil
+}
+
+// parseVariants parses variants like name=step|step,name=step.
+func parseVariants(v string) (interface{}, error) {
+	const tokensNameChainCount = 2
+
+	variants := make(Variants)
+
+	if strings.TrimSpace(v) == "" {
+		return variants, nil
+	}
+
+	for _, variant := range strings.Split(v, ",") {
+		tokens := strings.SplitN(variant, "=", tokensNameChainCount)
+		if len(tokens) != tokensNameChainCount || tokens[0] == "" || tokens[1] == "" {
+			return nil, fmt.Errorf("expected name=step|step, got %s", variant)
+		}
+
+		variants[tokens[0]] = strings.Split(tokens[1], "|")
+	}
+
+	return variants, nil
+}
+
 // Duration helps to parse string duration to time.Duration.
 type Duration time.Duration
 
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -52,6 +53,30 @@ func TestLoad_Environment(t *testing.T) {
 	}
 }
 
+func TestLoad_Variants(t *testing.T) {
+	const envVar = "SWAPTILE_CORE_VARIANTS"
+
+	test.AssertErrNil(t, os.Setenv(envVar, "hard=grayscale|blur:2,soft=blur:1"))
+	defer func() { test.AssertErrNil(t, os.Unsetenv(envVar)) }()
+
+	cfg, err := config.Load(config.UseEnv)
+	test.AssertErrNil(t, err)
+
+	exp := config.Variants{
+		"hard": {"grayscale", "blur:2"},
+		"soft": {"blur:1"},
+	}
+	if !reflect.DeepEqual(cfg.Variants, exp) {
+		t.Fatal("exp", exp, "got", cfg.Variants)
+	}
+
+	test.AssertErrNil(t, os.Setenv(envVar, "hard"))
+
+	if _, err = config.Load(config.UseEnv); err == nil {
+		t.Fatal("invalid variants are parsed")
+	}
+}
+
 func TestLoad_FileNotFound(t *testing.T) {
 	_, err := config.Load(uuid.New().String())
 
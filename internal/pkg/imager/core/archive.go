@@ -0,0 +1,537 @@
+package core
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository/imredis"
+
+	"github.com/rs/zerolog"
+)
+
+// ArchiveFormatVersion is a version of the catalog archive format. It
+// is increased on incompatible changes, see docs/archive.md.
+const ArchiveFormatVersion = 1
+
+// Names of archive entries.
+const (
+	archiveManifest      = "manifest.json"
+	archiveCategories    = "categories.json"
+	archiveImages        = "images.jsonl"
+	archivePrefixOrigin  = "originals/"
+	archivePAXSHA256     = "SWAPTILE.sha256"
+	archiveFormatName    = "swaptile-imager-catalog"
+	archiveListBatchSize = 200
+	archiveMaxLineSize   = 1 << 20
+)
+
+// ImportMode defines how imported images are combined with existing.
+type ImportMode string
+
+const (
+	// ImportMerge keeps existing images, images with known ids are
+	// skipped.
+	ImportMerge ImportMode = "merge"
+	// ImportReplace overwrites images with known ids after the whole
+	// archive is verified, deletes images missing in the archive and
+	// restores the order of categories.
+	ImportReplace ImportMode = "replace"
+)
+
+// ImportReport holds the result of the import.
+type ImportReport struct {
+	Imported int
+	Skipped  int
+}
+
+type archiveManifestData struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Images    int       `json:"images"`
+}
+
+// ExportCatalog writes all originals and their meta to w as a tar
+// archive.
+func (c Core) ExportCatalog(ctx context.Context, w io.Writer) (err error) {
+	l := zerolog.Ctx(ctx)
+
+	categories, err := c.catalogOrder(ctx)
+	if err != nil {
+		return fmt.Errorf("getting categories: %w", err)
+	}
+
+	rawIMs, err := c.listCategory(ctx, imredis.CategoryNameAll)
+	if err != nil {
+		return fmt.Errorf("listing images: %w", err)
+	}
+
+	var images bytes.Buffer
+
+	imageMetas := make([]imager.ImageMeta, 0, len(rawIMs))
+	for _, rawIM := range rawIMs {
+		im, err := rawIM.ImageMeta()
+		if err != nil {
+			return fmt.Errorf("decoding image meta: %w", err)
+		}
+
+		images.Write(rawIM)
+		images.WriteByte('\n')
+
+		imageMetas = append(imageMetas, im)
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now().UTC()
+
+	manifest := archiveManifestData{
+		Format:    archiveFormatName,
+		Version:   ArchiveFormatVersion,
+		CreatedAt: now,
+		Images:    len(imageMetas),
+	}
+
+	if err = writeArchiveJSON(tw, archiveManifest, now, manifest); err != nil {
+		return err
+	}
+
+	if err = writeArchiveJSON(tw, archiveCategories, now, categories); err != nil {
+		return err
+	}
+
+	if err = writeArchiveFile(tw, archiveImages, now, images.Bytes(), nil); err != nil {
+		return err
+	}
+
+	buf := c.buffersPool.Get().(*bytes.Buffer)
+	defer c.buffersPool.Put(buf)
+
+	for _, im := range imageMetas {
+		buf.Reset()
+
+		if err = c.readOriginal(ctx, im.StorageID(), buf); err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(buf.Bytes())
+
+		err = writeArchiveFile(tw, archivePrefixOrigin+im.ID, now, buf.Bytes(), map[string]string{
+			archivePAXSHA256: hex.EncodeToString(sum[:]),
+		})
+		if err != nil {
+			return err
+		}
+
+		l.Debug().Str("image_id", im.ID).Msg("exported image")
+	}
+
+	if err = tw.Close(); err != nil {
+		return fmt.Errorf("closing archive: %w", err)
+	}
+
+	return nil
+}
+
+// ImportCatalog reads the archive created by ExportCatalog and uploads
+// its images. Checksums of originals are verified before the upload.
+func (c Core) ImportCatalog(
+	ctx context.Context,
+	r io.Reader,
+	mode ImportMode,
+) (report ImportReport, err error) {
+	l := zerolog.Ctx(ctx)
+
+	if mode != ImportMerge && mode != ImportReplace {
+		err = fmt.Errorf("unknown import mode: %s", mode)
+
+		return report, imerrors.NewUnprocessableEntity(err)
+	}
+
+	tr := tar.NewReader(r)
+
+	var manifest archiveManifestData
+	if err = readArchiveJSON(tr, archiveManifest, &manifest); err != nil {
+		return report, err
+	}
+
+	switch {
+	case manifest.Format != archiveFormatName:
+		err = fmt.Errorf("unknown archive format: %q", manifest.Format)
+
+		return report, imerrors.NewUnprocessableEntity(err)
+	case manifest.Version != ArchiveFormatVersion:
+		err = fmt.Errorf("unsupported archive version: %d", manifest.Version)
+
+		return report, imerrors.NewUnprocessableEntity(err)
+	}
+
+	var categories map[string][]string
+	if err = readArchiveJSON(tr, archiveCategories, &categories); err != nil {
+		return report, err
+	}
+
+	imageMetas, err := readArchiveImages(tr)
+	if err != nil {
+		return report, err
+	}
+
+	if len(imageMetas) != manifest.Images {
+		err = fmt.Errorf("expected %d images, got %d", manifest.Images, len(imageMetas))
+
+		return report, imerrors.NewUnprocessableEntity(err)
+	}
+
+	buf := c.buffersPool.Get().(*bytes.Buffer)
+	defer c.buffersPool.Put(buf)
+
+	// Images are replaced after the whole archive is verified, originals
+	// of not replaced images are released.
+	var staged []imager.ImageMeta
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		for _, im := range staged {
+			if rerr := c.releaseOriginal(ctx, im); rerr != nil {
+				l.Warn().Err(rerr).Str("image_id", im.ID).Msg("releasing staged original")
+			}
+		}
+	}()
+
+	for {
+		hdr, err := tr.Next()
+		switch {
+		case errors.Is(err, io.EOF):
+			if report.Imported+report.Skipped != len(imageMetas) {
+				err = fmt.Errorf(
+					"expected %d originals, got %d",
+					len(imageMetas), report.Imported+report.Skipped,
+				)
+
+				return report, imerrors.NewUnprocessableEntity(err)
+			}
+
+			if mode == ImportReplace {
+				if staged, err = c.replaceImages(ctx, staged); err != nil {
+					return report, fmt.Errorf("replacing images: %w", err)
+				}
+
+				if err = c.deleteImagesExcept(ctx, imageMetas); err != nil {
+					return report, fmt.Errorf("deleting images: %w", err)
+				}
+
+				if err = c.restoreCatalogOrder(ctx, categories); err != nil {
+					return report, fmt.Errorf("restoring order: %w", err)
+				}
+			}
+
+			return report, nil
+		case err != nil:
+			return report, fmt.Errorf("reading archive: %w", err)
+		}
+
+		id := strings.TrimPrefix(hdr.Name, archivePrefixOrigin)
+
+		im, ok := imageMetas[id]
+		if !ok || id == hdr.Name {
+			err = fmt.Errorf("unexpected entry: %s", hdr.Name)
+
+			return report, imerrors.NewUnprocessableEntity(err)
+		}
+
+		buf.Reset()
+		if _, err = buf.ReadFrom(tr); err != nil {
+			return report, fmt.Errorf("reading original: %s: %w", id, err)
+		}
+
+		sum := sha256.Sum256(buf.Bytes())
+		if hex.EncodeToString(sum[:]) != hdr.PAXRecords[archivePAXSHA256] {
+			err = fmt.Errorf("checksum mismatch: %s", id)
+
+			return report, imerrors.NewUnprocessableEntity(err)
+		}
+
+		im.Size = int64(buf.Len())
+
+		if mode == ImportReplace {
+			// The replaced image is similar to itself.
+			res, err := c.stageImage(ctx, im, bytes.NewReader(buf.Bytes()), UploadOptions{
+				Duplicates:     DuplicatesShare,
+				NearDuplicates: NearDuplicatesWarn,
+				KeepContent:    true,
+			}, true)
+			if err != nil {
+				return report, fmt.Errorf("staging image: %s: %w", id, err)
+			}
+
+			staged = append(staged, res.ImageMeta)
+			report.Imported++
+
+			continue
+		}
+
+		_, err = c.UploadImage(ctx, im, bytes.NewReader(buf.Bytes()), UploadOptions{
+			Duplicates:  DuplicatesShare,
+			KeepContent: true,
+		})
+		switch {
+		case err == nil:
+			report.Imported++
+		case mode == ImportMerge && errors.As(err, &imerrors.ConflictError{}):
+			report.Skipped++
+
+			l.Debug().Str("image_id", id).Msg("image exists, skipped")
+		default:
+			return report, fmt.Errorf("uploading image: %s: %w", id, err)
+		}
+	}
+}
+
+// replaceImages deletes images with ids of staged ones and inserts
+// staged images instead. It returns staged images that are not inserted.
+func (c Core) replaceImages(
+	ctx context.Context,
+	staged []imager.ImageMeta,
+) (rest []imager.ImageMeta, err error) {
+	for i, im := range staged {
+		err = c.DeleteImage(ctx, im.ID)
+		if err != nil && !errors.As(err, &imerrors.NotFoundError{}) {
+			return staged[i:], fmt.Errorf("deleting image: %s: %w", im.ID, err)
+		}
+
+		// The original is released by insertImage if it fails.
+		if err = c.insertImage(ctx, im); err != nil {
+			return staged[i+1:], fmt.Errorf("inserting image: %s: %w", im.ID, err)
+		}
+	}
+
+	return nil, nil
+}
+
+// catalogOrder returns ids of images for each category in their order.
+func (c Core) catalogOrder(ctx context.Context) (order map[string][]string, err error) {
+	categories, err := c.repoImageMeta.Categories(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing categories: %w", err)
+	}
+
+	order = make(map[string][]string, len(categories)+1)
+	order[imredis.CategoryNameAll] = nil
+
+	for _, category := range categories {
+		rawIMs, err := c.listCategory(ctx, category)
+		if err != nil {
+			return nil, fmt.Errorf("listing category: %s: %w", category, err)
+		}
+
+		ids := make([]string, 0, len(rawIMs))
+		for _, rawIM := range rawIMs {
+			im, err := rawIM.ImageMeta()
+			if err != nil {
+				return nil, fmt.Errorf("decoding image meta: %w", err)
+			}
+
+			ids = append(ids, im.ID)
+		}
+
+		order[category] = ids
+	}
+
+	return order, nil
+}
+
+// listCategory returns all image meta of the category.
+func (c Core) listCategory(
+	ctx context.Context,
+	category string,
+) (rawIMs []imager.RawImageMetaJSON, err error) {
+	pagination := repository.Pagination{
+		Limit:  archiveListBatchSize,
+		Offset: 0,
+	}
+
+	for {
+		batch, err := c.repoImageMeta.List(ctx, category, pagination)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rawIM := range batch {
+			// Meta can be deleted concurrently.
+			if len(rawIM) != 0 {
+				rawIMs = append(rawIMs, rawIM)
+			}
+		}
+
+		if len(batch) < pagination.Limit {
+			return rawIMs, nil
+		}
+
+		pagination.Offset += pagination.Limit
+	}
+}
+
+// deleteImagesExcept deletes all images that are not in keep.
+func (c Core) deleteImagesExcept(
+	ctx context.Context,
+	keep map[string]imager.ImageMeta,
+) (err error) {
+	rawIMs, err := c.listCategory(ctx, imredis.CategoryNameAll)
+	if err != nil {
+		return fmt.Errorf("listing images: %w", err)
+	}
+
+	for _, rawIM := range rawIMs {
+		im, err := rawIM.ImageMeta()
+		if err != nil {
+			return fmt.Errorf("decoding image meta: %w", err)
+		}
+
+		if _, ok := keep[im.ID]; ok {
+			continue
+		}
+
+		err = c.DeleteImage(ctx, im.ID)
+		if err != nil && !errors.As(err, &imerrors.NotFoundError{}) {
+			return fmt.Errorf("deleting image: %s: %w", im.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (c Core) restoreCatalogOrder(ctx context.Context, order map[string][]string) (err error) {
+	for category, ids := range order {
+		if err = c.repoImageMeta.Reorder(ctx, category, ids); err != nil {
+			return fmt.Errorf("reordering category: %s: %w", category, err)
+		}
+	}
+
+	return nil
+}
+
+func (c Core) readOriginal(ctx context.Context, id string, buf *bytes.Buffer) (err error) {
+	f, err := c.fileStorage.Get(ctx, id)
+	if err != nil {
+		return fmt.Errorf("getting original: %s: %w", id, err)
+	}
+
+	defer func() { err = imerrors.ErrorPair(err, f.Close()) }()
+
+	if _, err = buf.ReadFrom(f); err != nil {
+		return fmt.Errorf("reading original: %s: %w", id, err)
+	}
+
+	return nil
+}
+
+func writeArchiveJSON(tw *tar.Writer, name string, modTime time.Time, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding %s: %w", name, err)
+	}
+
+	return writeArchiveFile(tw, name, modTime, data, nil)
+}
+
+func writeArchiveFile(
+	tw *tar.Writer,
+	name string,
+	modTime time.Time,
+	data []byte,
+	paxRecords map[string]string,
+) error {
+	const mode = 0o644
+
+	hdr := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       name,
+		Mode:       mode,
+		Size:       int64(len(data)),
+		ModTime:    modTime,
+		PAXRecords: paxRecords,
+		Format:     tar.FormatPAX,
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("writing header: %s: %w", name, err)
+	}
+
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("writing data: %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func readArchiveJSON(tr *tar.Reader, name string, v interface{}) error {
+	if err := nextArchiveEntry(tr, name); err != nil {
+		return err
+	}
+
+	if err := json.NewDecoder(tr).Decode(v); err != nil {
+		err = fmt.Errorf("decoding %s: %w", name, err)
+
+		return imerrors.NewUnprocessableEntity(err)
+	}
+
+	return nil
+}
+
+func readArchiveImages(tr *tar.Reader) (imageMetas map[string]imager.ImageMeta, err error) {
+	if err = nextArchiveEntry(tr, archiveImages); err != nil {
+		return nil, err
+	}
+
+	imageMetas = make(map[string]imager.ImageMeta)
+
+	scanner := bufio.NewScanner(tr)
+	scanner.Buffer(nil, archiveMaxLineSize)
+	for scanner.Scan() {
+		im, err := imager.RawImageMetaJSON(scanner.Bytes()).ImageMeta()
+		if err != nil {
+			return nil, imerrors.NewUnprocessableEntity(err)
+		}
+
+		imageMetas[im.ID] = im
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", archiveImages, err)
+	}
+
+	return imageMetas, nil
+}
+
+func nextArchiveEntry(tr *tar.Reader, name string) error {
+	hdr, err := tr.Next()
+	switch {
+	case errors.Is(err, io.EOF):
+		err = fmt.Errorf("%s not found", name)
+
+		return imerrors.NewUnprocessableEntity(err)
+	case err != nil:
+		return fmt.Errorf("reading archive: %w", err)
+	case hdr.Name != name:
+		err = fmt.Errorf("expected %s, got %s", name, hdr.Name)
+
+		return imerrors.NewUnprocessableEntity(err)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/picture"
+)
+
+const (
+	// paletteSize is a count of dominant colors of images.
+	paletteSize = 5
+
+	// chromaticMinSaturation and chromaticMinValue tell colors that
+	// have a hue from grays, blacks and whites.
+	chromaticMinSaturation = 0.2
+	chromaticMinValue      = 0.15
+)
+
+// Hues are named hues by their angle in degrees.
+// nolint: gochecknoglobals // Hues are immutable.
+var hues = []struct {
+	Name  string
+	Angle float64
+}{
+	{Name: "red", Angle: 0},
+	{Name: "orange", Angle: 30},
+	{Name: "yellow", Angle: 60},
+	{Name: "green", Angle: 120},
+	{Name: "cyan", Angle: 180},
+	{Name: "blue", Angle: 225},
+	{Name: "purple", Angle: 275},
+	{Name: "pink", Angle: 320},
+}
+
+// ImagePalette returns dominant colors of the image as they are stored
+// in the image meta.
+func ImagePalette(img image.Image) []imager.PaletteColor {
+	swatches := picture.Palette(img, paletteSize)
+
+	palette := make([]imager.PaletteColor, len(swatches))
+	for i, s := range swatches {
+		palette[i] = imager.PaletteColor{
+			Color:  fmt.Sprintf("#%02x%02x%02x", s.Color.R, s.Color.G, s.Color.B),
+			Weight: s.Weight,
+		}
+	}
+
+	return palette
+}
+
+// imageHue returns the name of the hue nearest to the most dominant
+// chromatic color of the image, it is empty if there is none.
+func imageHue(im imager.ImageMeta) string {
+	for _, pc := range im.Palette {
+		c, err := parseHexColor(pc.Color)
+		if err != nil {
+			continue
+		}
+
+		if h, ok := chromaticHue(c); ok {
+			return nearestHue(h)
+		}
+	}
+
+	return ""
+}
+
+// chromaticHue returns the hue of the color in degrees. It is false for
+// grays, blacks and whites.
+func chromaticHue(c color.NRGBA) (h float64, ok bool) {
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	delta := max - min
+
+	if max < chromaticMinValue || delta/max < chromaticMinSaturation {
+		return 0, false
+	}
+
+	switch max {
+	case r:
+		h = math.Mod((g-b)/delta, 6)
+	case g:
+		h = (b-r)/delta + 2
+	default:
+		h = (r-g)/delta + 4
+	}
+
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+
+	return h, true
+}
+
+// nearestHue returns the name of the hue closest to the angle.
+func nearestHue(angle float64) string {
+	var name string
+
+	minDistance := math.Inf(1)
+
+	for _, hue := range hues {
+		distance := math.Abs(angle - hue.Angle)
+		if distance > 180 {
+			distance = 360 - distance
+		}
+
+		if distance < minDistance {
+			name, minDistance = hue.Name, distance
+		}
+	}
+
+	return name
+}
+
+func knownHue(name string) bool {
+	for _, hue := range hues {
+		if hue.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hueNames() string {
+	names := make([]string, len(hues))
+	for i, hue := range hues {
+		names[i] = hue.Name
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func parseHexColor(s string) (c color.NRGBA, err error) {
+	c.A = math.MaxUint8
+
+	if _, err = fmt.Sscanf(s, "#%02x%02x%02x", &c.R, &c.G, &c.B); err != nil {
+		return color.NRGBA{}, fmt.Errorf("parsing color: %s: %w", s, err)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+)
+
+func TestImageHue(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Palette []imager.PaletteColor
+		Exp     string
+	}{{
+		Name:    "blue",
+		Palette: []imager.PaletteColor{{Color: "#1e90ff", Weight: 1}},
+		Exp:     "blue",
+	}, {
+		Name:    "red_wraps",
+		Palette: []imager.PaletteColor{{Color: "#ff0022", Weight: 1}},
+		Exp:     "red",
+	}, {
+		Name: "gray_skipped",
+		Palette: []imager.PaletteColor{
+			{Color: "#808080", Weight: 0.6},
+			{Color: "#20c040", Weight: 0.4},
+		},
+		Exp: "green",
+	}, {
+		Name: "achromatic",
+		Palette: []imager.PaletteColor{
+			{Color: "#000000", Weight: 0.5},
+			{Color: "#ffffff", Weight: 0.5},
+		},
+		Exp: "",
+	}, {
+		Name:    "invalid",
+		Palette: []imager.PaletteColor{{Color: "blue", Weight: 1}},
+		Exp:     "",
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			got := imageHue(imager.ImageMeta{Palette: tc.Palette})
+			if got != tc.Exp {
+				t.Fatal("exp", tc.Exp, "got", got)
+			}
+		})
+	}
+}
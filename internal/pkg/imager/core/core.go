@@ -3,13 +3,20 @@ package core
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/picture"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/jobs"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/validate"
@@ -17,7 +24,6 @@ import (
 	"github.com/go-playground/validator/v10"
 	"github.com/gomodule/redigo/redis"
 	"github.com/google/uuid"
-	"github.com/h2non/bimg"
 	"github.com/rs/zerolog"
 )
 
@@ -31,11 +37,20 @@ type Core struct {
 	healthCheckers []imager.Healther
 
 	buffersPool *sync.Pool
+	jobs        *jobs.Queue
+	watermark   *Watermark
+	variants    *Variants
 }
 
 // Essentials of the Core.
 type Essentials struct {
-	KVP *redis.Pool
+	KVP  *redis.Pool
+	Jobs *jobs.Queue
+	// Watermark is drawn over watermarked renditions, nil disables
+	// watermarks.
+	Watermark *Watermark
+	// Variants of renditions, nil disables variants.
+	Variants *Variants
 	repository.ImageMetaRepository
 	storage.FileStorage
 	*validator.Validate
@@ -43,7 +58,7 @@ type Essentials struct {
 
 // NewCore creates the application main API.
 func NewCore(es Essentials, cfg config.Core) *Core {
-	return &Core{
+	c := &Core{
 		repoImageMeta: es.ImageMetaRepository,
 		fileStorage:   es.FileStorage,
 		validate:      es.Validate,
@@ -53,23 +68,126 @@ func NewCore(es Essentials, cfg config.Core) *Core {
 				return new(bytes.Buffer)
 			},
 		},
+		jobs:      es.Jobs,
+		watermark: es.Watermark,
+		variants:  es.Variants,
 		healthCheckers: []imager.Healther{
 			es.FileStorage,
 			redisHealthChecker{KVP: es.KVP},
 		},
 	}
+
+	es.Jobs.Handle(JobRenderImage, c.HandleRenderJob)
+
+	return c
+}
+
+// DuplicatePolicy tells what to do with uploads of known content.
+type DuplicatePolicy string
+
+// Duplicate policies.
+const (
+	// DuplicatesReject rejects the upload with DuplicateError.
+	DuplicatesReject DuplicatePolicy = "reject"
+	// DuplicatesShare saves the image meta, but the original is stored
+	// once and shared by both images.
+	DuplicatesShare DuplicatePolicy = "share"
+)
+
+// contentTypeUndeclared is sent by clients that do not know the type of
+// the file.
+const contentTypeUndeclared = "application/octet-stream"
+
+// objectIDPrefix is a prefix of ids of originals addressed by their
+// content. It is longer than max image id, so they never collide.
+const objectIDPrefix = "sha256-"
+
+// DuplicateError means that the uploaded content is already stored as
+// another image or the image is similar to another one.
+type DuplicateError struct {
+	// ImageID is an id of the existing image.
+	ImageID string
+	// Distance between perceptual hashes, it is zero for the same
+	// content.
+	Distance int
+}
+
+func (err DuplicateError) Error() string {
+	if err.Distance > 0 {
+		return fmt.Sprintf("similar image exists: %s, distance %d", err.ImageID, err.Distance)
+	}
+
+	return "image content already exists: " + err.ImageID
 }
 
-// UploadImage saves original image to storage.
+// UploadOptions of the image. Default policies are taken from the
+// config.
+type UploadOptions struct {
+	// Duplicates is a policy for known content.
+	Duplicates DuplicatePolicy
+	// NearDuplicates is a policy for images similar to known ones.
+	NearDuplicates NearDuplicatePolicy
+	// KeepContent skips the normalization and the check of the min
+	// resolution, it is used by the import of already stored images.
+	KeepContent bool
+	// ContentMD5 is an optional base64 encoded MD5 of the body as in the
+	// Content-MD5 header.
+	ContentMD5 string
+	// ContentSHA256 is an optional hex encoded SHA-256 of the body.
+	ContentSHA256 string
+}
+
+// UploadResult is the saved image meta.
+type UploadResult struct {
+	imager.ImageMeta
+
+	// NearDuplicates are ids of similar images.
+	NearDuplicates []string `json:"near_duplicates,omitempty"`
+}
+
+// UploadImage saves original image to storage. Size, dimensions and
+// checksum are taken from the data. Timestamps are kept if they are
+// set, it is used by the import.
 func (c Core) UploadImage(
 	ctx context.Context,
 	im imager.ImageMeta,
 	r io.Reader,
-) (newIM imager.ImageMeta, err error) {
+	opts UploadOptions,
+) (res UploadResult, err error) {
+	res, err = c.stageImage(ctx, im, r, opts, false)
+	if err != nil {
+		return res, err
+	}
+
+	if err = c.insertImage(ctx, res.ImageMeta); err != nil {
+		return UploadResult{ImageMeta: res.ImageMeta}, err
+	}
+
+	return res, nil
+}
+
+// stageImage checks the image and stores its original, the meta is not
+// inserted. The image with the id can exist if replace is set. The
+// original should be released if the image is not inserted.
+func (c Core) stageImage(
+	ctx context.Context,
+	im imager.ImageMeta,
+	r io.Reader,
+	opts UploadOptions,
+	replace bool,
+) (res UploadResult, err error) {
 	if im.ID == "" {
 		im.ID = uuid.NewString()
 	}
 
+	if opts.Duplicates == "" {
+		opts.Duplicates = DuplicatePolicy(c.cfg.Duplicates)
+	}
+
+	if opts.NearDuplicates == "" {
+		opts.NearDuplicates = NearDuplicatePolicy(c.cfg.NearDuplicates)
+	}
+
 	l := zerolog.Ctx(ctx)
 	l.Debug().
 		Str("image_id", im.ID).
@@ -81,41 +199,160 @@ func (c Core) UploadImage(
 			fmt.Sprintf("max allowed image size is %d", c.cfg.MaxImageSize),
 		)
 
-		return im, imerrors.NewOversizeError(err)
+		return UploadResult{ImageMeta: im}, imerrors.NewOversizeError(err)
 	}
 
 	if err = c.validate.Struct(&im); err != nil {
 		err = fmt.Errorf("validating image meta: %w", err)
 
-		return im, imerrors.NewUnprocessableEntity(err)
+		return UploadResult{ImageMeta: im}, imerrors.NewUnprocessableEntity(err)
+	}
+
+	if im.MIMEType != contentTypeUndeclared {
+		err = validate.ContentType(im.MIMEType, c.cfg.ImageContentTypes)
+		if err != nil {
+			err = fmt.Errorf("validating content-type: %w", err)
+
+			return UploadResult{ImageMeta: im}, imerrors.NewMediaTypeError(err)
+		}
 	}
 
-	err = validate.ContentType(im.MIMEType, c.cfg.ImageContentTypes)
+	err = c.validate.Var(string(opts.Duplicates), "oneof=reject share")
 	if err != nil {
-		err = fmt.Errorf("validating content-type: %w", err)
+		err = fmt.Errorf("validating duplicates: %w", err)
 
-		return im, imerrors.NewMediaTypeError(err)
+		return UploadResult{ImageMeta: im}, imerrors.NewUnprocessableEntity(err)
 	}
 
-	found, err := c.repoImageMeta.Exists(ctx, im.ID)
+	err = c.validate.Var(string(opts.NearDuplicates), "oneof=warn reject")
+	if err != nil {
+		err = fmt.Errorf("validating near duplicates: %w", err)
+
+		return UploadResult{ImageMeta: im}, imerrors.NewUnprocessableEntity(err)
+	}
+
+	err = c.validate.Var(opts.ContentMD5, "omitempty,base64,len=24")
+	if err != nil {
+		err = fmt.Errorf("validating content md5: %w", err)
+
+		return UploadResult{ImageMeta: im}, imerrors.NewUnprocessableEntity(err)
+	}
+
+	err = c.validate.Var(opts.ContentSHA256, "omitempty,hexadecimal,len=64")
+	if err != nil {
+		err = fmt.Errorf("validating content sha256: %w", err)
+
+		return UploadResult{ImageMeta: im}, imerrors.NewUnprocessableEntity(err)
+	}
+
+	if !replace {
+		found, err := c.repoImageMeta.Exists(ctx, im.ID)
+		switch {
+		case err != nil:
+			return UploadResult{ImageMeta: im}, fmt.Errorf("checking id: %w", err)
+		case found:
+			return UploadResult{ImageMeta: im}, imerrors.NewConflictError(imerrors.Error("id already found"))
+		}
+	}
+
+	buf := c.buffersPool.Get().(*bytes.Buffer)
+	defer c.buffersPool.Put(buf)
+	buf.Reset()
+
+	// One more byte is read to detect the exceeded limit.
+	n, err := buf.ReadFrom(io.LimitReader(r, c.cfg.MaxImageSize+1))
 	switch {
 	case err != nil:
-		return im, fmt.Errorf("checking id: %w", err)
-	case found:
-		return im, imerrors.NewConflictError(imerrors.Error("id already found"))
+		return UploadResult{ImageMeta: im}, fmt.Errorf("reading image: %w", err)
+	case n > c.cfg.MaxImageSize:
+		err = imerrors.Error(
+			fmt.Sprintf("max allowed image size is %d", c.cfg.MaxImageSize),
+		)
+
+		return UploadResult{ImageMeta: im}, imerrors.NewOversizeError(err)
+	case n != im.Size:
+		err = fmt.Errorf("declared size %d, received %d", im.Size, n)
+
+		return UploadResult{ImageMeta: im}, imerrors.NewOversizeError(err)
 	}
 
-	r = io.LimitReader(r, c.cfg.MaxImageSize)
+	data := buf.Bytes()
+	if err = verifyDigests(data, opts); err != nil {
+		return UploadResult{ImageMeta: im}, imerrors.NewBadRequestError(err)
+	}
 
-	if err = c.fileStorage.Upload(ctx, im, r); err != nil {
-		return im, fmt.Errorf("uploading file: %w", err)
+	if err = c.describeImage(&im, data); err != nil {
+		return UploadResult{ImageMeta: im}, err
 	}
 
+	// Imported images could be uploaded before the rule was added.
+	if !opts.KeepContent {
+		err = validate.Resolution(im.Width, im.Height, c.cfg.SupportedImageSizes)
+		if err != nil {
+			err = fmt.Errorf("validating resolution: %w", err)
+
+			return UploadResult{ImageMeta: im}, imerrors.NewUnprocessableEntity(err)
+		}
+	}
+
+	var source []byte
+	if c.cfg.NormalizeImages && !opts.KeepContent {
+		source = data
+
+		data, err = c.normalizeImage(ctx, source)
+		if err != nil {
+			return UploadResult{ImageMeta: im}, fmt.Errorf("normalizing image: %w", err)
+		}
+
+		if err = c.describeImage(&im, data); err != nil {
+			return UploadResult{ImageMeta: im}, fmt.Errorf("describing normalized image: %w", err)
+		}
+
+		if !c.cfg.KeepSources {
+			source = nil
+		}
+	}
+
+	now := time.Now().UTC()
+	if im.CreatedAt.IsZero() {
+		im.CreatedAt = now
+	}
+
+	if im.UpdatedAt.IsZero() {
+		im.UpdatedAt = now
+	}
+
+	sameIDs, err := c.repoImageMeta.FindByChecksum(ctx, im.SHA256)
+	if err != nil {
+		return UploadResult{ImageMeta: im}, fmt.Errorf("finding by checksum: %w", err)
+	}
+
+	nearIDs, err := c.checkNearDuplicates(ctx, im, sameIDs, opts.NearDuplicates)
+	if err != nil {
+		return UploadResult{ImageMeta: im}, err
+	}
+
+	err = c.storeOriginal(ctx, &im, data, source, sameIDs, opts.Duplicates)
+	if err != nil {
+		return UploadResult{ImageMeta: im}, err
+	}
+
+	return UploadResult{
+		ImageMeta:      im,
+		NearDuplicates: nearIDs,
+	}, nil
+}
+
+// insertImage inserts the meta of the staged image. The original is
+// released if it fails.
+func (c Core) insertImage(ctx context.Context, im imager.ImageMeta) (err error) {
+	l := zerolog.Ctx(ctx)
+
 	err = c.repoImageMeta.Insert(ctx, im)
 	if err != nil {
 		err = fmt.Errorf("inseting meta info: %w", err)
 
-		if derr := c.fileStorage.Delete(ctx, im.ID); derr != nil {
+		if derr := c.releaseOriginal(ctx, im); derr != nil {
 			derr = fmt.Errorf("deleting file: %w", derr)
 			err = imerrors.ErrorPair(err, derr)
 
@@ -123,96 +360,252 @@ func (c Core) UploadImage(
 				Msg("failed to rollback file upload")
 		}
 
-		return im, fmt.Errorf("inserting meta: %w", err)
+		return fmt.Errorf("inserting meta: %w", err)
 	}
 
-	return im, nil
+	if c.cfg.RenderOnUpload {
+		// Renditions are rendered on demand if it fails.
+		if err = c.enqueueRendering(ctx, im.ID); err != nil {
+			l.Warn().Err(err).Str("image_id", im.ID).Msg("enqueueing rendering")
+		}
+	}
+
+	return nil
 }
 
-// DeleteImage from a database and a storage.
-func (c Core) DeleteImage(ctx context.Context, id string) (err error) {
-	if err = c.validate.Var(id, "image_id"); err != nil {
-		err = fmt.Errorf("validating image_id: %w", err)
+// verifyDigests compares digests of the received data with the expected
+// ones, if they are set.
+func verifyDigests(data []byte, opts UploadOptions) (err error) {
+	if opts.ContentMD5 != "" {
+		// nolint: gosec // It is a checksum of the transfer.
+		sum := md5.Sum(data)
+		if got := base64.StdEncoding.EncodeToString(sum[:]); got != opts.ContentMD5 {
+			return fmt.Errorf("content md5 mismatch: expected %s, got %s", opts.ContentMD5, got)
+		}
+	}
+
+	if opts.ContentSHA256 != "" {
+		if got := picture.Checksum(data); got != strings.ToLower(opts.ContentSHA256) {
+			return fmt.Errorf("content sha256 mismatch: expected %s, got %s", opts.ContentSHA256, got)
+		}
+	}
+
+	return nil
+}
+
+// describeImage checks that the data is an image of the declared type
+// and fills the image meta with details of the original. If the type is
+// not declared, the detected one is used.
+func (c Core) describeImage(im *imager.ImageMeta, data []byte) (err error) {
+	contentType := picture.DetectContentType(data)
+	switch contentType {
+	case "":
+		err = imerrors.Error("data is not an image")
 
 		return imerrors.NewUnprocessableEntity(err)
+	case im.MIMEType:
+	default:
+		if im.MIMEType != contentTypeUndeclared {
+			err = fmt.Errorf("declared %s, detected %s", im.MIMEType, contentType)
+
+			return imerrors.NewMediaTypeError(err)
+		}
+
+		err = validate.ContentType(contentType, c.cfg.ImageContentTypes)
+		if err != nil {
+			err = fmt.Errorf("validating detected content-type: %w", err)
+
+			return imerrors.NewMediaTypeError(err)
+		}
+
+		im.MIMEType = contentType
 	}
 
-	found, err := c.repoImageMeta.Exists(ctx, id)
+	hdr, err := picture.DecodeHeader(data)
 	switch {
 	case err != nil:
-		return fmt.Errorf("exists: %w", err)
-	case !found:
-		return imerrors.NewNotFoundError(imerrors.Error("image not found"))
+		err = fmt.Errorf("decoding image header: %w", err)
+
+		return imerrors.NewUnprocessableEntity(err)
+	case hdr.ContentType() != contentType:
+		err = fmt.Errorf("detected %s, decoded %s", contentType, hdr.ContentType())
+
+		return imerrors.NewMediaTypeError(err)
 	}
 
-	err = c.fileStorage.Delete(ctx, id)
+	// The header is checked before decoding, so the image does not
+	// exhaust memory.
+	if err = c.validateDimensions(hdr); err != nil {
+		return imerrors.NewOversizeError(err)
+	}
+
+	img, err := picture.Decode(data)
 	if err != nil {
-		return fmt.Errorf("deleting image from file storage: %w", err)
+		return imerrors.NewUnprocessableEntity(err)
 	}
 
-	err = c.repoImageMeta.Delete(ctx, id)
+	im.Size = int64(len(data))
+	// Renditions, crops and the focal point are in oriented pixels.
+	im.Width, im.Height = hdr.OrientedSize()
+	im.SHA256 = picture.Checksum(data)
+	im.DHash = picture.FormatHash(picture.DHash(img))
+	im.BlurHash = picture.BlurHash(img)
+	im.Palette = ImagePalette(img)
+	im.Difficulty, im.GridDifficulty = c.imageDifficulty(img)
+
+	im.LQIP, err = picture.LQIP(img)
 	if err != nil {
-		return fmt.Errorf("deleting image from database: %w", err)
+		return fmt.Errorf("making placeholder: %w", err)
+	}
+
+	return nil
+}
+
+// validateDimensions checks the decoded header against configured
+// limits.
+func (c Core) validateDimensions(hdr picture.Header) (err error) {
+	err = validate.Dimensions(
+		hdr.Width,
+		hdr.Height,
+		c.cfg.MaxImageWidth,
+		c.cfg.MaxImageHeight,
+		c.cfg.MaxImagePixels,
+	)
+	if err != nil {
+		return fmt.Errorf("validating dimensions: %w", err)
 	}
 
 	return nil
 }
 
-// GetImage downloads image, resizes it and returns its body.
-func (c Core) GetImage(
+// storeOriginal uploads the original by its content, sets ObjectID of
+// the image and references it. If the content is already stored by
+// images with sameIDs, the original is shared or DuplicateError is
+// returned, it depends on the policy. The source is uploaded along with
+// the new original if it is not nil. The reference should be released
+// by releaseOriginal if the image is not inserted.
+func (c Core) storeOriginal(
 	ctx context.Context,
-	id string,
-	size imager.ImageSize,
-) (f storage.File, err error) {
-	cacheID := id + ":" + string(size)
+	im *imager.ImageMeta,
+	data []byte,
+	source []byte,
+	sameIDs []string,
+	duplicates DuplicatePolicy,
+) (err error) {
+	im.SourceID = ""
+
+	for _, id := range sameIDs {
+		existing, err := c.repoImageMeta.Get(ctx, id)
+		switch {
+		case errors.As(err, &imerrors.NotFoundError{}):
+			// It was deleted concurrently.
+			continue
+		case err != nil:
+			return fmt.Errorf("getting existing image: %w", err)
+		case duplicates == DuplicatesReject:
+			return imerrors.NewConflictError(DuplicateError{ImageID: id})
+		}
 
-	l := zerolog.Ctx(ctx)
-	l.Debug().
-		Str("image_id", id).
-		Str("cache_id", cacheID).
-		Str("image_size", string(size)).
-		Msg("getting image")
+		found, err := c.repoImageMeta.AcquireObject(ctx, existing.StorageID(), true)
+		switch {
+		case err != nil:
+			return fmt.Errorf("acquiring existing original: %w", err)
+		case !found:
+			// It was released concurrently.
+			continue
+		}
 
-	err = validate.ImageSize(size, c.cfg.SupportedImageSizes)
-	if err != nil {
-		err = fmt.Errorf("size: %w", err)
+		im.ObjectID = existing.StorageID()
+		im.SourceID = existing.SourceID
 
-		return storage.File{}, imerrors.NewUnprocessableEntity(err)
+		return nil
 	}
 
-	if err = c.validate.Var(id, "image_id"); err != nil {
-		err = fmt.Errorf("validating image_id: %w", err)
+	im.ObjectID = objectIDPrefix + im.SHA256
+
+	if _, err = c.repoImageMeta.AcquireObject(ctx, im.ObjectID, false); err != nil {
+		return fmt.Errorf("acquiring original: %w", err)
+	}
+
+	// The content is the same if the original is referenced
+	// concurrently, so it is uploaded anyway.
+	obj := *im
+	obj.ID = im.ObjectID
+
+	err = c.fileStorage.Upload(ctx, obj, bytes.NewReader(data))
+	if err == nil && source != nil {
+		obj.ID = sourceIDPrefix + im.ObjectID
+		obj.Size = int64(len(source))
 
-		return storage.File{}, imerrors.NewUnprocessableEntity(err)
+		im.SourceID = obj.ID
+
+		err = c.fileStorage.Upload(ctx, obj, bytes.NewReader(source))
 	}
 
-	f, err = c.fileStorage.Get(ctx, id)
 	if err != nil {
-		return storage.File{}, fmt.Errorf("getting image from storage: %w", err)
+		err = fmt.Errorf("uploading file: %w", err)
+
+		if derr := c.releaseOriginal(ctx, *im); derr != nil {
+			err = imerrors.ErrorPair(err, fmt.Errorf("releasing original: %w", derr))
+		}
+
+		return err
 	}
 
-	buf := c.buffersPool.Get().(*bytes.Buffer)
-	defer c.buffersPool.Put(buf)
-	buf.Reset()
+	return nil
+}
 
-	_, err = buf.ReadFrom(f)
-	if err != nil {
-		return storage.File{}, fmt.Errorf("reading image: %w", err)
+// releaseOriginal removes the reference of the image to the original.
+// The original, its renditions and the source are deleted with the last
+// reference.
+func (c Core) releaseOriginal(ctx context.Context, im imager.ImageMeta) (err error) {
+	last, err := c.repoImageMeta.ReleaseObject(ctx, im.StorageID())
+	if err != nil || !last {
+		return err
 	}
 
-	imgData := buf.Bytes()
+	// The upload of the original can fail before it is stored.
+	err = c.fileStorage.Delete(ctx, im.StorageID())
+	if err != nil && !errors.As(err, &imerrors.NotFoundError{}) {
+		return err
+	}
 
-	width, height := size.Size()
-	img := bimg.NewImage(imgData)
+	if err = c.deleteRenditions(ctx, im); err != nil {
+		return err
+	}
 
-	resizedImgData, err := img.ResizeAndCrop(width, height)
+	if err = c.deleteSource(ctx, im); err != nil {
+		return err
+	}
+
+	return c.repoImageMeta.DeletedObject(ctx, im.StorageID())
+}
+
+// DeleteImage from a database and a storage. The original is kept
+// while other images share it.
+func (c Core) DeleteImage(ctx context.Context, id string) (err error) {
+	if err = c.validate.Var(id, "image_id"); err != nil {
+		err = fmt.Errorf("validating image_id: %w", err)
+
+		return imerrors.NewUnprocessableEntity(err)
+	}
+
+	im, err := c.repoImageMeta.Get(ctx, id)
 	if err != nil {
-		return storage.File{}, fmt.Errorf("resizing image: %w", err)
+		return fmt.Errorf("getting image: %w", err)
+	}
+
+	err = c.repoImageMeta.Delete(ctx, id)
+	if err != nil {
+		return fmt.Errorf("deleting image from database: %w", err)
 	}
 
-	f.ReadCloser = io.NopCloser(bytes.NewReader(resizedImgData))
+	err = c.releaseOriginal(ctx, im)
+	if err != nil {
+		return fmt.Errorf("deleting image from file storage: %w", err)
+	}
 
-	return f, nil
+	return nil
 }
 
 // ListCategories returns all known categories.
@@ -264,6 +657,17 @@ func (c Core) ListImages(
 	return c.repoImageMeta.List(ctx, category, pagination)
 }
 
+// GetImageMeta returns details of the image.
+func (c Core) GetImageMeta(ctx context.Context, id string) (im imager.ImageMeta, err error) {
+	if err = c.validate.Var(id, "image_id"); err != nil {
+		err = fmt.Errorf("validating image_id: %w", err)
+
+		return imager.ImageMeta{}, imerrors.NewUnprocessableEntity(err)
+	}
+
+	return c.repoImageMeta.Get(ctx, id)
+}
+
 // Health checks health of Redis and S3.
 func (c Core) Health(ctx context.Context) (err error) {
 	for _, h := range c.healthCheckers {
@@ -5,18 +5,28 @@ package core_test
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"image"
 	"image/color"
 	"image/jpeg"
+	"io"
 	"math"
+	"math/rand"
+	"strings"
 	"testing"
 
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/core"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/jobs"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository/imredis"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage/s3"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/test"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/validate"
@@ -33,17 +43,40 @@ const (
 func newTestCore(tb testing.TB) (c *core.Core, close func(tb testing.TB)) {
 	tb.Helper()
 
+	return newTestCoreConfig(tb, func(*config.Core) {})
+}
+
+func newTestCoreConfig(
+	tb testing.TB,
+	configure func(cfg *config.Core),
+) (c *core.Core, close func(tb testing.TB)) {
+	tb.Helper()
+
 	cfg := test.LoadConfig(tb)
 	cfg.ImageContentTypes = append(cfg.ImageContentTypes, contentType)
-	cfg.SupportedImageSizes = append(cfg.SupportedImageSizes, imageSize)
+	// Test images are smaller than default sizes.
+	cfg.SupportedImageSizes = []imager.ImageSize{imageSize}
+	configure(&cfg.Core)
 
 	kvp := test.InitKVP(tb)
 
 	s3, err := s3.NewStorage(cfg.S3)
 	test.AssertErrNil(tb, err)
 
+	queue, err := jobs.NewQueue(jobs.Essentials{KVP: kvp}, cfg.Jobs)
+	test.AssertErrNil(tb, err)
+
+	watermark, err := core.NewWatermark(cfg.Core)
+	test.AssertErrNil(tb, err)
+
+	variants, err := core.NewVariants(cfg.Core)
+	test.AssertErrNil(tb, err)
+
 	c = core.NewCore(core.Essentials{
 		KVP:                 kvp,
+		Jobs:                queue,
+		Watermark:           watermark,
+		Variants:            variants,
 		ImageMetaRepository: imredis.NewImageMetaRepository(kvp),
 		FileStorage:         s3,
 		Validate:            validate.New(),
@@ -128,7 +161,7 @@ func TestUploadImage(t *testing.T) {
 			}
 			tc.Meta(&im)
 
-			_, err := c.UploadImage(ctx, im, bytes.NewReader(imageBytes))
+			_, err := c.UploadImage(ctx, im, bytes.NewReader(imageBytes), core.UploadOptions{})
 			switch {
 			case tc.ErrTarget == nil:
 				test.AssertErrNil(t, err)
@@ -139,6 +172,478 @@ func TestUploadImage(t *testing.T) {
 	}
 }
 
+func TestUploadImage_integrity(t *testing.T) {
+	c, close := newTestCore(t)
+	defer close(t)
+
+	imageBytes := getTestImageBytes(t)
+	size := int64(len(imageBytes))
+
+	md5Sum := md5.Sum(imageBytes)
+	contentMD5 := base64.StdEncoding.EncodeToString(md5Sum[:])
+	sha256Sum := sha256.Sum256(imageBytes)
+	contentSHA256 := hex.EncodeToString(sha256Sum[:])
+
+	testCases := []struct {
+		Name      string
+		Size      int64
+		Options   core.UploadOptions
+		ErrTarget interface{}
+	}{{
+		Name: "ok",
+		Size: size,
+		Options: core.UploadOptions{
+			ContentMD5:    contentMD5,
+			ContentSHA256: contentSHA256,
+		},
+		ErrTarget: nil,
+	}, {
+		Name:      "under_reported",
+		Size:      size - 1,
+		ErrTarget: &imerrors.OversizeError{},
+	}, {
+		Name:      "over_reported",
+		Size:      size + 1,
+		ErrTarget: &imerrors.OversizeError{},
+	}, {
+		Name:      "md5_mismatch",
+		Size:      size,
+		Options:   core.UploadOptions{ContentMD5: base64.StdEncoding.EncodeToString(make([]byte, 16))},
+		ErrTarget: &imerrors.BadRequestError{},
+	}, {
+		Name:      "sha256_mismatch",
+		Size:      size,
+		Options:   core.UploadOptions{ContentSHA256: strings.Repeat("0", 64)},
+		ErrTarget: &imerrors.BadRequestError{},
+	}, {
+		Name:      "invalid_md5",
+		Size:      size,
+		Options:   core.UploadOptions{ContentMD5: "invalid"},
+		ErrTarget: &imerrors.UnprocessableEntity{},
+	}}
+
+	ctx := context.Background()
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			res, err := c.UploadImage(ctx, imager.ImageMeta{
+				Author:    "author",
+				WEBSource: "localhost",
+				MIMEType:  contentType,
+				Size:      tc.Size,
+				Category:  "test",
+			}, bytes.NewReader(imageBytes), tc.Options)
+			switch {
+			case tc.ErrTarget == nil:
+				test.AssertErrNil(t, err)
+				test.AssertErrNil(t, c.DeleteImage(ctx, res.ID))
+			case !errors.As(err, tc.ErrTarget):
+				t.Fatal("exp", tc.ErrTarget, "got", err)
+			}
+		})
+	}
+}
+
+func TestUploadImage_details(t *testing.T) {
+	c, close := newTestCore(t)
+	defer close(t)
+
+	imageBytes := getTestImageBytes(t)
+	width, height := imageSize.Size()
+
+	ctx := context.Background()
+
+	im, err := c.UploadImage(ctx, imager.ImageMeta{
+		Author:    "author",
+		WEBSource: "localhost",
+		MIMEType:  contentType,
+		Size:      int64(len(imageBytes)),
+		Category:  "test",
+		Uploader:  "test_uploader",
+	}, bytes.NewReader(imageBytes), core.UploadOptions{})
+	test.AssertErrNil(t, err)
+
+	sum := sha256.Sum256(imageBytes)
+
+	switch {
+	case im.Width != width*2 || im.Height != height*2:
+		t.Fatal("exp", width*2, height*2, "got", im.Width, im.Height)
+	case im.Size != int64(len(imageBytes)):
+		t.Fatal("exp", len(imageBytes), "got", im.Size)
+	case im.SHA256 != hex.EncodeToString(sum[:]):
+		t.Fatal("unexpected checksum", im.SHA256)
+	case im.Uploader != "test_uploader":
+		t.Fatal("exp test_uploader, got", im.Uploader)
+	case im.CreatedAt.IsZero() || !im.UpdatedAt.Equal(im.CreatedAt):
+		t.Fatal("unexpected timestamps", im.CreatedAt, im.UpdatedAt)
+	}
+
+	t.Run("undecodable", func(t *testing.T) {
+		data := []byte("not an image")
+
+		_, err := c.UploadImage(ctx, imager.ImageMeta{
+			Author:    "author",
+			WEBSource: "localhost",
+			MIMEType:  contentType,
+			Size:      int64(len(data)),
+			Category:  "test",
+		}, bytes.NewReader(data), core.UploadOptions{})
+		if !errors.As(err, &imerrors.UnprocessableEntity{}) {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestUploadImage_content(t *testing.T) {
+	c, close := newTestCore(t)
+	defer close(t)
+
+	imageBytes := getTestImageBytes(t)
+
+	testCases := []struct {
+		Name      string
+		MIMEType  string
+		Data      []byte
+		ErrTarget interface{}
+	}{{
+		Name:      "declared_png",
+		MIMEType:  "image/png",
+		Data:      imageBytes,
+		ErrTarget: &imerrors.MediaTypeError{},
+	}, {
+		Name:      "undeclared",
+		MIMEType:  "application/octet-stream",
+		Data:      []byte("<html></html>"),
+		ErrTarget: &imerrors.UnprocessableEntity{},
+	}, {
+		Name:      "truncated",
+		MIMEType:  contentType,
+		Data:      imageBytes[:len(imageBytes)/2],
+		ErrTarget: &imerrors.UnprocessableEntity{},
+	}, {
+		Name:      "not_image",
+		MIMEType:  contentType,
+		Data:      []byte("<html></html>"),
+		ErrTarget: &imerrors.UnprocessableEntity{},
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := c.UploadImage(context.Background(), imager.ImageMeta{
+				Author:    "author",
+				WEBSource: "localhost",
+				MIMEType:  tc.MIMEType,
+				Size:      int64(len(tc.Data)),
+				Category:  "test",
+			}, bytes.NewReader(tc.Data), core.UploadOptions{})
+			if !errors.As(err, tc.ErrTarget) {
+				t.Fatal("exp", tc.ErrTarget, "got", err)
+			}
+		})
+	}
+}
+
+func TestUploadImage_dimensions(t *testing.T) {
+	width, height := imageSize.Size()
+
+	testCases := []struct {
+		Name      string
+		Configure func(cfg *config.Core)
+		Width     int
+		Height    int
+		ErrTarget interface{}
+	}{{
+		Name:      "ok",
+		Configure: func(cfg *config.Core) {},
+		Width:     width,
+		Height:    height,
+		ErrTarget: nil,
+	}, {
+		Name:      "too_small",
+		Configure: func(cfg *config.Core) {},
+		Width:     width,
+		Height:    height - 1,
+		ErrTarget: &imerrors.UnprocessableEntity{},
+	}, {
+		Name:      "max_width",
+		Configure: func(cfg *config.Core) { cfg.MaxImageWidth = width },
+		Width:     width + 1,
+		Height:    height,
+		ErrTarget: &imerrors.OversizeError{},
+	}, {
+		Name:      "max_height",
+		Configure: func(cfg *config.Core) { cfg.MaxImageHeight = height },
+		Width:     width,
+		Height:    height + 1,
+		ErrTarget: &imerrors.OversizeError{},
+	}, {
+		Name:      "max_pixels",
+		Configure: func(cfg *config.Core) { cfg.MaxImagePixels = int64(width * height) },
+		Width:     width + 1,
+		Height:    height + 1,
+		ErrTarget: &imerrors.OversizeError{},
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			c, close := newTestCoreConfig(t, tc.Configure)
+			defer close(t)
+
+			var imageData bytes.Buffer
+			img := image.NewGray(image.Rect(0, 0, tc.Width, tc.Height))
+			err := jpeg.Encode(&imageData, img, nil)
+			test.AssertErrNil(t, err)
+
+			ctx := context.Background()
+
+			im, err := c.UploadImage(ctx, imager.ImageMeta{
+				Author:    "author",
+				WEBSource: "localhost",
+				MIMEType:  contentType,
+				Size:      int64(imageData.Len()),
+				Category:  "test",
+			}, &imageData, core.UploadOptions{Duplicates: core.DuplicatesShare})
+			switch {
+			case tc.ErrTarget == nil:
+				test.AssertErrNil(t, err)
+				test.AssertErrNil(t, c.DeleteImage(ctx, im.ID))
+			case !errors.As(err, tc.ErrTarget):
+				t.Fatal("exp", tc.ErrTarget, "got", err)
+			}
+		})
+	}
+}
+
+// withOrientation inserts EXIF with the orientation tag into the JPEG.
+func withOrientation(data []byte, orientation uint16) []byte {
+	tiff := []byte{
+		'I', 'I', 42, 0, // Little endian header.
+		8, 0, 0, 0, // Offset of IFD0.
+		1, 0, // Entries count.
+		0x12, 0x01, 3, 0, 1, 0, 0, 0, // Orientation, SHORT, 1 value.
+		byte(orientation), byte(orientation >> 8), 0, 0,
+		0, 0, 0, 0, // No next IFD.
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	length := len(payload) + 2
+
+	app1 := append([]byte{0xFF, 0xE1, byte(length >> 8), byte(length)}, payload...)
+
+	// After SOI marker.
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+func TestUploadImage_normalize(t *testing.T) {
+	c, close := newTestCoreConfig(t, func(cfg *config.Core) {
+		cfg.NormalizeImages = true
+		cfg.KeepSources = true
+	})
+	defer close(t)
+
+	width, height := imageSize.Size()
+
+	var imageData bytes.Buffer
+	img := image.NewGray(image.Rect(0, 0, width*2, height))
+	err := jpeg.Encode(&imageData, img, nil)
+	test.AssertErrNil(t, err)
+
+	// Rotated by 90 degrees clockwise.
+	data := withOrientation(imageData.Bytes(), 6)
+
+	ctx := context.Background()
+
+	im, err := c.UploadImage(ctx, imager.ImageMeta{
+		Author:    "author",
+		WEBSource: "localhost",
+		MIMEType:  contentType,
+		Size:      int64(len(data)),
+		Category:  "test",
+	}, bytes.NewReader(data), core.UploadOptions{})
+	test.AssertErrNil(t, err)
+	defer func() { test.AssertErrNil(t, c.DeleteImage(ctx, im.ID)) }()
+
+	sum := sha256.Sum256(data)
+
+	switch {
+	case im.Width != width || im.Height != height*2:
+		t.Fatal("exp", width, height*2, "got", im.Width, im.Height)
+	case im.SHA256 == hex.EncodeToString(sum[:]):
+		t.Fatal("image is not normalized")
+	case im.SourceID != "source-"+im.ObjectID:
+		t.Fatal("unexpected source id", im.SourceID)
+	}
+}
+
+func TestUploadImage_duplicates(t *testing.T) {
+	c, close := newTestCore(t)
+	defer close(t)
+
+	// The content is unique, so other tests do not share it.
+	var imageData bytes.Buffer
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	copy(img.Pix, uuid.New().String())
+	err := jpeg.Encode(&imageData, img, nil)
+	test.AssertErrNil(t, err)
+
+	imageBytes := imageData.Bytes()
+
+	ctx := context.Background()
+
+	upload := func(duplicates core.DuplicatePolicy) (core.UploadResult, error) {
+		return c.UploadImage(ctx, imager.ImageMeta{
+			Author:    "author",
+			WEBSource: "localhost",
+			MIMEType:  contentType,
+			Size:      int64(len(imageBytes)),
+			Category:  "test",
+		}, bytes.NewReader(imageBytes), core.UploadOptions{
+			Duplicates: duplicates,
+		})
+	}
+
+	first, err := upload(core.DuplicatesReject)
+	test.AssertErrNil(t, err)
+
+	_, err = upload(core.DuplicatesReject)
+
+	var dupErr core.DuplicateError
+	switch {
+	case !errors.As(err, &imerrors.ConflictError{}):
+		t.Fatal(err)
+	case !errors.As(err, &dupErr):
+		t.Fatal(err)
+	case dupErr.ImageID != first.ID:
+		t.Fatal("exp", first.ID, "got", dupErr.ImageID)
+	}
+
+	second, err := upload(core.DuplicatesShare)
+	test.AssertErrNil(t, err)
+
+	if second.ObjectID != first.ObjectID {
+		t.Fatal("exp", first.ObjectID, "got", second.ObjectID)
+	}
+
+	_, err = upload("unknown")
+	if !errors.As(err, &imerrors.UnprocessableEntity{}) {
+		t.Fatal(err)
+	}
+
+	// The original is still used by the second image.
+	test.AssertErrNil(t, c.DeleteImage(ctx, first.ID))
+
+	f, err := c.GetImage(ctx, second.ID, imageSize)
+	test.AssertErrNil(t, err)
+	test.AssertErrNil(t, f.Close())
+
+	test.AssertErrNil(t, c.DeleteImage(ctx, second.ID))
+}
+
+// getRandomTestImage returns an image of random blocks, so it is not
+// similar to images of other tests.
+func getRandomTestImage() image.Image {
+	const blocks = 8
+
+	width, height := imageSize.Size()
+	img := image.NewGray(image.Rect(0, 0, width*2, height*2))
+
+	var colors [blocks][blocks]uint8
+	for y := range colors {
+		for x := range colors[y] {
+			colors[y][x] = uint8(rand.Intn(256))
+		}
+	}
+
+	for y := 0; y < img.Rect.Dy(); y++ {
+		for x := 0; x < img.Rect.Dx(); x++ {
+			img.Pix[y*img.Stride+x] = colors[y*blocks/img.Rect.Dy()][x*blocks/img.Rect.Dx()]
+		}
+	}
+
+	return img
+}
+
+func TestSimilarImages(t *testing.T) {
+	c, close := newTestCore(t)
+	defer close(t)
+
+	ctx := context.Background()
+	img := getRandomTestImage()
+
+	upload := func(quality int, opts core.UploadOptions) (core.UploadResult, error) {
+		var imageData bytes.Buffer
+		err := jpeg.Encode(&imageData, img, &jpeg.Options{Quality: quality})
+		test.AssertErrNil(t, err)
+
+		return c.UploadImage(ctx, imager.ImageMeta{
+			Author:    "author",
+			WEBSource: "localhost",
+			MIMEType:  contentType,
+			Size:      int64(imageData.Len()),
+			Category:  "test",
+		}, &imageData, opts)
+	}
+
+	original, err := upload(90, core.UploadOptions{})
+	test.AssertErrNil(t, err)
+	defer func() { test.AssertErrNil(t, c.DeleteImage(ctx, original.ID)) }()
+
+	// Recompressed copy.
+	copied, err := upload(40, core.UploadOptions{
+		NearDuplicates: core.NearDuplicatesWarn,
+	})
+	test.AssertErrNil(t, err)
+	defer func() { test.AssertErrNil(t, c.DeleteImage(ctx, copied.ID)) }()
+
+	if len(copied.NearDuplicates) != 1 || copied.NearDuplicates[0] != original.ID {
+		t.Fatal("exp", original.ID, "got", copied.NearDuplicates)
+	}
+
+	_, err = upload(20, core.UploadOptions{
+		NearDuplicates: core.NearDuplicatesReject,
+	})
+
+	var dupErr core.DuplicateError
+	switch {
+	case !errors.As(err, &imerrors.ConflictError{}):
+		t.Fatal(err)
+	case !errors.As(err, &dupErr):
+		t.Fatal(err)
+	case dupErr.ImageID != original.ID && dupErr.ImageID != copied.ID:
+		t.Fatal("unexpected duplicate", dupErr.ImageID)
+	}
+
+	similar, err := c.SimilarImages(ctx, original.ID, 10)
+	test.AssertErrNil(t, err)
+
+	if len(similar) != 1 || similar[0].ID != copied.ID {
+		t.Fatal("exp", copied.ID, "got", similar)
+	}
+
+	clusters, err := c.NearDuplicateClusters(ctx, -1)
+	test.AssertErrNil(t, err)
+
+	var found bool
+	for _, cluster := range clusters {
+		joined := strings.Join(cluster, ",")
+		found = found || strings.Contains(joined, original.ID) && strings.Contains(joined, copied.ID)
+	}
+
+	if !found {
+		t.Fatal(original.ID, copied.ID, "not in", clusters)
+	}
+
+	_, err = c.SimilarImages(ctx, uuid.NewString(), 10)
+	if !errors.As(err, &imerrors.NotFoundError{}) {
+		t.Fatal(err)
+	}
+}
+
 func TestGetImage(t *testing.T) {
 	imageID := uuid.NewString()
 
@@ -182,7 +687,7 @@ func TestGetImage(t *testing.T) {
 		MIMEType:  contentType,
 		Size:      int64(len(imageBytes)),
 		Category:  "test",
-	}, bytes.NewReader(imageBytes))
+	}, bytes.NewReader(imageBytes), core.UploadOptions{})
 	test.AssertErrNil(t, err)
 
 	for _, tc := range testCases {
@@ -221,6 +726,351 @@ func TestGetImage(t *testing.T) {
 	}
 }
 
+func TestGetRendition(t *testing.T) {
+	c, close := newTestCoreConfig(t, func(cfg *config.Core) {
+		cfg.RenditionFormats = []string{"png"}
+	})
+	defer close(t)
+
+	ctx := context.Background()
+	imageBytes := getTestImageBytes(t)
+
+	im, err := c.UploadImage(ctx, imager.ImageMeta{
+		Author:    "author",
+		WEBSource: "websource",
+		MIMEType:  contentType,
+		Size:      int64(len(imageBytes)),
+		Category:  "test",
+	}, bytes.NewReader(imageBytes), core.UploadOptions{})
+	test.AssertErrNil(t, err)
+	defer func() { test.AssertErrNil(t, c.DeleteImage(ctx, im.ID)) }()
+
+	getRendition := func(format string) ([]byte, string) {
+		f, err := c.GetRendition(ctx, im.ID, core.Rendition{
+			Size:   imageSize,
+			Format: format,
+		})
+		test.AssertErrNil(t, err)
+
+		defer func() { test.AssertErrNil(t, f.Close()) }()
+
+		var data bytes.Buffer
+		_, err = data.ReadFrom(f)
+		test.AssertErrNil(t, err)
+
+		return data.Bytes(), f.ContentType
+	}
+
+	rendered, ct := getRendition("png")
+	if ct != "image/png" || !bytes.HasPrefix(rendered, []byte("\x89PNG")) {
+		t.Fatal("exp png, got", ct)
+	}
+
+	// It is cached now.
+	cached, _ := getRendition("png")
+	if !bytes.Equal(rendered, cached) {
+		t.Fatal("cached rendition differs")
+	}
+
+	_, err = c.GetRendition(ctx, im.ID, core.Rendition{Size: imageSize, Format: "gif"})
+	if !errors.As(err, &imerrors.UnprocessableEntity{}) {
+		t.Fatal(err)
+	}
+
+	report, err := c.WarmRenditions(ctx, "test", 2)
+	test.AssertErrNil(t, err)
+
+	if report.Rendered == 0 || report.Failed != 0 {
+		t.Fatal("unexpected report", report)
+	}
+
+	count, err := c.QueueRenditions(ctx, "test")
+	test.AssertErrNil(t, err)
+
+	if count == 0 {
+		t.Fatal("nothing queued")
+	}
+}
+
+func TestSetFocalPoint(t *testing.T) {
+	c, close := newTestCore(t)
+	defer close(t)
+
+	ctx := context.Background()
+	imageBytes := getTestImageBytes(t)
+
+	res, err := c.UploadImage(ctx, imager.ImageMeta{
+		Author:    "author",
+		WEBSource: "websource",
+		MIMEType:  contentType,
+		Size:      int64(len(imageBytes)),
+		Category:  "test",
+	}, bytes.NewReader(imageBytes), core.UploadOptions{})
+	test.AssertErrNil(t, err)
+	defer func() { test.AssertErrNil(t, c.DeleteImage(ctx, res.ID)) }()
+
+	fp := &imager.FocalPoint{X: 0.2, Y: 0.8}
+
+	im, err := c.SetFocalPoint(ctx, res.ID, fp)
+	test.AssertErrNil(t, err)
+
+	if im.FocalPoint == nil || *im.FocalPoint != *fp {
+		t.Fatal("exp", fp, "got", im.FocalPoint)
+	}
+
+	f, err := c.GetImage(ctx, res.ID, imageSize)
+	test.AssertErrNil(t, err)
+	test.AssertErrNil(t, f.Close())
+
+	_, err = c.SetFocalPoint(ctx, res.ID, &imager.FocalPoint{X: 1.5})
+	if !errors.As(err, &imerrors.UnprocessableEntity{}) {
+		t.Fatal(err)
+	}
+
+	_, err = c.SetFocalPoint(ctx, uuid.NewString(), fp)
+	if !errors.As(err, &imerrors.NotFoundError{}) {
+		t.Fatal(err)
+	}
+
+	im, err = c.SetFocalPoint(ctx, res.ID, nil)
+	test.AssertErrNil(t, err)
+
+	if im.FocalPoint != nil {
+		t.Fatal("focal point is not reset")
+	}
+}
+
+func TestSetWatermark(t *testing.T) {
+	c, close := newTestCoreConfig(t, func(cfg *config.Core) {
+		cfg.WatermarkCategories = []string{"test"}
+		cfg.WatermarkMinWidth = 0
+	})
+	defer close(t)
+
+	ctx := context.Background()
+	imageBytes := getTestImageBytes(t)
+
+	res, err := c.UploadImage(ctx, imager.ImageMeta{
+		Author:    "author",
+		WEBSource: "websource",
+		MIMEType:  contentType,
+		Size:      int64(len(imageBytes)),
+		Category:  "test",
+	}, bytes.NewReader(imageBytes), core.UploadOptions{})
+	test.AssertErrNil(t, err)
+	defer func() { test.AssertErrNil(t, c.DeleteImage(ctx, res.ID)) }()
+
+	readImage := func() []byte {
+		f, err := c.GetImage(ctx, res.ID, imageSize)
+		test.AssertErrNil(t, err)
+
+		defer func() { test.AssertErrNil(t, f.Close()) }()
+
+		data, err := io.ReadAll(f)
+		test.AssertErrNil(t, err)
+
+		return data
+	}
+
+	watermarked := readImage()
+
+	disabled := false
+
+	im, err := c.SetWatermark(ctx, res.ID, &disabled)
+	test.AssertErrNil(t, err)
+
+	if im.Watermark == nil || *im.Watermark {
+		t.Fatal("exp disabled watermark, got", im.Watermark)
+	}
+
+	if bytes.Equal(watermarked, readImage()) {
+		t.Fatal("exp rendition without watermark")
+	}
+
+	_, err = c.SetWatermark(ctx, uuid.NewString(), &disabled)
+	if !errors.As(err, &imerrors.NotFoundError{}) {
+		t.Fatal(err)
+	}
+
+	im, err = c.SetWatermark(ctx, res.ID, nil)
+	test.AssertErrNil(t, err)
+
+	if im.Watermark != nil {
+		t.Fatal("watermark is not reset")
+	}
+
+	if !bytes.Equal(watermarked, readImage()) {
+		t.Fatal("exp watermarked rendition of the category")
+	}
+}
+
+func TestSetCrop(t *testing.T) {
+	c, close := newTestCore(t)
+	defer close(t)
+
+	ctx := context.Background()
+	imageBytes := getTestImageBytes(t)
+
+	res, err := c.UploadImage(ctx, imager.ImageMeta{
+		Author:    "author",
+		WEBSource: "websource",
+		MIMEType:  contentType,
+		Size:      int64(len(imageBytes)),
+		Category:  "test",
+	}, bytes.NewReader(imageBytes), core.UploadOptions{})
+	test.AssertErrNil(t, err)
+	defer func() { test.AssertErrNil(t, c.DeleteImage(ctx, res.ID)) }()
+
+	rect := imager.CropRect{X: 10, Y: 20, Width: 100, Height: 100}
+
+	im, err := c.SetCrop(ctx, res.ID, "2:2", &rect)
+	test.AssertErrNil(t, err)
+
+	if im.Crops["1:1"] != rect {
+		t.Fatal("exp", rect, "got", im.Crops)
+	}
+
+	f, err := c.GetImage(ctx, res.ID, imageSize)
+	test.AssertErrNil(t, err)
+	test.AssertErrNil(t, f.Close())
+
+	testCases := []struct {
+		Name string
+		Key  string
+		Rect imager.CropRect
+	}{{
+		Name: "outside",
+		Key:  string(imageSize),
+		Rect: imager.CropRect{X: res.Width, Width: 1, Height: 1},
+	}, {
+		Name: "empty",
+		Key:  string(imageSize),
+		Rect: imager.CropRect{},
+	}, {
+		Name: "unsupported_size",
+		Key:  "1x1",
+		Rect: rect,
+	}, {
+		Name: "invalid_ratio",
+		Key:  "0:1",
+		Rect: rect,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := c.SetCrop(ctx, res.ID, tc.Key, &tc.Rect)
+			if !errors.As(err, &imerrors.UnprocessableEntity{}) {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	im, err = c.SetCrop(ctx, res.ID, "1:1", nil)
+	test.AssertErrNil(t, err)
+
+	if im.Crops != nil {
+		t.Fatal("exp no crops, got", im.Crops)
+	}
+}
+
+func TestSetCrop_oriented(t *testing.T) {
+	c, close := newTestCore(t)
+	defer close(t)
+
+	ctx := context.Background()
+	width, height := imageSize.Size()
+
+	var imageData bytes.Buffer
+	err := jpeg.Encode(&imageData, image.NewNRGBA(image.Rect(0, 0, width*4, height*2)), nil)
+	test.AssertErrNil(t, err)
+
+	// The image is displayed rotated by 90°.
+	imageBytes := test.JPEGWithOrientation(imageData.Bytes(), 6)
+
+	res, err := c.UploadImage(ctx, imager.ImageMeta{
+		Author:    "author",
+		WEBSource: "websource",
+		MIMEType:  contentType,
+		Size:      int64(len(imageBytes)),
+		Category:  "test",
+	}, bytes.NewReader(imageBytes), core.UploadOptions{})
+	test.AssertErrNil(t, err)
+	defer func() { test.AssertErrNil(t, c.DeleteImage(ctx, res.ID)) }()
+
+	if res.Width != height*2 || res.Height != width*4 {
+		t.Fatal("exp", height*2, width*4, "got", res.Width, res.Height)
+	}
+
+	// The area is outside of the stored image, but inside of the
+	// displayed one.
+	rect := imager.CropRect{X: 0, Y: width * 3, Width: height, Height: width}
+
+	_, err = c.SetCrop(ctx, res.ID, string(imageSize), &rect)
+	test.AssertErrNil(t, err)
+
+	f, err := c.GetImage(ctx, res.ID, imageSize)
+	test.AssertErrNil(t, err)
+	test.AssertErrNil(t, f.Close())
+}
+
+func TestGetRenditionManifest(t *testing.T) {
+	c, close := newTestCore(t)
+	defer close(t)
+
+	ctx := context.Background()
+	imageBytes := getTestImageBytes(t)
+
+	res, err := c.UploadImage(ctx, imager.ImageMeta{
+		Author:    "author",
+		WEBSource: "websource",
+		MIMEType:  contentType,
+		Size:      int64(len(imageBytes)),
+		Category:  "test",
+	}, bytes.NewReader(imageBytes), core.UploadOptions{})
+	test.AssertErrNil(t, err)
+	defer func() { test.AssertErrNil(t, c.DeleteImage(ctx, res.ID)) }()
+
+	f, err := c.GetImage(ctx, res.ID, imageSize)
+	test.AssertErrNil(t, err)
+	test.AssertErrNil(t, f.Close())
+
+	manifest, err := c.GetRenditionManifest(ctx, res.ID)
+	test.AssertErrNil(t, err)
+
+	if manifest.AspectRatio != "1:1" {
+		t.Fatal("exp 1:1, got", manifest.AspectRatio)
+	}
+
+	if len(manifest.Renditions) == 0 {
+		t.Fatal("renditions are empty")
+	}
+
+	jpeg := manifest.Renditions[0]
+	if jpeg.Size != imageSize || jpeg.MIMEType != contentType || jpeg.ETag == "" {
+		t.Fatal("unexpected rendition", jpeg)
+	}
+
+	// The cached rendition is served with the same ETag.
+	f, err = c.GetImage(ctx, res.ID, imageSize)
+	test.AssertErrNil(t, err)
+	test.AssertErrNil(t, f.Close())
+
+	if f.ETag != jpeg.ETag {
+		t.Fatal("exp", jpeg.ETag, "got", f.ETag)
+	}
+
+	if manifest.Placeholder.Size != imageSize || manifest.Placeholder.Quality == 0 {
+		t.Fatal("unexpected placeholder", manifest.Placeholder)
+	}
+
+	_, err = c.GetRenditionManifest(ctx, uuid.NewString())
+	if !errors.As(err, &imerrors.NotFoundError{}) {
+		t.Fatal(err)
+	}
+}
+
 func TestListCategories(t *testing.T) {
 	const category = "test"
 
@@ -237,7 +1087,7 @@ func TestListCategories(t *testing.T) {
 		MIMEType:  contentType,
 		Size:      int64(len(imageBytes)),
 		Category:  category,
-	}, bytes.NewReader(imageBytes))
+	}, bytes.NewReader(imageBytes), core.UploadOptions{})
 	test.AssertErrNil(t, err)
 
 	categories, err := c.ListCategories(ctx)
@@ -303,7 +1153,7 @@ func TestListImages(t *testing.T) {
 		MIMEType:  contentType,
 		Size:      int64(len(imageBytes)),
 		Category:  category,
-	}, bytes.NewReader(imageBytes))
+	}, bytes.NewReader(imageBytes), core.UploadOptions{})
 	test.AssertErrNil(t, err)
 
 	for _, tc := range testCases {
@@ -396,7 +1246,7 @@ func TestDelete(t *testing.T) {
 		MIMEType:  contentType,
 		Size:      int64(len(imageBytes)),
 		Category:  "test",
-	}, bytes.NewReader(imageBytes))
+	}, bytes.NewReader(imageBytes), core.UploadOptions{})
 	test.AssertErrNil(t, err)
 
 	testCases := []struct {
@@ -435,6 +1285,62 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestDelete_renditions(t *testing.T) {
+	c, close := newTestCore(t)
+	defer close(t)
+
+	ctx := context.Background()
+
+	cfg := test.LoadConfig(t)
+
+	fileStorage, err := s3.NewStorage(cfg.S3)
+	test.AssertErrNil(t, err)
+
+	imageBytes := getTestImageBytes(t)
+	im, err := c.UploadImage(ctx, imager.ImageMeta{
+		Author:    "author",
+		WEBSource: "websource",
+		MIMEType:  contentType,
+		Size:      int64(len(imageBytes)),
+		Category:  "test",
+	}, bytes.NewReader(imageBytes), core.UploadOptions{})
+	test.AssertErrNil(t, err)
+
+	// Renditions of device pixel ratios, qualities and overlays are not
+	// listed by the config.
+	for _, r := range []core.Rendition{
+		{Size: imageSize + "@2x"},
+		{Size: imageSize, Quality: cfg.SaveDataQuality},
+		{Size: imageSize, Overlay: core.Overlay{Grid: 4}},
+	} {
+		f, err := c.GetRendition(ctx, im.ID, r)
+		test.AssertErrNil(t, err)
+		test.AssertErrNil(t, f.Close())
+	}
+
+	listRenditions := func() (ids []string) {
+		err := fileStorage.List(ctx, "rendition-"+im.StorageID()+"-", func(fi storage.FileInfo) error {
+			ids = append(ids, fi.ID)
+
+			return nil
+		})
+		test.AssertErrNil(t, err)
+
+		return ids
+	}
+
+	if ids := listRenditions(); len(ids) != 3 {
+		t.Fatal("exp 3 renditions, got", ids)
+	}
+
+	err = c.DeleteImage(ctx, im.ID)
+	test.AssertErrNil(t, err)
+
+	if ids := listRenditions(); len(ids) != 0 {
+		t.Fatal("exp renditions deleted, got", ids)
+	}
+}
+
 func TestHealth(t *testing.T) {
 	c, close := newTestCore(t)
 	defer close(t)
@@ -465,7 +1371,7 @@ func BenchmarkImage(b *testing.B) {
 		MIMEType:  contentType,
 		Size:      int64(imageData.Len()),
 		Category:  "test",
-	}, &imageData)
+	}, &imageData, core.UploadOptions{})
 	test.AssertErrNil(b, err)
 
 	b.ReportAllocs()
@@ -479,3 +1385,110 @@ func BenchmarkImage(b *testing.B) {
 		test.AssertErrNil(b, err)
 	}
 }
+
+func TestExportImportCatalog(t *testing.T) {
+	c, close := newTestCore(t)
+	defer close(t)
+
+	ctx := context.Background()
+
+	imageBytes := getTestImageBytes(t)
+	im, err := c.UploadImage(ctx, imager.ImageMeta{
+		ID:        "",
+		Author:    "author",
+		WEBSource: "websource",
+		MIMEType:  contentType,
+		Size:      int64(len(imageBytes)),
+		Category:  "test",
+	}, bytes.NewReader(imageBytes), core.UploadOptions{})
+	test.AssertErrNil(t, err)
+
+	var archive bytes.Buffer
+	err = c.ExportCatalog(ctx, &archive)
+	test.AssertErrNil(t, err)
+
+	t.Run("merge", func(t *testing.T) {
+		report, err := c.ImportCatalog(ctx, bytes.NewReader(archive.Bytes()), core.ImportMerge)
+		test.AssertErrNil(t, err)
+
+		if report.Imported != 0 || report.Skipped == 0 {
+			t.Fatal(report)
+		}
+	})
+
+	t.Run("replace_corrupted", func(t *testing.T) {
+		corrupted := bytes.Replace(archive.Bytes(), imageBytes, make([]byte, len(imageBytes)), 1)
+
+		_, err := c.ImportCatalog(ctx, bytes.NewReader(corrupted), core.ImportReplace)
+		if !errors.As(err, &imerrors.UnprocessableEntity{}) {
+			t.Fatal(err)
+		}
+
+		got, err := c.GetImageMeta(ctx, im.ID)
+		test.AssertErrNil(t, err)
+
+		if got.StorageID() != im.StorageID() {
+			t.Fatal("exp", im.StorageID(), "got", got.StorageID())
+		}
+
+		// Originals of kept images are readable.
+		err = c.ExportCatalog(ctx, io.Discard)
+		test.AssertErrNil(t, err)
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		report, err := c.ImportCatalog(ctx, bytes.NewReader(archive.Bytes()), core.ImportReplace)
+		test.AssertErrNil(t, err)
+
+		if report.Imported == 0 {
+			t.Fatal(report)
+		}
+
+		err = c.ExportCatalog(ctx, io.Discard)
+		test.AssertErrNil(t, err)
+	})
+
+	t.Run("min_resolution_raised", func(t *testing.T) {
+		width, height := imageSize.Size()
+		larger := imager.NewImageSize(width*4, height*4)
+
+		c, close := newTestCoreConfig(t, func(cfg *config.Core) {
+			cfg.SupportedImageSizes = []imager.ImageSize{larger}
+		})
+		defer close(t)
+
+		_, err := c.UploadImage(ctx, imager.ImageMeta{
+			Author:    "author",
+			WEBSource: "websource",
+			MIMEType:  contentType,
+			Size:      int64(len(imageBytes)),
+			Category:  "test",
+		}, bytes.NewReader(imageBytes), core.UploadOptions{})
+		if !errors.As(err, &imerrors.UnprocessableEntity{}) {
+			t.Fatal("exp unprocessable entity, got", err)
+		}
+
+		// Stored images are restored.
+		_, err = c.ImportCatalog(ctx, bytes.NewReader(archive.Bytes()), core.ImportReplace)
+		test.AssertErrNil(t, err)
+	})
+
+	t.Run("checksum_mismatch", func(t *testing.T) {
+		err = c.DeleteImage(ctx, im.ID)
+		test.AssertErrNil(t, err)
+
+		corrupted := bytes.Replace(archive.Bytes(), imageBytes, make([]byte, len(imageBytes)), 1)
+
+		_, err := c.ImportCatalog(ctx, bytes.NewReader(corrupted), core.ImportMerge)
+		if !errors.As(err, &imerrors.UnprocessableEntity{}) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("unknown_mode", func(t *testing.T) {
+		_, err := c.ImportCatalog(ctx, bytes.NewReader(archive.Bytes()), "unknown")
+		if !errors.As(err, &imerrors.UnprocessableEntity{}) {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,258 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/validate"
+
+	"github.com/rs/zerolog"
+)
+
+// SetFocalPoint sets the focal point of the image, nil resets it.
+// Renditions are rendered again around the new point.
+func (c Core) SetFocalPoint(
+	ctx context.Context,
+	id string,
+	fp *imager.FocalPoint,
+) (im imager.ImageMeta, err error) {
+	if err = c.validate.Var(id, "image_id"); err != nil {
+		err = fmt.Errorf("validating image_id: %w", err)
+
+		return imager.ImageMeta{}, imerrors.NewUnprocessableEntity(err)
+	}
+
+	if fp != nil {
+		if err = c.validate.Struct(fp); err != nil {
+			err = fmt.Errorf("validating focal point: %w", err)
+
+			return imager.ImageMeta{}, imerrors.NewUnprocessableEntity(err)
+		}
+	}
+
+	var previous imager.ImageMeta
+
+	im, err = c.repoImageMeta.Update(ctx, id, func(im *imager.ImageMeta) error {
+		previous = *im
+
+		im.FocalPoint = fp
+		im.UpdatedAt = time.Now().UTC()
+
+		return nil
+	})
+	if err != nil {
+		return imager.ImageMeta{}, fmt.Errorf("updating image: %w", err)
+	}
+
+	c.refreshRenditions(ctx, previous, im)
+
+	return im, nil
+}
+
+// refreshRenditions deletes renditions of the original of the image and
+// enqueues rendering of new ones. Errors are logged,
+// renditions are rendered on demand anyway.
+func (c Core) refreshRenditions(ctx context.Context, previous, im imager.ImageMeta) {
+	l := zerolog.Ctx(ctx)
+
+	if err := c.deleteRenditions(ctx, previous); err != nil {
+		l.Warn().Err(err).Str("image_id", im.ID).Msg("deleting previous renditions")
+	}
+
+	if !c.cfg.RenderOnUpload {
+		return
+	}
+
+	if err := c.enqueueRendering(ctx, im.ID); err != nil {
+		l.Warn().Err(err).Str("image_id", im.ID).Msg("enqueueing rendering")
+	}
+}
+
+// SetCrop sets the art-directed crop of the image for the key, nil
+// deletes it. The key is a supported image size or an aspect ratio like
+// 3:4, the area should be inside the original.
+func (c Core) SetCrop(
+	ctx context.Context,
+	id string,
+	key string,
+	rect *imager.CropRect,
+) (im imager.ImageMeta, err error) {
+	if err = c.validate.Var(id, "image_id"); err != nil {
+		err = fmt.Errorf("validating image_id: %w", err)
+
+		return imager.ImageMeta{}, imerrors.NewUnprocessableEntity(err)
+	}
+
+	key, err = c.normalizeCropKey(key)
+	if err != nil {
+		err = fmt.Errorf("crop key: %w", err)
+
+		return imager.ImageMeta{}, imerrors.NewUnprocessableEntity(err)
+	}
+
+	if rect != nil {
+		if err = c.validate.Struct(rect); err != nil {
+			err = fmt.Errorf("validating crop: %w", err)
+
+			return imager.ImageMeta{}, imerrors.NewUnprocessableEntity(err)
+		}
+	}
+
+	var previous imager.ImageMeta
+
+	im, err = c.repoImageMeta.Update(ctx, id, func(im *imager.ImageMeta) error {
+		previous = *im
+
+		// The previous meta keeps its crops.
+		crops := make(map[string]imager.CropRect, len(im.Crops)+1)
+		for k, v := range im.Crops {
+			crops[k] = v
+		}
+
+		if rect == nil {
+			delete(crops, key)
+		} else {
+			if im.Width == 0 || im.Height == 0 {
+				return imerrors.NewUnprocessableEntity(
+					imerrors.Error("dimensions of the original are unknown"),
+				)
+			}
+
+			if err := validate.CropRect(*rect, im.Width, im.Height); err != nil {
+				return imerrors.NewUnprocessableEntity(fmt.Errorf("crop: %w", err))
+			}
+
+			crops[key] = *rect
+		}
+
+		im.Crops = crops
+		if len(crops) == 0 {
+			im.Crops = nil
+		}
+
+		im.UpdatedAt = time.Now().UTC()
+
+		return nil
+	})
+	if err != nil {
+		return imager.ImageMeta{}, fmt.Errorf("updating image: %w", err)
+	}
+
+	c.refreshRenditions(ctx, previous, im)
+
+	return im, nil
+}
+
+// normalizeCropKey checks that the key is a supported size or an aspect
+// ratio and reduces the aspect ratio.
+func (c Core) normalizeCropKey(key string) (normalized string, err error) {
+	const tokensWidthHeightCount = 2
+
+	if tokens := strings.Split(key, ":"); len(tokens) == tokensWidthHeightCount {
+		ratio := imager.ImageSize(tokens[0] + "x" + tokens[1]).AspectRatio()
+		if ratio == "" {
+			return "", fmt.Errorf("invalid aspect ratio: %s", key)
+		}
+
+		return ratio, nil
+	}
+
+	if err = validate.ImageSize(imager.ImageSize(key), c.cfg.SupportedImageSizes); err != nil {
+		return "", fmt.Errorf("expected W:H aspect ratio or size: %w", err)
+	}
+
+	return key, nil
+}
+
+// imageCrop returns the art-directed crop of the size, it is preferred
+// to the aspect ratio one. Otherwise, the focal point is returned.
+func imageCrop(
+	im imager.ImageMeta,
+	size imager.ImageSize,
+) (rect *imager.CropRect, fp *imager.FocalPoint) {
+	for _, key := range []string{string(size), size.AspectRatio()} {
+		if rect, ok := im.Crops[key]; ok {
+			return &rect, nil
+		}
+	}
+
+	return nil, im.FocalPoint
+}
+
+// cropArea returns the area of the original to crop before resizing to
+// the size. It is false if the original should be cropped by the smart
+// gravity.
+func cropArea(
+	im imager.ImageMeta,
+	width, height int,
+	size imager.ImageSize,
+) (area image.Rectangle, ok bool) {
+	rect, fp := imageCrop(im, size)
+
+	switch {
+	case rect != nil:
+		area = image.Rect(rect.X, rect.Y, rect.X+rect.Width, rect.Y+rect.Height)
+		// The original could be replaced after the crop was set.
+		area = area.Intersect(image.Rect(0, 0, width, height))
+
+		return area, !area.Empty()
+	case fp != nil:
+		return focalArea(*fp, width, height, size), true
+	default:
+		return image.Rectangle{}, false
+	}
+}
+
+// focalArea returns the largest area with the aspect ratio of the size
+// centered at the focal point as close as it fits into the original.
+func focalArea(fp imager.FocalPoint, width, height int, size imager.ImageSize) image.Rectangle {
+	sizeWidth, sizeHeight := size.Size()
+
+	scale := math.Min(
+		float64(width)/float64(sizeWidth),
+		float64(height)/float64(sizeHeight),
+	)
+
+	areaWidth := clamp(int(math.Round(float64(sizeWidth)*scale)), 1, width)
+	areaHeight := clamp(int(math.Round(float64(sizeHeight)*scale)), 1, height)
+
+	left := int(math.Round(fp.X*float64(width) - float64(areaWidth)/2))
+	top := int(math.Round(fp.Y*float64(height) - float64(areaHeight)/2))
+
+	left = clamp(left, 0, width-areaWidth)
+	top = clamp(top, 0, height-areaHeight)
+
+	return image.Rect(left, top, left+areaWidth, top+areaHeight)
+}
+
+// cropKey is a part of ids of renditions of the size that depends on
+// the crop.
+func cropKey(im imager.ImageMeta, size imager.ImageSize) string {
+	rect, fp := imageCrop(im, size)
+
+	switch {
+	case rect != nil:
+		return fmt.Sprintf("-c%d_%d_%d_%d", rect.X, rect.Y, rect.Width, rect.Height)
+	case fp != nil:
+		return fmt.Sprintf("-f%.4fx%.4f", fp.X, fp.Y)
+	default:
+		return ""
+	}
+}
+
+func clamp(value, min, max int) int {
+	switch {
+	case value < min:
+		return min
+	case value > max:
+		return max
+	default:
+		return value
+	}
+}
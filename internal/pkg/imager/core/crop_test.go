@@ -0,0 +1,128 @@
+package core
+
+import (
+	"image"
+	"testing"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+)
+
+func TestFocalArea(t *testing.T) {
+	testCases := []struct {
+		Name       string
+		FocalPoint imager.FocalPoint
+		Width      int
+		Height     int
+		Size       imager.ImageSize
+		Exp        image.Rectangle
+	}{{
+		Name:       "portrait_of_landscape",
+		FocalPoint: imager.FocalPoint{X: 0.25, Y: 0.5},
+		Width:      1600,
+		Height:     900,
+		Size:       "360x480",
+		Exp:        image.Rect(63, 0, 738, 900),
+	}, {
+		Name:       "clamped_left",
+		FocalPoint: imager.FocalPoint{X: 0, Y: 0},
+		Width:      1600,
+		Height:     900,
+		Size:       "360x480",
+		Exp:        image.Rect(0, 0, 675, 900),
+	}, {
+		Name:       "clamped_right",
+		FocalPoint: imager.FocalPoint{X: 1, Y: 1},
+		Width:      1600,
+		Height:     900,
+		Size:       "360x480",
+		Exp:        image.Rect(925, 0, 1600, 900),
+	}, {
+		Name:       "landscape_of_portrait",
+		FocalPoint: imager.FocalPoint{X: 0.5, Y: 0.1},
+		Width:      900,
+		Height:     1600,
+		Size:       "480x360",
+		Exp:        image.Rect(0, 0, 900, 675),
+	}, {
+		Name:       "same_aspect",
+		FocalPoint: imager.FocalPoint{X: 0.9, Y: 0.9},
+		Width:      720,
+		Height:     960,
+		Size:       "360x480",
+		Exp:        image.Rect(0, 0, 720, 960),
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			got := focalArea(tc.FocalPoint, tc.Width, tc.Height, tc.Size)
+			if got != tc.Exp {
+				t.Fatal("exp", tc.Exp, "got", got)
+			}
+		})
+	}
+}
+
+func TestCropArea(t *testing.T) {
+	_, ok := cropArea(imager.ImageMeta{}, 100, 100, "10x10")
+	if ok {
+		t.Fatal("exp smart crop without focal point")
+	}
+
+	im := imager.ImageMeta{
+		FocalPoint: &imager.FocalPoint{X: 0.5, Y: 0.5},
+	}
+
+	area, ok := cropArea(im, 100, 50, "10x10")
+	if !ok || area != image.Rect(25, 0, 75, 50) {
+		t.Fatal("got", area, ok)
+	}
+
+	im.Crops = map[string]imager.CropRect{
+		"1:1":   {X: 0, Y: 0, Width: 50, Height: 50},
+		"10x10": {X: 10, Y: 10, Width: 40, Height: 40},
+		"3:4":   {X: 90, Y: 0, Width: 30, Height: 40},
+	}
+
+	area, ok = cropArea(im, 100, 50, "10x10")
+	if !ok || area != image.Rect(10, 10, 50, 50) {
+		t.Fatal("exp the crop of the size, got", area, ok)
+	}
+
+	area, ok = cropArea(im, 100, 50, "20x20")
+	if !ok || area != image.Rect(0, 0, 50, 50) {
+		t.Fatal("exp the crop of the aspect ratio, got", area, ok)
+	}
+
+	area, ok = cropArea(im, 100, 50, "30x40")
+	if !ok || area != image.Rect(90, 0, 100, 40) {
+		t.Fatal("exp the crop inside the original, got", area, ok)
+	}
+
+	area, ok = cropArea(im, 100, 50, "20x10")
+	if !ok || area != image.Rect(0, 0, 100, 50) {
+		t.Fatal("exp the focal point, got", area, ok)
+	}
+}
+
+func TestCropKey(t *testing.T) {
+	if got := cropKey(imager.ImageMeta{}, "10x10"); got != "" {
+		t.Fatal("exp empty, got", got)
+	}
+
+	im := imager.ImageMeta{
+		FocalPoint: &imager.FocalPoint{X: 0.5, Y: 1},
+		Crops: map[string]imager.CropRect{
+			"3:4": {X: 1, Y: 2, Width: 30, Height: 40},
+		},
+	}
+
+	if got := cropKey(im, "10x10"); got != "-f0.5000x1.0000" {
+		t.Fatal("got", got)
+	}
+
+	if got := cropKey(im, "360x480"); got != "-c1_2_30_40" {
+		t.Fatal("got", got)
+	}
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"math"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+)
+
+// ClientHints describe the display of the client. Zero values are
+// unknown.
+type ClientHints struct {
+	// Width is a width of the image in physical pixels.
+	Width int
+	// ViewportWidth and ViewportHeight are in CSS pixels.
+	ViewportWidth  int
+	ViewportHeight int
+	// DPR is a device pixel ratio.
+	DPR float64
+	// SaveData tells that the client prefers to reduce data usage.
+	SaveData bool
+}
+
+// SelectRendition returns the supported size and the quality that fit the
+// client best: the narrowest size of the orientation of the viewport that
+// covers the width. Clients that save data get the reduced quality at the
+// device pixel ratio of 1.
+func (c Core) SelectRendition(hints ClientHints) Rendition {
+	dpr := hints.DPR
+	if dpr <= 0 {
+		dpr = 1
+	}
+
+	var cssWidth float64
+
+	switch {
+	case hints.Width > 0:
+		cssWidth = float64(hints.Width) / dpr
+	case hints.ViewportWidth > 0:
+		cssWidth = float64(hints.ViewportWidth)
+	default:
+		cssWidth = float64(c.cfg.AutoDefaultWidth)
+	}
+
+	var quality int
+
+	if hints.SaveData {
+		dpr = 1
+		quality = c.cfg.SaveDataQuality
+	}
+
+	target := int(math.Ceil(cssWidth * dpr))
+
+	candidates := c.cfg.SupportedImageSizes
+	if hints.ViewportWidth > 0 && hints.ViewportHeight > 0 {
+		candidates = orientedSizes(candidates, hints.ViewportWidth, hints.ViewportHeight)
+	}
+
+	return Rendition{
+		Size:    coveringSize(candidates, target),
+		Quality: quality,
+	}
+}
+
+// orientedSizes returns sizes of the orientation of width:height, square
+// sizes fit both orientations. All sizes are returned if none fit.
+func orientedSizes(sizes []imager.ImageSize, width, height int) []imager.ImageSize {
+	oriented := make([]imager.ImageSize, 0, len(sizes))
+
+	for _, size := range sizes {
+		w, h := size.Size()
+
+		if w == h || (w > h) == (width > height) {
+			oriented = append(oriented, size)
+		}
+	}
+
+	if len(oriented) == 0 {
+		return sizes
+	}
+
+	return oriented
+}
+
+// coveringSize returns the narrowest size that is not narrower than the
+// width, otherwise the widest one.
+func coveringSize(sizes []imager.ImageSize, width int) imager.ImageSize {
+	var covering, widest imager.ImageSize
+
+	var coveringWidth, widestWidth int
+
+	for _, size := range sizes {
+		w, _ := size.Size()
+
+		if w >= width && (covering == "" || w < coveringWidth) {
+			covering, coveringWidth = size, w
+		}
+
+		if w > widestWidth {
+			widest, widestWidth = size, w
+		}
+	}
+
+	if covering != "" {
+		return covering
+	}
+
+	return widest
+}
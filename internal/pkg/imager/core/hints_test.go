@@ -0,0 +1,60 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+)
+
+func TestSelectRendition(t *testing.T) {
+	c := Core{cfg: config.Core{
+		SupportedImageSizes: []imager.ImageSize{"1920x1080", "480x360", "1080x1920", "360x480"},
+		AutoDefaultWidth:    360,
+		SaveDataQuality:     50,
+	}}
+
+	testCases := []struct {
+		Name  string
+		Hints ClientHints
+		Exp   Rendition
+	}{{
+		Name:  "no_hints",
+		Hints: ClientHints{},
+		Exp:   Rendition{Size: "360x480"},
+	}, {
+		Name:  "portrait_phone",
+		Hints: ClientHints{ViewportWidth: 360, ViewportHeight: 740, DPR: 3},
+		Exp:   Rendition{Size: "1080x1920"},
+	}, {
+		Name:  "portrait_phone_save_data",
+		Hints: ClientHints{ViewportWidth: 360, ViewportHeight: 740, DPR: 3, SaveData: true},
+		Exp:   Rendition{Size: "360x480", Quality: 50},
+	}, {
+		Name:  "landscape_tablet",
+		Hints: ClientHints{ViewportWidth: 1024, ViewportHeight: 768, DPR: 1},
+		Exp:   Rendition{Size: "1920x1080"},
+	}, {
+		Name:  "width",
+		Hints: ClientHints{Width: 400, DPR: 1},
+		Exp:   Rendition{Size: "480x360"},
+	}, {
+		Name:  "width_save_data",
+		Hints: ClientHints{Width: 1000, DPR: 2, SaveData: true},
+		Exp:   Rendition{Size: "1080x1920", Quality: 50},
+	}, {
+		Name:  "wider_than_all",
+		Hints: ClientHints{Width: 4000},
+		Exp:   Rendition{Size: "1920x1080"},
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := c.SelectRendition(tc.Hints); got != tc.Exp {
+				t.Fatal("exp", tc.Exp, "got", got)
+			}
+		})
+	}
+}
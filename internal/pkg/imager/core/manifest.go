@@ -0,0 +1,127 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+
+	"github.com/rs/zerolog"
+)
+
+// RenditionManifest lists renditions of the image for responsive
+// clients, like srcset of the img tag.
+type RenditionManifest struct {
+	// ImageID is an id of the image.
+	ImageID string `json:"image_id"`
+	// Width and Height of the original, zero if unknown.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// AspectRatio of the original as W:H, empty if unknown.
+	AspectRatio string `json:"aspect_ratio"`
+	// BlurHash and LQIP are placeholders of the image, see ImageMeta.
+	BlurHash string `json:"blurhash"`
+	LQIP     string `json:"lqip"`
+	// Placeholder is the smallest rendition of the reduced quality,
+	// it is shown while the rendition loads.
+	Placeholder ManifestRendition `json:"placeholder"`
+	// Renditions of every supported size and format.
+	Renditions []ManifestRendition `json:"renditions"`
+}
+
+// ManifestRendition describes a rendition in the manifest.
+type ManifestRendition struct {
+	Rendition `json:"-"`
+
+	// URL of the rendition. It is set by the API.
+	URL      string `json:"url"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	MIMEType string `json:"mimetype"`
+	// ETag of the cached rendition, empty if it is not rendered yet.
+	ETag string `json:"etag,omitempty"`
+}
+
+// GetRenditionManifest returns renditions of every supported size in
+// the format of the original and in configured formats.
+func (c Core) GetRenditionManifest(
+	ctx context.Context,
+	id string,
+) (manifest RenditionManifest, err error) {
+	if err = c.validate.Var(id, "image_id"); err != nil {
+		err = fmt.Errorf("validating image_id: %w", err)
+
+		return RenditionManifest{}, imerrors.NewUnprocessableEntity(err)
+	}
+
+	im, err := c.repoImageMeta.Get(ctx, id)
+	if err != nil {
+		return RenditionManifest{}, fmt.Errorf("getting image: %w", err)
+	}
+
+	manifest = RenditionManifest{
+		ImageID:    im.ID,
+		Width:      im.Width,
+		Height:     im.Height,
+		BlurHash:   im.BlurHash,
+		LQIP:       im.LQIP,
+		Renditions: make([]ManifestRendition, 0, len(c.cfg.SupportedImageSizes)),
+	}
+
+	if im.Width > 0 && im.Height > 0 {
+		manifest.AspectRatio = imager.NewImageSize(im.Width, im.Height).AspectRatio()
+	}
+
+	var smallest imager.ImageSize
+
+	smallestWidth := 0
+
+	for _, r := range c.renditions(im) {
+		manifest.Renditions = append(manifest.Renditions, c.manifestRendition(ctx, im, r))
+
+		if w, _ := r.Size.Size(); smallest == "" || w < smallestWidth {
+			smallest, smallestWidth = r.Size, w
+		}
+	}
+
+	if smallest != "" {
+		manifest.Placeholder = c.manifestRendition(ctx, im, Rendition{
+			Size:    smallest,
+			Format:  imageFormat(im),
+			Quality: c.cfg.SaveDataQuality,
+		})
+	}
+
+	return manifest, nil
+}
+
+// manifestRendition describes the rendition, the ETag is known if the
+// rendition is cached.
+func (c Core) manifestRendition(
+	ctx context.Context,
+	im imager.ImageMeta,
+	r Rendition,
+) ManifestRendition {
+	width, height := r.Size.Size()
+
+	mr := ManifestRendition{
+		Rendition: r,
+		Width:     width,
+		Height:    height,
+		MIMEType:  formatContentType(r.Format),
+	}
+
+	renditionID := c.renditionStorageID(im, r)
+
+	fi, err := c.fileStorage.Stat(ctx, renditionID)
+	switch {
+	case err == nil:
+		mr.ETag = fi.ETag()
+	case !errors.As(err, &imerrors.NotFoundError{}):
+		zerolog.Ctx(ctx).Warn().Err(err).Str("rendition_id", renditionID).Msg("getting rendition info")
+	}
+
+	return mr
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/tracing"
+
+	"github.com/h2non/bimg"
+)
+
+// sourceIDPrefix is a prefix of ids of uploaded files of normalized
+// images. The rest is the id of the normalized original.
+const sourceIDPrefix = "source-"
+
+// iccProfileSRGB is the built-in libvips profile.
+const iccProfileSRGB = "srgb"
+
+// normalizeImage applies configured normalization steps to the image and
+// re-encodes it once in the same format.
+func (c Core) normalizeImage(ctx context.Context, data []byte) (normalized []byte, err error) {
+	_, span := tracing.Start(ctx, "bimg.Normalize")
+	defer func() { tracing.End(span, err) }()
+
+	opts := bimg.Options{
+		NoAutoRotate: !c.cfg.NormalizeOrientation,
+		// The orientation tag is kept by the rotation.
+		StripMetadata: c.cfg.NormalizeStripMetadata || c.cfg.NormalizeOrientation,
+		Quality:       c.cfg.NormalizeQuality,
+	}
+
+	if c.cfg.NormalizeSRGB {
+		opts.Interpretation = bimg.InterpretationSRGB
+		opts.OutputICC = iccProfileSRGB
+	}
+
+	normalized, err = bimg.NewImage(data).Process(opts)
+	if err != nil {
+		return nil, fmt.Errorf("processing image: %w", err)
+	}
+
+	return normalized, nil
+}
+
+// deleteSource deletes the kept uploaded file of the image, it is fine
+// if it is already deleted.
+func (c Core) deleteSource(ctx context.Context, im imager.ImageMeta) (err error) {
+	if im.SourceID == "" {
+		return nil
+	}
+
+	err = c.fileStorage.Delete(ctx, im.SourceID)
+	if err != nil && !errors.As(err, &imerrors.NotFoundError{}) {
+		return fmt.Errorf("deleting source: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package core
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/picture"
+
+	"github.com/disintegration/imaging"
+)
+
+// overlayMinGrid is the smallest grid of tiles of the puzzle.
+const overlayMinGrid = 2
+
+// Overlay is drawn over the rendition for tutorial and easy modes of the
+// game. The zero value draws nothing.
+type Overlay struct {
+	// Grid is a count of n×n tiles, zero for none.
+	Grid int
+	// GridColor is a color of grid lines like #rrggbb or #rrggbbaa, one
+	// of colors from the config. The default color is used if it is
+	// empty.
+	GridColor string
+	// GridWidth is a width of grid lines in CSS pixels, one of widths
+	// from the config. The default width is used if it is zero.
+	GridWidth int
+	// Numbers tells to draw indexes of tiles, it requires the grid.
+	Numbers bool
+	// Ghost tells to fade the image to preview the solved puzzle.
+	Ghost bool
+}
+
+func (o Overlay) empty() bool {
+	return o == Overlay{}
+}
+
+// validateOverlay checks the overlay and sets defaults from the config.
+func (c Core) validateOverlay(o Overlay) (resolved Overlay, err error) {
+	if o.empty() {
+		return o, nil
+	}
+
+	if o.Grid != 0 && (o.Grid < overlayMinGrid || o.Grid > c.cfg.OverlayMaxGrid) {
+		return Overlay{}, fmt.Errorf("grid: expected from %d to %d", overlayMinGrid, c.cfg.OverlayMaxGrid)
+	}
+
+	if o.Grid == 0 && (o.GridColor != "" || o.GridWidth != 0 || o.Numbers) {
+		return Overlay{}, fmt.Errorf("grid: required for grid_color, grid_width and numbers")
+	}
+
+	if o.Grid == 0 {
+		return o, nil
+	}
+
+	// Values are limited by the config, so clients can not fill the cache
+	// with renditions of arbitrary overlays.
+	if o.GridWidth == 0 {
+		o.GridWidth = c.cfg.OverlayGridWidth
+	} else if !c.overlayGridWidthAllowed(o.GridWidth) {
+		return Overlay{}, fmt.Errorf("grid_width: expected one of %v", c.cfg.OverlayGridWidths)
+	}
+
+	if o.GridColor == "" {
+		o.GridColor = c.cfg.OverlayGridColor
+	}
+
+	// The color is normalized, so equal colors share cached renditions.
+	o.GridColor, err = normalizeOverlayColor(o.GridColor)
+	if err != nil {
+		return Overlay{}, fmt.Errorf("grid_color: %w", err)
+	}
+
+	if !c.overlayGridColorAllowed(o.GridColor) {
+		return Overlay{}, fmt.Errorf("grid_color: expected one of %v", c.cfg.OverlayGridColors)
+	}
+
+	return o, nil
+}
+
+// overlayGridWidthAllowed tells whether the width is the default one or
+// one of widths from the config.
+func (c Core) overlayGridWidthAllowed(width int) bool {
+	if width == c.cfg.OverlayGridWidth {
+		return true
+	}
+
+	for _, allowed := range c.cfg.OverlayGridWidths {
+		if allowed == width {
+			return true
+		}
+	}
+
+	return false
+}
+
+// overlayGridColorAllowed tells whether the normalized color is the
+// default one or one of colors from the config.
+func (c Core) overlayGridColorAllowed(gridColor string) bool {
+	for _, allowed := range append([]string{c.cfg.OverlayGridColor}, c.cfg.OverlayGridColors...) {
+		allowed, err := normalizeOverlayColor(allowed)
+		if err == nil && allowed == gridColor {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeOverlayColor formats the color as #rrggbbaa in lower case.
+func normalizeOverlayColor(s string) (string, error) {
+	c, err := parseOverlayColor(s)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("#%02x%02x%02x%02x", c.R, c.G, c.B, c.A), nil
+}
+
+// overlayKey is a part of ids of renditions that depends on the resolved
+// overlay.
+func (c Core) overlayKey(o Overlay) string {
+	if o.empty() {
+		return ""
+	}
+
+	key := "-o" + strconv.Itoa(o.Grid)
+
+	if o.Grid != 0 {
+		key += "_" + strings.TrimPrefix(o.GridColor, "#") + "_w" + strconv.Itoa(o.GridWidth)
+	}
+
+	if o.Numbers {
+		key += "_n"
+	}
+
+	if o.Ghost {
+		// The opacity renders the ghost again if the config is changed.
+		key += "_g" + strconv.Itoa(int(math.Round(c.cfg.OverlayGhostOpacity*100)))
+	}
+
+	return key
+}
+
+// drawOverlay draws the resolved overlay over the resized image. The
+// ghost of images without transparency is faded to white. Grid lines are
+// scaled by the device pixel ratio.
+func (c Core) drawOverlay(img image.Image, o Overlay, format string, dpr int) (result image.Image, err error) {
+	bounds := img.Bounds()
+
+	var canvas *image.NRGBA
+
+	if o.Ghost {
+		background := color.NRGBA{}
+		if !formatHasAlpha(format) {
+			background = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+		}
+
+		canvas = imaging.Overlay(
+			imaging.New(bounds.Dx(), bounds.Dy(), background),
+			img, image.Point{}, c.cfg.OverlayGhostOpacity,
+		)
+	} else {
+		canvas = imaging.Clone(img)
+	}
+
+	if o.Grid == 0 {
+		return canvas, nil
+	}
+
+	gridColor, err := parseOverlayColor(o.GridColor)
+	if err != nil {
+		return nil, fmt.Errorf("parsing grid color: %w", err)
+	}
+
+	if dpr < 1 {
+		dpr = 1
+	}
+
+	picture.DrawGrid(canvas, o.Grid, o.GridWidth*dpr, gridColor)
+
+	if o.Numbers {
+		if err = picture.DrawTileNumbers(canvas, o.Grid); err != nil {
+			return nil, fmt.Errorf("drawing tile numbers: %w", err)
+		}
+	}
+
+	return canvas, nil
+}
+
+// formatHasAlpha tells that images of the format can be transparent.
+func formatHasAlpha(format string) bool {
+	switch format {
+	case "png", "webp", "gif":
+		return true
+	default:
+		return false
+	}
+}
+
+// parseOverlayColor parses colors like #rrggbb or #rrggbbaa.
+func parseOverlayColor(s string) (c color.NRGBA, err error) {
+	const (
+		lengthRGB  = len("#rrggbb")
+		lengthRGBA = len("#rrggbbaa")
+	)
+
+	switch len(s) {
+	case lengthRGB:
+		return parseHexColor(s)
+	case lengthRGBA:
+		c, err = parseHexColor(s[:lengthRGB])
+		if err != nil {
+			return color.NRGBA{}, err
+		}
+
+		alpha, err := strconv.ParseUint(s[lengthRGB:], 16, 8)
+		if err != nil {
+			return color.NRGBA{}, fmt.Errorf("parsing alpha: %s: %w", s, err)
+		}
+
+		c.A = uint8(alpha)
+
+		return c, nil
+	default:
+		return color.NRGBA{}, fmt.Errorf("expected #rrggbb or #rrggbbaa, got %s", s)
+	}
+}
@@ -0,0 +1,163 @@
+package core
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+)
+
+func newOverlayTestCore() Core {
+	return Core{cfg: config.Core{
+		OverlayGridColor:    "#FFFFFFCC",
+		OverlayGridWidth:    2,
+		OverlayGridColors:   []string{"#ff0000", "#000000CC"},
+		OverlayGridWidths:   []int{1, 4},
+		OverlayMaxGrid:      10,
+		OverlayGhostOpacity: 0.35,
+	}}
+}
+
+func TestValidateOverlay(t *testing.T) {
+	c := newOverlayTestCore()
+
+	testCases := []struct {
+		Name    string
+		Overlay Overlay
+		Exp     Overlay
+		ExpErr  bool
+	}{{
+		Name: "empty",
+	}, {
+		Name:    "ghost",
+		Overlay: Overlay{Ghost: true},
+		Exp:     Overlay{Ghost: true},
+	}, {
+		Name:    "defaults",
+		Overlay: Overlay{Grid: 4, Numbers: true},
+		Exp:     Overlay{Grid: 4, GridColor: "#ffffffcc", GridWidth: 2, Numbers: true},
+	}, {
+		Name:    "color",
+		Overlay: Overlay{Grid: 3, GridColor: "#FF0000", GridWidth: 4},
+		Exp:     Overlay{Grid: 3, GridColor: "#ff0000ff", GridWidth: 4},
+	}, {
+		Name:    "small_grid",
+		Overlay: Overlay{Grid: 1},
+		ExpErr:  true,
+	}, {
+		Name:    "large_grid",
+		Overlay: Overlay{Grid: 11},
+		ExpErr:  true,
+	}, {
+		Name:    "numbers_without_grid",
+		Overlay: Overlay{Numbers: true},
+		ExpErr:  true,
+	}, {
+		Name:    "default_color",
+		Overlay: Overlay{Grid: 3, GridColor: "#FFFFFFCC", GridWidth: 2},
+		Exp:     Overlay{Grid: 3, GridColor: "#ffffffcc", GridWidth: 2},
+	}, {
+		Name:    "listed_color",
+		Overlay: Overlay{Grid: 3, GridColor: "#000000cc", GridWidth: 1},
+		Exp:     Overlay{Grid: 3, GridColor: "#000000cc", GridWidth: 1},
+	}, {
+		Name:    "invalid_color",
+		Overlay: Overlay{Grid: 4, GridColor: "white"},
+		ExpErr:  true,
+	}, {
+		Name:    "unlisted_color",
+		Overlay: Overlay{Grid: 4, GridColor: "#00ff00"},
+		ExpErr:  true,
+	}, {
+		Name:    "unlisted_width",
+		Overlay: Overlay{Grid: 4, GridWidth: 3},
+		ExpErr:  true,
+	}, {
+		Name:    "negative_width",
+		Overlay: Overlay{Grid: 4, GridWidth: -1},
+		ExpErr:  true,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			got, err := c.validateOverlay(tc.Overlay)
+			switch {
+			case tc.ExpErr && err == nil:
+				t.Fatal("exp error")
+			case !tc.ExpErr && err != nil:
+				t.Fatal(err)
+			case got != tc.Exp:
+				t.Fatalf("exp %+v, got %+v", tc.Exp, got)
+			}
+		})
+	}
+}
+
+func TestOverlayKey(t *testing.T) {
+	c := newOverlayTestCore()
+
+	if got := c.overlayKey(Overlay{}); got != "" {
+		t.Fatal("exp empty key, got", got)
+	}
+
+	o := Overlay{Grid: 4, GridColor: "#ffffffcc", GridWidth: 2, Numbers: true, Ghost: true}
+	if got, exp := c.overlayKey(o), "-o4_ffffffcc_w2_n_g35"; got != exp {
+		t.Fatal("exp", exp, "got", got)
+	}
+
+	if got, exp := c.overlayKey(Overlay{Ghost: true}), "-o0_g35"; got != exp {
+		t.Fatal("exp", exp, "got", got)
+	}
+}
+
+func TestDrawOverlay(t *testing.T) {
+	c := newOverlayTestCore()
+
+	black := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	for i := 3; i < len(black.Pix); i += 4 {
+		black.Pix[i] = 255
+	}
+
+	t.Run("grid", func(t *testing.T) {
+		o := Overlay{Grid: 2, GridColor: "#ff0000ff", GridWidth: 1}
+
+		img, err := c.drawOverlay(black, o, "jpeg", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Lines are scaled by the device pixel ratio.
+		for _, x := range []int{19, 20, 0, 39} {
+			if got := color.NRGBAModel.Convert(img.At(x, 10)).(color.NRGBA); got.R != 255 {
+				t.Fatal("exp line at", x, "got", got)
+			}
+		}
+
+		if got := color.NRGBAModel.Convert(img.At(10, 10)).(color.NRGBA); got.R != 0 {
+			t.Fatal("exp no line inside tile, got", got)
+		}
+	})
+
+	t.Run("ghost", func(t *testing.T) {
+		img, err := c.drawOverlay(black, Overlay{Ghost: true}, "png", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := color.NRGBAModel.Convert(img.At(10, 10)).(color.NRGBA); got.A != 89 {
+			t.Fatal("exp transparent ghost, got", got)
+		}
+
+		img, err = c.drawOverlay(black, Overlay{Ghost: true}, "jpeg", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := color.NRGBAModel.Convert(img.At(10, 10)).(color.NRGBA); got.A != 255 || got.R != 165 {
+			t.Fatal("exp ghost faded to white, got", got)
+		}
+	})
+}
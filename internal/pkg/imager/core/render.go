@@ -0,0 +1,599 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/picture"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/jobs"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/tracing"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/validate"
+
+	"github.com/h2non/bimg"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// renditionIDPrefix is a prefix of ids of cached renditions. The rest is
+// the id of the original, the size, the crop, the quality, the variant,
+// the overlay, the watermark and the format.
+const renditionIDPrefix = "rendition-"
+
+// JobRenderImage is a type of jobs that render all renditions of the
+// image.
+const JobRenderImage = "render_image"
+
+type renderJobPayload struct {
+	ImageID string `json:"image_id"`
+}
+
+// Rendition is a resized image in the format.
+type Rendition struct {
+	// Size can have the device pixel ratio suffix like 360x480@2x.
+	Size imager.ImageSize
+	// Format is an image type, like jpeg or webp. The format of the
+	// original is used if it is empty.
+	Format string
+	// Quality is zero for the default quality, otherwise it is
+	// SaveDataQuality of the config.
+	Quality int
+	// Variant is a name of the chain of transforms from the config,
+	// empty for none.
+	Variant string
+	// Overlay is drawn over the resized image.
+	Overlay Overlay
+
+	// dpr is a device pixel ratio of the resolved size.
+	dpr int
+}
+
+// pixelSize returns the size multiplied by the device pixel ratio.
+func (r Rendition) pixelSize() imager.ImageSize {
+	if r.dpr > 1 {
+		return r.Size.Scale(r.dpr)
+	}
+
+	return r.Size
+}
+
+// qualityKey is a part of ids of renditions that depends on the quality.
+func (r Rendition) qualityKey() string {
+	if r.Quality > 0 {
+		return "-q" + strconv.Itoa(r.Quality)
+	}
+
+	return ""
+}
+
+// sizeKey is a part of ids of renditions that depends on the size.
+func (r Rendition) sizeKey() string {
+	if r.dpr > 1 {
+		return string(r.Size) + "@" + strconv.Itoa(r.dpr) + "x"
+	}
+
+	return string(r.Size)
+}
+
+// RenderReport holds the result of the rendering.
+type RenderReport struct {
+	// Rendered is a count of images with all renditions rendered.
+	Rendered int64 `json:"rendered"`
+	// Failed is a count of images that were not rendered.
+	Failed int64 `json:"failed"`
+}
+
+// GetImage downloads image, resizes it and returns its body.
+func (c Core) GetImage(
+	ctx context.Context,
+	id string,
+	size imager.ImageSize,
+) (f storage.File, err error) {
+	return c.GetRendition(ctx, id, Rendition{Size: size})
+}
+
+// GetRendition returns the cached rendition of the image. If it is not
+// cached, it is rendered from the original and cached.
+func (c Core) GetRendition(
+	ctx context.Context,
+	id string,
+	r Rendition,
+) (f storage.File, err error) {
+	l := zerolog.Ctx(ctx)
+	l.Debug().
+		Str("image_id", id).
+		Str("image_size", string(r.Size)).
+		Str("image_format", r.Format).
+		Int("image_quality", r.Quality).
+		Str("image_variant", r.Variant).
+		Int("image_grid", r.Overlay.Grid).
+		Msg("getting image")
+
+	r.Size, r.dpr, err = c.resolveSize(r.Size)
+	if err != nil {
+		err = fmt.Errorf("size: %w", err)
+
+		return storage.File{}, imerrors.NewUnprocessableEntity(err)
+	}
+
+	if r.Quality != 0 && r.Quality != c.cfg.SaveDataQuality {
+		err = fmt.Errorf("quality: expected %d or none", c.cfg.SaveDataQuality)
+
+		return storage.File{}, imerrors.NewUnprocessableEntity(err)
+	}
+
+	if r.Variant != "" {
+		if _, ok := c.variants.get(r.Variant); !ok {
+			err = fmt.Errorf("variant: unknown: %s", r.Variant)
+
+			return storage.File{}, imerrors.NewUnprocessableEntity(err)
+		}
+	}
+
+	r.Overlay, err = c.validateOverlay(r.Overlay)
+	if err != nil {
+		err = fmt.Errorf("overlay: %w", err)
+
+		return storage.File{}, imerrors.NewUnprocessableEntity(err)
+	}
+
+	if r.Format != "" {
+		if err = validate.ContentType(r.Format, c.cfg.RenditionFormats); err != nil {
+			err = fmt.Errorf("format: %w", err)
+
+			return storage.File{}, imerrors.NewUnprocessableEntity(err)
+		}
+	}
+
+	if err = c.validate.Var(id, "image_id"); err != nil {
+		err = fmt.Errorf("validating image_id: %w", err)
+
+		return storage.File{}, imerrors.NewUnprocessableEntity(err)
+	}
+
+	im, err := c.repoImageMeta.Get(ctx, id)
+	if err != nil {
+		return storage.File{}, fmt.Errorf("getting image: %w", err)
+	}
+
+	if r.Format == "" {
+		r.Format = imageFormat(im)
+	}
+
+	renditionID := c.renditionStorageID(im, r)
+
+	f, err = c.fileStorage.Get(ctx, renditionID)
+	switch {
+	case err == nil:
+		f.ContentType = formatContentType(r.Format)
+
+		return f, nil
+	case !errors.As(err, &imerrors.NotFoundError{}):
+		l.Warn().Err(err).Str("rendition_id", renditionID).Msg("getting cached rendition")
+	}
+
+	buf := c.buffersPool.Get().(*bytes.Buffer)
+	defer c.buffersPool.Put(buf)
+	buf.Reset()
+
+	if err = c.readOriginal(ctx, im.StorageID(), buf); err != nil {
+		return storage.File{}, err
+	}
+
+	data, err := c.renderImage(ctx, buf.Bytes(), im, r)
+	if err != nil {
+		return storage.File{}, err
+	}
+
+	if err = c.storeRendition(ctx, im, r, data); err != nil {
+		l.Warn().Err(err).Str("rendition_id", renditionID).Msg("caching rendition")
+	}
+
+	return storage.File{
+		ReadCloser:  io.NopCloser(bytes.NewReader(data)),
+		ContentType: formatContentType(r.Format),
+	}, nil
+}
+
+// RenderImage renders all renditions of the image and caches them.
+func (c Core) RenderImage(ctx context.Context, id string) (err error) {
+	im, err := c.repoImageMeta.Get(ctx, id)
+	if err != nil {
+		return fmt.Errorf("getting image: %w", err)
+	}
+
+	buf := c.buffersPool.Get().(*bytes.Buffer)
+	defer c.buffersPool.Put(buf)
+	buf.Reset()
+
+	if err = c.readOriginal(ctx, im.StorageID(), buf); err != nil {
+		return err
+	}
+
+	for _, r := range c.renditions(im) {
+		data, err := c.renderImage(ctx, buf.Bytes(), im, r)
+		if err != nil {
+			return fmt.Errorf("rendering %s %s: %w", r.Size, r.Format, err)
+		}
+
+		if err = c.storeRendition(ctx, im, r, data); err != nil {
+			return fmt.Errorf("caching %s %s: %w", r.Size, r.Format, err)
+		}
+	}
+
+	return nil
+}
+
+// WarmRenditions renders renditions of all images in the category with
+// concurrent workers. Errors of single images are logged and counted.
+func (c Core) WarmRenditions(
+	ctx context.Context,
+	category string,
+	workers int,
+) (report RenderReport, err error) {
+	l := zerolog.Ctx(ctx)
+
+	ids, err := c.listImageIDs(ctx, category)
+	if err != nil {
+		return RenderReport{}, err
+	}
+
+	if workers <= 0 {
+		workers = 1
+	}
+
+	idsCh := make(chan string)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for id := range idsCh {
+				if err := c.RenderImage(ctx, id); err != nil {
+					atomic.AddInt64(&report.Failed, 1)
+
+					l.Warn().Err(err).Str("image_id", id).Msg("rendering image")
+
+					continue
+				}
+
+				atomic.AddInt64(&report.Rendered, 1)
+			}
+		}()
+	}
+
+	for _, id := range ids {
+		select {
+		case idsCh <- id:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	close(idsCh)
+	wg.Wait()
+
+	return report, err
+}
+
+// QueueRenditions enqueues render jobs of all images in the category and
+// returns their count.
+func (c Core) QueueRenditions(ctx context.Context, category string) (count int, err error) {
+	ids, err := c.listImageIDs(ctx, category)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if err = c.enqueueRendering(ctx, id); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// HandleRenderJob is the handler of JobRenderImage jobs. Images deleted
+// before the job is processed are skipped.
+func (c Core) HandleRenderJob(ctx context.Context, job jobs.Job) (err error) {
+	var payload renderJobPayload
+	if err = job.Decode(&payload); err != nil {
+		return err
+	}
+
+	err = c.RenderImage(ctx, payload.ImageID)
+	if errors.As(err, &imerrors.NotFoundError{}) {
+		zerolog.Ctx(ctx).Debug().Str("image_id", payload.ImageID).Msg("rendering deleted image")
+
+		return nil
+	}
+
+	return err
+}
+
+func (c Core) enqueueRendering(ctx context.Context, id string) (err error) {
+	_, err = c.jobs.Enqueue(ctx, JobRenderImage, renderJobPayload{ImageID: id})
+	if err != nil {
+		return fmt.Errorf("enqueueing render job: %w", err)
+	}
+
+	return nil
+}
+
+// listImageIDs returns ids of all images in the category.
+func (c Core) listImageIDs(ctx context.Context, category string) (ids []string, err error) {
+	if err = c.validate.Var(category, "category"); err != nil {
+		err = fmt.Errorf("validating category: %w", err)
+
+		return nil, imerrors.NewUnprocessableEntity(err)
+	}
+
+	rawIMs, err := c.listCategory(ctx, category)
+	if err != nil {
+		return nil, fmt.Errorf("listing images: %w", err)
+	}
+
+	ids = make([]string, 0, len(rawIMs))
+	for _, rawIM := range rawIMs {
+		im, err := rawIM.ImageMeta()
+		if err != nil {
+			return nil, fmt.Errorf("decoding image meta: %w", err)
+		}
+
+		ids = append(ids, im.ID)
+	}
+
+	return ids, nil
+}
+
+// renditions returns all renditions of the image: every supported size
+// in the format of the original and in configured formats.
+func (c Core) renditions(im imager.ImageMeta) []Rendition {
+	formats := []string{imageFormat(im)}
+	for _, format := range c.cfg.RenditionFormats {
+		if format != formats[0] {
+			formats = append(formats, format)
+		}
+	}
+
+	renditions := make([]Rendition, 0, len(c.cfg.SupportedImageSizes)*len(formats))
+	for _, size := range c.cfg.SupportedImageSizes {
+		for _, format := range formats {
+			renditions = append(renditions, Rendition{Size: size, Format: format})
+		}
+	}
+
+	return renditions
+}
+
+// renderImage crops and resizes the original, the format of the
+// rendition should be set.
+func (c Core) renderImage(
+	ctx context.Context,
+	data []byte,
+	im imager.ImageMeta,
+	r Rendition,
+) (rendered []byte, err error) {
+	_, span := tracing.Start(ctx, "bimg.Render",
+		attribute.String("imager.image_id", im.ID),
+		attribute.String("imager.size", string(r.Size)),
+		attribute.String("imager.format", r.Format),
+		attribute.String("imager.variant", r.Variant),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	// Originals uploaded before the limits were configured are checked
+	// before resizing.
+	hdr, err := picture.DecodeHeader(data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding image header: %w", err)
+	}
+
+	if err = c.validateDimensions(hdr); err != nil {
+		return nil, imerrors.NewUnprocessableEntity(err)
+	}
+
+	imageType, err := renditionImageType(r.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	gravity := bimg.GravitySmart
+
+	// bimg rotates the image by the EXIF orientation before extracting
+	// the area.
+	originalWidth, originalHeight := hdr.OrientedSize()
+
+	if area, ok := cropArea(im, originalWidth, originalHeight, r.Size); ok {
+		data, err = bimg.NewImage(data).Extract(area.Min.Y, area.Min.X, area.Dx(), area.Dy())
+		if err != nil {
+			return nil, fmt.Errorf("cropping image: %w", err)
+		}
+
+		// The area has the aspect ratio of the size already.
+		gravity = bimg.GravityCentre
+	}
+
+	// The variant is checked by the validation, it is empty without it.
+	v, _ := c.variants.get(r.Variant)
+
+	width, height := r.pixelSize().Size()
+
+	opts := bimg.Options{
+		Width:   width,
+		Height:  height,
+		Embed:   true,
+		Crop:    true,
+		Gravity: gravity,
+		Type:    imageType,
+		Quality: r.Quality,
+	}
+	v.apply(&opts)
+
+	if !v.postprocessed() && r.Overlay.empty() && !c.watermarked(im, r) {
+		rendered, err = bimg.NewImage(data).Process(opts)
+		if err != nil {
+			return nil, fmt.Errorf("resizing image: %w", err)
+		}
+
+		return rendered, nil
+	}
+
+	// The resized image is kept lossless until it is postprocessed.
+	opts.Type = bimg.PNG
+	opts.Quality = 0
+
+	resized, err := bimg.NewImage(data).Process(opts)
+	if err != nil {
+		return nil, fmt.Errorf("resizing image: %w", err)
+	}
+
+	processed, err := c.postprocess(resized, im, v, r)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered, err = bimg.NewImage(processed).Process(bimg.Options{
+		Type:    imageType,
+		Quality: r.Quality,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("converting image: %w", err)
+	}
+
+	return rendered, nil
+}
+
+// postprocess applies the variant and draws the overlay and the
+// watermark over the resized image, the result is encoded to PNG.
+func (c Core) postprocess(
+	resized []byte,
+	im imager.ImageMeta,
+	v variant,
+	r Rendition,
+) (processed []byte, err error) {
+	img, err := picture.Decode(resized)
+	if err != nil {
+		return nil, fmt.Errorf("decoding resized image: %w", err)
+	}
+
+	img = v.postprocess(img)
+
+	if !r.Overlay.empty() {
+		img, err = c.drawOverlay(img, r.Overlay, r.Format, r.dpr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.watermarked(im, r) {
+		img, err = c.watermark.draw(img, im)
+		if err != nil {
+			return nil, fmt.Errorf("drawing watermark: %w", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("encoding processed image: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c Core) storeRendition(
+	ctx context.Context,
+	im imager.ImageMeta,
+	r Rendition,
+	data []byte,
+) (err error) {
+	return c.fileStorage.Upload(ctx, imager.ImageMeta{
+		ID:       c.renditionStorageID(im, r),
+		MIMEType: formatContentType(r.Format),
+		Size:     int64(len(data)),
+	}, bytes.NewReader(data))
+}
+
+// deleteRenditions deletes all cached renditions of the original: every
+// size, device pixel ratio, crop, quality, variant, overlay and watermark.
+// Renditions of images that share the original are rendered again on
+// demand.
+func (c Core) deleteRenditions(ctx context.Context, im imager.ImageMeta) (err error) {
+	var ids []string
+
+	prefix := renditionIDPrefix + im.StorageID() + "-"
+
+	err = c.fileStorage.List(ctx, prefix, func(fi storage.FileInfo) error {
+		ids = append(ids, fi.ID)
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing renditions: %w", err)
+	}
+
+	for _, id := range ids {
+		err = c.fileStorage.Delete(ctx, id)
+		if err != nil && !errors.As(err, &imerrors.NotFoundError{}) {
+			return fmt.Errorf("deleting rendition: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// variantRenditions returns the rendition in every configured variant.
+func (c Core) variantRenditions(r Rendition) []Rendition {
+	names := c.variants.names()
+	renditions := make([]Rendition, 0, len(names))
+
+	for _, name := range names {
+		r.Variant = name
+		renditions = append(renditions, r)
+	}
+
+	return renditions
+}
+
+func (c Core) renditionStorageID(im imager.ImageMeta, r Rendition) string {
+	return renditionIDPrefix + im.StorageID() + "-" + r.sizeKey() + cropKey(im, r.Size) + r.qualityKey() +
+		c.variants.key(r.Variant) + c.overlayKey(r.Overlay) + c.watermarkKey(im, r) + "." + r.Format
+}
+
+func renditionImageType(format string) (bimg.ImageType, error) {
+	for imageType, name := range bimg.ImageTypes {
+		if name == format {
+			return imageType, nil
+		}
+	}
+
+	return bimg.UNKNOWN, fmt.Errorf("unknown format: %s", format)
+}
+
+// imageFormat returns the format of the original.
+func imageFormat(im imager.ImageMeta) string {
+	return strings.TrimPrefix(im.MIMEType, "image/")
+}
+
+func formatContentType(format string) string {
+	return "image/" + format
+}
@@ -0,0 +1,256 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/picture"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository"
+)
+
+// searchScanBatch is a count of images read at once while searching.
+const searchScanBatch = 200
+
+// Sort keys of images.
+const (
+	SortDifficulty     = "difficulty"
+	SortDifficultyDesc = "-difficulty"
+)
+
+// ImageFilter selects images of the category. Zero values match all
+// images.
+type ImageFilter struct {
+	// Hue is a name of the hue nearest to the most dominant chromatic
+	// color of the image, like blue.
+	Hue string `json:"hue"`
+	// Grid selects the difficulty of the grid of n×n tiles, zero
+	// selects the average difficulty.
+	Grid int `json:"grid"`
+	// MinDifficulty and MaxDifficulty limit the difficulty. Images of
+	// unknown difficulty do not match.
+	MinDifficulty *float64 `json:"min_difficulty" validate:"omitempty,gte=0,lte=1"`
+	MaxDifficulty *float64 `json:"max_difficulty" validate:"omitempty,gte=0,lte=1"`
+	// Sort is empty to keep the order of the category, otherwise it is
+	// SortDifficulty or SortDifficultyDesc. Images of unknown
+	// difficulty are the last.
+	Sort string `json:"sort" validate:"omitempty,oneof=difficulty -difficulty"`
+}
+
+func (f ImageFilter) empty() bool {
+	return f == ImageFilter{}
+}
+
+// SearchImages returns a list of images of the category that match the
+// filter by pagination. Images are read from the whole category unless
+// the filter is empty.
+func (c Core) SearchImages(
+	ctx context.Context,
+	category string,
+	filter ImageFilter,
+	pagination repository.Pagination,
+) (im []imager.RawImageMetaJSON, err error) {
+	if filter.empty() {
+		return c.ListImages(ctx, category, pagination)
+	}
+
+	if err = c.validateFilter(filter); err != nil {
+		return nil, imerrors.NewUnprocessableEntity(err)
+	}
+
+	if err = c.validate.Var(category, "category"); err != nil {
+		err = fmt.Errorf("validating category: %w", err)
+
+		return nil, imerrors.NewUnprocessableEntity(err)
+	}
+
+	if err = c.validate.Struct(&pagination); err != nil {
+		err = fmt.Errorf("validating pagination: %w", err)
+
+		return nil, imerrors.NewUnprocessableEntity(err)
+	}
+
+	type match struct {
+		raw        imager.RawImageMetaJSON
+		difficulty float64
+		known      bool
+	}
+
+	var matches []match
+
+	// Without sorting, the scan stops when the page is filled.
+	need := pagination.Offset + pagination.Limit
+
+	for offset := 0; filter.Sort != "" || len(matches) < need; offset += searchScanBatch {
+		batch, err := c.repoImageMeta.List(ctx, category, repository.Pagination{
+			Limit:  searchScanBatch,
+			Offset: offset,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing images: %w", err)
+		}
+
+		for _, raw := range batch {
+			// Meta can be deleted concurrently.
+			if len(raw) == 0 {
+				continue
+			}
+
+			meta, err := raw.ImageMeta()
+			if err != nil {
+				return nil, err
+			}
+
+			if filter.Hue != "" && imageHue(meta) != filter.Hue {
+				continue
+			}
+
+			difficulty, known := difficultyOf(meta, filter.Grid)
+			if filter.MinDifficulty != nil || filter.MaxDifficulty != nil {
+				if !known || !difficultyInRange(difficulty, filter) {
+					continue
+				}
+			}
+
+			matches = append(matches, match{raw: raw, difficulty: difficulty, known: known})
+		}
+
+		if len(batch) < searchScanBatch {
+			break
+		}
+	}
+
+	if filter.Sort != "" {
+		desc := filter.Sort == SortDifficultyDesc
+
+		sort.SliceStable(matches, func(i, j int) bool {
+			a, b := matches[i], matches[j]
+			if a.known != b.known {
+				return a.known
+			}
+
+			if desc {
+				return a.difficulty > b.difficulty
+			}
+
+			return a.difficulty < b.difficulty
+		})
+	}
+
+	if pagination.Offset >= len(matches) {
+		return nil, nil
+	}
+
+	matches = matches[pagination.Offset:]
+	if len(matches) > pagination.Limit {
+		matches = matches[:pagination.Limit]
+	}
+
+	im = make([]imager.RawImageMetaJSON, len(matches))
+	for i, m := range matches {
+		im[i] = m.raw
+	}
+
+	return im, nil
+}
+
+func (c Core) validateFilter(filter ImageFilter) (err error) {
+	if filter.Hue != "" && !knownHue(filter.Hue) {
+		return fmt.Errorf("hue: expected one of %s", hueNames())
+	}
+
+	if filter.Grid != 0 && !c.knownGrid(filter.Grid) {
+		return fmt.Errorf("grid: expected one of %v", c.cfg.DifficultyGrids)
+	}
+
+	if err = c.validate.Struct(&filter); err != nil {
+		return fmt.Errorf("validating filter: %w", err)
+	}
+
+	if filter.MinDifficulty != nil && filter.MaxDifficulty != nil &&
+		*filter.MinDifficulty > *filter.MaxDifficulty {
+		return imerrors.Error("min difficulty is greater than max one")
+	}
+
+	return nil
+}
+
+func (c Core) knownGrid(n int) bool {
+	for _, grid := range c.cfg.DifficultyGrids {
+		if grid == n {
+			return true
+		}
+	}
+
+	return false
+}
+
+// imageDifficulty computes the difficulty of the image for configured
+// grids and the average one.
+func (c Core) imageDifficulty(img image.Image) (average float64, grids map[string]float64) {
+	return ImageDifficulty(img, c.cfg.DifficultyGrids)
+}
+
+// ImageDifficulty computes the difficulty of the image for each grid of
+// n×n tiles keyed like 4x4 and the average one, as they are stored in
+// the image meta.
+func ImageDifficulty(img image.Image, grids []int) (average float64, gridDifficulty map[string]float64) {
+	difficulty := picture.Difficulty(img, grids)
+	if len(difficulty) == 0 {
+		return 0, nil
+	}
+
+	gridDifficulty = make(map[string]float64, len(difficulty))
+	for n, d := range difficulty {
+		gridDifficulty[gridKey(n)] = d
+		average += d
+	}
+
+	return math.Round(average/float64(len(difficulty))*1000) / 1000, gridDifficulty
+}
+
+// HasGridDifficulty tells if the difficulty of the image is known for
+// each of grids.
+func HasGridDifficulty(im imager.ImageMeta, grids []int) bool {
+	for _, grid := range grids {
+		if _, ok := im.GridDifficulty[gridKey(grid)]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// difficultyOf returns the difficulty of the grid of the image, the
+// average one if the grid is zero. It is false if it is unknown.
+func difficultyOf(im imager.ImageMeta, grid int) (difficulty float64, known bool) {
+	if grid != 0 {
+		difficulty, known = im.GridDifficulty[gridKey(grid)]
+
+		return difficulty, known
+	}
+
+	return im.Difficulty, len(im.GridDifficulty) > 0
+}
+
+func difficultyInRange(difficulty float64, filter ImageFilter) bool {
+	if filter.MinDifficulty != nil && difficulty < *filter.MinDifficulty {
+		return false
+	}
+
+	if filter.MaxDifficulty != nil && difficulty > *filter.MaxDifficulty {
+		return false
+	}
+
+	return true
+}
+
+// gridKey returns the key of the grid of n×n tiles like 4x4.
+func gridKey(n int) string {
+	return strconv.Itoa(n) + "x" + strconv.Itoa(n)
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/validate"
+)
+
+func TestDifficultyOf(t *testing.T) {
+	im := imager.ImageMeta{
+		Difficulty:     0.5,
+		GridDifficulty: map[string]float64{"3x3": 0.4, "4x4": 0.6},
+	}
+
+	testCases := []struct {
+		Name     string
+		Meta     imager.ImageMeta
+		Grid     int
+		Exp      float64
+		ExpKnown bool
+	}{{
+		Name:     "average",
+		Meta:     im,
+		Exp:      0.5,
+		ExpKnown: true,
+	}, {
+		Name:     "grid",
+		Meta:     im,
+		Grid:     4,
+		Exp:      0.6,
+		ExpKnown: true,
+	}, {
+		Name: "unknown_grid",
+		Meta: im,
+		Grid: 5,
+	}, {
+		Name: "unknown",
+		Meta: imager.ImageMeta{},
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			got, known := difficultyOf(tc.Meta, tc.Grid)
+			if got != tc.Exp || known != tc.ExpKnown {
+				t.Fatal("exp", tc.Exp, tc.ExpKnown, "got", got, known)
+			}
+		})
+	}
+}
+
+func TestHasGridDifficulty(t *testing.T) {
+	im := imager.ImageMeta{GridDifficulty: map[string]float64{"3x3": 0.4, "4x4": 0.6}}
+
+	switch {
+	case !HasGridDifficulty(im, []int{3, 4}):
+		t.Fatal("exp known grids")
+	case HasGridDifficulty(im, []int{4, 5}):
+		t.Fatal("exp unknown grid 5")
+	case !HasGridDifficulty(imager.ImageMeta{}, nil):
+		t.Fatal("exp no grids to be known")
+	}
+}
+
+func TestDifficultyInRange(t *testing.T) {
+	min, max := 0.2, 0.6
+
+	filter := ImageFilter{MinDifficulty: &min, MaxDifficulty: &max}
+
+	for difficulty, exp := range map[float64]bool{0.1: false, 0.2: true, 0.6: true, 0.7: false} {
+		if got := difficultyInRange(difficulty, filter); got != exp {
+			t.Fatal(difficulty, "exp", exp, "got", got)
+		}
+	}
+}
+
+type searchTestRepository struct {
+	repository.ImageMetaRepository
+
+	images []imager.RawImageMetaJSON
+}
+
+func (r searchTestRepository) List(
+	ctx context.Context,
+	category string,
+	pagination repository.Pagination,
+) ([]imager.RawImageMetaJSON, error) {
+	if pagination.Offset >= len(r.images) {
+		return nil, nil
+	}
+
+	return r.images[pagination.Offset:], nil
+}
+
+func TestSearchImages_deleted(t *testing.T) {
+	im, err := imager.ImageMeta{
+		ID:             "00000000-0000-0000-0000-000000000001",
+		Difficulty:     0.5,
+		GridDifficulty: map[string]float64{"3x3": 0.5},
+	}.RawJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Core{
+		validate: validate.New(),
+		// The meta of the first image is deleted concurrently.
+		repoImageMeta: searchTestRepository{images: []imager.RawImageMetaJSON{nil, im}},
+	}
+
+	got, err := c.SearchImages(context.Background(), "all", ImageFilter{
+		Sort: SortDifficulty,
+	}, repository.Pagination{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 || string(got[0]) != string(im) {
+		t.Fatal("exp the only image, got", got)
+	}
+}
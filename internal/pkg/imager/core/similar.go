@@ -0,0 +1,307 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/picture"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+
+	"github.com/rs/zerolog"
+)
+
+// NearDuplicatePolicy tells what to do with uploads of images similar
+// to known ones.
+type NearDuplicatePolicy string
+
+// Near duplicate policies.
+const (
+	// NearDuplicatesWarn saves the image and returns ids of similar
+	// images.
+	NearDuplicatesWarn NearDuplicatePolicy = "warn"
+	// NearDuplicatesReject rejects the upload with DuplicateError.
+	NearDuplicatesReject NearDuplicatePolicy = "reject"
+)
+
+// SimilarImage is an image with the distance to the requested one.
+type SimilarImage struct {
+	imager.ImageMeta
+
+	// Distance is a Hamming distance between perceptual hashes.
+	Distance int `json:"distance"`
+}
+
+// similarImageID is an id of the similar image.
+type similarImageID struct {
+	ID       string
+	Distance int
+}
+
+// SimilarImages returns images similar to the given one, the closest
+// first. Images without the perceptual hash have no similar images.
+func (c Core) SimilarImages(
+	ctx context.Context,
+	id string,
+	limit int,
+) (images []SimilarImage, err error) {
+	if err = c.validate.Var(id, "image_id"); err != nil {
+		err = fmt.Errorf("validating image_id: %w", err)
+
+		return nil, imerrors.NewUnprocessableEntity(err)
+	}
+
+	if err = c.validate.Var(limit, "min=1,max=100"); err != nil {
+		err = fmt.Errorf("validating limit: %w", err)
+
+		return nil, imerrors.NewUnprocessableEntity(err)
+	}
+
+	im, err := c.repoImageMeta.Get(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("getting image: %w", err)
+	}
+
+	if im.DHash == "" {
+		return nil, nil
+	}
+
+	similar, err := c.findSimilar(ctx, im.ID, im.DHash)
+	if err != nil {
+		return nil, err
+	}
+
+	images = make([]SimilarImage, 0, limit)
+	for _, s := range similar {
+		if len(images) == limit {
+			break
+		}
+
+		im, err := c.repoImageMeta.Get(ctx, s.ID)
+		switch {
+		case errors.As(err, &imerrors.NotFoundError{}):
+			// It was deleted concurrently.
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("getting similar image: %w", err)
+		}
+
+		images = append(images, SimilarImage{
+			ImageMeta: im,
+			Distance:  s.Distance,
+		})
+	}
+
+	return images, nil
+}
+
+// NearDuplicateClusters groups images with close perceptual hashes.
+// Images are in the same cluster if there is a chain of images between
+// them with distances up to maxDistance. Each cluster has at least two
+// images. A negative maxDistance means the configured one, it can not be
+// greater than picture.MaxBandDistance.
+func (c Core) NearDuplicateClusters(
+	ctx context.Context,
+	maxDistance int,
+) (clusters [][]string, err error) {
+	if maxDistance < 0 {
+		maxDistance = c.nearDuplicateDistance()
+	}
+
+	if err = c.validate.Var(maxDistance, "max="+strconv.Itoa(picture.MaxBandDistance)); err != nil {
+		err = fmt.Errorf("validating distance: %w", err)
+
+		return nil, imerrors.NewUnprocessableEntity(err)
+	}
+
+	hashes, err := c.dhashes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(hashes))
+	for id := range hashes {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	// Disjoint set of indexes of ids.
+	parents := make([]int, len(ids))
+	for i := range parents {
+		parents[i] = i
+	}
+
+	find := func(i int) int {
+		for parents[i] != i {
+			parents[i] = parents[parents[i]]
+			i = parents[i]
+		}
+
+		return i
+	}
+
+	// Close hashes share a band, so only hashes of the same band are
+	// compared instead of all pairs.
+	bands := make(map[string][]int)
+	for i, id := range ids {
+		for _, band := range picture.Bands(hashes[id]) {
+			bands[band] = append(bands[band], i)
+		}
+	}
+
+	for _, band := range bands {
+		for k, i := range band {
+			for _, j := range band[k+1:] {
+				if find(i) != find(j) && picture.Distance(hashes[ids[i]], hashes[ids[j]]) <= maxDistance {
+					parents[find(j)] = find(i)
+				}
+			}
+		}
+	}
+
+	groups := make(map[int][]string)
+	for i, id := range ids {
+		root := find(i)
+		groups[root] = append(groups[root], id)
+	}
+
+	for _, group := range groups {
+		if len(group) > 1 {
+			clusters = append(clusters, group)
+		}
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i][0] < clusters[j][0]
+	})
+
+	return clusters, nil
+}
+
+// checkNearDuplicates finds images similar to the uploaded one. Exact
+// duplicates are handled by the duplicates policy, so they are skipped.
+func (c Core) checkNearDuplicates(
+	ctx context.Context,
+	im imager.ImageMeta,
+	sameIDs []string,
+	policy NearDuplicatePolicy,
+) (imageIDs []string, err error) {
+	similar, err := c.findSimilar(ctx, im.ID, im.DHash)
+	if err != nil {
+		return nil, err
+	}
+
+	same := make(map[string]struct{}, len(sameIDs))
+	for _, id := range sameIDs {
+		same[id] = struct{}{}
+	}
+
+	for _, s := range similar {
+		if _, ok := same[s.ID]; ok {
+			continue
+		}
+
+		if policy == NearDuplicatesReject {
+			return nil, imerrors.NewConflictError(DuplicateError{
+				ImageID:  s.ID,
+				Distance: s.Distance,
+			})
+		}
+
+		imageIDs = append(imageIDs, s.ID)
+	}
+
+	if len(imageIDs) > 0 {
+		zerolog.Ctx(ctx).Warn().
+			Str("image_id", im.ID).
+			Strs("similar", imageIDs).
+			Msg("uploading near duplicate")
+	}
+
+	return imageIDs, nil
+}
+
+// findSimilar returns ids of images with hashes up to the configured
+// distance from the given one, the closest first. The image itself is
+// skipped. Only images that share a band of the hash are compared.
+func (c Core) findSimilar(
+	ctx context.Context,
+	id string,
+	dhash string,
+) (similar []similarImageID, err error) {
+	hash, err := picture.ParseHash(dhash)
+	if err != nil {
+		return nil, err
+	}
+
+	rawHashes, err := c.repoImageMeta.FindByDHash(ctx, dhash)
+	if err != nil {
+		return nil, fmt.Errorf("finding dhashes: %w", err)
+	}
+
+	maxDistance := c.nearDuplicateDistance()
+	for otherID, rawHash := range rawHashes {
+		otherHash, err := picture.ParseHash(rawHash)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("image_id", otherID).Msg("invalid dhash")
+
+			continue
+		}
+
+		d := picture.Distance(hash, otherHash)
+		if otherID != id && d <= maxDistance {
+			similar = append(similar, similarImageID{
+				ID:       otherID,
+				Distance: d,
+			})
+		}
+	}
+
+	sort.Slice(similar, func(i, j int) bool {
+		if similar[i].Distance != similar[j].Distance {
+			return similar[i].Distance < similar[j].Distance
+		}
+
+		return similar[i].ID < similar[j].ID
+	})
+
+	return similar, nil
+}
+
+// nearDuplicateDistance returns the configured distance of near
+// duplicates. Farther hashes may have no equal bands, the distance is
+// limited by picture.MaxBandDistance.
+func (c Core) nearDuplicateDistance() int {
+	if c.cfg.NearDuplicateDistance > picture.MaxBandDistance {
+		return picture.MaxBandDistance
+	}
+
+	return c.cfg.NearDuplicateDistance
+}
+
+// dhashes returns parsed perceptual hashes of all images. Invalid
+// hashes are skipped.
+func (c Core) dhashes(ctx context.Context) (hashes map[string]uint64, err error) {
+	rawHashes, err := c.repoImageMeta.DHashes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting dhashes: %w", err)
+	}
+
+	hashes = make(map[string]uint64, len(rawHashes))
+	for id, rawHash := range rawHashes {
+		hash, err := picture.ParseHash(rawHash)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("image_id", id).Msg("invalid dhash")
+
+			continue
+		}
+
+		hashes[id] = hash
+	}
+
+	return hashes, nil
+}
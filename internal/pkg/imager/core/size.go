@@ -0,0 +1,134 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/validate"
+)
+
+// Size policies.
+const (
+	// SizePolicyList allows only supported image sizes.
+	SizePolicyList = "list"
+	// SizePolicySnap snaps other sizes to the nearest allowed size.
+	SizePolicySnap = "snap"
+	// SizePolicyReject rejects other sizes that are not allowed.
+	SizePolicyReject = "reject"
+)
+
+// resolveSize splits the device pixel ratio suffix of the requested size
+// and applies the size policy to the rest. Supported image sizes are
+// always allowed.
+func (c Core) resolveSize(requested imager.ImageSize) (size imager.ImageSize, dpr int, err error) {
+	size, dpr = requested.DPR()
+	if dpr == 0 || (dpr > 1 && dpr > c.cfg.MaxDPR) {
+		return "", 0, fmt.Errorf("device pixel ratio should be from 1 to %d", c.cfg.MaxDPR)
+	}
+
+	if validate.ImageSize(size, c.cfg.SupportedImageSizes) == nil {
+		return size, dpr, nil
+	}
+
+	switch c.cfg.SizePolicy {
+	case SizePolicySnap:
+		size, err = c.snapSize(size)
+		if err != nil {
+			return "", 0, err
+		}
+	case SizePolicyReject:
+		snapped, err := c.snapSize(size)
+		switch {
+		case err != nil:
+			return "", 0, err
+		case snapped != size:
+			return "", 0, fmt.Errorf("size is not allowed, the nearest one is %s", snapped)
+		}
+	default:
+		if err = validate.ImageSize(size, c.cfg.SupportedImageSizes); err != nil {
+			return "", 0, err
+		}
+	}
+
+	return size, dpr, nil
+}
+
+// snapSize returns the nearest size with an allowed aspect ratio, the
+// width rounded to the step and dimensions within limits.
+func (c Core) snapSize(size imager.ImageSize) (snapped imager.ImageSize, err error) {
+	width, height := size.Size()
+	if width == 0 {
+		return "", fmt.Errorf("expected WIDTHxHEIGHT, got %s", size)
+	}
+
+	if len(c.cfg.SizeAspectRatios) == 0 {
+		return imager.NewImageSize(c.snapDimension(width), c.snapDimension(height)), nil
+	}
+
+	ratioWidth, ratioHeight, err := nearestAspectRatio(width, height, c.cfg.SizeAspectRatios)
+	if err != nil {
+		return "", err
+	}
+
+	width = c.snapDimension(width)
+	height = int(math.Round(float64(width*ratioHeight) / float64(ratioWidth)))
+
+	if limited := c.limitDimension(height); limited != height {
+		height = limited
+		width = c.limitDimension(int(math.Round(float64(height*ratioWidth) / float64(ratioHeight))))
+	}
+
+	return imager.NewImageSize(width, height), nil
+}
+
+// snapDimension rounds the value to the step and limits it.
+func (c Core) snapDimension(value int) int {
+	if step := c.cfg.SizeStep; step > 0 {
+		value = int(math.Round(float64(value)/float64(step))) * step
+		if value < step {
+			value = step
+		}
+	}
+
+	return c.limitDimension(value)
+}
+
+// limitDimension returns the value within the min and the max
+// dimensions, zero disables the limit.
+func (c Core) limitDimension(value int) int {
+	if c.cfg.SizeMinDimension > 0 && value < c.cfg.SizeMinDimension {
+		value = c.cfg.SizeMinDimension
+	}
+
+	if c.cfg.SizeMaxDimension > 0 && value > c.cfg.SizeMaxDimension {
+		value = c.cfg.SizeMaxDimension
+	}
+
+	return value
+}
+
+// nearestAspectRatio returns the ratio closest to width:height from
+// ratios like 3:4.
+func nearestAspectRatio(
+	width, height int,
+	ratios []string,
+) (ratioWidth, ratioHeight int, err error) {
+	target := math.Log(float64(width) / float64(height))
+	minDistance := math.Inf(1)
+
+	for _, ratio := range ratios {
+		w, h := imager.ImageSize(strings.Replace(ratio, ":", "x", 1)).Size()
+		if w == 0 {
+			return 0, 0, fmt.Errorf("invalid aspect ratio in config: %s", ratio)
+		}
+
+		if distance := math.Abs(math.Log(float64(w)/float64(h)) - target); distance < minDistance {
+			minDistance = distance
+			ratioWidth, ratioHeight = w, h
+		}
+	}
+
+	return ratioWidth, ratioHeight, nil
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+)
+
+func TestResolveSize(t *testing.T) {
+	newCore := func(policy string, ratios ...string) Core {
+		return Core{cfg: config.Core{
+			SupportedImageSizes: []imager.ImageSize{"360x480", "1000x1000"},
+			SizePolicy:          policy,
+			SizeAspectRatios:    ratios,
+			SizeMinDimension:    32,
+			SizeMaxDimension:    2048,
+			SizeStep:            16,
+			MaxDPR:              3,
+		}}
+	}
+
+	testCases := []struct {
+		Name    string
+		Core    Core
+		Size    imager.ImageSize
+		ExpSize imager.ImageSize
+		ExpDPR  int
+		ExpErr  bool
+	}{{
+		Name:    "supported",
+		Core:    newCore(SizePolicyList),
+		Size:    "360x480",
+		ExpSize: "360x480",
+		ExpDPR:  1,
+	}, {
+		Name:    "supported_dpr",
+		Core:    newCore(SizePolicyList),
+		Size:    "360x480@3x",
+		ExpSize: "360x480",
+		ExpDPR:  3,
+	}, {
+		Name:   "dpr_too_large",
+		Core:   newCore(SizePolicyList),
+		Size:   "360x480@4x",
+		ExpErr: true,
+	}, {
+		Name:   "invalid_dpr",
+		Core:   newCore(SizePolicyList),
+		Size:   "360x480@x",
+		ExpErr: true,
+	}, {
+		Name:   "list",
+		Core:   newCore(SizePolicyList),
+		Size:   "400x300",
+		ExpErr: true,
+	}, {
+		Name:    "snap_step",
+		Core:    newCore(SizePolicySnap),
+		Size:    "401x297",
+		ExpSize: "400x304",
+		ExpDPR:  1,
+	}, {
+		Name:    "snap_limits",
+		Core:    newCore(SizePolicySnap),
+		Size:    "4000x1@2x",
+		ExpSize: "2048x32",
+		ExpDPR:  2,
+	}, {
+		Name:    "snap_ratio",
+		Core:    newCore(SizePolicySnap, "3:4", "16:9"),
+		Size:    "390x500",
+		ExpSize: "384x512",
+		ExpDPR:  1,
+	}, {
+		Name:    "snap_ratio_limits",
+		Core:    newCore(SizePolicySnap, "1:4"),
+		Size:    "1000x4000",
+		ExpSize: "512x2048",
+		ExpDPR:  1,
+	}, {
+		Name:   "snap_invalid",
+		Core:   newCore(SizePolicySnap),
+		Size:   "auto",
+		ExpErr: true,
+	}, {
+		Name:    "reject_allowed",
+		Core:    newCore(SizePolicyReject, "16:9"),
+		Size:    "640x360",
+		ExpSize: "640x360",
+		ExpDPR:  1,
+	}, {
+		Name:   "reject",
+		Core:   newCore(SizePolicyReject, "16:9"),
+		Size:   "640x480",
+		ExpErr: true,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			size, dpr, err := tc.Core.resolveSize(tc.Size)
+
+			switch {
+			case tc.ExpErr && err == nil:
+				t.Fatal("exp error, got", size, dpr)
+			case tc.ExpErr:
+				return
+			case err != nil:
+				t.Fatal(err)
+			case size != tc.ExpSize || dpr != tc.ExpDPR:
+				t.Fatal("exp", tc.ExpSize, tc.ExpDPR, "got", size, dpr)
+			}
+		})
+	}
+}
+
+func TestRendition_sizeKey(t *testing.T) {
+	r := Rendition{Size: "360x480", dpr: 2}
+
+	if got := r.sizeKey(); got != "360x480@2x" {
+		t.Fatal("got", got)
+	}
+
+	if got := r.pixelSize(); got != "720x960" {
+		t.Fatal("got", got)
+	}
+
+	r.dpr = 0
+
+	if got := r.sizeKey(); got != "360x480" {
+		t.Fatal("got", got)
+	}
+}
@@ -0,0 +1,246 @@
+package core
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+
+	"github.com/disintegration/imaging"
+	"github.com/h2non/bimg"
+)
+
+// Steps of variants.
+const (
+	stepGrayscale = "grayscale"
+	stepBlur      = "blur"
+	stepSharpen   = "sharpen"
+	stepContrast  = "contrast"
+	stepRemap     = "remap"
+
+	defaultBlurSigma       = 2
+	defaultContrastPercent = 30
+)
+
+// Color vision deficiencies corrected by the remap step.
+const (
+	remapProtanopia   = "protanopia"
+	remapDeuteranopia = "deuteranopia"
+	remapTritanopia   = "tritanopia"
+)
+
+// variant is a parsed chain of transforms. Grayscale, blur and sharpen
+// are applied by libvips while resizing, contrast and remapping are
+// applied to the resized image.
+type variant struct {
+	grayscale bool
+	blur      float64
+	sharpen   bool
+	contrast  float64
+	remap     string
+}
+
+// Variants are named chains of transforms of renditions parsed from the
+// config.
+type Variants struct {
+	chains map[string]variant
+	// keys are parts of ids of renditions of variants.
+	keys map[string]string
+}
+
+// NewVariants parses chains of transforms of variants from the config.
+func NewVariants(cfg config.Core) (*Variants, error) {
+	v := &Variants{
+		chains: make(map[string]variant, len(cfg.Variants)),
+		keys:   make(map[string]string, len(cfg.Variants)),
+	}
+
+	for name, steps := range cfg.Variants {
+		chain, err := parseVariant(steps)
+		if err != nil {
+			return nil, fmt.Errorf("variant %s: %w", name, err)
+		}
+
+		v.chains[name] = chain
+		v.keys[name] = variantKey(name, steps)
+	}
+
+	return v, nil
+}
+
+// get returns the variant by the name, it is false if the variant is
+// unknown.
+func (v *Variants) get(name string) (chain variant, ok bool) {
+	if v == nil {
+		return variant{}, false
+	}
+
+	chain, ok = v.chains[name]
+
+	return chain, ok
+}
+
+// key returns the part of ids of renditions of the variant, it is empty
+// without the variant.
+func (v *Variants) key(name string) string {
+	if v == nil {
+		return ""
+	}
+
+	return v.keys[name]
+}
+
+// names returns sorted names of variants.
+func (v *Variants) names() []string {
+	if v == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(v.chains))
+	for name := range v.chains {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// parseVariant parses steps like blur:2.
+func parseVariant(steps []string) (v variant, err error) {
+	for _, step := range steps {
+		name, arg := step, ""
+		if i := strings.IndexByte(step, ':'); i >= 0 {
+			name, arg = step[:i], step[i+1:]
+		}
+
+		parseArg := func(defaultValue float64) (float64, error) {
+			if arg == "" {
+				return defaultValue, nil
+			}
+
+			value, err := strconv.ParseFloat(arg, 64)
+			if err != nil || value <= 0 {
+				return 0, fmt.Errorf("%s: invalid argument: %s", name, arg)
+			}
+
+			return value, nil
+		}
+
+		switch name {
+		case stepGrayscale:
+			v.grayscale = true
+		case stepBlur:
+			v.blur, err = parseArg(defaultBlurSigma)
+		case stepSharpen:
+			v.sharpen = true
+		case stepContrast:
+			v.contrast, err = parseArg(defaultContrastPercent)
+		case stepRemap:
+			switch arg {
+			case remapProtanopia, remapDeuteranopia, remapTritanopia:
+				v.remap = arg
+			default:
+				err = fmt.Errorf("remap: expected %s, %s or %s, got %s",
+					remapProtanopia, remapDeuteranopia, remapTritanopia, arg)
+			}
+		default:
+			err = fmt.Errorf("unknown step: %s", step)
+		}
+
+		if err != nil {
+			return variant{}, err
+		}
+	}
+
+	return v, nil
+}
+
+// variantKey is a part of ids of renditions that depends on the variant.
+// The hash of steps renders the variant again if its config is changed.
+func variantKey(name string, steps []string) string {
+	if name == "" {
+		return ""
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(strings.Join(steps, "|")))
+
+	return fmt.Sprintf("-v%s_%08x", name, h.Sum32())
+}
+
+// apply sets options of libvips.
+func (v variant) apply(opts *bimg.Options) {
+	if v.grayscale {
+		opts.Interpretation = bimg.InterpretationBW
+	}
+
+	if v.blur > 0 {
+		opts.GaussianBlur = bimg.GaussianBlur{Sigma: v.blur}
+	}
+
+	if v.sharpen {
+		opts.Sharpen = bimg.Sharpen{Radius: 1, X1: 2, Y2: 10, Y3: 20, M1: 0, M2: 3}
+	}
+}
+
+// postprocessed tells that the resized image is changed again.
+func (v variant) postprocessed() bool {
+	return v.contrast > 0 || v.remap != ""
+}
+
+// postprocess changes contrast and colors of the resized image.
+func (v variant) postprocess(img image.Image) image.Image {
+	if v.remap != "" {
+		img = daltonize(img, v.remap)
+	}
+
+	if v.contrast > 0 {
+		img = imaging.AdjustContrast(img, v.contrast)
+	}
+
+	return img
+}
+
+// daltonize shifts colors that are lost with the deficiency to colors
+// that are still seen.
+func daltonize(img image.Image, deficiency string) *image.NRGBA {
+	var simulation [3][3]float64
+
+	switch deficiency {
+	case remapProtanopia:
+		simulation = [3][3]float64{{0.567, 0.433, 0}, {0.558, 0.442, 0}, {0, 0.242, 0.758}}
+	case remapDeuteranopia:
+		simulation = [3][3]float64{{0.625, 0.375, 0}, {0.7, 0.3, 0}, {0, 0.3, 0.7}}
+	default:
+		simulation = [3][3]float64{{0.95, 0.05, 0}, {0, 0.433, 0.567}, {0, 0.475, 0.525}}
+	}
+
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		r, g, b := float64(c.R), float64(c.G), float64(c.B)
+
+		sr := simulation[0][0]*r + simulation[0][1]*g + simulation[0][2]*b
+		sg := simulation[1][0]*r + simulation[1][1]*g + simulation[1][2]*b
+		sb := simulation[2][0]*r + simulation[2][1]*g + simulation[2][2]*b
+
+		// The lost red is moved to green and blue.
+		er, eg, eb := r-sr, g-sg, b-sb
+
+		return color.NRGBA{
+			R: clampChannel(r),
+			G: clampChannel(g + 0.7*er + eg),
+			B: clampChannel(b + 0.7*er + eb),
+			A: c.A,
+		}
+	})
+}
+
+func clampChannel(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(math.MaxUint8, math.Round(v))))
+}
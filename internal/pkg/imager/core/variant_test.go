@@ -0,0 +1,137 @@
+package core
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+)
+
+func TestParseVariant(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Steps  []string
+		Exp    variant
+		ExpErr bool
+	}{{
+		Name:  "empty",
+		Steps: nil,
+		Exp:   variant{},
+	}, {
+		Name:  "chain",
+		Steps: []string{"grayscale", "blur:1.5", "sharpen", "contrast:40", "remap:protanopia"},
+		Exp: variant{
+			grayscale: true,
+			blur:      1.5,
+			sharpen:   true,
+			contrast:  40,
+			remap:     remapProtanopia,
+		},
+	}, {
+		Name:  "defaults",
+		Steps: []string{"blur", "contrast"},
+		Exp:   variant{blur: defaultBlurSigma, contrast: defaultContrastPercent},
+	}, {
+		Name:   "invalid_argument",
+		Steps:  []string{"blur:x"},
+		ExpErr: true,
+	}, {
+		Name:   "negative_argument",
+		Steps:  []string{"contrast:-10"},
+		ExpErr: true,
+	}, {
+		Name:   "unknown_remap",
+		Steps:  []string{"remap:monochromacy"},
+		ExpErr: true,
+	}, {
+		Name:   "unknown_step",
+		Steps:  []string{"sepia"},
+		ExpErr: true,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			got, err := parseVariant(tc.Steps)
+			switch {
+			case tc.ExpErr && err == nil:
+				t.Fatal("exp error")
+			case !tc.ExpErr && err != nil:
+				t.Fatal(err)
+			case got != tc.Exp:
+				t.Fatal("exp", tc.Exp, "got", got)
+			}
+		})
+	}
+}
+
+func TestVariantKey(t *testing.T) {
+	if got := variantKey("", nil); got != "" {
+		t.Fatal("exp empty key, got", got)
+	}
+
+	key := variantKey("hard", []string{"grayscale"})
+	if key == variantKey("hard", []string{"grayscale", "blur"}) {
+		t.Fatal("changed steps have the same key", key)
+	}
+
+	if key != variantKey("hard", []string{"grayscale"}) {
+		t.Fatal("key is not stable", key)
+	}
+}
+
+func TestNewVariants(t *testing.T) {
+	v, err := NewVariants(config.Core{Variants: config.Variants{
+		"hard":      {"grayscale", "blur:2"},
+		"grayscale": {"grayscale"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, ok := v.get("hard"); !ok || got != (variant{grayscale: true, blur: 2}) {
+		t.Fatal("unexpected variant", got, ok)
+	}
+
+	if _, ok := v.get("unknown"); ok {
+		t.Fatal("exp unknown variant")
+	}
+
+	if got, exp := v.key("hard"), variantKey("hard", []string{"grayscale", "blur:2"}); got != exp {
+		t.Fatal("exp", exp, "got", got)
+	}
+
+	if got := v.names(); len(got) != 2 || got[0] != "grayscale" || got[1] != "hard" {
+		t.Fatal("unexpected names", got)
+	}
+
+	_, err = NewVariants(config.Core{Variants: config.Variants{"sepia": {"sepia"}}})
+	if err == nil {
+		t.Fatal("exp error")
+	}
+
+	var disabled *Variants
+	if _, ok := disabled.get("hard"); ok || disabled.key("hard") != "" || len(disabled.names()) != 0 {
+		t.Fatal("exp no variants")
+	}
+}
+
+func TestDaltonize(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 200, G: 200, B: 200, A: 255})
+	img.SetNRGBA(1, 0, color.NRGBA{R: 220, G: 20, B: 20, A: 255})
+
+	got := daltonize(img, remapDeuteranopia)
+
+	// Grays are seen, they are kept.
+	if gray := got.NRGBAAt(0, 0); gray != img.NRGBAAt(0, 0) {
+		t.Fatal("exp gray, got", gray)
+	}
+
+	// Red is shifted to be told from green.
+	if red := got.NRGBAAt(1, 0); red.R != 220 || red.B <= 20 {
+		t.Fatal("unexpected red", red)
+	}
+}
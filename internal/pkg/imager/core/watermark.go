@@ -0,0 +1,250 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/picture"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+
+	"github.com/disintegration/imaging"
+)
+
+// Positions of the watermark.
+const (
+	WatermarkTopLeft     = "top_left"
+	WatermarkTopRight    = "top_right"
+	WatermarkBottomLeft  = "bottom_left"
+	WatermarkBottomRight = "bottom_right"
+	WatermarkCenter      = "center"
+)
+
+const (
+	// watermarkTextScale is a size of the text relative to the short side
+	// of the rendition.
+	watermarkTextScale = 0.04
+	// watermarkMinTextSize is the smallest size of the text in pixels.
+	watermarkMinTextSize = 12
+	// watermarkImageScale is a width of the image of the watermark
+	// relative to the width of the rendition.
+	watermarkImageScale = 0.2
+	// watermarkMarginScale is a margin from edges relative to the short
+	// side of the rendition.
+	watermarkMarginScale = 0.02
+)
+
+// Watermark is drawn over renditions of watermarked images, it is a text
+// or an image.
+type Watermark struct {
+	text  *template.Template
+	image image.Image
+	// digest is a hash of the image, it renders watermarked renditions
+	// again if the image is changed.
+	digest   string
+	position string
+	opacity  float64
+}
+
+// NewWatermark parses the template of the text and loads the image of
+// the watermark from the config.
+func NewWatermark(cfg config.Core) (w *Watermark, err error) {
+	switch cfg.WatermarkPosition {
+	case WatermarkTopLeft, WatermarkTopRight, WatermarkBottomLeft, WatermarkBottomRight, WatermarkCenter:
+	default:
+		return nil, fmt.Errorf("position: unknown: %s", cfg.WatermarkPosition)
+	}
+
+	if cfg.WatermarkOpacity <= 0 || cfg.WatermarkOpacity > 1 {
+		return nil, fmt.Errorf("opacity: expected from 0 to 1, got %v", cfg.WatermarkOpacity)
+	}
+
+	w = &Watermark{
+		position: cfg.WatermarkPosition,
+		opacity:  cfg.WatermarkOpacity,
+	}
+
+	if cfg.WatermarkImage != "" {
+		data, err := os.ReadFile(cfg.WatermarkImage)
+		if err != nil {
+			return nil, fmt.Errorf("reading image: %w", err)
+		}
+
+		w.image, err = picture.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+
+		h := fnv.New32a()
+		_, _ = h.Write(data)
+		w.digest = fmt.Sprintf("%08x", h.Sum32())
+
+		return w, nil
+	}
+
+	w.text, err = template.New("watermark").Parse(cfg.WatermarkText)
+	if err != nil {
+		return nil, fmt.Errorf("parsing text: %w", err)
+	}
+
+	// Unknown fields fail once here instead of while rendering.
+	if err = w.text.Execute(io.Discard, imager.ImageMeta{}); err != nil {
+		return nil, fmt.Errorf("executing text: %w", err)
+	}
+
+	return w, nil
+}
+
+// textOf returns the text of the watermark of the image, it is empty for
+// image watermarks.
+func (w *Watermark) textOf(im imager.ImageMeta) string {
+	if w.text == nil {
+		return ""
+	}
+
+	var text strings.Builder
+
+	// The template is checked by NewWatermark, the text of the meta it
+	// fails with is not drawn.
+	if err := w.text.Execute(&text, im); err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(text.String())
+}
+
+// key is a part of ids of watermarked renditions of the image.
+func (w *Watermark) key(im imager.ImageMeta) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(w.digest + "|" + w.textOf(im) + "|" + w.position + "|" +
+		strconv.FormatFloat(w.opacity, 'f', -1, 64)))
+
+	return fmt.Sprintf("-wm%08x", h.Sum32())
+}
+
+// draw draws the watermark of the image over the rendition. The
+// watermark is scaled to the rendition.
+func (w *Watermark) draw(img image.Image, im imager.ImageMeta) (result image.Image, err error) {
+	bounds := img.Bounds()
+	short := math.Min(float64(bounds.Dx()), float64(bounds.Dy()))
+	margin := int(watermarkMarginScale * short)
+
+	var mark image.Image
+
+	if w.image != nil {
+		mark = imaging.Resize(w.image, int(watermarkImageScale*float64(bounds.Dx())), 0, imaging.Lanczos)
+	} else {
+		text := w.textOf(im)
+		if text == "" {
+			return img, nil
+		}
+
+		mark, err = picture.TextImage(text, math.Max(watermarkMinTextSize, watermarkTextScale*short))
+		if err != nil {
+			return nil, fmt.Errorf("drawing text: %w", err)
+		}
+	}
+
+	// Long texts are shrunk to the rendition.
+	if maxWidth := bounds.Dx() - 2*margin; mark.Bounds().Dx() > maxWidth && maxWidth > 0 {
+		mark = imaging.Resize(mark, maxWidth, 0, imaging.Lanczos)
+	}
+
+	return imaging.Overlay(img, mark, w.point(bounds.Size(), mark.Bounds().Size(), margin), w.opacity), nil
+}
+
+// point returns the top left corner of the watermark of the size on the
+// rendition.
+func (w *Watermark) point(rendition, mark image.Point, margin int) image.Point {
+	free := rendition.Sub(mark)
+
+	switch w.position {
+	case WatermarkTopLeft:
+		return image.Pt(margin, margin)
+	case WatermarkTopRight:
+		return image.Pt(free.X-margin, margin)
+	case WatermarkBottomLeft:
+		return image.Pt(margin, free.Y-margin)
+	case WatermarkCenter:
+		return free.Div(2)
+	default:
+		return image.Pt(free.X-margin, free.Y-margin)
+	}
+}
+
+// watermarked tells that the rendition of the image is watermarked. The
+// image meta overrides the config of the category, renditions narrower
+// than the threshold are never watermarked.
+func (c Core) watermarked(im imager.ImageMeta, r Rendition) bool {
+	if c.watermark == nil {
+		return false
+	}
+
+	if width, _ := r.pixelSize().Size(); width < c.cfg.WatermarkMinWidth {
+		return false
+	}
+
+	if im.Watermark != nil {
+		return *im.Watermark
+	}
+
+	for _, category := range c.cfg.WatermarkCategories {
+		if category == im.Category {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watermarkKey is a part of ids of renditions that depends on the
+// watermark.
+func (c Core) watermarkKey(im imager.ImageMeta, r Rendition) string {
+	if !c.watermarked(im, r) {
+		return ""
+	}
+
+	return c.watermark.key(im)
+}
+
+// SetWatermark toggles the watermark of the image, nil resets it to the
+// config of the category. Renditions are rendered again.
+func (c Core) SetWatermark(
+	ctx context.Context,
+	id string,
+	enabled *bool,
+) (im imager.ImageMeta, err error) {
+	if err = c.validate.Var(id, "image_id"); err != nil {
+		err = fmt.Errorf("validating image_id: %w", err)
+
+		return imager.ImageMeta{}, imerrors.NewUnprocessableEntity(err)
+	}
+
+	var previous imager.ImageMeta
+
+	im, err = c.repoImageMeta.Update(ctx, id, func(im *imager.ImageMeta) error {
+		previous = *im
+
+		im.Watermark = enabled
+		im.UpdatedAt = time.Now().UTC()
+
+		return nil
+	})
+	if err != nil {
+		return imager.ImageMeta{}, fmt.Errorf("updating image: %w", err)
+	}
+
+	c.refreshRenditions(ctx, previous, im)
+
+	return im, nil
+}
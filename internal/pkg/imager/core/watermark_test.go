@@ -0,0 +1,220 @@
+package core
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+)
+
+func newWatermarkTestConfig() config.Core {
+	return config.Core{
+		WatermarkCategories: []string{"licensed"},
+		WatermarkText:       "© {{.Author}}",
+		WatermarkPosition:   WatermarkBottomRight,
+		WatermarkOpacity:    1,
+		WatermarkMinWidth:   100,
+	}
+}
+
+func TestNewWatermark(t *testing.T) {
+	logo := filepath.Join(t.TempDir(), "logo.png")
+
+	f, err := os.Create(logo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = png.Encode(f, image.NewNRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		Name      string
+		Configure func(cfg *config.Core)
+		ExpErr    bool
+	}{{
+		Name:      "text",
+		Configure: func(cfg *config.Core) {},
+	}, {
+		Name:      "image",
+		Configure: func(cfg *config.Core) { cfg.WatermarkImage = logo },
+	}, {
+		Name:      "missing_image",
+		Configure: func(cfg *config.Core) { cfg.WatermarkImage = logo + ".missing" },
+		ExpErr:    true,
+	}, {
+		Name:      "unknown_field",
+		Configure: func(cfg *config.Core) { cfg.WatermarkText = "{{.License}}" },
+		ExpErr:    true,
+	}, {
+		Name:      "invalid_template",
+		Configure: func(cfg *config.Core) { cfg.WatermarkText = "{{.Author" },
+		ExpErr:    true,
+	}, {
+		Name:      "unknown_position",
+		Configure: func(cfg *config.Core) { cfg.WatermarkPosition = "middle" },
+		ExpErr:    true,
+	}, {
+		Name:      "invalid_opacity",
+		Configure: func(cfg *config.Core) { cfg.WatermarkOpacity = 1.5 },
+		ExpErr:    true,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			cfg := newWatermarkTestConfig()
+			tc.Configure(&cfg)
+
+			_, err := NewWatermark(cfg)
+			switch {
+			case tc.ExpErr && err == nil:
+				t.Fatal("exp error")
+			case !tc.ExpErr && err != nil:
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWatermarked(t *testing.T) {
+	cfg := newWatermarkTestConfig()
+
+	w, err := NewWatermark(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Core{cfg: cfg, watermark: w}
+	enabled, disabled := true, false
+
+	testCases := []struct {
+		Name      string
+		Meta      imager.ImageMeta
+		Rendition Rendition
+		Exp       bool
+	}{{
+		Name:      "category",
+		Meta:      imager.ImageMeta{Category: "licensed"},
+		Rendition: Rendition{Size: "360x480"},
+		Exp:       true,
+	}, {
+		Name:      "other_category",
+		Meta:      imager.ImageMeta{Category: "free"},
+		Rendition: Rendition{Size: "360x480"},
+	}, {
+		Name:      "enabled_image",
+		Meta:      imager.ImageMeta{Category: "free", Watermark: &enabled},
+		Rendition: Rendition{Size: "360x480"},
+		Exp:       true,
+	}, {
+		Name:      "disabled_image",
+		Meta:      imager.ImageMeta{Category: "licensed", Watermark: &disabled},
+		Rendition: Rendition{Size: "360x480"},
+	}, {
+		Name:      "small",
+		Meta:      imager.ImageMeta{Category: "licensed"},
+		Rendition: Rendition{Size: "90x120"},
+	}, {
+		Name:      "small_high_dpr",
+		Meta:      imager.ImageMeta{Category: "licensed"},
+		Rendition: Rendition{Size: "90x120", dpr: 2},
+		Exp:       true,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := c.watermarked(tc.Meta, tc.Rendition); got != tc.Exp {
+				t.Fatal("exp", tc.Exp, "got", got)
+			}
+		})
+	}
+
+	if c := (Core{cfg: cfg}); c.watermarked(imager.ImageMeta{Category: "licensed"}, Rendition{Size: "360x480"}) {
+		t.Fatal("exp no watermark without it")
+	}
+}
+
+func TestWatermarkKey(t *testing.T) {
+	w, err := NewWatermark(newWatermarkTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := imager.ImageMeta{Author: "a"}, imager.ImageMeta{Author: "b"}
+
+	if w.key(a) == w.key(b) {
+		t.Fatal("exp keys of different texts to differ")
+	}
+
+	if w.key(a) != w.key(a) {
+		t.Fatal("exp equal keys of equal texts")
+	}
+}
+
+func TestWatermarkDraw(t *testing.T) {
+	w, err := NewWatermark(newWatermarkTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	black := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	for i := 3; i < len(black.Pix); i += 4 {
+		black.Pix[i] = 255
+	}
+
+	bright := func(img image.Image, r image.Rectangle) (count int) {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA); c.R > 128 {
+					count++
+				}
+			}
+		}
+
+		return count
+	}
+
+	img, err := w.draw(black, imager.ImageMeta{Author: "Author"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bright(img, image.Rect(200, 225, 400, 300)) == 0 {
+		t.Fatal("exp text in bottom right corner")
+	}
+
+	if bright(img, image.Rect(0, 0, 400, 225)) != 0 {
+		t.Fatal("exp no text out of bottom right corner")
+	}
+
+	cfg := newWatermarkTestConfig()
+	cfg.WatermarkText = "{{.Author}}"
+
+	w, err = NewWatermark(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err = w.draw(black, imager.ImageMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bright(img, img.Bounds()) != 0 {
+		t.Fatal("exp no empty text")
+	}
+}
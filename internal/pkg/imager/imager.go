@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // ImageMeta contains the main information about an image.
@@ -22,7 +23,86 @@ type ImageMeta struct {
 	// Category of the image.
 	Category string `json:"category" validate:"required,category,ne=all"`
 	// Size of file in bytes.
-	Size int64 `json:"-" validate:"required,gt=0"`
+	Size int64 `json:"size" validate:"required,gt=0"`
+	// Width of the original in pixels rotated by the EXIF orientation.
+	Width int `json:"width"`
+	// Height of the original in pixels rotated by the EXIF orientation.
+	Height int `json:"height"`
+	// SHA256 is a hex encoded checksum of the original.
+	SHA256 string `json:"sha256"`
+	// DHash is a hex encoded perceptual difference hash of the
+	// original. Similar images have close hashes.
+	DHash string `json:"dhash"`
+	// BlurHash is a compact placeholder of the image.
+	BlurHash string `json:"blurhash"`
+	// LQIP is a tiny low quality preview of the image as a data URI.
+	LQIP string `json:"lqip"`
+	// Palette holds dominant colors of the image sorted by weight.
+	Palette []PaletteColor `json:"palette,omitempty"`
+	// Difficulty of the swap puzzle from 0 for busy images to 1 for
+	// flat ones, averaged over grids.
+	Difficulty float64 `json:"difficulty"`
+	// GridDifficulty is the difficulty by grids like 4x4, it is empty if
+	// the difficulty is unknown.
+	GridDifficulty map[string]float64 `json:"grid_difficulty,omitempty"`
+	// ObjectID is an id of the original in the file storage. Images
+	// with the same content share one original. It is empty for images
+	// stored by their ID.
+	ObjectID string `json:"object_id,omitempty"`
+	// SourceID is an id of the uploaded file in the file storage, it is
+	// kept if the original was normalized.
+	SourceID string `json:"source_id,omitempty"`
+	// FocalPoint is a point of the subject, renditions are cropped
+	// around it.
+	FocalPoint *FocalPoint `json:"focal_point,omitempty"`
+	// Crops are art-directed areas of the original by image sizes or
+	// aspect ratios like 3:4. They are preferred to the focal point.
+	Crops map[string]CropRect `json:"crops,omitempty"`
+	// Watermark tells to watermark renditions of the image, the config
+	// of the category is used if it is nil.
+	Watermark *bool `json:"watermark,omitempty"`
+	// Uploader is an identity of the client that uploaded the image as
+	// it is claimed by the client. It is not authenticated, so it is
+	// informational and must not be used for access control.
+	Uploader string `json:"uploader" validate:"omitempty,uploader"`
+	// CreatedAt is a time of the upload.
+	CreatedAt time.Time `json:"created_at"`
+	// UpdatedAt is a time of the last change of the image.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// StorageID returns the id of the original in the file storage.
+func (im ImageMeta) StorageID() string {
+	if im.ObjectID != "" {
+		return im.ObjectID
+	}
+
+	return im.ID
+}
+
+// FocalPoint is a point on the image in coordinates normalized to the
+// size of the original: 0,0 is the top left corner and 1,1 is the bottom
+// right one.
+type FocalPoint struct {
+	X float64 `json:"x" validate:"gte=0,lte=1"`
+	Y float64 `json:"y" validate:"gte=0,lte=1"`
+}
+
+// PaletteColor is a dominant color of the image.
+type PaletteColor struct {
+	// Color is a hex RGB color like #1e90ff.
+	Color string `json:"color"`
+	// Weight is a share of pixels of the color from 0 to 1.
+	Weight float64 `json:"weight"`
+}
+
+// CropRect is an area of the original in pixels rotated by the EXIF
+// orientation.
+type CropRect struct {
+	X      int `json:"x" validate:"gte=0"`
+	Y      int `json:"y" validate:"gte=0"`
+	Width  int `json:"width" validate:"gt=0"`
+	Height int `json:"height" validate:"gt=0"`
 }
 
 // RawJSON converts ImageMeta to raw json representation.
@@ -94,6 +174,61 @@ func (is ImageSize) Size() (width int, height int) {
 	return width, height
 }
 
+// DPR splits the device pixel ratio suffix of the size like 360x480@2x.
+// The ratio is 1 without the suffix and 0 if the suffix is invalid.
+func (is ImageSize) DPR() (size ImageSize, dpr int) {
+	i := strings.LastIndex(string(is), "@")
+	if i == -1 {
+		return is, 1
+	}
+
+	size, suffix := is[:i], string(is[i+1:])
+
+	if !strings.HasSuffix(suffix, "x") {
+		return size, 0
+	}
+
+	dpr, err := strconv.Atoi(strings.TrimSuffix(suffix, "x"))
+	if err != nil || dpr <= 0 {
+		return size, 0
+	}
+
+	return size, dpr
+}
+
+// Scale multiplies the width and the height of the size.
+func (is ImageSize) Scale(factor int) ImageSize {
+	width, height := is.Size()
+
+	return NewImageSize(width*factor, height*factor)
+}
+
+// NewImageSize formats the size as WIDTHxHEIGHT.
+func NewImageSize(width, height int) ImageSize {
+	return ImageSize(strconv.Itoa(width) + "x" + strconv.Itoa(height))
+}
+
+// AspectRatio returns the reduced aspect ratio of the size as W:H. It is
+// empty if the size is invalid.
+func (is ImageSize) AspectRatio() string {
+	width, height := is.Size()
+	if width == 0 {
+		return ""
+	}
+
+	d := gcd(width, height)
+
+	return strconv.Itoa(width/d) + ":" + strconv.Itoa(height/d)
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}
+
 // Healther checks component status.
 type Healther interface {
 	// Healther checks component status.
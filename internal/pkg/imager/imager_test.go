@@ -56,6 +56,60 @@ func TestImageSize(t *testing.T) {
 	}
 }
 
+func TestImageSize_AspectRatio(t *testing.T) {
+	testCases := map[imager.ImageSize]string{
+		"360x480":   "3:4",
+		"1920x1080": "16:9",
+		"7x7":       "1:1",
+		"10x0":      "",
+	}
+
+	for size, exp := range testCases {
+		if got := size.AspectRatio(); got != exp {
+			t.Fatal(size, "exp", exp, "got", got)
+		}
+	}
+}
+
+func TestImageSize_DPR(t *testing.T) {
+	testCases := []struct {
+		ImageSize imager.ImageSize
+		ExpSize   imager.ImageSize
+		ExpDPR    int
+	}{{
+		ImageSize: "360x480",
+		ExpSize:   "360x480",
+		ExpDPR:    1,
+	}, {
+		ImageSize: "360x480@2x",
+		ExpSize:   "360x480",
+		ExpDPR:    2,
+	}, {
+		ImageSize: "360x480@0x",
+		ExpSize:   "360x480",
+		ExpDPR:    0,
+	}, {
+		ImageSize: "360x480@2",
+		ExpSize:   "360x480",
+		ExpDPR:    0,
+	}, {
+		ImageSize: "360x480@",
+		ExpSize:   "360x480",
+		ExpDPR:    0,
+	}}
+
+	for _, tc := range testCases {
+		size, dpr := tc.ImageSize.DPR()
+		if size != tc.ExpSize || dpr != tc.ExpDPR {
+			t.Fatal(tc.ImageSize, "exp", tc.ExpSize, tc.ExpDPR, "got", size, dpr)
+		}
+	}
+
+	if got := imager.ImageSize("360x480").Scale(3); got != "1080x1440" {
+		t.Fatal("got", got)
+	}
+}
+
 func TestRawImageMetaJSON(t *testing.T) {
 	im := imager.ImageMeta{
 		ID:        "test",
@@ -0,0 +1,124 @@
+package picture
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+	"strconv"
+)
+
+const (
+	dhashWidth  = 9
+	dhashHeight = 8
+
+	// dhashCellSamples limits samples of each cell per axis, so large
+	// images are hashed fast.
+	dhashCellSamples = 32
+
+	// HashBands is a number of bands the hash is split into by Bands.
+	HashBands = 9
+	// MaxBandDistance is the max distance between hashes that always
+	// have an equal band: hashes differ in fewer bits than there are
+	// bands, so at least one band has no different bits.
+	MaxBandDistance = HashBands - 1
+)
+
+// DHash returns the difference hash of the image. The image is scaled
+// down to 9x8 gray pixels and each bit tells whether a pixel is
+// brighter than its right neighbour. Resized and recompressed copies
+// have close hashes.
+func DHash(img image.Image) uint64 {
+	var cells [dhashHeight][dhashWidth]float64
+
+	bounds := img.Bounds()
+	for y := 0; y < dhashHeight; y++ {
+		for x := 0; x < dhashWidth; x++ {
+			cells[y][x] = averageGray(img, image.Rect(
+				bounds.Min.X+x*bounds.Dx()/dhashWidth,
+				bounds.Min.Y+y*bounds.Dy()/dhashHeight,
+				bounds.Min.X+(x+1)*bounds.Dx()/dhashWidth,
+				bounds.Min.Y+(y+1)*bounds.Dy()/dhashHeight,
+			))
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < dhashHeight; y++ {
+		for x := 0; x < dhashWidth-1; x++ {
+			hash <<= 1
+
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// averageGray returns the average brightness of the rectangle. It
+// samples at most dhashCellSamples pixels per axis.
+func averageGray(img image.Image, r image.Rectangle) float64 {
+	if r.Empty() {
+		return 0
+	}
+
+	stepX := r.Dx()/dhashCellSamples + 1
+	stepY := r.Dy()/dhashCellSamples + 1
+
+	var sum, count float64
+	for y := r.Min.Y; y < r.Max.Y; y += stepY {
+		for x := r.Min.X; x < r.Max.X; x += stepX {
+			sum += float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			count++
+		}
+	}
+
+	return sum / count
+}
+
+// Distance returns the Hamming distance between hashes.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// FormatHash encodes the hash as 16 hex digits.
+func FormatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// ParseHash decodes the hash encoded by FormatHash.
+func ParseHash(s string) (hash uint64, err error) {
+	hash, err = strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing hash: %w", err)
+	}
+
+	return hash, nil
+}
+
+// Bands splits the hash into HashBands bands of 7 or 8 bits. Bands are
+// formatted with their indexes, so equal bands of different positions
+// are not mixed. Hashes up to MaxBandDistance apart share a band, it
+// allows to index hashes by bands and compare only hashes of the same
+// bands.
+func Bands(hash uint64) []string {
+	const hashBits = 64
+
+	bands := make([]string, HashBands)
+
+	offset := 0
+	for i := range bands {
+		width := hashBits / HashBands
+		if i < hashBits%HashBands {
+			width++
+		}
+
+		band := hash >> offset & (1<<width - 1)
+		bands[i] = strconv.Itoa(i) + ":" + strconv.FormatUint(band, 16)
+		offset += width
+	}
+
+	return bands
+}
@@ -0,0 +1,164 @@
+package picture
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// difficultySampleSize is a size of the long side of the image the
+	// difficulty is computed from.
+	difficultySampleSize = 240
+
+	// edgeThreshold is a magnitude of the Sobel gradient of gray pixels
+	// that counts as an edge.
+	edgeThreshold = 96
+	// edgeDensityBusy is a share of edge pixels of very busy images.
+	edgeDensityBusy = 0.25
+
+	// tileDeviationBusy is a standard deviation of gray pixels of a
+	// tile with a lot of detail.
+	tileDeviationBusy = 48
+	// tileMeanDistinct is a difference of average gray of tiles that
+	// tells them apart.
+	tileMeanDistinct = 24
+
+	// Weights of detail measures.
+	weightEdges    = 0.3
+	weightEntropy  = 0.2
+	weightTiles    = 0.3
+	weightDistinct = 0.2
+)
+
+// Difficulty returns the difficulty of the swap puzzle made from the
+// image for each grid of n×n tiles from 0 for busy images to 1 for flat
+// ones. It grows if the image has few edges, low entropy or tiles that
+// are flat or look alike.
+func Difficulty(img image.Image, grids []int) map[int]float64 {
+	sample := imaging.Grayscale(imaging.Fit(img, difficultySampleSize, difficultySampleSize, imaging.Box))
+
+	width, height := sample.Rect.Dx(), sample.Rect.Dy()
+
+	gray := make([]float64, width*height)
+	for i := range gray {
+		gray[i] = float64(sample.Pix[i*4])
+	}
+
+	edges := math.Min(1, edgeDensity(gray, width, height)/edgeDensityBusy)
+	entropy := grayEntropy(gray)
+
+	difficulty := make(map[int]float64, len(grids))
+
+	for _, n := range grids {
+		if n <= 0 || n > width || n > height {
+			continue
+		}
+
+		tiles, distinct := tileDetail(gray, width, height, n)
+
+		detail := weightEdges*edges +
+			weightEntropy*entropy +
+			weightTiles*tiles +
+			weightDistinct*distinct
+
+		difficulty[n] = math.Round((1-detail)*1000) / 1000
+	}
+
+	return difficulty
+}
+
+// edgeDensity returns the share of pixels on edges.
+func edgeDensity(gray []float64, width, height int) float64 {
+	if width < 3 || height < 3 {
+		return 0
+	}
+
+	at := func(x, y int) float64 { return gray[y*width+x] }
+
+	var edges int
+
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) -
+				at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) -
+				at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+
+			if math.Hypot(gx, gy) > edgeThreshold {
+				edges++
+			}
+		}
+	}
+
+	return float64(edges) / float64((width-2)*(height-2))
+}
+
+// grayEntropy returns the Shannon entropy of gray levels normalized to
+// the range from 0 to 1.
+func grayEntropy(gray []float64) float64 {
+	var histogram [256]float64
+	for _, v := range gray {
+		histogram[int(v)]++
+	}
+
+	var entropy float64
+
+	for _, count := range histogram {
+		if count == 0 {
+			continue
+		}
+
+		p := count / float64(len(gray))
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy / 8
+}
+
+// tileDetail splits the image into n×n tiles. It returns the average
+// detail of tiles and the share of tile pairs that differ by their
+// average gray.
+func tileDetail(gray []float64, width, height, n int) (detail, distinct float64) {
+	means := make([]float64, 0, n*n)
+
+	for ty := 0; ty < n; ty++ {
+		for tx := 0; tx < n; tx++ {
+			var sum, sumSq, count float64
+
+			for y := ty * height / n; y < (ty+1)*height/n; y++ {
+				for x := tx * width / n; x < (tx+1)*width/n; x++ {
+					v := gray[y*width+x]
+					sum += v
+					sumSq += v * v
+					count++
+				}
+			}
+
+			mean := sum / count
+			deviation := math.Sqrt(math.Max(0, sumSq/count-mean*mean))
+
+			detail += math.Min(1, deviation/tileDeviationBusy)
+			means = append(means, mean)
+		}
+	}
+
+	var pairs, distinctPairs float64
+
+	for i := range means {
+		for j := i + 1; j < len(means); j++ {
+			pairs++
+
+			if math.Abs(means[i]-means[j]) > tileMeanDistinct {
+				distinctPairs++
+			}
+		}
+	}
+
+	if pairs > 0 {
+		distinct = distinctPairs / pairs
+	}
+
+	return detail / float64(len(means)), distinct
+}
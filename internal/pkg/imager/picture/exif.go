@@ -0,0 +1,112 @@
+package picture
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	// orientationNormal is the EXIF orientation of images that are
+	// displayed as stored.
+	orientationNormal = 1
+	// orientationTransposed is the first EXIF orientation that swaps
+	// width and height, orientations 5 to 8 rotate the image by 90°.
+	orientationTransposed = 5
+	orientationMax        = 8
+
+	tagOrientation = 0x0112
+)
+
+// exifOrientation returns the EXIF orientation of the JPEG image. It is
+// orientationNormal if the image has no valid orientation.
+func exifOrientation(data []byte) int {
+	const (
+		markerStart = 0xd8
+		markerSOS   = 0xda
+		markerEOI   = 0xd9
+		markerAPP1  = 0xe1
+	)
+
+	if len(data) < 2 || data[0] != 0xff || data[1] != markerStart {
+		return orientationNormal
+	}
+
+	// Segments of markers before the scan have the length.
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return orientationNormal
+		}
+
+		marker := data[i+1]
+		if marker == markerSOS || marker == markerEOI {
+			return orientationNormal
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+
+		if length < 2 || end > len(data) {
+			return orientationNormal
+		}
+
+		segment := data[i+4 : end]
+		if marker == markerAPP1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[len("Exif\x00\x00"):])
+		}
+
+		i = end
+	}
+
+	return orientationNormal
+}
+
+// tiffOrientation reads the orientation tag of the first IFD of the EXIF
+// TIFF structure.
+func tiffOrientation(tiff []byte) int {
+	const (
+		headerSize = 8
+		entrySize  = 12
+	)
+
+	if len(tiff) < headerSize {
+		return orientationNormal
+	}
+
+	var order binary.ByteOrder
+
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return orientationNormal
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < headerSize || offset+2 > len(tiff) {
+		return orientationNormal
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*entrySize
+		if entry+entrySize > len(tiff) {
+			return orientationNormal
+		}
+
+		if order.Uint16(tiff[entry:]) != tagOrientation {
+			continue
+		}
+
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < orientationNormal || orientation > orientationMax {
+			return orientationNormal
+		}
+
+		return orientation
+	}
+
+	return orientationNormal
+}
@@ -0,0 +1,244 @@
+package picture
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+const (
+	// tileNumberScale is a size of tile numbers relative to the short
+	// side of the tile.
+	tileNumberScale = 0.4
+	// tileNumberShadowScale is an offset of the shadow of tile numbers
+	// and other text relative to its size.
+	tileNumberShadowScale = 0.06
+)
+
+// Colors of tile numbers and other text.
+// nolint: gochecknoglobals // Colors are immutable.
+var (
+	tileNumberColor       = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	tileNumberShadowColor = color.NRGBA{A: 160}
+)
+
+// DrawGrid draws lines between n×n tiles and around them. Crossings of
+// semi-transparent lines are not darker than lines.
+func DrawGrid(img draw.Image, n, width int, c color.Color) {
+	bounds := img.Bounds()
+	if n <= 0 || width <= 0 {
+		return
+	}
+
+	mask := image.NewAlpha(bounds)
+	opaque := image.NewUniform(color.Alpha{A: math.MaxUint8})
+
+	// line returns the line at the offset of the side of the length.
+	// Lines at edges are moved inside.
+	line := func(offset, length int) (start, end int) {
+		start = offset - width/2
+		if start < 0 {
+			start = 0
+		}
+
+		if start > length-width {
+			start = length - width
+		}
+
+		return start, start + width
+	}
+
+	for i := 0; i <= n; i++ {
+		x0, x1 := line(i*bounds.Dx()/n, bounds.Dx())
+		draw.Draw(mask, image.Rect(x0, 0, x1, bounds.Dy()).Add(bounds.Min), opaque, image.Point{}, draw.Src)
+
+		y0, y1 := line(i*bounds.Dy()/n, bounds.Dy())
+		draw.Draw(mask, image.Rect(0, y0, bounds.Dx(), y1).Add(bounds.Min), opaque, image.Point{}, draw.Src)
+	}
+
+	draw.DrawMask(img, bounds, image.NewUniform(c), image.Point{}, mask, bounds.Min, draw.Over)
+}
+
+// DrawTileNumbers draws indexes of n×n tiles from 1 in the center of
+// tiles row by row. Numbers have a shadow to be seen on light images.
+func DrawTileNumbers(img draw.Image, n int) (err error) {
+	bounds := img.Bounds()
+	if n <= 0 {
+		return nil
+	}
+
+	f, err := sfnt.Parse(gobold.TTF)
+	if err != nil {
+		return fmt.Errorf("parsing font: %w", err)
+	}
+
+	tileWidth, tileHeight := bounds.Dx()/n, bounds.Dy()/n
+
+	size := tileNumberScale * math.Min(float64(tileWidth), float64(tileHeight))
+	if size < 1 {
+		return nil
+	}
+
+	shadow := textShadow(size)
+
+	var buf sfnt.Buffer
+
+	for i := 0; i < n*n; i++ {
+		mask, err := textMask(f, &buf, strconv.Itoa(i+1), size)
+		if err != nil {
+			return err
+		}
+
+		tile := image.Rect(0, 0, tileWidth, tileHeight).
+			Add(image.Pt(i%n*bounds.Dx()/n, i/n*bounds.Dy()/n)).
+			Add(bounds.Min)
+
+		// The text is centered in the tile.
+		drawText(img, mask, tile.Min.Add(tile.Size().Sub(mask.Rect.Size()).Div(2)), shadow)
+	}
+
+	return nil
+}
+
+// TextImage renders the text of the size in pixels with a shadow on the
+// transparent image of the size of the text.
+func TextImage(text string, size float64) (img *image.NRGBA, err error) {
+	f, err := sfnt.Parse(gobold.TTF)
+	if err != nil {
+		return nil, fmt.Errorf("parsing font: %w", err)
+	}
+
+	mask, err := textMask(f, &sfnt.Buffer{}, text, size)
+	if err != nil {
+		return nil, err
+	}
+
+	shadow := textShadow(size)
+
+	img = image.NewNRGBA(image.Rect(0, 0, mask.Rect.Dx()+shadow, mask.Rect.Dy()+shadow))
+	drawText(img, mask, image.Point{}, shadow)
+
+	return img, nil
+}
+
+// textShadow returns the offset of the shadow of the text of the size.
+func textShadow(size float64) int {
+	return int(math.Max(1, math.Round(size*tileNumberShadowScale)))
+}
+
+// drawText draws the text of the mask with the shadow at the point.
+func drawText(img draw.Image, mask *image.Alpha, at image.Point, shadow int) {
+	r := mask.Rect.Sub(mask.Rect.Min).Add(at)
+
+	draw.DrawMask(img, r.Add(image.Pt(shadow, shadow)), image.NewUniform(tileNumberShadowColor),
+		image.Point{}, mask, mask.Rect.Min, draw.Over)
+	draw.DrawMask(img, r, image.NewUniform(tileNumberColor),
+		image.Point{}, mask, mask.Rect.Min, draw.Over)
+}
+
+// textMask rasterizes the text of the size in pixels. Bounds of the mask
+// are bounds of glyphs.
+func textMask(f *sfnt.Font, buf *sfnt.Buffer, text string, size float64) (mask *image.Alpha, err error) {
+	ppem := fixed.Int26_6(size * 64)
+
+	var (
+		segments []sfnt.Segment
+		x        fixed.Int26_6
+	)
+
+	for _, r := range text {
+		index, err := f.GlyphIndex(buf, r)
+		if err != nil {
+			return nil, fmt.Errorf("getting glyph of %q: %w", r, err)
+		}
+
+		glyph, err := f.LoadGlyph(buf, index, ppem, nil)
+		if err != nil {
+			return nil, fmt.Errorf("loading glyph of %q: %w", r, err)
+		}
+
+		for _, s := range glyph {
+			for j := range s.Args {
+				s.Args[j].X += x
+			}
+
+			segments = append(segments, s)
+		}
+
+		advance, err := f.GlyphAdvance(buf, index, ppem, font.HintingNone)
+		if err != nil {
+			return nil, fmt.Errorf("getting advance of %q: %w", r, err)
+		}
+
+		x += advance
+	}
+
+	// Control points bound curves.
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+
+	for _, s := range segments {
+		for _, p := range s.Args[:segmentPoints(s.Op)] {
+			px, py := float64(p.X)/64, float64(p.Y)/64
+			minX, minY = math.Min(minX, px), math.Min(minY, py)
+			maxX, maxY = math.Max(maxX, px), math.Max(maxY, py)
+		}
+	}
+
+	if len(segments) == 0 {
+		return image.NewAlpha(image.Rectangle{}), nil
+	}
+
+	origin := image.Pt(int(math.Floor(minX)), int(math.Floor(minY)))
+	rect := image.Rectangle{Min: origin, Max: image.Pt(int(math.Ceil(maxX)), int(math.Ceil(maxY)))}
+
+	z := vector.NewRasterizer(rect.Dx(), rect.Dy())
+
+	point := func(p fixed.Point26_6) (float32, float32) {
+		return float32(p.X)/64 - float32(origin.X), float32(p.Y)/64 - float32(origin.Y)
+	}
+
+	for _, s := range segments {
+		switch s.Op {
+		case sfnt.SegmentOpMoveTo:
+			z.MoveTo(point(s.Args[0]))
+		case sfnt.SegmentOpLineTo:
+			z.LineTo(point(s.Args[0]))
+		case sfnt.SegmentOpQuadTo:
+			bx, by := point(s.Args[0])
+			cx, cy := point(s.Args[1])
+			z.QuadTo(bx, by, cx, cy)
+		case sfnt.SegmentOpCubeTo:
+			bx, by := point(s.Args[0])
+			cx, cy := point(s.Args[1])
+			dx, dy := point(s.Args[2])
+			z.CubeTo(bx, by, cx, cy, dx, dy)
+		}
+	}
+
+	mask = image.NewAlpha(rect)
+	z.Draw(mask, rect, image.Opaque, image.Point{})
+
+	return mask, nil
+}
+
+// segmentPoints returns a count of points of the segment.
+func segmentPoints(op sfnt.SegmentOp) int {
+	switch op {
+	case sfnt.SegmentOpQuadTo:
+		return 2
+	case sfnt.SegmentOpCubeTo:
+		return 3
+	default:
+		return 1
+	}
+}
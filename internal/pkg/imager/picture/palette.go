@@ -0,0 +1,137 @@
+package picture
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// paletteSampleSize is a size of the long side of the image the
+	// palette is extracted from.
+	paletteSampleSize = 64
+
+	// paletteBucketBits are bits of each channel that group colors.
+	paletteBucketBits = 4
+
+	// paletteMergeDistance is a distance in RGB below which colors are
+	// merged into one swatch.
+	paletteMergeDistance = 48
+
+	// paletteMinAlpha skips mostly transparent pixels.
+	paletteMinAlpha = 128
+)
+
+// Swatch is a color of the palette and its share of pixels.
+type Swatch struct {
+	Color  color.NRGBA
+	Weight float64
+}
+
+// Palette returns up to size dominant colors of the image sorted by
+// their weight. Close colors are merged.
+func Palette(img image.Image, size int) []Swatch {
+	sample := imaging.Fit(img, paletteSampleSize, paletteSampleSize, imaging.Box)
+
+	type bucket struct {
+		r, g, b float64
+		count   float64
+	}
+
+	const shift = 8 - paletteBucketBits
+
+	buckets := make(map[int]*bucket)
+
+	var total float64
+
+	for i := 0; i+3 < len(sample.Pix); i += 4 {
+		px := sample.Pix[i : i+4]
+		if px[3] < paletteMinAlpha {
+			continue
+		}
+
+		key := int(px[0]>>shift)<<(2*paletteBucketBits) |
+			int(px[1]>>shift)<<paletteBucketBits |
+			int(px[2]>>shift)
+
+		b, ok := buckets[key]
+		if !ok {
+			b = &bucket{}
+			buckets[key] = b
+		}
+
+		b.r += float64(px[0])
+		b.g += float64(px[1])
+		b.b += float64(px[2])
+		b.count++
+		total++
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, b := range buckets {
+		b.r /= b.count
+		b.g /= b.count
+		b.b /= b.count
+		sorted = append(sorted, b)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+
+		// Equal counts are ordered by color, so the palette is stable.
+		return sorted[i].r+sorted[i].g+sorted[i].b < sorted[j].r+sorted[j].g+sorted[j].b
+	})
+
+	swatches := make([]*bucket, 0, size)
+
+	for _, b := range sorted {
+		nearest, distance := -1, math.Inf(1)
+
+		for i, s := range swatches {
+			if d := math.Sqrt(sq(s.r-b.r) + sq(s.g-b.g) + sq(s.b-b.b)); d < distance {
+				nearest, distance = i, d
+			}
+		}
+
+		if nearest == -1 || (distance >= paletteMergeDistance && len(swatches) < size) {
+			swatches = append(swatches, &bucket{r: b.r, g: b.g, b: b.b, count: b.count})
+
+			continue
+		}
+
+		s := swatches[nearest]
+		count := s.count + b.count
+		s.r = (s.r*s.count + b.r*b.count) / count
+		s.g = (s.g*s.count + b.g*b.count) / count
+		s.b = (s.b*s.count + b.b*b.count) / count
+		s.count = count
+	}
+
+	sort.SliceStable(swatches, func(i, j int) bool {
+		return swatches[i].count > swatches[j].count
+	})
+
+	palette := make([]Swatch, len(swatches))
+	for i, s := range swatches {
+		palette[i] = Swatch{
+			Color: color.NRGBA{
+				R: uint8(math.Round(s.r)),
+				G: uint8(math.Round(s.g)),
+				B: uint8(math.Round(s.b)),
+				A: math.MaxUint8,
+			},
+			Weight: math.Round(s.count/total*1000) / 1000,
+		}
+	}
+
+	return palette
+}
+
+func sq(v float64) float64 {
+	return v * v
+}
@@ -0,0 +1,97 @@
+// Package picture analyzes image data without libvips.
+package picture
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"net/http"
+	"strings"
+
+	// Supported formats of originals.
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+// DetectContentType detects the media type of the image by its magic
+// bytes. It returns an empty string if the data is not an image.
+func DetectContentType(data []byte) string {
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") {
+		return ""
+	}
+
+	return contentType
+}
+
+// Header holds information decoded from the image header.
+type Header struct {
+	// Format is a name of the format: jpeg, png or webp.
+	Format string
+	// Width in pixels.
+	Width int
+	// Height in pixels.
+	Height int
+	// Orientation is the EXIF orientation of JPEG images from 1 to 8,
+	// it is 1 for images without it.
+	Orientation int
+}
+
+// DecodeHeader decodes the image header. It does not decode pixels.
+func DecodeHeader(data []byte) (h Header, err error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Header{}, fmt.Errorf("decoding config: %w", err)
+	}
+
+	h = Header{
+		Format:      format,
+		Width:       cfg.Width,
+		Height:      cfg.Height,
+		Orientation: orientationNormal,
+	}
+
+	if format == "jpeg" {
+		h.Orientation = exifOrientation(data)
+	}
+
+	return h, nil
+}
+
+// OrientedSize returns dimensions of the image rotated by the EXIF
+// orientation, as renditions are rendered. Width and Height are stored
+// dimensions.
+func (h Header) OrientedSize() (width, height int) {
+	if h.Orientation >= orientationTransposed {
+		return h.Height, h.Width
+	}
+
+	return h.Width, h.Height
+}
+
+// ContentType returns the media type of the decoded format.
+func (h Header) ContentType() string {
+	return "image/" + h.Format
+}
+
+// Checksum returns hex encoded SHA-256 of the data.
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Decode decodes the whole image, so truncated and corrupted data is
+// detected.
+func Decode(data []byte) (img image.Image, err error) {
+	img, _, err = image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decoding image: %w", err)
+	}
+
+	return img, nil
+}
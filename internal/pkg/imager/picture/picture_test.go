@@ -0,0 +1,393 @@
+package picture_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/picture"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/test"
+)
+
+// newTestImage returns an image with a diagonal gradient and a bright
+// square, so it has some structure.
+func newTestImage(width, height int, mirrored bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			px := x
+			if mirrored {
+				px = width - x - 1
+			}
+
+			v := uint8((px*255/width + y*255/height) / 2)
+			if px > width/4 && px < width/2 && y > height/4 && y < height/2 {
+				v = 255 - v
+			}
+
+			img.Set(x, y, color.RGBA{R: v, G: v / 2, B: 255 - v, A: 255})
+		}
+	}
+
+	return img
+}
+
+func TestDecodeHeader(t *testing.T) {
+	var data bytes.Buffer
+	err := png.Encode(&data, newTestImage(40, 30, false))
+	test.AssertErrNil(t, err)
+
+	hdr, err := picture.DecodeHeader(data.Bytes())
+	test.AssertErrNil(t, err)
+
+	exp := picture.Header{Format: "png", Width: 40, Height: 30, Orientation: 1}
+	if hdr != exp {
+		t.Fatal("exp", exp, "got", hdr)
+	}
+
+	_, err = picture.DecodeHeader([]byte("not an image"))
+	if err == nil {
+		t.Fatal("decoded invalid data")
+	}
+}
+
+func TestDecodeHeader_orientation(t *testing.T) {
+	var data bytes.Buffer
+	err := jpeg.Encode(&data, newTestImage(40, 30, false), nil)
+	test.AssertErrNil(t, err)
+
+	testCases := []struct {
+		Name           string
+		Data           []byte
+		ExpOrientation int
+		ExpWidth       int
+		ExpHeight      int
+	}{{
+		Name:           "none",
+		Data:           data.Bytes(),
+		ExpOrientation: 1,
+		ExpWidth:       40,
+		ExpHeight:      30,
+	}, {
+		Name:           "rotated_180",
+		Data:           test.JPEGWithOrientation(data.Bytes(), 3),
+		ExpOrientation: 3,
+		ExpWidth:       40,
+		ExpHeight:      30,
+	}, {
+		Name:           "rotated_90",
+		Data:           test.JPEGWithOrientation(data.Bytes(), 6),
+		ExpOrientation: 6,
+		ExpWidth:       30,
+		ExpHeight:      40,
+	}, {
+		Name:           "invalid",
+		Data:           test.JPEGWithOrientation(data.Bytes(), 9),
+		ExpOrientation: 1,
+		ExpWidth:       40,
+		ExpHeight:      30,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			hdr, err := picture.DecodeHeader(tc.Data)
+			test.AssertErrNil(t, err)
+
+			if hdr.Width != 40 || hdr.Height != 30 || hdr.Orientation != tc.ExpOrientation {
+				t.Fatal("unexpected header", hdr)
+			}
+
+			width, height := hdr.OrientedSize()
+			if width != tc.ExpWidth || height != tc.ExpHeight {
+				t.Fatal("exp", tc.ExpWidth, tc.ExpHeight, "got", width, height)
+			}
+		})
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	var pngData bytes.Buffer
+	err := png.Encode(&pngData, newTestImage(4, 4, false))
+	test.AssertErrNil(t, err)
+
+	var jpegData bytes.Buffer
+	err = jpeg.Encode(&jpegData, newTestImage(4, 4, false), nil)
+	test.AssertErrNil(t, err)
+
+	testCases := []struct {
+		Name string
+		Data []byte
+		Exp  string
+	}{{
+		Name: "png",
+		Data: pngData.Bytes(),
+		Exp:  "image/png",
+	}, {
+		Name: "jpeg",
+		Data: jpegData.Bytes(),
+		Exp:  "image/jpeg",
+	}, {
+		Name: "text",
+		Data: []byte("not an image"),
+		Exp:  "",
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := picture.DetectContentType(tc.Data); got != tc.Exp {
+				t.Fatal("exp", tc.Exp, "got", got)
+			}
+		})
+	}
+}
+
+func TestDHash(t *testing.T) {
+	original := newTestImage(640, 480, false)
+	origHash := picture.DHash(original)
+
+	var data bytes.Buffer
+	err := jpeg.Encode(&data, newTestImage(320, 240, false), &jpeg.Options{Quality: 30})
+	test.AssertErrNil(t, err)
+
+	recompressed, err := picture.Decode(data.Bytes())
+	test.AssertErrNil(t, err)
+
+	const maxNearDistance = 4
+	if d := picture.Distance(origHash, picture.DHash(recompressed)); d > maxNearDistance {
+		t.Fatal("resized copy distance", d)
+	}
+
+	const minFarDistance = 16
+	mirrored := newTestImage(640, 480, true)
+	if d := picture.Distance(origHash, picture.DHash(mirrored)); d < minFarDistance {
+		t.Fatal("different image distance", d)
+	}
+}
+
+func TestBands(t *testing.T) {
+	const hash uint64 = 0x00ff00ff12345678
+
+	bands := picture.Bands(hash)
+	if len(bands) != picture.HashBands {
+		t.Fatal("exp", picture.HashBands, "got", len(bands))
+	}
+
+	// Each flipped bit changes one band.
+	other := hash
+	for i := 0; i < picture.MaxBandDistance; i++ {
+		other ^= 1 << (i * 7)
+	}
+
+	otherBands := picture.Bands(other)
+
+	var equal int
+	for i := range bands {
+		if bands[i] == otherBands[i] {
+			equal++
+		}
+	}
+
+	if equal == 0 {
+		t.Fatal("no equal bands of", bands, otherBands)
+	}
+
+	if changed := hash ^ 1<<63; picture.Bands(changed)[picture.HashBands-1] == bands[picture.HashBands-1] {
+		t.Fatal("the last band does not cover the high bit")
+	}
+}
+
+func TestFormatHash(t *testing.T) {
+	const hash uint64 = 0x00ff00ff12345678
+
+	s := picture.FormatHash(hash)
+	if s != "00ff00ff12345678" {
+		t.Fatal(s)
+	}
+
+	got, err := picture.ParseHash(s)
+	test.AssertErrNil(t, err)
+
+	if got != hash {
+		t.Fatal("exp", hash, "got", got)
+	}
+
+	if _, err = picture.ParseHash("xyz"); err == nil {
+		t.Fatal("parsed invalid hash")
+	}
+}
+
+func TestBlurHash(t *testing.T) {
+	black := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for i := 3; i < len(black.Pix); i += 4 {
+		black.Pix[i] = 255
+	}
+
+	const expBlack = "L00000fQfQfQfQfQfQfQfQfQfQfQ"
+	if got := picture.BlurHash(black); got != expBlack {
+		t.Fatal("exp", expBlack, "got", got)
+	}
+
+	// 3 components along the width and 4 along the height.
+	const expLength = 1 + 1 + 4 + 2*(3*4-1)
+
+	hash := picture.BlurHash(newTestImage(300, 400, false))
+	if len(hash) != expLength || hash[0] != 'T' {
+		t.Fatal("unexpected hash", hash)
+	}
+
+	if hash == picture.BlurHash(newTestImage(300, 400, true)) {
+		t.Fatal("mirrored image has the same hash")
+	}
+}
+
+func TestLQIP(t *testing.T) {
+	const prefix = "data:image/jpeg;base64,"
+
+	uri, err := picture.LQIP(newTestImage(640, 480, false))
+	test.AssertErrNil(t, err)
+
+	if !strings.HasPrefix(uri, prefix) {
+		t.Fatal("unexpected uri", uri)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(uri, prefix))
+	test.AssertErrNil(t, err)
+
+	hdr, err := picture.DecodeHeader(data)
+	test.AssertErrNil(t, err)
+
+	if hdr.Width != 16 || hdr.Height != 12 {
+		t.Fatal("exp 16x12, got", hdr.Width, hdr.Height)
+	}
+}
+
+func TestPalette(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 100))
+
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			c := color.RGBA{R: 220, G: 30, B: 30, A: 255}
+
+			switch {
+			case x >= 70:
+				c = color.RGBA{R: 20, G: 40, B: 200, A: 255}
+			case x >= 60:
+				// Close to red, it is merged.
+				c = color.RGBA{R: 230, G: 40, B: 20, A: 255}
+			}
+
+			img.Set(x, y, c)
+		}
+	}
+
+	palette := picture.Palette(img, 5)
+	if len(palette) != 2 {
+		t.Fatal("exp 2 colors, got", palette)
+	}
+
+	// Edges are blurred by scaling down.
+	const weightDelta = 0.02
+
+	if red := palette[0]; red.Color.R < 200 || math.Abs(red.Weight-0.7) > weightDelta {
+		t.Fatal("unexpected first color", red)
+	}
+
+	if blue := palette[1]; blue.Color.B < 190 || math.Abs(blue.Weight-0.3) > weightDelta {
+		t.Fatal("unexpected second color", blue)
+	}
+
+	if got := picture.Palette(image.NewNRGBA(image.Rect(0, 0, 4, 4)), 5); len(got) != 0 {
+		t.Fatal("exp empty palette of transparent image, got", got)
+	}
+}
+
+func TestDifficulty(t *testing.T) {
+	grids := []int{3, 4, 5}
+
+	flat := image.NewGray(image.Rect(0, 0, 300, 400))
+	for i := range flat.Pix {
+		flat.Pix[i] = 128
+	}
+
+	// Noise with bright and dark tiles is busy.
+	busy := image.NewGray(image.Rect(0, 0, 300, 400))
+	for i := range busy.Pix {
+		busy.Pix[i] = uint8((i*7919)%256/2 + (i/300/80)*30)
+	}
+
+	flatDifficulty := picture.Difficulty(flat, grids)
+	gradientDifficulty := picture.Difficulty(newTestImage(300, 400, false), grids)
+	busyDifficulty := picture.Difficulty(busy, grids)
+
+	for _, n := range grids {
+		if flatDifficulty[n] != 1 {
+			t.Fatal("exp 1 for flat image, got", flatDifficulty[n])
+		}
+
+		if !(busyDifficulty[n] < gradientDifficulty[n] && gradientDifficulty[n] < flatDifficulty[n]) {
+			t.Fatal("unexpected order", n, busyDifficulty[n], gradientDifficulty[n], flatDifficulty[n])
+		}
+	}
+
+	if got := picture.Difficulty(flat, []int{0, 1000}); len(got) != 0 {
+		t.Fatal("exp no invalid grids, got", got)
+	}
+}
+
+func TestDrawGrid(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 30, 30))
+	picture.DrawGrid(img, 3, 2, color.NRGBA{R: 255, A: 128})
+
+	// Lines at edges are inside the image, crossings are not darker.
+	for _, p := range []image.Point{{0, 5}, {1, 5}, {9, 5}, {10, 5}, {29, 5}, {10, 10}, {0, 0}} {
+		if got := img.NRGBAAt(p.X, p.Y); got.R != 255 || got.A != 128 {
+			t.Fatal("exp line at", p, "got", got)
+		}
+	}
+
+	if got := img.NRGBAAt(5, 5); got.A != 0 {
+		t.Fatal("exp no line inside tile, got", got)
+	}
+}
+
+func TestDrawTileNumbers(t *testing.T) {
+	const size, n = 120, 3
+
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	if err := picture.DrawTileNumbers(img, n); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every tile has a number near its center.
+	for i := 0; i < n*n; i++ {
+		tile := image.Rect(0, 0, size/n, size/n).Add(image.Pt(i%n*size/n, i/n*size/n))
+
+		var drawn int
+
+		for y := tile.Min.Y; y < tile.Max.Y; y++ {
+			for x := tile.Min.X; x < tile.Max.X; x++ {
+				if img.NRGBAAt(x, y).A != 0 {
+					drawn++
+				}
+			}
+		}
+
+		if drawn == 0 {
+			t.Fatal("exp number in tile", i)
+		}
+
+		if img.NRGBAAt(tile.Min.X, tile.Min.Y).A != 0 {
+			t.Fatal("exp number in center of tile", i)
+		}
+	}
+}
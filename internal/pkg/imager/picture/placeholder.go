@@ -0,0 +1,172 @@
+package picture
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// blurHashComponentsLong and blurHashComponentsShort are counts of
+	// components along the long and the short sides of the image.
+	blurHashComponentsLong  = 4
+	blurHashComponentsShort = 3
+
+	// blurHashSampleSize is a size of the long side of the image the
+	// hash is computed from, the hash is blurred anyway.
+	blurHashSampleSize = 32
+
+	// lqipSize is a size of the long side of the LQIP.
+	lqipSize    = 16
+	lqipQuality = 40
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// BlurHash returns the BlurHash of the image with 4 components along
+// the long side and 3 along the short one.
+func BlurHash(img image.Image) string {
+	bounds := img.Bounds()
+
+	componentsX, componentsY := blurHashComponentsLong, blurHashComponentsShort
+	if bounds.Dx() < bounds.Dy() {
+		componentsX, componentsY = componentsY, componentsX
+	}
+
+	sample := imaging.Fit(img, blurHashSampleSize, blurHashSampleSize, imaging.Box)
+
+	return encodeBlurHash(sample, componentsX, componentsY)
+}
+
+func encodeBlurHash(img *image.NRGBA, componentsX, componentsY int) string {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+
+	factors := make([][3]float64, 0, componentsX*componentsY)
+
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var factor [3]float64
+
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i*x)/float64(width)) *
+						math.Cos(math.Pi*float64(j*y)/float64(height))
+
+					px := img.Pix[y*img.Stride+x*4:]
+					factor[0] += basis * srgbToLinear(px[0])
+					factor[1] += basis * srgbToLinear(px[1])
+					factor[2] += basis * srgbToLinear(px[2])
+				}
+			}
+
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{
+				factor[0] * scale,
+				factor[1] * scale,
+				factor[2] * scale,
+			})
+		}
+	}
+
+	var hash strings.Builder
+
+	writeBase83(&hash, (componentsX-1)+(componentsY-1)*9, 1)
+
+	maxValue := 1.0
+
+	if ac := factors[1:]; len(ac) > 0 {
+		var actualMax float64
+
+		for _, factor := range ac {
+			for _, v := range factor {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+
+		quantisedMax := clampInt(int(math.Floor(actualMax*166-0.5)), 0, 82)
+		maxValue = float64(quantisedMax+1) / 166
+
+		writeBase83(&hash, quantisedMax, 1)
+	} else {
+		writeBase83(&hash, 0, 1)
+	}
+
+	dc := factors[0]
+	writeBase83(&hash, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+
+	for _, factor := range factors[1:] {
+		quantised := func(v float64) int {
+			return clampInt(int(math.Floor(signPow(v/maxValue, 0.5)*9+9.5)), 0, 18)
+		}
+
+		writeBase83(&hash, quantised(factor[0])*19*19+quantised(factor[1])*19+quantised(factor[2]), 2)
+	}
+
+	return hash.String()
+}
+
+func writeBase83(b *strings.Builder, value, length int) {
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		b.WriteByte(base83Chars[digit])
+	}
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+func clampInt(value, min, max int) int {
+	switch {
+	case value < min:
+		return min
+	case value > max:
+		return max
+	default:
+		return value
+	}
+}
+
+// LQIP returns a tiny low quality JPEG preview of the image as a data
+// URI, so clients can show it without extra requests.
+func LQIP(img image.Image) (uri string, err error) {
+	preview := imaging.Fit(img, lqipSize, lqipSize, imaging.Box)
+
+	var data bytes.Buffer
+
+	if err = jpeg.Encode(&data, preview, &jpeg.Options{Quality: lqipQuality}); err != nil {
+		return "", fmt.Errorf("encoding lqip: %w", err)
+	}
+
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(data.Bytes()), nil
+}
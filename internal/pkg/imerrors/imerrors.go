@@ -108,6 +108,26 @@ func NewConflictError(err error) error {
 	}
 }
 
+// TemporaryError means that given err is about a temporary failure,
+// the request can be retried.
+type TemporaryError struct {
+	WrappedError
+}
+
+// NewTemporaryError wraps err and creates TemporaryError.
+func NewTemporaryError(err error) error {
+	return TemporaryError{
+		WrappedError: WrappedError{
+			Err: err,
+		},
+	}
+}
+
+// Temporary implements the interface of temporary errors.
+func (err TemporaryError) Temporary() bool {
+	return true
+}
+
 type errorPair struct {
 	main      error
 	secondary error
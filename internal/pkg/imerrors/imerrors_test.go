@@ -57,6 +57,9 @@ func TestSubWrappedErrors(t *testing.T) {
 	}, {
 		Err: imerrors.NewBadRequestError(errOriginal),
 		Exp: &imerrors.BadRequestError{},
+	}, {
+		Err: imerrors.NewTemporaryError(errOriginal),
+		Exp: &imerrors.TemporaryError{},
 	}}
 
 	for _, tc := range testCases {
@@ -128,5 +131,7 @@ func TestIsTemporaryError(t *testing.T) {
 		t.Fatal(ctx.Err())
 	case imerrors.IsTemporaryError(errPermanent):
 		t.Fatal(ctx.Err())
+	case !imerrors.IsTemporaryError(imerrors.NewTemporaryError(errPermanent)):
+		t.Fatal("exp temporary error")
 	}
 }
@@ -0,0 +1,186 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// MaxListLimit is a max count of listed jobs.
+const MaxListLimit = 1000
+
+// Stats holds counts of jobs by states.
+type Stats struct {
+	Ready   int `json:"ready"`
+	Delayed int `json:"delayed"`
+	Running int `json:"running"`
+	Dead    int `json:"dead"`
+}
+
+// Stats returns counts of jobs by states.
+func (q *Queue) Stats(ctx context.Context) (stats Stats, err error) {
+	kv := q.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	p := newPipeline(kv)
+	p.Send("MULTI")
+	p.Send("LLEN", q.keys.Ready)
+	p.Send("ZCARD", q.keys.Delayed)
+	p.Send("ZCARD", q.keys.Running)
+	p.Send("LLEN", q.keys.Dead)
+
+	reply, err := redis.Values(p.Do("EXEC"))
+	if err != nil {
+		return Stats{}, fmt.Errorf("doing exec: %w", err)
+	}
+
+	_, err = redis.Scan(reply, &stats.Ready, &stats.Delayed, &stats.Running, &stats.Dead)
+	if err != nil {
+		return Stats{}, fmt.Errorf("scanning stats: %w", err)
+	}
+
+	return stats, nil
+}
+
+// List returns up to limit first jobs in the state.
+func (q *Queue) List(ctx context.Context, state string, limit int) (jobs []Job, err error) {
+	if limit <= 0 || limit > MaxListLimit {
+		err = fmt.Errorf("limit should be from 1 to %d", MaxListLimit)
+
+		return nil, imerrors.NewUnprocessableEntity(err)
+	}
+
+	kv := q.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	var ids []string
+
+	switch state {
+	case StateReady:
+		ids, err = redis.Strings(kv.Do("LRANGE", q.keys.Ready, 0, limit-1))
+	case StateDelayed:
+		ids, err = redis.Strings(kv.Do("ZRANGE", q.keys.Delayed, 0, limit-1))
+	case StateRunning:
+		ids, err = redis.Strings(kv.Do("ZRANGE", q.keys.Running, 0, limit-1))
+	case StateDead:
+		ids, err = redis.Strings(kv.Do("LRANGE", q.keys.Dead, 0, limit-1))
+	default:
+		err = fmt.Errorf("unknown state: %s", state)
+
+		return nil, imerrors.NewUnprocessableEntity(err)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("listing ids: %w", err)
+	}
+
+	jobs = make([]Job, 0, len(ids))
+	for _, id := range ids {
+		job, err := q.get(kv, id)
+		switch {
+		case errors.As(err, &imerrors.NotFoundError{}):
+			// It was finished concurrently.
+			continue
+		case err != nil:
+			return nil, err
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// Get returns the job, NotFoundError is returned for finished jobs.
+func (q *Queue) Get(ctx context.Context, id string) (job Job, err error) {
+	kv := q.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	return q.get(kv, id)
+}
+
+// RetryDead moves the job from the dead-letter list to the ready list,
+// attempts are counted again.
+func (q *Queue) RetryDead(ctx context.Context, id string) (err error) {
+	kv := q.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	moved, err := redis.Bool(scriptRetryDead.Do(kv, q.keys.Dead, q.keys.Ready, q.keys.Attempts, id))
+	switch {
+	case err != nil:
+		return fmt.Errorf("doing retry dead script: %w", err)
+	case !moved:
+		return imerrors.NewNotFoundError(imerrors.Error("dead job not found"))
+	}
+
+	return nil
+}
+
+func (q *Queue) get(kv redis.Conn, id string) (job Job, err error) {
+	p := newPipeline(kv)
+	p.Send("MULTI")
+	p.Send("HGET", q.keys.Data, id)
+	p.Send("HGET", q.keys.Attempts, id)
+
+	reply, err := redis.Values(p.Do("EXEC"))
+	if err != nil {
+		return Job{}, fmt.Errorf("doing exec: %w", err)
+	}
+
+	var (
+		rawJob  []byte
+		attempt int
+	)
+
+	if _, err = redis.Scan(reply, &rawJob, &attempt); err != nil {
+		return Job{}, fmt.Errorf("scanning job: %w", err)
+	}
+
+	if rawJob == nil {
+		return Job{}, imerrors.NewNotFoundError(imerrors.Error("job not found"))
+	}
+
+	if err = json.Unmarshal(rawJob, &job); err != nil {
+		return Job{}, fmt.Errorf("decoding job: %s: %w", id, err)
+	}
+
+	job.Attempt = attempt
+
+	return job, nil
+}
+
+// pipeline helps to handle send error.
+type pipeline struct {
+	kv redis.Conn
+
+	err error
+}
+
+func newPipeline(kv redis.Conn) *pipeline {
+	return &pipeline{
+		kv: kv,
+
+		err: nil,
+	}
+}
+
+func (p *pipeline) Send(commandName string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+
+	p.err = p.kv.Send(commandName, args...)
+}
+
+func (p *pipeline) Do(commandName string, args ...interface{}) (reply interface{}, err error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	return p.kv.Do(commandName, args...)
+}
@@ -0,0 +1,449 @@
+// Package jobs is a background job queue stored in redis.
+//
+// Ready jobs are in a list. A taken job is moved to the running set
+// with a deadline of the visibility timeout, after it the job is given
+// to another worker. Failed jobs are retried with an exponential backoff
+// from the delayed set, after the last attempt they are moved to the
+// dead-letter list.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// DefaultKeyPrefix is a prefix of redis keys of the queue.
+const DefaultKeyPrefix = "ocmoxa:jobs:"
+
+// Job states.
+const (
+	StateReady   = "ready"
+	StateDelayed = "delayed"
+	StateRunning = "running"
+	StateDead    = "dead"
+)
+
+// Job is a unit of the background work.
+type Job struct {
+	ID string `json:"id"`
+	// Type selects the handler of the job.
+	Type string `json:"type"`
+	// Payload is decoded by the handler.
+	Payload json.RawMessage `json:"payload"`
+	// Attempt is a number of the current attempt, it starts from 1.
+	Attempt int `json:"attempt"`
+	// LastError is an error of the last failed attempt.
+	LastError string    `json:"last_error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Decode decodes the payload to v.
+func (j Job) Decode(v interface{}) error {
+	if err := json.Unmarshal(j.Payload, v); err != nil {
+		return fmt.Errorf("decoding payload: %w", err)
+	}
+
+	return nil
+}
+
+// Handler processes jobs of one type. The job is retried if it returns
+// an error.
+type Handler func(ctx context.Context, job Job) error
+
+// Essentials of the Queue.
+type Essentials struct {
+	KVP *redis.Pool
+	// PromRegistry is optional, metrics are registered in it.
+	PromRegistry prometheus.Registerer
+	// KeyPrefix is DefaultKeyPrefix if it is empty.
+	KeyPrefix string
+}
+
+// Queue of jobs.
+type Queue struct {
+	kvp *redis.Pool
+	cfg config.Jobs
+
+	keys keys
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+
+	metrics *metrics
+}
+
+type keys struct {
+	Ready    string
+	Delayed  string
+	Running  string
+	Dead     string
+	Data     string
+	Attempts string
+}
+
+// NewQueue creates the job queue.
+func NewQueue(es Essentials, cfg config.Jobs) (*Queue, error) {
+	prefix := es.KeyPrefix
+	if prefix == "" {
+		prefix = DefaultKeyPrefix
+	}
+
+	q := &Queue{
+		kvp: es.KVP,
+		cfg: cfg,
+		keys: keys{
+			Ready:    prefix + StateReady,
+			Delayed:  prefix + StateDelayed,
+			Running:  prefix + StateRunning,
+			Dead:     prefix + StateDead,
+			Data:     prefix + "data",
+			Attempts: prefix + "attempts",
+		},
+		handlers: make(map[string]Handler),
+	}
+
+	q.metrics = newMetrics(q)
+
+	if es.PromRegistry != nil {
+		if err := q.metrics.register(es.PromRegistry); err != nil {
+			return nil, fmt.Errorf("registering metrics: %w", err)
+		}
+	}
+
+	return q, nil
+}
+
+// Handle sets the handler of jobs of the type.
+func (q *Queue) Handle(jobType string, h Handler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.handlers[jobType] = h
+}
+
+// Enqueue adds the job with the payload encoded to JSON and returns its
+// id.
+func (q *Queue) Enqueue(
+	ctx context.Context,
+	jobType string,
+	payload interface{},
+) (id string, err error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("encoding payload: %w", err)
+	}
+
+	job := Job{
+		ID:        uuid.NewString(),
+		Type:      jobType,
+		Payload:   data,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	rawJob, err := json.Marshal(job)
+	if err != nil {
+		return "", fmt.Errorf("encoding job: %w", err)
+	}
+
+	kv := q.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	_, err = scriptEnqueue.Do(kv, q.keys.Data, q.keys.Ready, job.ID, rawJob)
+	if err != nil {
+		return "", fmt.Errorf("doing enqueue script: %w", err)
+	}
+
+	zerolog.Ctx(ctx).Debug().
+		Str("job_id", job.ID).
+		Str("job_type", jobType).
+		Msg("job enqueued")
+
+	return job.ID, nil
+}
+
+// Run processes jobs by workers until the context is done. Jobs in
+// progress are finished before it returns.
+func (q *Queue) Run(ctx context.Context) {
+	workers := q.cfg.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			q.work(ctx)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (q *Queue) work(ctx context.Context) {
+	l := zerolog.Ctx(ctx)
+
+	for ctx.Err() == nil {
+		job, found, err := q.take()
+		switch {
+		case err != nil:
+			l.Warn().Err(err).Msg("taking job")
+		case found:
+			q.process(ctx, job)
+
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(q.cfg.PollInterval)):
+		}
+	}
+}
+
+// process runs the handler of the job. The job is not cancelled with
+// ctx, so it is finished on the shutdown.
+func (q *Queue) process(ctx context.Context, job Job) {
+	l := zerolog.Ctx(ctx).With().
+		Str("job_id", job.ID).
+		Str("job_type", job.Type).
+		Int("attempt", job.Attempt).
+		Logger()
+
+	q.mu.RLock()
+	h, ok := q.handlers[job.Type]
+	q.mu.RUnlock()
+
+	var err error
+
+	switch {
+	case !ok:
+		err = imerrors.Error("unknown job type")
+	case job.Attempt > q.cfg.MaxAttempts:
+		// The worker was lost on all attempts.
+		err = imerrors.Error("visibility timeout exceeded")
+	default:
+		jobCtx, cancel := context.WithTimeout(
+			l.WithContext(context.Background()),
+			time.Duration(q.cfg.VisibilityTimeout),
+		)
+
+		started := time.Now()
+		err = h(jobCtx, job)
+		q.metrics.observeDuration(job.Type, time.Since(started))
+
+		cancel()
+	}
+
+	if err == nil {
+		if err = q.ack(job); err != nil {
+			l.Warn().Err(err).Msg("acknowledging job")
+		}
+
+		q.metrics.countProcessed(job.Type, resultDone)
+
+		return
+	}
+
+	job.LastError = err.Error()
+
+	if !ok || job.Attempt >= q.cfg.MaxAttempts {
+		l.Warn().Err(err).Msg("job failed, moving to dead-letter list")
+
+		if err = q.bury(job); err != nil {
+			l.Warn().Err(err).Msg("burying job")
+		}
+
+		q.metrics.countProcessed(job.Type, resultDead)
+
+		return
+	}
+
+	delay := q.backoff(job.Attempt)
+
+	l.Info().Err(err).Dur("delay", delay).Msg("job failed, retrying")
+
+	if err = q.retryLater(job, delay); err != nil {
+		l.Warn().Err(err).Msg("delaying job")
+	}
+
+	q.metrics.countProcessed(job.Type, resultRetried)
+}
+
+// backoff returns a delay before the next attempt.
+func (q *Queue) backoff(attempt int) time.Duration {
+	delay := time.Duration(q.cfg.MinBackoff)
+	for i := 1; i < attempt && delay < time.Duration(q.cfg.MaxBackoff); i++ {
+		delay *= 2
+	}
+
+	if delay > time.Duration(q.cfg.MaxBackoff) {
+		delay = time.Duration(q.cfg.MaxBackoff)
+	}
+
+	return delay
+}
+
+// take moves due delayed and expired running jobs to the ready list and
+// takes the first ready job.
+func (q *Queue) take() (job Job, found bool, err error) {
+	kv := q.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	now := time.Now()
+	deadline := now.Add(time.Duration(q.cfg.VisibilityTimeout))
+
+	reply, err := redis.Values(scriptTake.Do(kv,
+		q.keys.Ready, q.keys.Delayed, q.keys.Running, q.keys.Data, q.keys.Attempts,
+		now.UnixNano()/int64(time.Millisecond),
+		deadline.UnixNano()/int64(time.Millisecond),
+	))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+		return Job{}, false, nil
+	case err != nil:
+		return Job{}, false, fmt.Errorf("doing take script: %w", err)
+	}
+
+	var (
+		id      string
+		rawJob  []byte
+		attempt int
+	)
+
+	if _, err = redis.Scan(reply, &id, &rawJob, &attempt); err != nil {
+		return Job{}, false, fmt.Errorf("scanning job: %w", err)
+	}
+
+	if err = json.Unmarshal(rawJob, &job); err != nil {
+		return Job{}, false, fmt.Errorf("decoding job: %s: %w", id, err)
+	}
+
+	job.Attempt = attempt
+
+	return job, true, nil
+}
+
+func (q *Queue) ack(job Job) (err error) {
+	kv := q.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	_, err = scriptAck.Do(kv, q.keys.Running, q.keys.Data, q.keys.Attempts, job.ID)
+	if err != nil {
+		return fmt.Errorf("doing ack script: %w", err)
+	}
+
+	return nil
+}
+
+func (q *Queue) retryLater(job Job, delay time.Duration) (err error) {
+	rawJob, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("encoding job: %w", err)
+	}
+
+	kv := q.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	runAt := time.Now().Add(delay).UnixNano() / int64(time.Millisecond)
+
+	_, err = scriptRetryLater.Do(kv,
+		q.keys.Running, q.keys.Delayed, q.keys.Data,
+		job.ID, runAt, rawJob,
+	)
+	if err != nil {
+		return fmt.Errorf("doing retry script: %w", err)
+	}
+
+	return nil
+}
+
+func (q *Queue) bury(job Job) (err error) {
+	rawJob, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("encoding job: %w", err)
+	}
+
+	kv := q.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	_, err = scriptBury.Do(kv, q.keys.Running, q.keys.Dead, q.keys.Data, job.ID, rawJob)
+	if err != nil {
+		return fmt.Errorf("doing bury script: %w", err)
+	}
+
+	return nil
+}
+
+// nolint: gochecknoglobals // Scripts are immutable.
+var (
+	scriptEnqueue = redis.NewScript(2, `
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return redis.call("RPUSH", KEYS[2], ARGV[1])`)
+	scriptTake = redis.NewScript(5, `
+local due = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", ARGV[1])
+for _, id in ipairs(due) do
+	redis.call("ZREM", KEYS[2], id)
+	redis.call("RPUSH", KEYS[1], id)
+end
+local expired = redis.call("ZRANGEBYSCORE", KEYS[3], "-inf", ARGV[1])
+for _, id in ipairs(expired) do
+	redis.call("ZREM", KEYS[3], id)
+	redis.call("RPUSH", KEYS[1], id)
+end
+while true do
+	local id = redis.call("LPOP", KEYS[1])
+	if not id then
+		return false
+	end
+	local job = redis.call("HGET", KEYS[4], id)
+	if job then
+		redis.call("ZADD", KEYS[3], ARGV[2], id)
+		local attempt = redis.call("HINCRBY", KEYS[5], id, 1)
+		return {id, job, attempt}
+	end
+end`)
+	scriptAck = redis.NewScript(3, `
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HDEL", KEYS[2], ARGV[1])
+redis.call("HDEL", KEYS[3], ARGV[1])
+return 1`)
+	scriptRetryLater = redis.NewScript(3, `
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[3], ARGV[1], ARGV[3])
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+return 1`)
+	scriptBury = redis.NewScript(3, `
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[3], ARGV[1], ARGV[2])
+redis.call("RPUSH", KEYS[2], ARGV[1])
+return 1`)
+	scriptRetryDead = redis.NewScript(3, `
+if redis.call("LREM", KEYS[1], 0, ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HDEL", KEYS[3], ARGV[1])
+redis.call("RPUSH", KEYS[2], ARGV[1])
+return 1`)
+)
@@ -0,0 +1,232 @@
+// +build integration
+
+package jobs_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/jobs"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/test"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const jobType = "test"
+
+type testPayload struct {
+	Value string `json:"value"`
+}
+
+func newTestQueue(tb testing.TB) (q *jobs.Queue, close func(tb testing.TB)) {
+	tb.Helper()
+
+	kvp := test.InitKVP(tb)
+
+	q, err := jobs.NewQueue(jobs.Essentials{
+		KVP:          kvp,
+		PromRegistry: prometheus.NewRegistry(),
+		KeyPrefix:    "test:jobs:" + uuid.NewString() + ":",
+	}, config.Jobs{
+		Workers:           2,
+		MaxAttempts:       3,
+		VisibilityTimeout: config.Duration(time.Second),
+		MinBackoff:        config.Duration(time.Millisecond),
+		MaxBackoff:        config.Duration(10 * time.Millisecond),
+		PollInterval:      config.Duration(10 * time.Millisecond),
+	})
+	test.AssertErrNil(tb, err)
+
+	return q, func(tb testing.TB) {
+		test.DisposeKVP(tb, kvp)
+	}
+}
+
+// runQueue runs the queue until cond returns true.
+func runQueue(t *testing.T, q *jobs.Queue, cond func() bool) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		q.Run(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+
+	if !cond() {
+		t.Fatal("condition is not met")
+	}
+}
+
+func TestQueue_done(t *testing.T) {
+	q, close := newTestQueue(t)
+	defer close(t)
+
+	ctx := context.Background()
+
+	var got atomic.Value
+
+	q.Handle(jobType, func(ctx context.Context, job jobs.Job) error {
+		var payload testPayload
+		if err := job.Decode(&payload); err != nil {
+			return err
+		}
+
+		got.Store(payload.Value)
+
+		return nil
+	})
+
+	id, err := q.Enqueue(ctx, jobType, testPayload{Value: "value"})
+	test.AssertErrNil(t, err)
+
+	job, err := q.Get(ctx, id)
+	test.AssertErrNil(t, err)
+
+	if job.Type != jobType {
+		t.Fatal("exp", jobType, "got", job.Type)
+	}
+
+	runQueue(t, q, func() bool { return got.Load() != nil })
+
+	if got.Load() != "value" {
+		t.Fatal("exp value, got", got.Load())
+	}
+
+	_, err = q.Get(ctx, id)
+	if !errors.As(err, &imerrors.NotFoundError{}) {
+		t.Fatal(err)
+	}
+
+	stats, err := q.Stats(ctx)
+	test.AssertErrNil(t, err)
+
+	if stats != (jobs.Stats{}) {
+		t.Fatal("unexpected stats", stats)
+	}
+}
+
+func TestQueue_deadLetter(t *testing.T) {
+	q, close := newTestQueue(t)
+	defer close(t)
+
+	ctx := context.Background()
+
+	var (
+		attempts int32
+		fail     int32 = 1
+	)
+
+	q.Handle(jobType, func(ctx context.Context, job jobs.Job) error {
+		atomic.AddInt32(&attempts, 1)
+
+		if atomic.LoadInt32(&fail) == 1 {
+			return imerrors.Error("failed")
+		}
+
+		return nil
+	})
+
+	id, err := q.Enqueue(ctx, jobType, testPayload{})
+	test.AssertErrNil(t, err)
+
+	isDead := func() bool {
+		stats, err := q.Stats(ctx)
+		test.AssertErrNil(t, err)
+
+		return stats.Dead == 1
+	}
+
+	runQueue(t, q, isDead)
+
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Fatal("exp 3 attempts, got", got)
+	}
+
+	dead, err := q.List(ctx, jobs.StateDead, 10)
+	test.AssertErrNil(t, err)
+
+	if len(dead) != 1 || dead[0].ID != id || dead[0].LastError != "failed" {
+		t.Fatal("unexpected dead jobs", dead)
+	}
+
+	atomic.StoreInt32(&fail, 0)
+
+	test.AssertErrNil(t, q.RetryDead(ctx, id))
+
+	err = q.RetryDead(ctx, id)
+	if !errors.As(err, &imerrors.NotFoundError{}) {
+		t.Fatal(err)
+	}
+
+	runQueue(t, q, func() bool { return atomic.LoadInt32(&attempts) == 4 })
+
+	stats, err := q.Stats(ctx)
+	test.AssertErrNil(t, err)
+
+	if stats != (jobs.Stats{}) {
+		t.Fatal("unexpected stats", stats)
+	}
+}
+
+func TestQueue_unknownType(t *testing.T) {
+	q, close := newTestQueue(t)
+	defer close(t)
+
+	ctx := context.Background()
+
+	_, err := q.Enqueue(ctx, "unknown", testPayload{})
+	test.AssertErrNil(t, err)
+
+	runQueue(t, q, func() bool {
+		stats, err := q.Stats(ctx)
+		test.AssertErrNil(t, err)
+
+		return stats.Dead == 1
+	})
+}
+
+func TestQueue_List(t *testing.T) {
+	q, close := newTestQueue(t)
+	defer close(t)
+
+	ctx := context.Background()
+
+	_, err := q.List(ctx, "unknown", 10)
+	if !errors.As(err, &imerrors.UnprocessableEntity{}) {
+		t.Fatal(err)
+	}
+
+	_, err = q.List(ctx, jobs.StateReady, 0)
+	if !errors.As(err, &imerrors.UnprocessableEntity{}) {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err = q.Enqueue(ctx, jobType, testPayload{})
+		test.AssertErrNil(t, err)
+	}
+
+	ready, err := q.List(ctx, jobs.StateReady, 2)
+	test.AssertErrNil(t, err)
+
+	if len(ready) != 2 {
+		t.Fatal("exp 2, got", len(ready))
+	}
+}
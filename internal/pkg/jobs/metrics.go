@@ -0,0 +1,93 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Results of processing.
+const (
+	resultDone    = "done"
+	resultRetried = "retried"
+	resultDead    = "dead"
+)
+
+type metrics struct {
+	processed *prometheus.CounterVec
+	duration  *prometheus.HistogramVec
+	states    *statesCollector
+}
+
+func newMetrics(q *Queue) *metrics {
+	return &metrics{
+		processed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "swaptile",
+			Subsystem: "imager",
+			Help:      "Processed jobs by results",
+			Name:      "jobs_processed_total",
+		}, []string{"type", "result"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "swaptile",
+			Subsystem: "imager",
+			Help:      "Duration of job handlers",
+			Name:      "jobs_duration",
+		}, []string{"type"}),
+		states: &statesCollector{
+			queue: q,
+			desc: prometheus.NewDesc(
+				"swaptile_imager_jobs",
+				"Count of jobs by states",
+				[]string{"state"},
+				nil,
+			),
+		},
+	}
+}
+
+func (m *metrics) register(registerer prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{m.processed, m.duration, m.states} {
+		if err := registerer.Register(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *metrics) countProcessed(jobType string, result string) {
+	m.processed.WithLabelValues(jobType, result).Inc()
+}
+
+func (m *metrics) observeDuration(jobType string, d time.Duration) {
+	m.duration.WithLabelValues(jobType).Observe(d.Seconds())
+}
+
+// statesCollector gets counts of jobs on scraping.
+type statesCollector struct {
+	queue *Queue
+	desc  *prometheus.Desc
+}
+
+func (c *statesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *statesCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.queue.Stats(context.Background())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+
+		return
+	}
+
+	for state, count := range map[string]int{
+		StateReady:   stats.Ready,
+		StateDelayed: stats.Delayed,
+		StateRunning: stats.Running,
+		StateDead:    stats.Dead,
+	} {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), state)
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"sort"
 	"strings"
 
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/picture"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository"
 
@@ -98,6 +100,137 @@ func (r ImageMetaRepository) Exists(
 	return found, nil
 }
 
+// Get image meta by id.
+func (r ImageMetaRepository) Get(
+	ctx context.Context,
+	imageID string,
+) (im imager.ImageMeta, err error) {
+	kv := r.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	rawIM, err := redis.Bytes(kv.Do(
+		"HGET",
+		keyImageMeta,
+		imageID,
+	))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+		return imager.ImageMeta{}, imerrors.NewNotFoundError(imerrors.Error("image not found"))
+	case err != nil:
+		return imager.ImageMeta{}, fmt.Errorf("doing hget: %w", err)
+	}
+
+	return imager.RawImageMetaJSON(rawIM).ImageMeta()
+}
+
+// FindByChecksum returns ids of images with the same original.
+func (r ImageMetaRepository) FindByChecksum(
+	ctx context.Context,
+	sha256 string,
+) (imageIDs []string, err error) {
+	kv := r.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	imageIDs, err = redis.Strings(kv.Do(
+		"SMEMBERS",
+		keyPrefixSHA256+sha256,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("doing smembers: %w", err)
+	}
+
+	sort.Strings(imageIDs)
+
+	return imageIDs, nil
+}
+
+// DHashes returns perceptual hashes of all images.
+func (r ImageMetaRepository) DHashes(
+	ctx context.Context,
+) (dhashes map[string]string, err error) {
+	kv := r.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	dhashes, err = redis.StringMap(kv.Do(
+		"HGETALL",
+		keyImageDHash,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("doing hgetall: %w", err)
+	}
+
+	return dhashes, nil
+}
+
+// FindByDHash returns perceptual hashes of images that share a band with
+// the given hash. Only these images can be up to
+// picture.MaxBandDistance apart, so other hashes are not read.
+func (r ImageMetaRepository) FindByDHash(
+	ctx context.Context,
+	dhash string,
+) (dhashes map[string]string, err error) {
+	bandKeys, err := dhashBandKeys(dhash)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := r.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	args := make([]interface{}, 0, len(bandKeys))
+	for _, key := range bandKeys {
+		args = append(args, key)
+	}
+
+	imageIDs, err := redis.Strings(kv.Do("SUNION", args...))
+	if err != nil {
+		return nil, fmt.Errorf("doing sunion: %w", err)
+	}
+
+	dhashes = make(map[string]string, len(imageIDs))
+	if len(imageIDs) == 0 {
+		return dhashes, nil
+	}
+
+	args = make([]interface{}, 0, len(imageIDs)+1)
+	args = append(args, keyImageDHash)
+	for _, id := range imageIDs {
+		args = append(args, id)
+	}
+
+	values, err := redis.Strings(kv.Do("HMGET", args...))
+	if err != nil {
+		return nil, fmt.Errorf("doing hmget: %w", err)
+	}
+
+	for i, value := range values {
+		// Images deleted concurrently have no hashes.
+		if value != "" {
+			dhashes[imageIDs[i]] = value
+		}
+	}
+
+	return dhashes, nil
+}
+
+// dhashBandKeys returns keys of sets of image ids by bands of the
+// perceptual hash.
+func dhashBandKeys(dhash string) (keys []string, err error) {
+	hash, err := picture.ParseHash(dhash)
+	if err != nil {
+		return nil, err
+	}
+
+	bands := picture.Bands(hash)
+
+	keys = make([]string, len(bands))
+	for i, band := range bands {
+		keys[i] = keyPrefixDHashBand + band
+	}
+
+	return keys, nil
+}
+
 // Insert an image metadata.
 func (r ImageMetaRepository) Insert(
 	ctx context.Context,
@@ -111,6 +244,13 @@ func (r ImageMetaRepository) Insert(
 		return fmt.Errorf("encoding image meta: %w", err)
 	}
 
+	var bandKeys []string
+	if im.DHash != "" {
+		if bandKeys, err = dhashBandKeys(im.DHash); err != nil {
+			return err
+		}
+	}
+
 	p := newPipeline(kv)
 	p.Send("MULTI")
 	p.Send(
@@ -129,6 +269,28 @@ func (r ImageMetaRepository) Insert(
 		im.ID,
 		imData, // Element.
 	)
+	if im.SHA256 != "" {
+		p.Send(
+			"SADD",
+			keyPrefixSHA256+im.SHA256,
+			im.ID, // Member.
+		)
+	}
+	if im.DHash != "" {
+		p.Send(
+			"HSET",
+			keyImageDHash,
+			im.ID,
+			im.DHash,
+		)
+	}
+	for _, key := range bandKeys {
+		p.Send(
+			"SADD",
+			key,
+			im.ID, // Member.
+		)
+	}
 	_, err = p.Do("EXEC")
 	if err != nil {
 		return fmt.Errorf("doing exec: %w", err)
@@ -137,6 +299,116 @@ func (r ImageMetaRepository) Insert(
 	return err
 }
 
+// nolint: gochecknoglobals // Scripts are immutable.
+var (
+	// scriptCompareAndSetImageMeta sets the image meta if it is not
+	// changed since it was read, it returns 0 otherwise. Values of the
+	// image in index hashes of other keys are set along with it.
+	scriptCompareAndSetImageMeta = redis.NewScript(-1, `
+if redis.call("HGET", KEYS[1], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+for i = 2, #KEYS do
+	redis.call("HSET", KEYS[i], ARGV[1], ARGV[i + 2])
+end
+return 1`)
+)
+
+// IndexField is a value of the image in the index hash.
+type IndexField struct {
+	Key   string
+	Value string
+}
+
+// CompareAndSetImageMeta sets the meta of the image in the hash if it is
+// still expected, so concurrent changes are not overwritten. Fields of
+// the image in indexes are set along with it. It is false if the meta
+// is changed or deleted.
+func CompareAndSetImageMeta(
+	kv redis.Conn,
+	keyImageMeta string,
+	imageID string,
+	expected imager.RawImageMetaJSON,
+	im imager.RawImageMetaJSON,
+	indexes ...IndexField,
+) (set bool, err error) {
+	keysAndArgs := make([]interface{}, 0, 2*len(indexes)+4)
+	keysAndArgs = append(keysAndArgs, 1+len(indexes), keyImageMeta)
+
+	for _, index := range indexes {
+		keysAndArgs = append(keysAndArgs, index.Key)
+	}
+
+	keysAndArgs = append(keysAndArgs, imageID, []byte(expected), []byte(im))
+
+	for _, index := range indexes {
+		keysAndArgs = append(keysAndArgs, index.Value)
+	}
+
+	set, err = redis.Bool(scriptCompareAndSetImageMeta.Do(kv, keysAndArgs...))
+	if err != nil {
+		return false, fmt.Errorf("doing compare and set script: %w", err)
+	}
+
+	return set, nil
+}
+
+// Update an image metadata. It uses optimistic locking on the meta of the
+// image, so concurrent changes of the image are not lost. Changes of
+// other images do not conflict.
+func (r ImageMetaRepository) Update(
+	ctx context.Context,
+	imageID string,
+	change func(im *imager.ImageMeta) error,
+) (im imager.ImageMeta, err error) {
+	const maxAttempts = 10
+
+	kv := r.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		rawIM, err := redis.Bytes(kv.Do(
+			"HGET",
+			keyImageMeta,
+			imageID,
+		))
+		switch {
+		case errors.Is(err, redis.ErrNil):
+			return imager.ImageMeta{}, imerrors.NewNotFoundError(imerrors.Error("image not found"))
+		case err != nil:
+			return imager.ImageMeta{}, fmt.Errorf("doing hget: %w", err)
+		}
+
+		im, err = imager.RawImageMetaJSON(rawIM).ImageMeta()
+		if err != nil {
+			return imager.ImageMeta{}, err
+		}
+
+		if err = change(&im); err != nil {
+			return imager.ImageMeta{}, err
+		}
+
+		imData, err := im.RawJSON()
+		if err != nil {
+			return imager.ImageMeta{}, fmt.Errorf("encoding image meta: %w", err)
+		}
+
+		set, err := CompareAndSetImageMeta(kv, keyImageMeta, imageID, rawIM, imData)
+		switch {
+		case err != nil:
+			return imager.ImageMeta{}, err
+		case set:
+			return im, nil
+		}
+		// The meta was changed concurrently, try again.
+	}
+
+	return imager.ImageMeta{}, imerrors.NewTemporaryError(
+		imerrors.Error("update: too many concurrent changes"),
+	)
+}
+
 // Delete an image metadata by index in the category.
 func (r ImageMetaRepository) Delete(
 	ctx context.Context,
@@ -178,6 +450,29 @@ func (r ImageMetaRepository) Delete(
 		keyImageMeta,
 		imageID,
 	)
+	if im.SHA256 != "" {
+		p.Send(
+			"SREM",
+			keyPrefixSHA256+im.SHA256,
+			imageID, // Member.
+		)
+	}
+	p.Send(
+		"HDEL",
+		keyImageDHash,
+		imageID,
+	)
+	if im.DHash != "" {
+		// Invalid hashes are not indexed.
+		bandKeys, _ := dhashBandKeys(im.DHash)
+		for _, key := range bandKeys {
+			p.Send(
+				"SREM",
+				key,
+				imageID, // Member.
+			)
+		}
+	}
 	_, err = p.Do("EXEC")
 	if err != nil {
 		return fmt.Errorf("doing exec: %w", err)
@@ -245,6 +540,82 @@ func (r ImageMetaRepository) Shuffle(
 	return nil
 }
 
+// Reorder images in the category. It uses optimistic locking, so
+// concurrent changes of the category are not lost.
+func (r ImageMetaRepository) Reorder(
+	ctx context.Context,
+	category string,
+	imageIDs []string,
+) (err error) {
+	const maxAttempts = 10
+
+	kv := r.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	key := r.keyImageID(category)
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if _, err = kv.Do("WATCH", key); err != nil {
+			return fmt.Errorf("doing watch: %w", err)
+		}
+
+		current, err := redis.Strings(kv.Do("LRANGE", key, 0, -1))
+		if err != nil {
+			return fmt.Errorf("doing lrange: %w", err)
+		}
+
+		ordered := reorderIDs(current, imageIDs)
+
+		args := make([]interface{}, 0, len(ordered)+1)
+		args = append(args, key)
+		for _, id := range ordered {
+			args = append(args, id)
+		}
+
+		p := newPipeline(kv)
+		p.Send("MULTI")
+		p.Send("DEL", key)
+		if len(ordered) > 0 {
+			p.Send("RPUSH", args...)
+		}
+		reply, err := p.Do("EXEC")
+		switch {
+		case err != nil:
+			return fmt.Errorf("doing exec: %w", err)
+		case reply != nil:
+			return nil
+		}
+		// The list was changed concurrently, try again.
+	}
+
+	return imerrors.Error("reorder: too many concurrent changes")
+}
+
+// reorderIDs moves known ids of the order to the head of current.
+func reorderIDs(current []string, order []string) []string {
+	counts := make(map[string]int, len(current))
+	for _, id := range current {
+		counts[id]++
+	}
+
+	ordered := make([]string, 0, len(current))
+	for _, id := range order {
+		if counts[id] > 0 {
+			counts[id]--
+			ordered = append(ordered, id)
+		}
+	}
+
+	for _, id := range current {
+		if counts[id] > 0 {
+			counts[id]--
+			ordered = append(ordered, id)
+		}
+	}
+
+	return ordered
+}
+
 // Categories returns a list of known categories. This data is obtained
 // from the keys of the images.
 func (r ImageMetaRepository) Categories(
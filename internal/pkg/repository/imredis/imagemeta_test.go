@@ -5,12 +5,16 @@ package imredis_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager/picture"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository/imredis"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/test"
@@ -81,6 +85,259 @@ func TestImageMetaRepository(t *testing.T) {
 	}
 }
 
+func TestImageMetaRepository_GetFindByChecksum(t *testing.T) {
+	kvp := test.InitKVP(t)
+	defer test.DisposeKVP(t, kvp)
+
+	ctx := context.Background()
+	imageMetaRepo := imredis.NewImageMetaRepository(kvp)
+
+	sha256 := uuid.NewString()
+	category := strings.ReplaceAll(uuid.NewString(), "-", "")
+	imageIDs := []string{uuid.NewString(), uuid.NewString()}
+
+	for _, id := range imageIDs {
+		err := imageMetaRepo.Insert(ctx, imager.ImageMeta{
+			ID:       id,
+			Author:   "test_author",
+			Category: category,
+			SHA256:   sha256,
+		})
+		test.AssertErrNil(t, err)
+	}
+
+	im, err := imageMetaRepo.Get(ctx, imageIDs[0])
+	test.AssertErrNil(t, err)
+
+	if im.ID != imageIDs[0] || im.SHA256 != sha256 {
+		t.Fatal("got", im)
+	}
+
+	_, err = imageMetaRepo.Get(ctx, uuid.NewString())
+	if !errors.As(err, &imerrors.NotFoundError{}) {
+		t.Fatal(err)
+	}
+
+	sort.Strings(imageIDs)
+
+	gotIDs, err := imageMetaRepo.FindByChecksum(ctx, sha256)
+	test.AssertErrNil(t, err)
+
+	if strings.Join(gotIDs, ",") != strings.Join(imageIDs, ",") {
+		t.Fatal("exp", imageIDs, "got", gotIDs)
+	}
+
+	for i, id := range imageIDs {
+		test.AssertErrNil(t, imageMetaRepo.Delete(ctx, id))
+
+		gotIDs, err = imageMetaRepo.FindByChecksum(ctx, sha256)
+		test.AssertErrNil(t, err)
+
+		if len(gotIDs) != len(imageIDs)-i-1 {
+			t.Fatal("exp", len(imageIDs)-i-1, "got", gotIDs)
+		}
+	}
+}
+
+func TestImageMetaRepository_FindByDHash(t *testing.T) {
+	kvp := test.InitKVP(t)
+	defer test.DisposeKVP(t, kvp)
+
+	ctx := context.Background()
+	imageMetaRepo := imredis.NewImageMetaRepository(kvp)
+
+	category := strings.ReplaceAll(uuid.NewString(), "-", "")
+	hash := rand.Uint64()
+
+	dhashes := map[string]string{
+		// Only the first band differs.
+		"near": picture.FormatHash(hash ^ 0xff),
+		// All bands differ.
+		"far": picture.FormatHash(^hash),
+	}
+
+	for name, dhash := range dhashes {
+		err := imageMetaRepo.Insert(ctx, imager.ImageMeta{
+			ID:       name + "_" + uuid.NewString(),
+			Author:   "test_author",
+			Category: category,
+			DHash:    dhash,
+		})
+		test.AssertErrNil(t, err)
+	}
+
+	got, err := imageMetaRepo.FindByDHash(ctx, picture.FormatHash(hash))
+	test.AssertErrNil(t, err)
+
+	if len(got) != 1 {
+		t.Fatal("exp near got", got)
+	}
+
+	for id, dhash := range got {
+		if !strings.HasPrefix(id, "near_") || dhash != dhashes["near"] {
+			t.Fatal("exp near got", id, dhash)
+		}
+
+		test.AssertErrNil(t, imageMetaRepo.Delete(ctx, id))
+	}
+
+	got, err = imageMetaRepo.FindByDHash(ctx, picture.FormatHash(hash))
+	test.AssertErrNil(t, err)
+
+	if len(got) != 0 {
+		t.Fatal("exp none got", got)
+	}
+
+	_, err = imageMetaRepo.FindByDHash(ctx, "hash")
+	if err == nil {
+		t.Fatal("exp error of invalid hash")
+	}
+}
+
+func TestImageMetaRepository_Update(t *testing.T) {
+	kvp := test.InitKVP(t)
+	defer test.DisposeKVP(t, kvp)
+
+	ctx := context.Background()
+	imageMetaRepo := imredis.NewImageMetaRepository(kvp)
+
+	id := uuid.NewString()
+	category := strings.ReplaceAll(uuid.NewString(), "-", "")
+
+	err := imageMetaRepo.Insert(ctx, imager.ImageMeta{
+		ID:       id,
+		Author:   "test_author",
+		Category: category,
+	})
+	test.AssertErrNil(t, err)
+	defer func() { test.AssertErrNil(t, imageMetaRepo.Delete(ctx, id)) }()
+
+	fp := &imager.FocalPoint{X: 0.25, Y: 0.75}
+
+	updated, err := imageMetaRepo.Update(ctx, id, func(im *imager.ImageMeta) error {
+		im.FocalPoint = fp
+
+		return nil
+	})
+	test.AssertErrNil(t, err)
+
+	im, err := imageMetaRepo.Get(ctx, id)
+	test.AssertErrNil(t, err)
+
+	if im.FocalPoint == nil || *im.FocalPoint != *fp || *updated.FocalPoint != *fp {
+		t.Fatal("exp", fp, "got", im.FocalPoint, updated.FocalPoint)
+	}
+
+	errChange := imerrors.Error("change")
+
+	_, err = imageMetaRepo.Update(ctx, id, func(im *imager.ImageMeta) error {
+		return errChange
+	})
+	if !errors.Is(err, errChange) {
+		t.Fatal(err)
+	}
+
+	_, err = imageMetaRepo.Update(ctx, uuid.NewString(), func(im *imager.ImageMeta) error {
+		return nil
+	})
+	if !errors.As(err, &imerrors.NotFoundError{}) {
+		t.Fatal(err)
+	}
+}
+
+func TestImageMetaRepository_UpdateConcurrent(t *testing.T) {
+	kvp := test.InitKVP(t)
+	defer test.DisposeKVP(t, kvp)
+
+	ctx := context.Background()
+	imageMetaRepo := imredis.NewImageMetaRepository(kvp)
+
+	category := strings.ReplaceAll(uuid.NewString(), "-", "")
+
+	insert := func(t *testing.T) string {
+		t.Helper()
+
+		id := uuid.NewString()
+
+		err := imageMetaRepo.Insert(ctx, imager.ImageMeta{
+			ID:       id,
+			Author:   "test_author",
+			Category: category,
+		})
+		test.AssertErrNil(t, err)
+		t.Cleanup(func() { test.AssertErrNil(t, imageMetaRepo.Delete(ctx, id)) })
+
+		return id
+	}
+
+	setAuthor := func(t *testing.T, id string, author string) {
+		t.Helper()
+
+		_, err := imageMetaRepo.Update(ctx, id, func(im *imager.ImageMeta) error {
+			im.Author = author
+
+			return nil
+		})
+		test.AssertErrNil(t, err)
+	}
+
+	t.Run("same_image", func(t *testing.T) {
+		id := insert(t)
+
+		calls := 0
+
+		updated, err := imageMetaRepo.Update(ctx, id, func(im *imager.ImageMeta) error {
+			calls++
+			if calls == 1 {
+				setAuthor(t, id, "concurrent_author")
+			}
+
+			im.WEBSource = "test_source"
+
+			return nil
+		})
+		test.AssertErrNil(t, err)
+
+		if calls != 2 || updated.Author != "concurrent_author" || updated.WEBSource != "test_source" {
+			t.Fatal("exp retry with the concurrent change, got", calls, updated)
+		}
+	})
+
+	t.Run("other_image", func(t *testing.T) {
+		id, otherID := insert(t), insert(t)
+
+		calls := 0
+
+		_, err := imageMetaRepo.Update(ctx, id, func(im *imager.ImageMeta) error {
+			calls++
+			setAuthor(t, otherID, "concurrent_author")
+
+			return nil
+		})
+		test.AssertErrNil(t, err)
+
+		if calls != 1 {
+			t.Fatal("exp no retries, got", calls)
+		}
+	})
+
+	t.Run("too_many_changes", func(t *testing.T) {
+		id := insert(t)
+
+		calls := 0
+
+		_, err := imageMetaRepo.Update(ctx, id, func(im *imager.ImageMeta) error {
+			calls++
+			setAuthor(t, id, "concurrent_author_"+strconv.Itoa(calls))
+
+			return nil
+		})
+		if !imerrors.IsTemporaryError(err) {
+			t.Fatal("exp temporary error, got", err)
+		}
+	})
+}
+
 func mustExistsImageMeta(
 	t *testing.T,
 	imageMetaList []imager.RawImageMetaJSON,
@@ -179,3 +436,120 @@ func TestImageMetaRepository_Shuffle_empty(t *testing.T) {
 		test.AssertErrNil(t, err)
 	})
 }
+
+func TestImageMetaRepository_Reorder(t *testing.T) {
+	const count = 5
+	category := uuid.New().String()
+
+	kvp := test.InitKVP(t)
+	defer test.DisposeKVP(t, kvp)
+
+	ctx := context.Background()
+	pagination := repository.Pagination{
+		Limit:  1000,
+		Offset: 0,
+	}
+
+	var imageMetaRepo repository.ImageMetaRepository = imredis.NewImageMetaRepository(kvp)
+	for i := 0; i < count; i++ {
+		err := imageMetaRepo.Insert(ctx, imager.ImageMeta{
+			ID:        category + "_" + strconv.Itoa(i),
+			Author:    "test_author",
+			WEBSource: "test_websource",
+			MIMEType:  "test_mimetype",
+			Category:  category,
+		})
+		test.AssertErrNil(t, err)
+	}
+
+	err := imageMetaRepo.Reorder(ctx, category, []string{
+		category + "_3",
+		"unknown",
+		category + "_1",
+	})
+	test.AssertErrNil(t, err)
+
+	rawIMs, err := imageMetaRepo.List(ctx, category, pagination)
+	test.AssertErrNil(t, err)
+
+	expOrder := []string{"_3", "_1", "_0", "_2", "_4"}
+	if len(rawIMs) != len(expOrder) {
+		t.Fatal("exp", len(expOrder), "got", len(rawIMs))
+	}
+
+	for i, rawIM := range rawIMs {
+		im, err := rawIM.ImageMeta()
+		test.AssertErrNil(t, err)
+
+		if im.ID != category+expOrder[i] {
+			t.Fatal("exp", category+expOrder[i], "got", im.ID)
+		}
+
+		test.AssertErrNil(t, imageMetaRepo.Delete(ctx, im.ID))
+	}
+}
+
+func TestImageMetaRepository_objects(t *testing.T) {
+	kvp := test.InitKVP(t)
+	defer test.DisposeKVP(t, kvp)
+
+	ctx := context.Background()
+	objectID := "test_" + uuid.NewString()
+
+	var imageMetaRepo repository.ImageMetaRepository = imredis.NewImageMetaRepository(kvp)
+
+	found, err := imageMetaRepo.AcquireObject(ctx, objectID, true)
+	test.AssertErrNil(t, err)
+
+	if found {
+		t.Fatal("exp unreferenced object not to be shared")
+	}
+
+	for i := 0; i < 2; i++ {
+		found, err = imageMetaRepo.AcquireObject(ctx, objectID, i > 0)
+		test.AssertErrNil(t, err)
+
+		if !found {
+			t.Fatal("exp object to be acquired")
+		}
+	}
+
+	last, err := imageMetaRepo.ReleaseObject(ctx, objectID)
+	test.AssertErrNil(t, err)
+
+	if last {
+		t.Fatal("exp shared object to be kept")
+	}
+
+	last, err = imageMetaRepo.ReleaseObject(ctx, objectID)
+	test.AssertErrNil(t, err)
+
+	if !last {
+		t.Fatal("exp last reference")
+	}
+
+	_, err = imageMetaRepo.AcquireObject(ctx, objectID, false)
+	if !imerrors.IsTemporaryError(err) {
+		t.Fatal("exp temporary error while deleting, got", err)
+	}
+
+	found, err = imageMetaRepo.AcquireObject(ctx, objectID, true)
+	test.AssertErrNil(t, err)
+
+	if found {
+		t.Fatal("exp deleted object not to be shared")
+	}
+
+	test.AssertErrNil(t, imageMetaRepo.DeletedObject(ctx, objectID))
+
+	found, err = imageMetaRepo.AcquireObject(ctx, objectID, false)
+	test.AssertErrNil(t, err)
+
+	if !found {
+		t.Fatal("exp object to be acquired after deleting")
+	}
+
+	_, err = imageMetaRepo.ReleaseObject(ctx, objectID)
+	test.AssertErrNil(t, err)
+	test.AssertErrNil(t, imageMetaRepo.DeletedObject(ctx, objectID))
+}
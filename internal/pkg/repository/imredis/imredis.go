@@ -6,6 +6,13 @@ import "github.com/gomodule/redigo/redis"
 const (
 	keyImageMeta     = "ocmoxa:image_meta"
 	keyPrefixImageID = "ocmoxa:image_id:"
+	keyPrefixSHA256  = "ocmoxa:image_sha256:"
+	keyImageDHash    = "ocmoxa:image_dhash"
+
+	keyPrefixDHashBand = "ocmoxa:image_dhash_band:"
+
+	keyPrefixObjectRefs     = "ocmoxa:object_refs:"
+	keyPrefixObjectDeleting = "ocmoxa:object_deleting:"
 )
 
 // pipeline helps to handle send error.
@@ -0,0 +1,104 @@
+package imredis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// objectDeletingTimeout limits the time the released original is
+// deleted, it can be referenced again after it if DeletedObject was not
+// called.
+const objectDeletingTimeout = 10 * time.Minute
+
+// nolint: gochecknoglobals // Scripts are immutable.
+var (
+	// scriptAcquireObject returns 0 if the shared original is not
+	// referenced and -1 if the new original is deleted.
+	scriptAcquireObject = redis.NewScript(2, `
+if ARGV[1] == "1" then
+	if redis.call("EXISTS", KEYS[1]) == 0 then
+		return 0
+	end
+elseif redis.call("EXISTS", KEYS[2]) == 1 then
+	return -1
+end
+return redis.call("INCR", KEYS[1])`)
+	// scriptReleaseObject returns the count of remaining references, the
+	// original is marked as deleted when it is 0.
+	scriptReleaseObject = redis.NewScript(2, `
+local refs = redis.call("DECR", KEYS[1])
+if refs > 0 then
+	return refs
+end
+redis.call("DEL", KEYS[1])
+redis.call("SET", KEYS[2], 1, "PX", ARGV[1])
+return 0`)
+)
+
+// AcquireObject adds a reference to the original.
+func (r ImageMetaRepository) AcquireObject(
+	ctx context.Context,
+	objectID string,
+	shared bool,
+) (found bool, err error) {
+	kv := r.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	refs, err := redis.Int64(scriptAcquireObject.Do(
+		kv,
+		keyPrefixObjectRefs+objectID,
+		keyPrefixObjectDeleting+objectID,
+		shared,
+	))
+	switch {
+	case err != nil:
+		return false, fmt.Errorf("doing acquire script: %w", err)
+	case refs < 0:
+		err = fmt.Errorf("original is being deleted: %s", objectID)
+
+		return false, imerrors.NewTemporaryError(err)
+	}
+
+	return refs > 0, nil
+}
+
+// ReleaseObject removes the reference to the original.
+func (r ImageMetaRepository) ReleaseObject(
+	ctx context.Context,
+	objectID string,
+) (last bool, err error) {
+	kv := r.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	refs, err := redis.Int64(scriptReleaseObject.Do(
+		kv,
+		keyPrefixObjectRefs+objectID,
+		keyPrefixObjectDeleting+objectID,
+		objectDeletingTimeout.Milliseconds(),
+	))
+	if err != nil {
+		return false, fmt.Errorf("doing release script: %w", err)
+	}
+
+	return refs == 0, nil
+}
+
+// DeletedObject allows to reference the original again.
+func (r ImageMetaRepository) DeletedObject(
+	ctx context.Context,
+	objectID string,
+) (err error) {
+	kv := r.kvp.Get()
+	defer func() { err = imerrors.ErrorPair(err, kv.Close()) }()
+
+	if _, err = kv.Do("DEL", keyPrefixObjectDeleting+objectID); err != nil {
+		return fmt.Errorf("doing del: %w", err)
+	}
+
+	return nil
+}
@@ -15,9 +15,28 @@ type ImageMetaRepository interface {
 	List(ctx context.Context, category string, pagination Pagination) (im []imager.RawImageMetaJSON, err error)
 	// Exists checks that image meta found.
 	Exists(ctx context.Context, imageID string) (found bool, err error)
+	// Get returns image meta by id. It returns imerrors.NotFoundError
+	// if the image is not found.
+	Get(ctx context.Context, imageID string) (im imager.ImageMeta, err error)
+	// FindByChecksum returns sorted ids of images with the given
+	// SHA-256 of the original.
+	FindByChecksum(ctx context.Context, sha256 string) (imageIDs []string, err error)
+	// DHashes returns perceptual hashes of all images by their ids.
+	DHashes(ctx context.Context) (dhashes map[string]string, err error)
+	// FindByDHash returns perceptual hashes of images by their ids that
+	// can be up to picture.MaxBandDistance apart from the given one.
+	// Farther images can be returned too.
+	FindByDHash(ctx context.Context, dhash string) (dhashes map[string]string, err error)
 	// Insert saves new image id to the category. The uniquness of the
 	// id is not checked.
 	Insert(ctx context.Context, im imager.ImageMeta) (err error)
+	// Update applies the change to the image meta and saves it. The
+	// change can be called again if the image was changed concurrently,
+	// its error is returned as is. The category, checksum and hash
+	// should not be changed. It returns imerrors.NotFoundError if the
+	// image is not found and imerrors.TemporaryError if it is changed
+	// concurrently too many times.
+	Update(ctx context.Context, imageID string, change func(im *imager.ImageMeta) error) (im imager.ImageMeta, err error)
 	// Delete deletes image by id from the category.
 	Delete(ctx context.Context, imageID string) (err error)
 	// Categories returns a list of known categories.
@@ -25,12 +44,27 @@ type ImageMetaRepository interface {
 	// Shuffle swaps random images in the category. The depth should be
 	// positive.
 	Shuffle(ctx context.Context, category string, depth int) (err error)
+	// Reorder moves given images of the category to the head in the
+	// given order. Unknown ids are ignored, other images keep their
+	// relative order after given ones.
+	Reorder(ctx context.Context, category string, imageIDs []string) (err error)
+	// AcquireObject adds a reference to the stored original. If shared
+	// is set, the reference is added only while the original is
+	// referenced, found is false otherwise. A new original can not be
+	// referenced while it is deleted, it returns imerrors.TemporaryError.
+	AcquireObject(ctx context.Context, objectID string, shared bool) (found bool, err error)
+	// ReleaseObject removes the reference to the original. If it was the
+	// last one, the original should be deleted and DeletedObject should
+	// be called, new references are not added until then.
+	ReleaseObject(ctx context.Context, objectID string) (last bool, err error)
+	// DeletedObject allows to reference the deleted original again.
+	DeletedObject(ctx context.Context, objectID string) (err error)
 }
 
 // Pagination holds query limits.
 type Pagination struct {
 	// Limit of rows in the result.
-	Limit int `validate:"gte=1,lte=200"`
+	Limit int `json:"limit" validate:"gte=1,lte=200"`
 	// Offset of rows in the result.
-	Offset int `validate:"gte=0"`
+	Offset int `json:"offset" validate:"gte=0"`
 }
@@ -0,0 +1,267 @@
+// Package local implements storage.FileStorage on the local file
+// system.
+package local
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage"
+)
+
+const (
+	dirPerm  = 0o755
+	filePerm = 0o644
+
+	// extMeta is an extension of files with meta information. Names of
+	// data files never contain dots.
+	extMeta = ".meta"
+	// prefixTemp is a prefix of files that are being written.
+	prefixTemp = ".tmp-"
+)
+
+// Storage implements storage.FileStorage for the local file system.
+// Each file is stored with a sidecar file that keeps its content type.
+type Storage struct {
+	cfg config.Local
+}
+
+type fileMeta struct {
+	ContentType string `json:"content_type"`
+}
+
+// NewStorage creates new local file storage that implements
+// storage.FileStorage interface. It creates the root directory if it
+// does not exist.
+func NewStorage(cfg config.Local) (*Storage, error) {
+	if err := os.MkdirAll(cfg.Root, dirPerm); err != nil {
+		return nil, fmt.Errorf("local creating root: %w", err)
+	}
+
+	return &Storage{
+		cfg: cfg,
+	}, nil
+}
+
+// Health checks that the root directory exists.
+func (s Storage) Health(ctx context.Context) (err error) {
+	fi, err := os.Stat(s.cfg.Root)
+	switch {
+	case err != nil:
+		return fmt.Errorf("local: checking root: %w", err)
+	case !fi.IsDir():
+		return imerrors.NewNotFoundError(imerrors.Error("local: root is not a directory"))
+	default:
+		return nil
+	}
+}
+
+// Get an image by ID from the file system.
+func (s Storage) Get(
+	ctx context.Context,
+	id string,
+) (f storage.File, err error) {
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return storage.File{}, err
+	}
+
+	file, err := os.Open(s.path(id))
+	if err != nil {
+		return storage.File{}, wrapNotFound(fmt.Errorf("local opening file: %w", err))
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+
+		return storage.File{}, fmt.Errorf("local getting stat: %w", err)
+	}
+
+	fi := storage.FileInfo{ID: id, Size: stat.Size(), ModTime: stat.ModTime()}
+
+	return storage.File{
+		ReadCloser:  file,
+		ContentType: meta.ContentType,
+		ETag:        fi.ETag(),
+	}, nil
+}
+
+// Upload an image to the file system. The file is written atomically,
+// readers never see partially written files.
+func (s Storage) Upload(ctx context.Context, im imager.ImageMeta, r io.Reader) (err error) {
+	err = s.writeFile(s.path(im.ID), r, im.Size)
+	if err != nil {
+		return fmt.Errorf("local writing file: %w", err)
+	}
+
+	metaData, err := json.Marshal(fileMeta{ContentType: im.MIMEType})
+	if err != nil {
+		return fmt.Errorf("local encoding meta: %w", err)
+	}
+
+	err = s.writeFile(s.path(im.ID)+extMeta, bytes.NewReader(metaData), int64(len(metaData)))
+	if err != nil {
+		return fmt.Errorf("local writing meta: %w", err)
+	}
+
+	return nil
+}
+
+// Delete the image by ID.
+func (s Storage) Delete(ctx context.Context, id string) (err error) {
+	for _, name := range []string{s.path(id) + extMeta, s.path(id)} {
+		err = os.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("local removing file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Stat returns information about the image by ID.
+func (s Storage) Stat(ctx context.Context, id string) (fi storage.FileInfo, err error) {
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return storage.FileInfo{}, err
+	}
+
+	stat, err := os.Stat(s.path(id))
+	if err != nil {
+		return storage.FileInfo{}, wrapNotFound(fmt.Errorf("local getting stat: %w", err))
+	}
+
+	return storage.FileInfo{
+		ID:          id,
+		Size:        stat.Size(),
+		ContentType: meta.ContentType,
+		ModTime:     stat.ModTime(),
+	}, nil
+}
+
+// List all images in the root directory.
+func (s Storage) List(ctx context.Context, prefix string, fn func(fi storage.FileInfo) error) (err error) {
+	entries, err := ioutil.ReadDir(s.cfg.Root)
+	if err != nil {
+		return fmt.Errorf("local reading root: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if entry.IsDir() || strings.Contains(name, ".") {
+			// Meta and temporary files.
+			continue
+		}
+
+		id, err := url.PathUnescape(name)
+		if err != nil {
+			return fmt.Errorf("local decoding name: %s: %w", name, err)
+		}
+
+		if !strings.HasPrefix(id, prefix) {
+			continue
+		}
+
+		if err = fn(storage.FileInfo{
+			ID:      id,
+			Size:    entry.Size(),
+			ModTime: entry.ModTime(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s Storage) readMeta(id string) (meta fileMeta, err error) {
+	data, err := ioutil.ReadFile(s.path(id) + extMeta)
+	if err != nil {
+		return fileMeta{}, wrapNotFound(fmt.Errorf("local reading meta: %w", err))
+	}
+
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return fileMeta{}, fmt.Errorf("local decoding meta: %w", err)
+	}
+
+	return meta, nil
+}
+
+// writeFile writes r to the temporary file and renames it. If size is
+// positive, it must match the count of written bytes.
+func (s Storage) writeFile(name string, r io.Reader, size int64) (err error) {
+	f, err := ioutil.TempFile(s.cfg.Root, prefixTemp)
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			err = imerrors.ErrorPair(err, os.Remove(f.Name()))
+		}
+	}()
+
+	n, err := io.Copy(f, r)
+	switch {
+	case err != nil:
+		return imerrors.ErrorPair(fmt.Errorf("copying data: %w", err), f.Close())
+	case size > 0 && n != size:
+		err = fmt.Errorf("expected %d bytes, got %d", size, n)
+
+		return imerrors.ErrorPair(err, f.Close())
+	}
+
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("closing file: %w", err)
+	}
+
+	if err = os.Chmod(f.Name(), filePerm); err != nil {
+		return fmt.Errorf("changing mode: %w", err)
+	}
+
+	if err = os.Rename(f.Name(), name); err != nil {
+		return fmt.Errorf("renaming file: %w", err)
+	}
+
+	return nil
+}
+
+// path returns the path of the image data. The id is escaped, so it
+// never contains separators or dots.
+func (s Storage) path(id string) string {
+	var name strings.Builder
+
+	for _, b := range []byte(id) {
+		switch {
+		case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9',
+			b == '-', b == '_':
+			name.WriteByte(b)
+		default:
+			fmt.Fprintf(&name, "%%%02X", b)
+		}
+	}
+
+	return filepath.Join(s.cfg.Root, name.String())
+}
+
+func wrapNotFound(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return imerrors.NewNotFoundError(err)
+	}
+
+	return err
+}
@@ -0,0 +1,134 @@
+package local_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage/local"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/test"
+)
+
+func TestStorage(t *testing.T) {
+	s, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	var fs storage.FileStorage = s
+
+	ctx := context.Background()
+	data := []byte("hello world")
+	im := imager.ImageMeta{
+		ID:       "../id with/unsafe.chars",
+		MIMEType: "text/plain",
+		Size:     int64(len(data)),
+	}
+
+	err = fs.Upload(ctx, im, bytes.NewReader(data))
+	test.AssertErrNil(t, err)
+
+	f, err := fs.Get(ctx, im.ID)
+	test.AssertErrNil(t, err)
+
+	gotData, err := ioutil.ReadAll(f)
+	test.AssertErrNil(t, err)
+	test.AssertErrNil(t, f.Close())
+
+	switch {
+	case !bytes.Equal(data, gotData):
+		t.Fatal("exp", data, "got", gotData)
+	case f.ContentType != im.MIMEType:
+		t.Fatal("exp", im.MIMEType, "got", f.ContentType)
+	}
+
+	fi, err := fs.Stat(ctx, im.ID)
+	test.AssertErrNil(t, err)
+
+	exp := storage.FileInfo{ID: im.ID, Size: im.Size, ContentType: im.MIMEType}
+	if fi.ModTime.IsZero() {
+		t.Fatal("zero modification time")
+	}
+
+	fi.ModTime = time.Time{}
+	if fi != exp {
+		t.Fatal("exp", exp, "got", fi)
+	}
+
+	var listed []storage.FileInfo
+	err = fs.List(ctx, "", func(fi storage.FileInfo) error {
+		listed = append(listed, fi)
+
+		return nil
+	})
+	test.AssertErrNil(t, err)
+
+	if len(listed) != 1 || listed[0].ID != im.ID || listed[0].Size != im.Size {
+		t.Fatal("exp", im.ID, "got", listed)
+	}
+
+	err = fs.Delete(ctx, im.ID)
+	test.AssertErrNil(t, err)
+
+	_, err = fs.Get(ctx, im.ID)
+	if !errors.As(err, &imerrors.NotFoundError{}) {
+		t.Fatal(err)
+	}
+
+	_, err = fs.Stat(ctx, im.ID)
+	if !errors.As(err, &imerrors.NotFoundError{}) {
+		t.Fatal(err)
+	}
+}
+
+func TestStorage_Upload_sizeMismatch(t *testing.T) {
+	s, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	ctx := context.Background()
+	im := imager.ImageMeta{ID: "id", MIMEType: "text/plain", Size: 100}
+
+	err = s.Upload(ctx, im, bytes.NewReader([]byte("short")))
+	if err == nil {
+		t.Fatal("upload of truncated data succeeded")
+	}
+
+	_, err = s.Stat(ctx, im.ID)
+	if !errors.As(err, &imerrors.NotFoundError{}) {
+		t.Fatal(err)
+	}
+}
+
+func TestStorage_List_prefix(t *testing.T) {
+	s, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	ctx := context.Background()
+	data := []byte("data")
+
+	for _, id := range []string{"rendition-a-1", "rendition-a-2", "rendition-ab-1", "a"} {
+		im := imager.ImageMeta{ID: id, MIMEType: "text/plain", Size: int64(len(data))}
+		test.AssertErrNil(t, s.Upload(ctx, im, bytes.NewReader(data)))
+	}
+
+	var listed []string
+	err = s.List(ctx, "rendition-a-", func(fi storage.FileInfo) error {
+		listed = append(listed, fi.ID)
+
+		return nil
+	})
+	test.AssertErrNil(t, err)
+
+	sort.Strings(listed)
+
+	if exp := []string{"rendition-a-1", "rendition-a-2"}; !reflect.DeepEqual(exp, listed) {
+		t.Fatal("exp", exp, "got", listed)
+	}
+}
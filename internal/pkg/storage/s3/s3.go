@@ -63,13 +63,13 @@ func (s Storage) Health(ctx context.Context) (err error) {
 	}
 }
 
+const errCodeNotFound = "NoSuchKey"
+
 // Get an image by ID from S3.
 func (s Storage) Get(
 	ctx context.Context,
 	id string,
 ) (f storage.File, err error) {
-	const errCodeNotFound = "NoSuchKey"
-
 	obj, err := s.client.GetObject(s.cfg.Bucket, id, minio.GetObjectOptions{})
 	if err != nil {
 		return storage.File{}, fmt.Errorf("s3 getting object: %w", err)
@@ -85,9 +85,12 @@ func (s Storage) Get(
 		return storage.File{}, fmt.Errorf("s3 getting stat: %w", err)
 	}
 
+	fi := storage.FileInfo{ID: id, Size: stat.Size, ModTime: stat.LastModified}
+
 	return storage.File{
 		ReadCloser:  obj,
 		ContentType: stat.ContentType,
+		ETag:        fi.ETag(),
 	}, nil
 }
 
@@ -120,3 +123,48 @@ func (s Storage) Delete(ctx context.Context, id string) (err error) {
 
 	return nil
 }
+
+// Stat returns information about S3 image by ID.
+func (s Storage) Stat(ctx context.Context, id string) (fi storage.FileInfo, err error) {
+	stat, err := s.client.StatObject(s.cfg.Bucket, id, minio.StatObjectOptions{})
+	if err != nil {
+		var errResp minio.ErrorResponse
+		if errors.As(err, &errResp) && errResp.Code == errCodeNotFound {
+			return storage.FileInfo{}, imerrors.NewNotFoundError(err)
+		}
+
+		return storage.FileInfo{}, fmt.Errorf("s3 getting stat: %w", err)
+	}
+
+	return storage.FileInfo{
+		ID:          id,
+		Size:        stat.Size,
+		ContentType: stat.ContentType,
+		ModTime:     stat.LastModified,
+	}, nil
+}
+
+// List all objects of the bucket. S3 does not return content types in
+// listings.
+func (s Storage) List(ctx context.Context, prefix string, fn func(fi storage.FileInfo) error) (err error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	for obj := range s.client.ListObjectsV2(s.cfg.Bucket, prefix, true, doneCh) {
+		if obj.Err != nil {
+			return fmt.Errorf("s3 listing objects: %w", obj.Err)
+		}
+
+		err = fn(storage.FileInfo{
+			ID:          obj.Key,
+			Size:        obj.Size,
+			ContentType: obj.ContentType,
+			ModTime:     obj.LastModified,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
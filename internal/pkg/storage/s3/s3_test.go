@@ -8,6 +8,7 @@ import (
 	"errors"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
@@ -70,3 +71,51 @@ func TestStorage_Health(t *testing.T) {
 	err = storage.Health(ctx)
 	test.AssertErrNil(t, err)
 }
+
+func TestStorage_StatList(t *testing.T) {
+	s, err := s3.NewStorage(test.LoadConfig(t).S3)
+	test.AssertErrNil(t, err)
+
+	ctx := context.Background()
+	data := []byte("hello world")
+	im := imager.ImageMeta{
+		ID:       uuid.New().String(),
+		MIMEType: "text/plain",
+		Size:     int64(len(data)),
+	}
+
+	err = s.Upload(ctx, im, bytes.NewReader(data))
+	test.AssertErrNil(t, err)
+
+	t.Cleanup(func() { test.AssertErrNil(t, s.Delete(ctx, im.ID)) })
+
+	fi, err := s.Stat(ctx, im.ID)
+	test.AssertErrNil(t, err)
+
+	exp := storage.FileInfo{ID: im.ID, Size: im.Size, ContentType: im.MIMEType}
+	if fi.ModTime.IsZero() {
+		t.Fatal("zero modification time")
+	}
+
+	fi.ModTime = time.Time{}
+	if fi != exp {
+		t.Fatal("exp", exp, "got", fi)
+	}
+
+	var found bool
+	err = s.List(ctx, "", func(fi storage.FileInfo) error {
+		found = found || fi.ID == im.ID
+
+		return nil
+	})
+	test.AssertErrNil(t, err)
+
+	if !found {
+		t.Fatal("listed files don't contain", im.ID)
+	}
+
+	_, err = s.Stat(ctx, uuid.New().String())
+	if !errors.As(err, &imerrors.NotFoundError{}) {
+		t.Fatal(err)
+	}
+}
@@ -2,7 +2,9 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"time"
 
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
 )
@@ -15,6 +17,13 @@ type FileStorage interface {
 	Upload(ctx context.Context, im imager.ImageMeta, r io.Reader) (err error)
 	// Delete image in the storage.
 	Delete(ctx context.Context, id string) (err error)
+	// Stat returns information about the file. ContentType can be
+	// empty if the storage does not keep it.
+	Stat(ctx context.Context, id string) (fi FileInfo, err error)
+	// List calls fn for each file in the storage which ID starts with
+	// prefix, an empty prefix lists all files. It stops on the first
+	// error returned by fn. ContentType of listed files can be empty.
+	List(ctx context.Context, prefix string, fn func(fi FileInfo) error) (err error)
 
 	imager.Healther
 }
@@ -25,4 +34,21 @@ type File struct {
 	io.ReadCloser
 
 	ContentType string
+	// ETag identifies the version of the stored file, it is empty if the
+	// file is not read from the storage.
+	ETag string
+}
+
+// FileInfo describes a stored file.
+type FileInfo struct {
+	ID          string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// ETag identifies the version of the stored file by its size and
+// modification time.
+func (fi FileInfo) ETag() string {
+	return fmt.Sprintf(`"%x-%x"`, fi.Size, uint64(fi.ModTime.UnixNano()))
 }
@@ -0,0 +1,384 @@
+// Package transfer copies files between storages.
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage"
+
+	"github.com/rs/zerolog"
+)
+
+// Options of the copying.
+type Options struct {
+	// Workers is a count of files copied concurrently.
+	Workers int
+	// VerifyChecksum tells to read copied and already copied files back
+	// and compare their SHA-256 with the source.
+	VerifyChecksum bool
+	// ProgressInterval is an interval of progress reports.
+	ProgressInterval time.Duration
+}
+
+// Report holds the result of the copying.
+type Report struct {
+	// Copied is a count of copied files.
+	Copied int64
+	// Skipped is a count of files that were already in the destination.
+	Skipped int64
+	// Failed is a count of files that were not copied.
+	Failed int64
+	// Bytes is a count of copied bytes.
+	Bytes int64
+
+	// Diff is a difference between storages after the copying.
+	Diff Diff
+}
+
+// Diff is a difference between the source and the destination.
+type Diff struct {
+	// Missing files are in the source, but not in the destination.
+	Missing []string
+	// Mismatched files have different sizes.
+	Mismatched []string
+	// Extra files are in the destination, but not in the source.
+	Extra []string
+}
+
+// Empty returns true if the storages have the same files.
+func (d Diff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Mismatched) == 0 && len(d.Extra) == 0
+}
+
+// Copy streams all files from src to dst. Files that are already in dst
+// are skipped, so the interrupted copying can be resumed by running it
+// again, see alreadyCopied. Errors of single files are logged and
+// counted, the copying continues. After the copying both storages are
+// listed and compared.
+func Copy(
+	ctx context.Context,
+	src storage.FileStorage,
+	dst storage.FileStorage,
+	opts Options,
+) (report Report, err error) {
+	l := zerolog.Ctx(ctx)
+
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	files := make(chan storage.FileInfo)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for fi := range files {
+				copied, n, err := copyFile(ctx, src, dst, fi, opts.VerifyChecksum)
+				switch {
+				case err != nil:
+					atomic.AddInt64(&report.Failed, 1)
+
+					l.Warn().Err(err).Str("id", fi.ID).Msg("copying file")
+				case copied:
+					atomic.AddInt64(&report.Copied, 1)
+					atomic.AddInt64(&report.Bytes, n)
+				default:
+					atomic.AddInt64(&report.Skipped, 1)
+				}
+			}
+		}()
+	}
+
+	stopProgress := reportProgress(l, &report, opts.ProgressInterval)
+
+	err = src.List(ctx, "", func(fi storage.FileInfo) error {
+		select {
+		case files <- fi:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	close(files)
+	wg.Wait()
+	stopProgress()
+
+	if err != nil {
+		return report, fmt.Errorf("listing source: %w", err)
+	}
+
+	report.Diff, err = Compare(ctx, src, dst)
+	if err != nil {
+		return report, fmt.Errorf("comparing storages: %w", err)
+	}
+
+	return report, nil
+}
+
+// Compare lists both storages and returns their difference.
+func Compare(
+	ctx context.Context,
+	src storage.FileStorage,
+	dst storage.FileStorage,
+) (diff Diff, err error) {
+	srcFiles := make(map[string]int64)
+
+	err = src.List(ctx, "", func(fi storage.FileInfo) error {
+		srcFiles[fi.ID] = fi.Size
+
+		return nil
+	})
+	if err != nil {
+		return Diff{}, fmt.Errorf("listing source: %w", err)
+	}
+
+	err = dst.List(ctx, "", func(fi storage.FileInfo) error {
+		size, ok := srcFiles[fi.ID]
+		switch {
+		case !ok:
+			diff.Extra = append(diff.Extra, fi.ID)
+		case size != fi.Size:
+			diff.Mismatched = append(diff.Mismatched, fi.ID)
+		}
+
+		delete(srcFiles, fi.ID)
+
+		return nil
+	})
+	if err != nil {
+		return Diff{}, fmt.Errorf("listing destination: %w", err)
+	}
+
+	for id := range srcFiles {
+		diff.Missing = append(diff.Missing, id)
+	}
+
+	sort.Strings(diff.Missing)
+	sort.Strings(diff.Mismatched)
+	sort.Strings(diff.Extra)
+
+	return diff, nil
+}
+
+func copyFile(
+	ctx context.Context,
+	src storage.FileStorage,
+	dst storage.FileStorage,
+	fi storage.FileInfo,
+	verifyChecksum bool,
+) (copied bool, n int64, err error) {
+	dstInfo, err := dst.Stat(ctx, fi.ID)
+	switch {
+	case err == nil:
+		skip, err := alreadyCopied(ctx, src, dst, fi, dstInfo, verifyChecksum)
+		if err != nil {
+			return false, 0, err
+		}
+
+		if skip {
+			return false, 0, nil
+		}
+	case !errors.As(err, &imerrors.NotFoundError{}):
+		return false, 0, fmt.Errorf("getting destination stat: %w", err)
+	}
+
+	f, err := src.Get(ctx, fi.ID)
+	if err != nil {
+		return false, 0, fmt.Errorf("getting file: %w", err)
+	}
+
+	defer func() { err = imerrors.ErrorPair(err, f.Close()) }()
+
+	h := sha256.New()
+	cr := &countingReader{r: io.TeeReader(f, h)}
+
+	err = dst.Upload(ctx, imager.ImageMeta{
+		ID:       fi.ID,
+		MIMEType: f.ContentType,
+		Size:     fi.Size,
+	}, cr)
+	if err != nil {
+		return false, cr.n, fmt.Errorf("uploading file: %w", err)
+	}
+
+	dstInfo, err = dst.Stat(ctx, fi.ID)
+	switch {
+	case err != nil:
+		return false, cr.n, fmt.Errorf("getting destination stat: %w", err)
+	case dstInfo.Size != fi.Size:
+		return false, cr.n, fmt.Errorf("size mismatch: expected %d, got %d", fi.Size, dstInfo.Size)
+	case dstInfo.ContentType != "" && dstInfo.ContentType != f.ContentType:
+		return false, cr.n, fmt.Errorf(
+			"content type mismatch: expected %s, got %s",
+			f.ContentType, dstInfo.ContentType,
+		)
+	}
+
+	srcChecksum := h.Sum(nil)
+
+	if idChecksum, ok := contentChecksum(fi.ID); ok && !bytes.Equal(idChecksum, srcChecksum) {
+		return false, cr.n, imerrors.Error("source checksum mismatch")
+	}
+
+	if verifyChecksum {
+		dstChecksum, err := fileChecksum(ctx, dst, fi.ID)
+		if err != nil {
+			return false, cr.n, fmt.Errorf("reading copied file: %w", err)
+		}
+
+		if !bytes.Equal(dstChecksum, srcChecksum) {
+			return false, cr.n, imerrors.Error("checksum mismatch")
+		}
+	}
+
+	return true, cr.n, nil
+}
+
+// alreadyCopied tells whether the file in dst is a copy of the source
+// one. They should have the same size and content type and the copy
+// should not be older than the source. If verifyChecksum is set, the
+// checksum of the copy is compared with the id of content addressed
+// files or with the checksum of the source.
+func alreadyCopied(
+	ctx context.Context,
+	src storage.FileStorage,
+	dst storage.FileStorage,
+	srcInfo storage.FileInfo,
+	dstInfo storage.FileInfo,
+	verifyChecksum bool,
+) (bool, error) {
+	// Listings of some storages have no content types.
+	contentTypeKnown := srcInfo.ContentType != "" && dstInfo.ContentType != ""
+
+	switch {
+	case dstInfo.Size != srcInfo.Size,
+		contentTypeKnown && dstInfo.ContentType != srcInfo.ContentType,
+		dstInfo.ModTime.Before(srcInfo.ModTime):
+		return false, nil
+	case !verifyChecksum:
+		return true, nil
+	}
+
+	srcChecksum, ok := contentChecksum(srcInfo.ID)
+	if !ok {
+		var err error
+
+		srcChecksum, err = fileChecksum(ctx, src, srcInfo.ID)
+		if err != nil {
+			return false, fmt.Errorf("reading file: %w", err)
+		}
+	}
+
+	dstChecksum, err := fileChecksum(ctx, dst, srcInfo.ID)
+	if err != nil {
+		return false, fmt.Errorf("reading copied file: %w", err)
+	}
+
+	return bytes.Equal(dstChecksum, srcChecksum), nil
+}
+
+// contentChecksumPrefix is a prefix of ids of content addressed files,
+// it is followed by the hex encoded SHA-256 of their content.
+const contentChecksumPrefix = "sha256-"
+
+// contentChecksum returns the SHA-256 from the id of the content
+// addressed file, it is false for other files.
+func contentChecksum(id string) ([]byte, bool) {
+	if !strings.HasPrefix(id, contentChecksumPrefix) {
+		return nil, false
+	}
+
+	checksum, err := hex.DecodeString(strings.TrimPrefix(id, contentChecksumPrefix))
+	if err != nil || len(checksum) != sha256.Size {
+		return nil, false
+	}
+
+	return checksum, true
+}
+
+// fileChecksum reads the file and returns its SHA-256.
+func fileChecksum(ctx context.Context, s storage.FileStorage, id string) (checksum []byte, err error) {
+	f, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { err = imerrors.ErrorPair(err, f.Close()) }()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// reportProgress logs the report periodically until the returned
+// function is called.
+func reportProgress(l *zerolog.Logger, report *Report, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				l.Info().
+					Int64("copied", atomic.LoadInt64(&report.Copied)).
+					Int64("skipped", atomic.LoadInt64(&report.Skipped)).
+					Int64("failed", atomic.LoadInt64(&report.Failed)).
+					Int64("bytes", atomic.LoadInt64(&report.Bytes)).
+					Msg("copying progress")
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.n += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,217 @@
+package transfer_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage/local"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage/transfer"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/test"
+)
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+
+	src, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	dst, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	upload := func(s *local.Storage, id string, data string) {
+		err := s.Upload(ctx, imager.ImageMeta{
+			ID:       id,
+			MIMEType: "image/jpeg",
+			Size:     int64(len(data)),
+		}, bytes.NewReader([]byte(data)))
+		test.AssertErrNil(t, err)
+	}
+
+	for i := 0; i < 10; i++ {
+		upload(src, fmt.Sprint("image_", i), fmt.Sprint("data_", i))
+	}
+
+	// Already copied.
+	upload(dst, "image_0", "data_0")
+	// Interrupted copying.
+	upload(dst, "image_1", "data")
+
+	opts := transfer.Options{Workers: 3, VerifyChecksum: true}
+
+	report, err := transfer.Copy(ctx, src, dst, opts)
+	test.AssertErrNil(t, err)
+
+	exp := transfer.Report{Copied: 9, Skipped: 1, Bytes: 9 * int64(len("data_0"))}
+	if !reflect.DeepEqual(exp, report) {
+		t.Fatal("exp", exp, "got", report)
+	}
+
+	f, err := dst.Get(ctx, "image_1")
+	test.AssertErrNil(t, err)
+	test.AssertErrNil(t, f.Close())
+
+	if f.ContentType != "image/jpeg" {
+		t.Fatal("exp image/jpeg, got", f.ContentType)
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		report, err := transfer.Copy(ctx, src, dst, opts)
+		test.AssertErrNil(t, err)
+
+		exp := transfer.Report{Skipped: 10}
+		if !reflect.DeepEqual(exp, report) {
+			t.Fatal("exp", exp, "got", report)
+		}
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		upload(dst, "extra", "data")
+		upload(dst, "image_2", "changed")
+		test.AssertErrNil(t, dst.Delete(ctx, "image_3"))
+
+		diff, err := transfer.Compare(ctx, src, dst)
+		test.AssertErrNil(t, err)
+
+		exp := transfer.Diff{
+			Missing:    []string{"image_3"},
+			Mismatched: []string{"image_2"},
+			Extra:      []string{"extra"},
+		}
+		if !reflect.DeepEqual(exp, diff) {
+			t.Fatal("exp", exp, "got", diff)
+		}
+	})
+}
+
+func TestCopy_changed(t *testing.T) {
+	ctx := context.Background()
+
+	src, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	dst, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	upload := func(s *local.Storage, id string, data string) {
+		err := s.Upload(ctx, imager.ImageMeta{
+			ID:       id,
+			MIMEType: "image/jpeg",
+			Size:     int64(len(data)),
+		}, bytes.NewReader([]byte(data)))
+		test.AssertErrNil(t, err)
+	}
+
+	assertContent := func(t *testing.T, id string, exp string) {
+		t.Helper()
+
+		f, err := dst.Get(ctx, id)
+		test.AssertErrNil(t, err)
+
+		defer func() { test.AssertErrNil(t, f.Close()) }()
+
+		got, err := io.ReadAll(f)
+		test.AssertErrNil(t, err)
+
+		if string(got) != exp {
+			t.Fatal("exp", exp, "got", string(got))
+		}
+	}
+
+	content := "original"
+	checksum := sha256.Sum256([]byte(content))
+	objectID := "sha256-" + hex.EncodeToString(checksum[:])
+
+	// Copies have the same sizes, but other contents.
+	upload(dst, "older", "data_0")
+	time.Sleep(10 * time.Millisecond)
+	upload(src, "older", "data_1")
+
+	upload(src, objectID, content)
+	upload(src, "changed", "data_2")
+	time.Sleep(10 * time.Millisecond)
+	upload(dst, objectID, "corrupted"[:len(content)])
+	upload(dst, "changed", "data_3")
+
+	t.Run("without_checksum", func(t *testing.T) {
+		report, err := transfer.Copy(ctx, src, dst, transfer.Options{})
+		test.AssertErrNil(t, err)
+
+		// The copy is older than the source.
+		if report.Copied != 1 || report.Skipped != 2 {
+			t.Fatal("unexpected report", report)
+		}
+
+		assertContent(t, "older", "data_1")
+	})
+
+	t.Run("checksum", func(t *testing.T) {
+		report, err := transfer.Copy(ctx, src, dst, transfer.Options{VerifyChecksum: true})
+		test.AssertErrNil(t, err)
+
+		if report.Copied != 2 || report.Skipped != 1 || report.Failed != 0 {
+			t.Fatal("unexpected report", report)
+		}
+
+		assertContent(t, objectID, content)
+		assertContent(t, "changed", "data_2")
+	})
+
+	t.Run("source_checksum", func(t *testing.T) {
+		corruptedID := "sha256-" + hex.EncodeToString(make([]byte, sha256.Size))
+		upload(src, corruptedID, content)
+
+		report, err := transfer.Copy(ctx, src, dst, transfer.Options{})
+		test.AssertErrNil(t, err)
+
+		if report.Failed != 1 {
+			t.Fatal("exp failed copying, got", report)
+		}
+	})
+}
+
+func TestCompare_sorted(t *testing.T) {
+	ctx := context.Background()
+
+	src, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	dst, err := local.NewStorage(config.Local{Root: t.TempDir()})
+	test.AssertErrNil(t, err)
+
+	upload := func(s *local.Storage, id string, data string) {
+		err := s.Upload(ctx, imager.ImageMeta{
+			ID:       id,
+			MIMEType: "image/jpeg",
+			Size:     int64(len(data)),
+		}, bytes.NewReader([]byte(data)))
+		test.AssertErrNil(t, err)
+	}
+
+	for _, id := range []string{"c", "a", "b"} {
+		upload(src, "missing_"+id, "data")
+		upload(src, "mismatched_"+id, "data")
+		upload(dst, "mismatched_"+id, "changed")
+		upload(dst, "extra_"+id, "data")
+	}
+
+	diff, err := transfer.Compare(ctx, src, dst)
+	test.AssertErrNil(t, err)
+
+	exp := transfer.Diff{
+		Missing:    []string{"missing_a", "missing_b", "missing_c"},
+		Mismatched: []string{"mismatched_a", "mismatched_b", "mismatched_c"},
+		Extra:      []string{"extra_a", "extra_b", "extra_c"},
+	}
+	if !reflect.DeepEqual(exp, diff) {
+		t.Fatal("exp", exp, "got", diff)
+	}
+}
@@ -2,6 +2,7 @@
 package test
 
 import (
+	"encoding/binary"
 	"io"
 	"testing"
 
@@ -52,3 +53,22 @@ func DisposeKVP(tb testing.TB, kvp io.Closer) {
 	err := kvp.Close()
 	AssertErrNil(tb, err)
 }
+
+// JPEGWithOrientation inserts the EXIF segment with the orientation after
+// the start marker of the JPEG data.
+func JPEGWithOrientation(data []byte, orientation uint16) []byte {
+	// Big-endian TIFF header with one IFD entry of the SHORT type.
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.BigEndian.PutUint16(tiff[18:], orientation)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	result := append([]byte{}, data[:2]...)
+	result = append(result, segment...)
+
+	return append(result, data[2:]...)
+}
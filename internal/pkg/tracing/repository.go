@@ -0,0 +1,158 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Attributes of spans of the repository.
+const (
+	attrImageID  = attribute.Key("imager.image_id")
+	attrCategory = attribute.Key("imager.category")
+	attrObjectID = attribute.Key("imager.object_id")
+)
+
+// ImageMetaRepository traces calls of the repository.
+type ImageMetaRepository struct {
+	repository.ImageMetaRepository
+}
+
+// NewImageMetaRepository wraps the repository.
+func NewImageMetaRepository(repo repository.ImageMetaRepository) *ImageMetaRepository {
+	return &ImageMetaRepository{ImageMetaRepository: repo}
+}
+
+// List implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) List(
+	ctx context.Context,
+	category string,
+	pagination repository.Pagination,
+) (im []imager.RawImageMetaJSON, err error) {
+	ctx, span := Start(ctx, "repository.List", attrCategory.String(category))
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.List(ctx, category, pagination)
+}
+
+// Exists implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) Exists(ctx context.Context, imageID string) (found bool, err error) {
+	ctx, span := Start(ctx, "repository.Exists", attrImageID.String(imageID))
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.Exists(ctx, imageID)
+}
+
+// Get implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) Get(ctx context.Context, imageID string) (im imager.ImageMeta, err error) {
+	ctx, span := Start(ctx, "repository.Get", attrImageID.String(imageID))
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.Get(ctx, imageID)
+}
+
+// FindByChecksum implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) FindByChecksum(ctx context.Context, sha256 string) (imageIDs []string, err error) {
+	ctx, span := Start(ctx, "repository.FindByChecksum")
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.FindByChecksum(ctx, sha256)
+}
+
+// DHashes implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) DHashes(ctx context.Context) (dhashes map[string]string, err error) {
+	ctx, span := Start(ctx, "repository.DHashes")
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.DHashes(ctx)
+}
+
+// FindByDHash implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) FindByDHash(ctx context.Context, dhash string) (dhashes map[string]string, err error) {
+	ctx, span := Start(ctx, "repository.FindByDHash")
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.FindByDHash(ctx, dhash)
+}
+
+// Insert implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) Insert(ctx context.Context, im imager.ImageMeta) (err error) {
+	ctx, span := Start(ctx, "repository.Insert",
+		attrImageID.String(im.ID),
+		attrCategory.String(im.Category),
+	)
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.Insert(ctx, im)
+}
+
+// Update implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) Update(
+	ctx context.Context,
+	imageID string,
+	change func(im *imager.ImageMeta) error,
+) (im imager.ImageMeta, err error) {
+	ctx, span := Start(ctx, "repository.Update", attrImageID.String(imageID))
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.Update(ctx, imageID, change)
+}
+
+// Delete implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) Delete(ctx context.Context, imageID string) (err error) {
+	ctx, span := Start(ctx, "repository.Delete", attrImageID.String(imageID))
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.Delete(ctx, imageID)
+}
+
+// Categories implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) Categories(ctx context.Context) (categories []string, err error) {
+	ctx, span := Start(ctx, "repository.Categories")
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.Categories(ctx)
+}
+
+// Shuffle implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) Shuffle(ctx context.Context, category string, depth int) (err error) {
+	ctx, span := Start(ctx, "repository.Shuffle", attrCategory.String(category))
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.Shuffle(ctx, category, depth)
+}
+
+// Reorder implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) Reorder(ctx context.Context, category string, imageIDs []string) (err error) {
+	ctx, span := Start(ctx, "repository.Reorder", attrCategory.String(category))
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.Reorder(ctx, category, imageIDs)
+}
+
+// AcquireObject implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) AcquireObject(ctx context.Context, objectID string, shared bool) (found bool, err error) {
+	ctx, span := Start(ctx, "repository.AcquireObject", attrObjectID.String(objectID))
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.AcquireObject(ctx, objectID, shared)
+}
+
+// ReleaseObject implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) ReleaseObject(ctx context.Context, objectID string) (last bool, err error) {
+	ctx, span := Start(ctx, "repository.ReleaseObject", attrObjectID.String(objectID))
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.ReleaseObject(ctx, objectID)
+}
+
+// DeletedObject implements repository.ImageMetaRepository.
+func (r ImageMetaRepository) DeletedObject(ctx context.Context, objectID string) (err error) {
+	ctx, span := Start(ctx, "repository.DeletedObject", attrObjectID.String(objectID))
+	defer func() { End(span, err) }()
+
+	return r.ImageMetaRepository.DeletedObject(ctx, objectID)
+}
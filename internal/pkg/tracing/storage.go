@@ -0,0 +1,71 @@
+package tracing
+
+import (
+	"context"
+	"io"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/storage"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Attributes of spans of the file storage.
+const (
+	attrFileID     = attribute.Key("imager.file_id")
+	attrFilePrefix = attribute.Key("imager.file_prefix")
+)
+
+// FileStorage traces calls of the file storage. Spans of Get end before
+// the file is read.
+type FileStorage struct {
+	storage.FileStorage
+}
+
+// NewFileStorage wraps the file storage.
+func NewFileStorage(fs storage.FileStorage) *FileStorage {
+	return &FileStorage{FileStorage: fs}
+}
+
+// Get implements storage.FileStorage.
+func (s FileStorage) Get(ctx context.Context, id string) (f storage.File, err error) {
+	ctx, span := Start(ctx, "storage.Get", attrFileID.String(id))
+	defer func() { End(span, err) }()
+
+	return s.FileStorage.Get(ctx, id)
+}
+
+// Upload implements storage.FileStorage.
+func (s FileStorage) Upload(ctx context.Context, im imager.ImageMeta, r io.Reader) (err error) {
+	ctx, span := Start(ctx, "storage.Upload",
+		attrFileID.String(im.ID),
+		attribute.Int64("imager.size", im.Size),
+	)
+	defer func() { End(span, err) }()
+
+	return s.FileStorage.Upload(ctx, im, r)
+}
+
+// Delete implements storage.FileStorage.
+func (s FileStorage) Delete(ctx context.Context, id string) (err error) {
+	ctx, span := Start(ctx, "storage.Delete", attrFileID.String(id))
+	defer func() { End(span, err) }()
+
+	return s.FileStorage.Delete(ctx, id)
+}
+
+// Stat implements storage.FileStorage.
+func (s FileStorage) Stat(ctx context.Context, id string) (fi storage.FileInfo, err error) {
+	ctx, span := Start(ctx, "storage.Stat", attrFileID.String(id))
+	defer func() { End(span, err) }()
+
+	return s.FileStorage.Stat(ctx, id)
+}
+
+// List implements storage.FileStorage. The span includes calls of fn.
+func (s FileStorage) List(ctx context.Context, prefix string, fn func(fi storage.FileInfo) error) (err error) {
+	ctx, span := Start(ctx, "storage.List", attrFilePrefix.String(prefix))
+	defer func() { End(span, err) }()
+
+	return s.FileStorage.List(ctx, prefix, fn)
+}
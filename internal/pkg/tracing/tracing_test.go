@@ -0,0 +1,127 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/config"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imerrors"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/repository"
+	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/test"
+)
+
+type testRepository struct {
+	repository.ImageMetaRepository
+}
+
+func (testRepository) Get(ctx context.Context, imageID string) (imager.ImageMeta, error) {
+	if TraceID(ctx) == "" {
+		return imager.ImageMeta{}, errors.New("exp trace in context")
+	}
+
+	return imager.ImageMeta{}, imerrors.NewNotFoundError(imerrors.Error("not found"))
+}
+
+type exportedSpan struct {
+	Name        string
+	SpanContext struct {
+		TraceID string
+	}
+	Parent struct {
+		TraceID string
+	}
+	Status struct {
+		Code string
+	}
+}
+
+func TestSetup_File(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "traces.json")
+
+	shutdown, err := Setup(ctx, config.Tracing{
+		Exporter:    config.TracingExporterFile,
+		ServiceName: "test",
+		File:        file,
+		SampleRatio: 1,
+	}, "test")
+	test.AssertErrNil(t, err)
+
+	ctx, span := Start(ctx, "test.Parent")
+
+	_, err = NewImageMetaRepository(testRepository{}).Get(ctx, "test")
+	if !errors.As(err, &imerrors.NotFoundError{}) {
+		t.Fatal("exp not found error, got", err)
+	}
+
+	End(span, nil)
+
+	test.AssertErrNil(t, shutdown(ctx))
+
+	f, err := os.Open(file)
+	test.AssertErrNil(t, err)
+
+	defer func() { test.AssertErrNil(t, f.Close()) }()
+
+	spans := map[string]exportedSpan{}
+
+	for dec := json.NewDecoder(f); ; {
+		var s exportedSpan
+
+		err = dec.Decode(&s)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		test.AssertErrNil(t, err)
+
+		spans[s.Name] = s
+	}
+
+	parent, child := spans["test.Parent"], spans["repository.Get"]
+
+	switch {
+	case parent.Name == "" || child.Name == "":
+		t.Fatal("exp spans, got", spans)
+	case child.Parent.TraceID != parent.SpanContext.TraceID:
+		t.Fatal("exp child of", parent.SpanContext.TraceID, "got", child.Parent.TraceID)
+	case child.Status.Code != "Error":
+		t.Fatal("exp error status, got", child.Status.Code)
+	}
+}
+
+func TestSetup_Invalid(t *testing.T) {
+	testCases := []struct {
+		Name string
+		Cfg  config.Tracing
+	}{{
+		Name: "unknown_exporter",
+		Cfg:  config.Tracing{Exporter: "jaeger", SampleRatio: 1},
+	}, {
+		Name: "sample_ratio",
+		Cfg:  config.Tracing{Exporter: config.TracingExporterStdout, SampleRatio: 2},
+	}, {
+		Name: "missing_dir",
+		Cfg: config.Tracing{
+			Exporter:    config.TracingExporterFile,
+			File:        filepath.Join(t.TempDir(), "missing", "traces.json"),
+			SampleRatio: 1,
+		},
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+
+		t.Run(tc.Name, func(t *testing.T) {
+			if _, err := Setup(context.Background(), tc.Cfg, ""); err == nil {
+				t.Fatal("exp error")
+			}
+		})
+	}
+}
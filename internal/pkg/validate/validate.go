@@ -2,6 +2,8 @@ package validate
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
 
 	"github.com/ocmoxa/SwapTile-Imager/internal/pkg/imager"
 
@@ -14,6 +16,17 @@ func New() *validator.Validate {
 
 	v.RegisterAlias("image_id", "printascii,min=1,max=64")
 	v.RegisterAlias("category", "alphanum,min=1,max=64")
+	v.RegisterAlias("uploader", "printascii,max=64")
+
+	// Errors name fields as clients do.
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+
+		return name
+	})
 
 	return v
 }
@@ -45,3 +58,62 @@ func ContentType(
 
 	return fmt.Errorf("expected one of %v", supportedContentTypes)
 }
+
+// Dimensions checks that the image is not larger than the limits. A zero
+// limit is not checked.
+func Dimensions(
+	width int,
+	height int,
+	maxWidth int,
+	maxHeight int,
+	maxPixels int64,
+) (err error) {
+	switch {
+	case maxWidth > 0 && width > maxWidth:
+		return fmt.Errorf("max allowed width is %d, got %d", maxWidth, width)
+	case maxHeight > 0 && height > maxHeight:
+		return fmt.Errorf("max allowed height is %d, got %d", maxHeight, height)
+	case maxPixels > 0 && int64(width)*int64(height) > maxPixels:
+		return fmt.Errorf("max allowed pixels count is %d, got %d", maxPixels, int64(width)*int64(height))
+	}
+
+	return nil
+}
+
+// Resolution checks that the image covers each of supported sizes by
+// both sides, so renditions are never upscaled.
+func Resolution(
+	width int,
+	height int,
+	supportedSizes []imager.ImageSize,
+) (err error) {
+	var minWidth, minHeight int
+	for _, s := range supportedSizes {
+		w, h := s.Size()
+		if w > minWidth {
+			minWidth = w
+		}
+
+		if h > minHeight {
+			minHeight = h
+		}
+	}
+
+	if width < minWidth || height < minHeight {
+		return fmt.Errorf("min resolution is %dx%d, got %dx%d", minWidth, minHeight, width, height)
+	}
+
+	return nil
+}
+
+// CropRect checks that the area is inside the original.
+func CropRect(rect imager.CropRect, width, height int) (err error) {
+	if rect.X+rect.Width > width || rect.Y+rect.Height > height {
+		return fmt.Errorf(
+			"area %dx%d+%d+%d is outside of the original %dx%d",
+			rect.Width, rect.Height, rect.X, rect.Y, width, height,
+		)
+	}
+
+	return nil
+}
@@ -16,6 +16,13 @@ func TestNew(t *testing.T) {
 
 	err = v.Var("a", "category")
 	test.AssertErrNil(t, err)
+
+	err = v.Var("ci-bot@example.com", "uploader")
+	test.AssertErrNil(t, err)
+
+	if err = v.Var("bot\n", "uploader"); err == nil {
+		t.Fatal("uploader with a control character is valid")
+	}
 }
 
 func TestValidateImageSize(t *testing.T) {
@@ -41,3 +48,67 @@ func TestValidateContentType(t *testing.T) {
 	err = validate.ContentType("image/jpeg", supported)
 	test.AssertErrNil(t, err)
 }
+
+func TestValidateDimensions(t *testing.T) {
+	err := validate.Dimensions(100, 100, 100, 100, 10000)
+	test.AssertErrNil(t, err)
+
+	err = validate.Dimensions(100000, 100000, 0, 0, 0)
+	test.AssertErrNil(t, err)
+
+	err = validate.Dimensions(101, 100, 100, 100, 0)
+	if err == nil {
+		t.Fatal(err)
+	}
+
+	err = validate.Dimensions(100, 101, 100, 100, 0)
+	if err == nil {
+		t.Fatal(err)
+	}
+
+	err = validate.Dimensions(100, 100, 0, 0, 9999)
+	if err == nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateResolution(t *testing.T) {
+	supported := []imager.ImageSize{"1920x1080", "480x360", "1080x1920"}
+
+	err := validate.Resolution(1920, 1920, supported)
+	test.AssertErrNil(t, err)
+
+	// The portrait size would be upscaled.
+	err = validate.Resolution(1920, 1080, supported)
+	if err == nil {
+		t.Fatal("exp error")
+	}
+
+	err = validate.Resolution(1080, 1920, supported)
+	if err == nil {
+		t.Fatal("exp error")
+	}
+
+	err = validate.Resolution(1280, 720, supported)
+	if err == nil {
+		t.Fatal("exp error")
+	}
+
+	err = validate.Resolution(10, 10, nil)
+	test.AssertErrNil(t, err)
+}
+
+func TestValidateCropRect(t *testing.T) {
+	err := validate.CropRect(imager.CropRect{X: 10, Y: 20, Width: 90, Height: 80}, 100, 100)
+	test.AssertErrNil(t, err)
+
+	err = validate.CropRect(imager.CropRect{X: 11, Width: 90, Height: 10}, 100, 100)
+	if err == nil {
+		t.Fatal(err)
+	}
+
+	err = validate.CropRect(imager.CropRect{Y: 1, Width: 10, Height: 100}, 100, 100)
+	if err == nil {
+		t.Fatal(err)
+	}
+}